@@ -0,0 +1,401 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"CipherOps/logging"
+	"CipherOps/utils"
+)
+
+// Files Enroll writes to the state directory
+const (
+	keyFile    = "agent.key"
+	certFile   = "agent.crt"
+	caFile     = "ca.crt"
+	serverFile = "server"
+)
+
+// Role is the role of the command policy every command the panel sends is
+// checked against.
+const Role = "agent"
+
+// Enroll trades a one-time token for a client certificate. The key is made
+// here and never leaves stateDir; the server is trusted only if its
+// certificate is signed by the CA in caPEM. It returns the host name the
+// panel enrolled the agent as.
+func Enroll(ctx context.Context, server, token string, caPEM []byte, stateDir string) (string, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return "", errors.New("no CA certificate in PEM")
+	}
+	key, csrPEM, err := newKey()
+	if err != nil {
+		return "", err
+	}
+	client := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}},
+	}
+	var enrolled enrollResponse
+	if err := post(ctx, client, server, "/agent/enroll", enrollRequest{Token: token, CSR: csrPEM}, &enrolled); err != nil {
+		return "", fmt.Errorf("enroll: %w", err)
+	}
+
+	if err := os.MkdirAll(stateDir, 0o700); err != nil {
+		return "", err
+	}
+	if err := saveIdentity(stateDir, key, enrolled.Certificate); err != nil {
+		return "", err
+	}
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{
+		{caFile, caPEM},
+		{serverFile, []byte(server + "\n")},
+	} {
+		if err := os.WriteFile(filepath.Join(stateDir, f.name), f.data, 0o644); err != nil {
+			return "", err
+		}
+	}
+	return enrolled.Host, nil
+}
+
+// Renew trades the certificate in stateDir, while it is still valid, for
+// one with a new key and a fresh lifetime. The old certificate stops
+// working; a connection made with it stays up.
+func Renew(ctx context.Context, stateDir string) error {
+	server, tlsConfig, err := loadState(stateDir)
+	if err != nil {
+		return err
+	}
+	key, csrPEM, err := newKey()
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 30 * time.Second, Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	var renewed enrollResponse
+	if err := post(ctx, client, server, "/agent/renew", renewRequest{CSR: csrPEM}, &renewed); err != nil {
+		return fmt.Errorf("renew: %w", err)
+	}
+	return saveIdentity(stateDir, key, renewed.Certificate)
+}
+
+// renewDue reports whether cert has less than a third of its lifetime left
+// at now.
+func renewDue(cert *x509.Certificate, now time.Time) bool {
+	return cert.NotAfter.Sub(now) < cert.NotAfter.Sub(cert.NotBefore)/3
+}
+
+// newKey makes the agent's key and a PEM certificate request for it.
+func newKey() (*ecdsa.PrivateKey, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	hostname, _ := os.Hostname()
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: hostname},
+	}, key)
+	if err != nil {
+		return nil, "", err
+	}
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER})), nil
+}
+
+// saveIdentity writes key and its certificate to stateDir. Both go to
+// temporary files first, so a failed write leaves the old pair in place.
+func saveIdentity(stateDir string, key *ecdsa.PrivateKey, certPEM string) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	files := []struct {
+		name string
+		data []byte
+		perm os.FileMode
+	}{
+		{keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600},
+		{certFile, []byte(certPEM), 0o644},
+	}
+	for _, f := range files {
+		if err := os.WriteFile(filepath.Join(stateDir, f.name+".new"), f.data, f.perm); err != nil {
+			return err
+		}
+	}
+	for _, f := range files {
+		if err := os.Rename(filepath.Join(stateDir, f.name+".new"), filepath.Join(stateDir, f.name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadState reads the panel's URL and the TLS setup to reach it with from
+// stateDir.
+func loadState(stateDir string) (string, *tls.Config, error) {
+	server, err := os.ReadFile(filepath.Join(stateDir, serverFile))
+	if err != nil {
+		return "", nil, err
+	}
+	caPEM, err := os.ReadFile(filepath.Join(stateDir, caFile))
+	if err != nil {
+		return "", nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return "", nil, fmt.Errorf("%s: no CA certificate", caFile)
+	}
+	cert, err := tls.LoadX509KeyPair(filepath.Join(stateDir, certFile), filepath.Join(stateDir, keyFile))
+	if err != nil {
+		return "", nil, err
+	}
+	origin := strings.TrimRight(strings.TrimSpace(string(server)), "/")
+	return origin, &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// post sends body as JSON to path on server and decodes the answer into
+// out.
+func post(ctx context.Context, client *http.Client, server, path string, body, out any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimRight(server, "/")+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return fmt.Errorf("%s: %s", resp.Status, e.Error)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// Agent is the host side of the channel. It dials the panel and runs the
+// commands it is sent with Exec.
+type Agent struct {
+	// directory written by Enroll
+	StateDir string
+	Exec     utils.Executor
+	// commands run only if a rule of Role matches them, arguments included;
+	// the zero policy refuses everything
+	Policy utils.CommandPolicy
+}
+
+// Run keeps a connection to the panel until ctx ends, reconnecting with
+// backoff. Commands still running when a connection drops finish; an
+// interrupted package manager is worse than a lost result. The certificate
+// is renewed when a third of its lifetime is left.
+func (a *Agent) Run(ctx context.Context) error {
+	go a.renew(ctx)
+	delay := time.Second
+	for {
+		start := time.Now()
+		err := a.connect(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if time.Since(start) > time.Minute {
+			delay = time.Second
+		}
+		slog.Warn("connection to the panel lost", "error", err, "retry_in", delay)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, time.Minute)
+	}
+}
+
+// renew checks the certificate every renewCheck and renews it when due,
+// until ctx ends.
+func (a *Agent) renew(ctx context.Context) {
+	for {
+		if err := a.renewIfDue(ctx); err != nil && ctx.Err() == nil {
+			slog.Error("cannot renew the agent certificate", "error", err, "retry_in", renewCheck)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(renewCheck):
+		}
+	}
+}
+
+func (a *Agent) renewIfDue(ctx context.Context) error {
+	cert, err := tls.LoadX509KeyPair(filepath.Join(a.StateDir, certFile), filepath.Join(a.StateDir, keyFile))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	switch {
+	case now.After(cert.Leaf.NotAfter):
+		return fmt.Errorf("certificate expired on %s, enroll again with a new token", cert.Leaf.NotAfter.Format(time.DateOnly))
+	case !renewDue(cert.Leaf, now):
+		return nil
+	}
+	if err := Renew(ctx, a.StateDir); err != nil {
+		return err
+	}
+	slog.Info("agent certificate renewed")
+	return nil
+}
+
+func (a *Agent) connect(ctx context.Context) error {
+	// read on every connect, so enrolling again or renewing needs no restart
+	origin, tlsConfig, err := loadState(a.StateDir)
+	if err != nil {
+		return err
+	}
+	cfg, err := websocket.NewConfig("wss"+strings.TrimPrefix(origin, "https")+"/agent/connect", origin)
+	if err != nil {
+		return err
+	}
+	cfg.TlsConfig = tlsConfig
+	cfg.Dialer = &net.Dialer{Timeout: 30 * time.Second}
+	ws, err := websocket.DialConfig(cfg)
+	if err != nil {
+		return err
+	}
+	slog.Info("connected to the panel", "server", origin)
+
+	c := &conn{ws: ws, cancels: map[uint64]context.CancelFunc{}}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				ws.Close()
+				return
+			case <-done:
+				ws.Close()
+				return
+			case <-ticker.C:
+				c.write(message{Type: msgPing})
+			}
+		}
+	}()
+	if err := c.write(message{Type: msgPing}); err != nil {
+		return err
+	}
+
+	for {
+		ws.SetReadDeadline(time.Now().Add(readTimeout))
+		var m message
+		if err := websocket.JSON.Receive(ws, &m); err != nil {
+			return err
+		}
+		switch m.Type {
+		case msgRun:
+			runCtx, cancel := context.WithCancel(ctx)
+			c.mu.Lock()
+			c.cancels[m.ID] = cancel
+			c.mu.Unlock()
+			go a.run(runCtx, c, m)
+		case msgCancel:
+			c.mu.Lock()
+			if cancel := c.cancels[m.ID]; cancel != nil {
+				cancel()
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// run runs the command of m and sends its output and result.
+func (a *Agent) run(ctx context.Context, c *conn, m message) {
+	defer func() {
+		c.mu.Lock()
+		if cancel := c.cancels[m.ID]; cancel != nil {
+			cancel()
+			delete(c.cancels, m.ID)
+		}
+		c.mu.Unlock()
+	}()
+	reply := message{Type: msgResult, ID: m.ID}
+	if err := a.allowed(m.Command); err != nil {
+		slog.Warn("refused command", "error", err)
+		reply.Result = &utils.CommandResult{ExitCode: -1}
+		reply.Error = err.Error()
+		c.write(reply)
+		return
+	}
+	res, err := a.Exec.Run(ctx, utils.Command{
+		Name: m.Command.Name,
+		Args: m.Command.Args,
+		Sudo: m.Command.Sudo,
+		Output: func(line utils.OutputLine) {
+			c.write(message{Type: msgOutput, ID: m.ID, Line: &line})
+		},
+	})
+	reply.Result = &res
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	c.write(reply)
+}
+
+// allowed lets through what the command policy allows Role, arguments
+// included, whatever role the command runs for on the panel. Commands may
+// run as root; a compromised panel must not turn the agent into a remote
+// shell.
+func (a *Agent) allowed(c *wireCommand) error {
+	if c == nil {
+		return errors.New("run without a command")
+	}
+	if !a.Policy.Allows(Role, utils.Command{Name: c.Name, Args: c.Args, Sudo: c.Sudo}) {
+		return &utils.CommandDeniedError{Role: Role, Command: c.Name, Args: logging.RedactArgs(c.Args), Sudo: c.Sudo}
+	}
+	return nil
+}
+
+// conn is the agent's end of one connection.
+type conn struct {
+	ws   *websocket.Conn
+	send sync.Mutex
+
+	mu      sync.Mutex
+	cancels map[uint64]context.CancelFunc
+}
+
+func (c *conn) write(m message) error {
+	c.send.Lock()
+	defer c.send.Unlock()
+	c.ws.SetWriteDeadline(time.Now().Add(readTimeout))
+	return websocket.JSON.Send(c.ws, m)
+}
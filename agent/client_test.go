@@ -0,0 +1,215 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"CipherOps/models"
+	"CipherOps/store"
+	"CipherOps/utils"
+)
+
+func TestAllowed(t *testing.T) {
+	policy, err := utils.LoadCommandPolicy("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Agent{Policy: policy}
+	tests := []struct {
+		name    string
+		c       *wireCommand
+		allowed bool
+	}{
+		{"os-release", &wireCommand{Name: "cat", Args: []string{"/etc/os-release"}}, true},
+		{"command probe", &wireCommand{Name: "sh", Args: []string{"-c", "command -v ufw"}}, true},
+		{"package probe", &wireCommand{Name: "dpkg", Args: []string{"-s", "nginx"}}, true},
+		{"package install", &wireCommand{Name: "apt-get", Args: []string{"install", "-y", "nginx", "curl"}, Sudo: true}, true},
+		{"service enable", &wireCommand{Name: "systemctl", Args: []string{"enable", "--now", "nginx"}, Sudo: true}, true},
+		{"other file", &wireCommand{Name: "cat", Args: []string{"/etc/shadow"}}, false},
+		{"shell", &wireCommand{Name: "sh", Args: []string{"-c", "command -v ufw; id"}}, false},
+		{"apt option injection", &wireCommand{Name: "apt-get", Args: []string{"install", "-y", "-o", "APT::Update::Pre-Invoke::=sh"}, Sudo: true}, false},
+		{"dpkg install", &wireCommand{Name: "dpkg", Args: []string{"-i", "/tmp/evil.deb"}, Sudo: true}, false},
+		{"unit file linking", &wireCommand{Name: "systemctl", Args: []string{"link", "/tmp/evil.service"}, Sudo: true}, false},
+		{"no command", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := a.allowed(tt.c); (err == nil) != tt.allowed {
+				t.Errorf("allowed = %v, want allowed %v", err, tt.allowed)
+			}
+		})
+	}
+
+	if err := (&Agent{}).allowed(&wireCommand{Name: "cat", Args: []string{"/etc/os-release"}}); err == nil {
+		t.Error("the zero policy allowed a command")
+	}
+}
+
+func TestRenewDue(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	cert := &x509.Certificate{NotBefore: start, NotAfter: start.AddDate(1, 0, 0)}
+	tests := []struct {
+		now  time.Time
+		want bool
+	}{
+		{start, false},
+		{start.AddDate(0, 6, 0), false},
+		{start.AddDate(0, 9, 0), true},
+		{start.AddDate(2, 0, 0), true},
+	}
+	for _, tt := range tests {
+		if got := renewDue(cert, tt.now); got != tt.want {
+			t.Errorf("renewDue at %s = %v, want %v", tt.now.Format(time.DateOnly), got, tt.want)
+		}
+	}
+}
+
+// fakeAgents keeps agents and tokens in memory.
+type fakeAgents struct {
+	mu     sync.Mutex
+	tokens map[string]models.AgentToken
+	agents map[int]models.Agent
+}
+
+func (f *fakeAgents) CreateToken(ctx context.Context, t *models.AgentToken) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tokens[t.TokenHash] = *t
+	return nil
+}
+
+func (f *fakeAgents) UseToken(ctx context.Context, tokenHash string, now time.Time) (models.AgentToken, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, ok := f.tokens[tokenHash]
+	if !ok || t.UsedAt != nil || now.After(t.ExpiresAt) {
+		return t, store.ErrNotFound
+	}
+	t.UsedAt = &now
+	f.tokens[tokenHash] = t
+	return t, nil
+}
+
+func (f *fakeAgents) Enroll(ctx context.Context, a models.Agent) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	a.Host = "web1"
+	f.agents[a.HostID] = a
+	return nil
+}
+
+func (f *fakeAgents) GetBySerial(ctx context.Context, serial string) (models.Agent, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, a := range f.agents {
+		if a.CertSerial == serial {
+			return a, nil
+		}
+	}
+	return models.Agent{}, store.ErrNotFound
+}
+
+func (f *fakeAgents) List(ctx context.Context) ([]models.Agent, error) { return nil, nil }
+
+func (f *fakeAgents) Touch(ctx context.Context, hostID int, at time.Time) error { return nil }
+
+func (f *fakeAgents) Revoke(ctx context.Context, hostID int, at time.Time) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	a := f.agents[hostID]
+	a.RevokedAt = &at
+	f.agents[hostID] = a
+	return nil
+}
+
+// startServer serves s over TLS as ListenAndServe does.
+func startServer(t *testing.T, s *Server) string {
+	t.Helper()
+	cert, err := s.CA.ServerCertificate([]string{"127.0.0.1"}, s.CertTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(s.Handler())
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    s.CA.Pool(),
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		MinVersion:   tls.VersionTLS12,
+	}
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return ts.URL
+}
+
+func TestEnrollAndRenew(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := LoadOrCreateCA(filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	agents := &fakeAgents{tokens: map[string]models.AgentToken{}, agents: map[int]models.Agent{}}
+	s := &Server{Agents: agents, CA: ca, CertTTL: time.Hour, TokenTTL: time.Hour}
+	url := startServer(t, s)
+	ctx := context.Background()
+
+	token, _, err := s.CreateToken(ctx, models.Host{ID: 7, Name: "web1"}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateDir := filepath.Join(dir, "state")
+	host, err := Enroll(ctx, url, token, ca.CertPEM(), stateDir)
+	if err != nil || host != "web1" {
+		t.Fatalf("Enroll = %q, %v", host, err)
+	}
+	if _, err := Enroll(ctx, url, token, ca.CertPEM(), filepath.Join(dir, "again")); err == nil {
+		t.Error("a used token enrolled again")
+	}
+	enrolled := agents.agents[7]
+
+	if err := Renew(ctx, stateDir); err != nil {
+		t.Fatal(err)
+	}
+	renewed := agents.agents[7]
+	if renewed.CertSerial == enrolled.CertSerial || !renewed.EnrolledAt.Equal(enrolled.EnrolledAt) {
+		t.Errorf("after renewal the agent is %+v, enrolled as %+v", renewed, enrolled)
+	}
+	pair, err := tls.LoadX509KeyPair(filepath.Join(stateDir, certFile), filepath.Join(stateDir, keyFile))
+	if err != nil {
+		t.Fatalf("renewed key and certificate do not match: %v", err)
+	}
+	if serialHex(pair.Leaf) != renewed.CertSerial {
+		t.Errorf("saved certificate %s, panel has %s", serialHex(pair.Leaf), renewed.CertSerial)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(stateDir, "*.new")); len(matches) != 0 {
+		t.Errorf("left behind %v", matches)
+	}
+
+	// the replaced certificate cannot renew again
+	old := filepath.Join(dir, "old")
+	os.MkdirAll(old, 0o700)
+	for _, name := range []string{caFile, serverFile, certFile, keyFile} {
+		data, _ := os.ReadFile(filepath.Join(stateDir, name))
+		os.WriteFile(filepath.Join(old, name), data, 0o600)
+	}
+	if err := Renew(ctx, stateDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := Renew(ctx, old); err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Errorf("renewal with a replaced certificate: %v", err)
+	}
+
+	if err := s.Revoke(ctx, models.Host{ID: 7, Name: "web1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Renew(ctx, stateDir); err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Errorf("renewal after revocation: %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+// Package agent is the control channel between the panel and
+// cipherops-agent, a small program on managed hosts that runs the commands
+// of installers, service managers and firewalls for the panel.
+//
+// The agent enrolls once with a one-time token: it sends a certificate
+// request to POST /agent/enroll and gets a client certificate signed by the
+// panel's own CA. From then on it dials out to /agent/connect over mutual
+// TLS and keeps a WebSocket open, so managed hosts need no inbound port.
+// Before the certificate runs out the agent trades it for a new one at
+// POST /agent/renew, again over mutual TLS.
+// The panel sends run and cancel messages, the agent streams output lines
+// back and ends each command with a result.
+package agent
+
+import (
+	"time"
+
+	"CipherOps/utils"
+)
+
+// Message types
+const (
+	msgRun    = "run"    // panel: run Command, tagged with ID
+	msgCancel = "cancel" // panel: stop the command ID
+	msgOutput = "output" // agent: a Line of the command ID
+	msgResult = "result" // agent: the command ID ended
+	msgPing   = "ping"   // either side, keeps the connection alive
+)
+
+const (
+	// the agent pings this often and either side gives up after
+	// readTimeout without hearing anything
+	pingInterval = 30 * time.Second
+	readTimeout  = 3 * pingInterval
+	// how often the agent looks whether its certificate is due for renewal
+	renewCheck = time.Hour
+)
+
+// message is one JSON frame on the WebSocket.
+type message struct {
+	Type    string               `json:"type"`
+	ID      uint64               `json:"id,omitempty"`
+	Command *wireCommand         `json:"command,omitempty"`
+	Line    *utils.OutputLine    `json:"line,omitempty"`
+	Result  *utils.CommandResult `json:"result,omitempty"`
+	// why the command failed beyond its exit code, with Result
+	Error string `json:"error,omitempty"`
+}
+
+// wireCommand is utils.Command without the output callback; output comes
+// back as messages instead.
+type wireCommand struct {
+	Name string   `json:"name"`
+	Args []string `json:"args,omitempty"`
+	Sudo bool     `json:"sudo,omitempty"`
+}
+
+// enrollRequest is the body of POST /agent/enroll.
+type enrollRequest struct {
+	Token string `json:"token"`
+	// PEM certificate request for the key the agent keeps
+	CSR string `json:"csr"`
+}
+
+// renewRequest is the body of POST /agent/renew, made with the current
+// client certificate.
+type renewRequest struct {
+	// PEM certificate request for the new key
+	CSR string `json:"csr"`
+}
+
+// enrollResponse carries the PEM client certificate, also in answer to a
+// renewal.
+type enrollResponse struct {
+	Host        string `json:"host"`
+	Certificate string `json:"certificate"`
+}
@@ -0,0 +1,412 @@
+package agent
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/websocket"
+
+	"CipherOps/auth"
+	"CipherOps/models"
+	"CipherOps/store"
+	"CipherOps/utils"
+)
+
+// TokenPrefix marks enrollment tokens, as APITokenPrefix does API tokens.
+const TokenPrefix = "coa_"
+
+// Server is the panel side of the channel. It enrolls agents, keeps their
+// connections and hands out executors that run commands through them.
+type Server struct {
+	Agents store.AgentRepository
+	CA     *CA
+	// lifetime of agent and listener certificates, and of enrollment tokens
+	CertTTL  time.Duration
+	TokenTTL time.Duration
+	// the address agents dial, handed out with enrollment tokens
+	URL string
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+// ListenAndServe serves agents on addr with a certificate for names until
+// the listener fails. Agents without a certificate may only enroll.
+func (s *Server) ListenAndServe(addr string, names []string) error {
+	cert, err := s.CA.ServerCertificate(names, s.CertTTL)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Addr:    addr,
+		Handler: s.Handler(),
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientCAs:    s.CA.Pool(),
+			ClientAuth:   tls.VerifyClientCertIfGiven,
+			MinVersion:   tls.VersionTLS12,
+		},
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	slog.Info("agent listener", "addr", addr)
+	return server.ListenAndServeTLS("", "")
+}
+
+// Handler serves POST /agent/enroll, POST /agent/renew and the
+// /agent/connect WebSocket.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /agent/enroll", s.enroll)
+	mux.HandleFunc("POST /agent/renew", s.renew)
+	mux.HandleFunc("GET /agent/connect", s.connect)
+	return mux
+}
+
+// CreateToken makes a one-time enrollment token for the agent of host.
+// Only its hash is stored, the token is shown once.
+func (s *Server) CreateToken(ctx context.Context, host models.Host, createdBy int) (string, models.AgentToken, error) {
+	raw, err := auth.RandomToken(32)
+	if err != nil {
+		return "", models.AgentToken{}, err
+	}
+	token := TokenPrefix + raw
+	t := models.AgentToken{
+		HostID:    host.ID,
+		Host:      host.Name,
+		TokenHash: auth.HashAPIToken(token),
+		ExpiresAt: time.Now().Add(s.TokenTTL),
+		CreatedBy: createdBy,
+	}
+	if err := s.Agents.CreateToken(ctx, &t); err != nil {
+		return "", t, err
+	}
+	return token, t, nil
+}
+
+// Revoke disowns the certificate of the agent of host and drops its
+// connection. The agent has to enroll again with a new token.
+func (s *Server) Revoke(ctx context.Context, host models.Host) error {
+	if err := s.Agents.Revoke(ctx, host.ID, time.Now()); err != nil {
+		return err
+	}
+	s.disconnect(host.Name)
+	return nil
+}
+
+// Connected reports whether the agent of host is connected now.
+func (s *Server) Connected(host string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions[host] != nil
+}
+
+// Executor runs commands on host through its agent. Each command goes to
+// the connection of the moment, so one made before a reconnect keeps
+// working.
+func (s *Server) Executor(host string) (utils.Executor, error) {
+	if !s.Connected(host) {
+		return nil, fmt.Errorf("agent of %s is not connected", host)
+	}
+	return &Executor{server: s, host: host}, nil
+}
+
+func (s *Server) enroll(w http.ResponseWriter, r *http.Request) {
+	var req enrollRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	// a broken request must not use up the token
+	csr, err := ParseCSR([]byte(req.CSR))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "csr: " + err.Error()})
+		return
+	}
+	t, err := s.Agents.UseToken(r.Context(), auth.HashAPIToken(req.Token), time.Now())
+	if errors.Is(err, store.ErrNotFound) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "invalid, used or expired token"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	cert, certPEM, err := s.CA.SignAgent(csr, t.Host, s.CertTTL)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	err = s.Agents.Enroll(r.Context(), models.Agent{
+		HostID:     t.HostID,
+		CertSerial: serialHex(cert),
+		CertExpiry: cert.NotAfter,
+		EnrolledAt: time.Now(),
+	})
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	// an agent still connected with the old certificate is no longer trusted
+	s.disconnect(t.Host)
+	slog.Info("agent enrolled", "host", t.Host, "serial", serialHex(cert), "remote", r.RemoteAddr)
+	writeJSON(w, http.StatusOK, enrollResponse{Host: t.Host, Certificate: string(certPEM)})
+}
+
+// renew issues a new certificate, for a new key, to an agent that shows its
+// current one. The old certificate is disowned, but a connection made with
+// it stays up.
+func (s *Server) renew(w http.ResponseWriter, r *http.Request) {
+	a, status, err := s.certified(r)
+	if err != nil {
+		writeJSON(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+	var req renewRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	csr, err := ParseCSR([]byte(req.CSR))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "csr: " + err.Error()})
+		return
+	}
+	cert, certPEM, err := s.CA.SignAgent(csr, a.Host, s.CertTTL)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	err = s.Agents.Enroll(r.Context(), models.Agent{
+		HostID:     a.HostID,
+		CertSerial: serialHex(cert),
+		CertExpiry: cert.NotAfter,
+		EnrolledAt: a.EnrolledAt,
+	})
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	slog.Info("agent certificate renewed", "host", a.Host, "old_serial", a.CertSerial, "serial", serialHex(cert), "remote", r.RemoteAddr)
+	writeJSON(w, http.StatusOK, enrollResponse{Host: a.Host, Certificate: string(certPEM)})
+}
+
+// certified returns the agent whose client certificate r was made with, or
+// the status and error to refuse r with.
+func (s *Server) certified(r *http.Request) (models.Agent, int, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return models.Agent{}, http.StatusUnauthorized, errors.New("client certificate required")
+	}
+	// the CA vouches for the certificate, the database for it being current
+	cert := r.TLS.VerifiedChains[0][0]
+	a, err := s.Agents.GetBySerial(r.Context(), serialHex(cert))
+	if errors.Is(err, store.ErrNotFound) || (err == nil && a.RevokedAt != nil) {
+		return a, http.StatusForbidden, errors.New("certificate revoked")
+	}
+	if err != nil {
+		return a, http.StatusInternalServerError, err
+	}
+	return a, http.StatusOK, nil
+}
+
+func (s *Server) connect(w http.ResponseWriter, r *http.Request) {
+	a, status, err := s.certified(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	websocket.Server{Handler: func(ws *websocket.Conn) { s.serve(ws, a) }}.ServeHTTP(w, r)
+}
+
+// serve keeps the connection of agent a until it drops.
+func (s *Server) serve(ws *websocket.Conn, a models.Agent) {
+	sess := &session{host: a.Host, ws: ws, calls: map[uint64]*call{}, done: make(chan struct{})}
+	s.mu.Lock()
+	if s.sessions == nil {
+		s.sessions = map[string]*session{}
+	}
+	// an agent that reconnects before its old connection timed out
+	if old := s.sessions[a.Host]; old != nil {
+		old.close()
+	}
+	s.sessions[a.Host] = sess
+	s.mu.Unlock()
+	slog.Info("agent connected", "host", a.Host, "remote", ws.Request().RemoteAddr)
+
+	s.touch(a)
+	err := sess.read(func() { s.touch(a) })
+
+	s.mu.Lock()
+	if s.sessions[a.Host] == sess {
+		delete(s.sessions, a.Host)
+	}
+	s.mu.Unlock()
+	sess.close()
+	slog.Info("agent disconnected", "host", a.Host, "error", err)
+}
+
+func (s *Server) touch(a models.Agent) {
+	if err := s.Agents.Touch(context.Background(), a.HostID, time.Now()); err != nil {
+		slog.Warn("cannot record agent contact", "host", a.Host, "error", err)
+	}
+}
+
+func (s *Server) disconnect(host string) {
+	s.mu.Lock()
+	sess := s.sessions[host]
+	delete(s.sessions, host)
+	s.mu.Unlock()
+	if sess != nil {
+		sess.close()
+	}
+}
+
+func (s *Server) session(host string) *session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions[host]
+}
+
+// Executor runs commands through the agent of a host. Privileged commands
+// are audited with the host, as SSHExecutor does.
+type Executor struct {
+	server *Server
+	host   string
+}
+
+func (e *Executor) Run(ctx context.Context, c utils.Command) (utils.CommandResult, error) {
+	res := utils.CommandResult{ExitCode: -1}
+	sess := e.server.session(e.host)
+	var err error
+	if sess == nil {
+		err = fmt.Errorf("agent of %s is not connected", e.host)
+	} else {
+		res, err = sess.run(ctx, c)
+	}
+	if c.Sudo {
+		utils.AuditCommand(ctx, e.host, c.Name, c.Args, res.Output(), err)
+	}
+	return res, err
+}
+
+// Host is the host the executor runs commands on.
+func (e *Executor) Host() string {
+	return e.host
+}
+
+// session is one connection of an agent.
+type session struct {
+	host string
+	ws   *websocket.Conn
+	// serializes writes, frames must not interleave
+	send sync.Mutex
+
+	mu    sync.Mutex
+	next  uint64
+	calls map[uint64]*call
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// call is a command waiting for its result.
+type call struct {
+	output utils.OutputFunc
+	result chan message
+}
+
+func (s *session) run(ctx context.Context, c utils.Command) (utils.CommandResult, error) {
+	res := utils.CommandResult{ExitCode: -1}
+	s.mu.Lock()
+	s.next++
+	id := s.next
+	pending := &call{output: c.Output, result: make(chan message, 1)}
+	s.calls[id] = pending
+	s.mu.Unlock()
+	defer s.take(id)
+
+	err := s.write(message{Type: msgRun, ID: id, Command: &wireCommand{Name: c.Name, Args: c.Args, Sudo: c.Sudo}})
+	if err != nil {
+		return res, fmt.Errorf("agent of %s: %w", s.host, err)
+	}
+	select {
+	case m := <-pending.result:
+		if m.Result != nil {
+			res = *m.Result
+		}
+		if m.Error != "" {
+			return res, errors.New(m.Error)
+		}
+		return res, nil
+	case <-ctx.Done():
+		// the agent stops the command and its result is dropped
+		s.write(message{Type: msgCancel, ID: id})
+		return res, ctx.Err()
+	case <-s.done:
+		return res, fmt.Errorf("agent of %s disconnected", s.host)
+	}
+}
+
+// read handles messages until the connection fails, calling seen on every
+// ping.
+func (s *session) read(seen func()) error {
+	for {
+		s.ws.SetReadDeadline(time.Now().Add(readTimeout))
+		var m message
+		if err := websocket.JSON.Receive(s.ws, &m); err != nil {
+			return err
+		}
+		switch m.Type {
+		case msgPing:
+			seen()
+			if err := s.write(message{Type: msgPing}); err != nil {
+				return err
+			}
+		case msgOutput:
+			s.mu.Lock()
+			pending := s.calls[m.ID]
+			s.mu.Unlock()
+			if pending != nil && pending.output != nil && m.Line != nil {
+				pending.output(*m.Line)
+			}
+		case msgResult:
+			if pending := s.take(m.ID); pending != nil {
+				pending.result <- m
+			}
+		}
+	}
+}
+
+func (s *session) take(id uint64) *call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := s.calls[id]
+	delete(s.calls, id)
+	return pending
+}
+
+func (s *session) write(m message) error {
+	s.send.Lock()
+	defer s.send.Unlock()
+	s.ws.SetWriteDeadline(time.Now().Add(readTimeout))
+	return websocket.JSON.Send(s.ws, m)
+}
+
+func (s *session) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.ws.Close()
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,257 @@
+// Package audit keeps a tamper-evident record of privileged actions. Every
+// entry stores the hash of the previous one, so editing or deleting an entry
+// breaks the chain from that point on. With a key the hashes are HMACs, and
+// rewriting the chain needs the key as well as the database.
+package audit
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"CipherOps/models"
+	"CipherOps/store"
+)
+
+// genesisHash is the previous hash of the first entry.
+const genesisHash = "0000000000000000000000000000000000000000000000000000000000000000"
+
+// maxOutput caps the command output kept per entry.
+const maxOutput = 4096
+
+// Entry is one audit record, see models.AuditEntry.
+type Entry = models.AuditEntry
+
+// Actor is who triggered an action. Requests put it in their context, actions
+// started by the server itself put SystemActor in theirs. An empty Username
+// is looked up from UserID when recording. Role is the user's role, or
+// "system", and decides which commands the actor may run.
+type Actor struct {
+	UserID   int
+	Username string
+	Role     string
+	IP       string
+}
+
+var SystemActor = Actor{Username: "system", Role: "system"}
+
+type actorKey struct{}
+
+func WithActor(ctx context.Context, actor Actor) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFrom returns the actor stored in ctx. Without one it is the zero
+// Actor, whose empty role the command policy gives no rules of its own.
+func ActorFrom(ctx context.Context) Actor {
+	actor, _ := ctx.Value(actorKey{}).(Actor)
+	return actor
+}
+
+// ActionKeyAdopted is the action of the entry AdoptKey records.
+const ActionKeyAdopted = "key-adopted"
+
+// Logger appends to and reads the audit log of a store.
+type Logger struct {
+	Store store.Store
+	// keys the hash chain, see NewKey; plain SHA-256 when nil
+	Key []byte
+}
+
+// NewKey derives the chain key from the configured secret, nil without one.
+func NewKey(secret string) []byte {
+	if secret == "" {
+		return nil
+	}
+	sum := sha256.Sum256([]byte("audit:" + secret))
+	return sum[:]
+}
+
+// Record appends an entry for actor and chains it to the last one. ID, Time
+// and the hashes are filled in.
+func (l *Logger) Record(ctx context.Context, actor Actor, e Entry) (Entry, error) {
+	e.UserID, e.Username, e.IP = actor.UserID, actor.Username, actor.IP
+	if e.Args == nil {
+		e.Args = []string{}
+	}
+	e.Output = truncate(e.Output, maxOutput)
+	if e.Username == "" && e.UserID != 0 {
+		user, err := l.Store.Users().Get(ctx, e.UserID)
+		if err != nil {
+			return e, fmt.Errorf("cannot resolve audit actor %d: %w", e.UserID, err)
+		}
+		e.Username = user.Username
+	}
+
+	return l.Store.Audit().Append(ctx, func(lastID int64, lastHash string) (Entry, error) {
+		e.ID = lastID + 1
+		e.PrevHash = lastHash
+		if e.PrevHash == "" {
+			e.PrevHash = genesisHash
+		}
+		// Postgres keeps microseconds, hash what will be read back
+		e.Time = time.Now().UTC().Truncate(time.Microsecond)
+		e.Hash = hashEntry(l.Key, e)
+		return e, nil
+	})
+}
+
+// truncate cuts s to at most n bytes without splitting a character.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n] + "…"
+}
+
+// hashEntry covers every field except Hash itself, in a fixed order. It is
+// an HMAC with key, a plain SHA-256 without.
+func hashEntry(key []byte, e Entry) string {
+	args, _ := json.Marshal(e.Args)
+	fields := []string{
+		strconv.FormatInt(e.ID, 10),
+		e.Time.UTC().Format(time.RFC3339Nano),
+		strconv.Itoa(e.UserID),
+		e.Username,
+		e.IP,
+		e.Action,
+		e.Command,
+		string(args),
+		strconv.FormatBool(e.Success),
+		e.Output,
+		e.Error,
+		e.PrevHash,
+	}
+	// added later; left out when empty so older entries still verify
+	if e.Host != "" {
+		fields = append(fields, "host", e.Host)
+	}
+	// length prefixes keep "ab","c" and "a","bc" apart
+	var h hash.Hash
+	if key != nil {
+		h = hmac.New(sha256.New, key)
+	} else {
+		h = sha256.New()
+	}
+	for _, f := range fields {
+		fmt.Fprintf(h, "%d:%s\n", len(f), f)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Filter selects entries, see store.AuditFilter.
+type Filter = store.AuditFilter
+
+// Query returns the matching entries, oldest first.
+func (l *Logger) Query(ctx context.Context, f Filter) ([]Entry, error) {
+	var entries []Entry
+	err := l.Store.Audit().Each(ctx, f, func(e Entry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	return entries, err
+}
+
+// VerifyResult is the outcome of checking the whole chain.
+type VerifyResult struct {
+	OK      bool  `json:"ok"`
+	Checked int64 `json:"checked"`
+	// hash of the last entry; keep a copy elsewhere to detect truncation
+	Head     string `json:"head"`
+	BrokenAt int64  `json:"broken_at,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	// entries recorded before the key was set, only as safe as plain
+	// SHA-256, and the ID of the key adoption entry that closes them
+	Unkeyed   int64 `json:"unkeyed,omitempty"`
+	AdoptedAt int64 `json:"adopted_at,omitempty"`
+}
+
+var errStop = errors.New("stop")
+
+// Verify recomputes every hash and checks the links between entries.
+// Entries from before the key was set verify with plain SHA-256, but only
+// when the first keyed entry after them is the one AdoptKey records; a
+// chain rewritten without the key has none. Removing entries from the end
+// cannot be detected from the chain alone, compare Head with a previously
+// saved value for that.
+func (l *Logger) Verify(ctx context.Context) (VerifyResult, error) {
+	res := VerifyResult{OK: true, Head: genesisHash}
+	var lastID int64
+	keyed := false
+	err := l.Store.Audit().Each(ctx, Filter{}, func(e Entry) error {
+		switch {
+		case e.ID != lastID+1:
+			res.Reason = fmt.Sprintf("entry %d follows entry %d", e.ID, lastID)
+		case e.PrevHash != res.Head:
+			res.Reason = "previous hash does not match the entry before"
+		case hashEntry(l.Key, e) == e.Hash:
+			if l.Key != nil && !keyed && res.Unkeyed > 0 {
+				if e.Action != ActionKeyAdopted {
+					res.Reason = "entries without the key are not closed by a key adoption entry"
+				}
+				res.AdoptedAt = e.ID
+			}
+			keyed = l.Key != nil
+		case l.Key != nil && !keyed && hashEntry(nil, e) == e.Hash:
+			res.Unkeyed++
+		default:
+			res.Reason = "entry content does not match its hash"
+		}
+		if res.Reason != "" {
+			res.OK = false
+			res.BrokenAt = e.ID
+			return errStop
+		}
+		res.Checked++
+		res.Head = e.Hash
+		lastID = e.ID
+		return nil
+	})
+	if errors.Is(err, errStop) {
+		err = nil
+	}
+	if res.OK && l.Key != nil && !keyed && res.Unkeyed > 0 {
+		res.OK = false
+		res.Reason = "no entry is keyed, the key was never adopted or the chain was rewritten without it"
+	}
+	return res, err
+}
+
+// AdoptKey records the key adoption entry when the log holds entries from
+// before the key was set and none with it, and reports whether it did.
+// Verify accepts unkeyed entries only before that entry. A chain that does
+// not verify is left alone rather than sealed.
+func (l *Logger) AdoptKey(ctx context.Context) (bool, error) {
+	if l.Key == nil {
+		return false, nil
+	}
+	res, err := l.Verify(ctx)
+	if err != nil || res.OK || res.BrokenAt != 0 || res.Unkeyed == 0 {
+		return false, err
+	}
+	_, err = l.Record(ctx, SystemActor, Entry{
+		Action: ActionKeyAdopted,
+		Output: fmt.Sprintf("%d entries recorded without the key, up to %s", res.Unkeyed, res.Head),
+	})
+	return err == nil, err
+}
+
+// Export writes the matching entries as JSON lines, oldest first.
+func (l *Logger) Export(ctx context.Context, w io.Writer, f Filter) error {
+	enc := json.NewEncoder(w)
+	return l.Store.Audit().Each(ctx, f, func(e Entry) error {
+		return enc.Encode(e)
+	})
+}
@@ -0,0 +1,175 @@
+package audit
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"CipherOps/store"
+)
+
+func openTest(t *testing.T) store.Store {
+	t.Helper()
+	st, err := store.OpenSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+	return st
+}
+
+// appendRaw adds e as it is, the way someone with write access to the
+// database would.
+func appendRaw(t *testing.T, st store.Store, e Entry) {
+	t.Helper()
+	_, err := st.Audit().Append(context.Background(), func(int64, string) (Entry, error) {
+		return e, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// appendForged adds an entry the way someone with write access to the
+// database but without the key would, with a plain SHA-256.
+func appendForged(t *testing.T, st store.Store, action string) {
+	t.Helper()
+	_, err := st.Audit().Append(context.Background(), func(lastID int64, lastHash string) (Entry, error) {
+		e := Entry{ID: lastID + 1, PrevHash: lastHash, Action: action, Args: []string{}, Time: time.Now().UTC().Truncate(time.Microsecond)}
+		if e.PrevHash == "" {
+			e.PrevHash = genesisHash
+		}
+		e.Hash = hashEntry(nil, e)
+		return e, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecordTruncatesOutput(t *testing.T) {
+	l := &Logger{Store: openTest(t), Key: NewKey("secret")}
+	// a three byte character across the limit
+	output := strings.Repeat("a", maxOutput-1) + "€€"
+	e, err := l.Record(context.Background(), SystemActor, Entry{Action: "command", Output: output})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !utf8.ValidString(e.Output) || e.Output != strings.Repeat("a", maxOutput-1)+"…" {
+		t.Errorf("output cut to %q…", e.Output[len(e.Output)-8:])
+	}
+}
+
+func TestVerifyKeyedChain(t *testing.T) {
+	ctx := context.Background()
+	st := openTest(t)
+	l := &Logger{Store: st, Key: NewKey("secret")}
+	for _, action := range []string{"install", "restart"} {
+		if _, err := l.Record(ctx, SystemActor, Entry{Action: action}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if res, err := l.Verify(ctx); err != nil || !res.OK || res.Checked != 2 || res.Unkeyed != 0 {
+		t.Fatalf("Verify = %+v, %v", res, err)
+	}
+	if res, _ := (&Logger{Store: st, Key: NewKey("other")}).Verify(ctx); res.OK {
+		t.Error("the chain verified with another key")
+	}
+
+	appendForged(t, st, "cover-up")
+	res, err := l.Verify(ctx)
+	if err != nil || res.OK || res.BrokenAt != 3 {
+		t.Errorf("Verify after a forged entry = %+v, %v", res, err)
+	}
+}
+
+func TestVerifyEntriesBeforeKey(t *testing.T) {
+	ctx := context.Background()
+	st := openTest(t)
+	if _, err := (&Logger{Store: st}).Record(ctx, SystemActor, Entry{Action: "install"}); err != nil {
+		t.Fatal(err)
+	}
+	l := &Logger{Store: st, Key: NewKey("secret")}
+	if res, _ := l.Verify(ctx); res.OK {
+		t.Errorf("Verify = %+v before the key was adopted", res)
+	}
+	if adopted, err := l.AdoptKey(ctx); err != nil || !adopted {
+		t.Fatalf("AdoptKey = %v, %v", adopted, err)
+	}
+	if adopted, err := l.AdoptKey(ctx); err != nil || adopted {
+		t.Errorf("adopted the key twice: %v", err)
+	}
+	if _, err := l.Record(ctx, SystemActor, Entry{Action: "restart"}); err != nil {
+		t.Fatal(err)
+	}
+	res, err := l.Verify(ctx)
+	if err != nil || !res.OK || res.Checked != 3 || res.Unkeyed != 1 || res.AdoptedAt != 2 {
+		t.Errorf("Verify = %+v, %v; want the old entry counted as unkeyed", res, err)
+	}
+}
+
+func TestVerifyUnadoptedEntriesBeforeKey(t *testing.T) {
+	ctx := context.Background()
+	st := openTest(t)
+	if _, err := (&Logger{Store: st}).Record(ctx, SystemActor, Entry{Action: "install"}); err != nil {
+		t.Fatal(err)
+	}
+	l := &Logger{Store: st, Key: NewKey("secret")}
+	if _, err := l.Record(ctx, SystemActor, Entry{Action: "restart"}); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := l.Verify(ctx); res.OK || res.BrokenAt != 2 {
+		t.Errorf("Verify = %+v, want the keyed entry without an adoption refused", res)
+	}
+}
+
+func TestVerifyRehashedChain(t *testing.T) {
+	ctx := context.Background()
+	st := openTest(t)
+	key := NewKey("secret")
+	if _, err := (&Logger{Store: st}).Record(ctx, SystemActor, Entry{Action: "install"}); err != nil {
+		t.Fatal(err)
+	}
+	l := &Logger{Store: st, Key: key}
+	if _, err := l.AdoptKey(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Record(ctx, SystemActor, Entry{Action: "restart"}); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := l.Query(ctx, Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same log with one entry changed and every hash redone without
+	// the key
+	rewritten := openTest(t)
+	prev := genesisHash
+	for _, e := range entries {
+		if e.Action == "restart" {
+			e.Action = "cover-up"
+		}
+		e.PrevHash = prev
+		e.Hash = hashEntry(nil, e)
+		appendRaw(t, rewritten, e)
+		prev = e.Hash
+	}
+	if res, err := (&Logger{Store: rewritten, Key: key}).Verify(ctx); err != nil || res.OK {
+		t.Errorf("Verify of the re-hashed chain = %+v, %v", res, err)
+	}
+
+	// keeping the keyed entries only works if the unkeyed ones are left as
+	// they were
+	rewritten = openTest(t)
+	entries[0].Action = "cover-up"
+	entries[0].Hash = hashEntry(nil, entries[0])
+	for _, e := range entries {
+		appendRaw(t, rewritten, e)
+	}
+	if res, err := (&Logger{Store: rewritten, Key: key}).Verify(ctx); err != nil || res.OK || res.BrokenAt != 2 {
+		t.Errorf("Verify after re-hashing the unkeyed entries = %+v, %v", res, err)
+	}
+}
@@ -0,0 +1,70 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"CipherOps/models"
+	"CipherOps/store"
+)
+
+const (
+	PurposeVerifyEmail   = "verify_email"
+	PurposeResetPassword = "reset_password"
+)
+
+var ErrInvalidEmailToken = errors.New("link is invalid, expired or was already used")
+
+// EmailTokens issues the links sent by mail. The link is signed and
+// time-limited; the row it points to makes it single-use.
+type EmailTokens struct {
+	Tokens    store.EmailTokenRepository
+	Key       []byte
+	VerifyTTL time.Duration
+	ResetTTL  time.Duration
+}
+
+// Issue creates a token for userID bound to the address it is mailed to.
+// Older unused tokens of the same purpose stop working.
+func (t *EmailTokens) Issue(ctx context.Context, userID int, purpose, email string) (string, error) {
+	ttl := t.VerifyTTL
+	if purpose == PurposeResetPassword {
+		ttl = t.ResetTTL
+	}
+	id, err := RandomToken(24)
+	if err != nil {
+		return "", err
+	}
+	err = t.Tokens.Issue(ctx, models.EmailToken{
+		ID:        id,
+		UserID:    userID,
+		Purpose:   purpose,
+		Email:     email,
+		ExpiresAt: time.Now().Add(ttl),
+	})
+	if err != nil {
+		return "", err
+	}
+	return SignValue(t.Key, purpose+"|"+id, ttl), nil
+}
+
+// Consume checks a token and marks it used. It returns the user and the
+// address the token was sent to.
+func (t *EmailTokens) Consume(ctx context.Context, purpose, token string) (int, string, error) {
+	value, err := VerifyValue(t.Key, token)
+	if err != nil {
+		return 0, "", ErrInvalidEmailToken
+	}
+	tokenPurpose, id, ok := strings.Cut(value, "|")
+	if !ok || tokenPurpose != purpose {
+		return 0, "", ErrInvalidEmailToken
+	}
+
+	used, err := t.Tokens.Consume(ctx, id, purpose, time.Now())
+	if errors.Is(err, store.ErrNotFound) {
+		return 0, "", ErrInvalidEmailToken
+	}
+	return used.UserID, used.Email, err
+}
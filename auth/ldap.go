@@ -0,0 +1,220 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// LDAPConn is the part of *ldap.Conn the provider uses, so tests can swap in
+// a fake directory.
+type LDAPConn interface {
+	Bind(username, password string) error
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	StartTLS(config *tls.Config) error
+	Close() error
+}
+
+type LDAPConfig struct {
+	// ldap://host:389 or ldaps://host:636
+	URL      string
+	StartTLS bool
+	// PEM bundle used to verify the server, system roots when empty
+	CAFile             string
+	InsecureSkipVerify bool
+
+	// service account used to look users up
+	BindDN       string
+	BindPassword string
+
+	BaseDN string
+	// every %s is replaced by the escaped username
+	UserFilter string
+	// attribute of the user entry listing its groups, e.g. memberOf
+	GroupAttribute string
+	// optional group search for servers without memberOf; every %s is
+	// replaced by the user DN
+	GroupBaseDN string
+	GroupFilter string
+
+	// semicolon separated group=role pairs, groups are DNs or CNs
+	RoleMap     string
+	DefaultRole string
+}
+
+// LDAPProvider authenticates against LDAP or Active Directory: bind as the
+// service account, find the user, then bind as the user with its password.
+type LDAPProvider struct {
+	cfg     LDAPConfig
+	tls     *tls.Config
+	roleMap []roleMapping
+	// Dial opens a connection; replaced in tests
+	Dial func() (LDAPConn, error)
+}
+
+func NewLDAPProvider(cfg LDAPConfig) (*LDAPProvider, error) {
+	if cfg.URL == "" || cfg.BaseDN == "" {
+		return nil, errors.New("LDAP provider needs a URL and a base DN")
+	}
+	if !strings.Contains(cfg.UserFilter, "%s") {
+		return nil, fmt.Errorf("LDAP user filter %q has no %%s placeholder", cfg.UserFilter)
+	}
+	if cfg.GroupBaseDN != "" && !strings.Contains(cfg.GroupFilter, "%s") {
+		return nil, fmt.Errorf("LDAP group filter %q has no %%s placeholder", cfg.GroupFilter)
+	}
+	mappings, err := parseRoleMap(cfg.RoleMap, ";")
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if host := ldapHost(cfg.URL); host != "" {
+		tlsConfig.ServerName = host
+	}
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read LDAP CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	p := &LDAPProvider{cfg: cfg, tls: tlsConfig, roleMap: mappings}
+	p.Dial = p.dial
+	return p, nil
+}
+
+func (p *LDAPProvider) Name() string { return "ldap" }
+
+func (p *LDAPProvider) Authenticate(ctx context.Context, username, password string) (Identity, error) {
+	// an empty password would turn the user bind into an anonymous bind,
+	// which most servers accept
+	if password == "" {
+		return Identity{}, ErrInvalidCredentials
+	}
+
+	conn, err := p.Dial()
+	if err != nil {
+		return Identity{}, err
+	}
+	defer conn.Close()
+
+	if err := p.serviceBind(conn); err != nil {
+		return Identity{}, err
+	}
+	res, err := conn.Search(ldap.NewSearchRequest(
+		p.cfg.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 0, false,
+		strings.ReplaceAll(p.cfg.UserFilter, "%s", ldap.EscapeFilter(username)),
+		[]string{"dn", p.cfg.GroupAttribute},
+		nil,
+	))
+	if err != nil {
+		return Identity{}, fmt.Errorf("LDAP user search failed: %w", err)
+	}
+	switch len(res.Entries) {
+	case 0:
+		return Identity{}, ErrUnknownUser
+	case 1:
+	default:
+		return Identity{}, fmt.Errorf("LDAP user filter matched %d entries for %q", len(res.Entries), username)
+	}
+	entry := res.Entries[0]
+
+	if err := conn.Bind(entry.DN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return Identity{}, ErrInvalidCredentials
+		}
+		return Identity{}, fmt.Errorf("LDAP user bind failed: %w", err)
+	}
+
+	groups := entry.GetAttributeValues(p.cfg.GroupAttribute)
+	if p.cfg.GroupBaseDN != "" {
+		// group entries may not be readable by the user itself
+		if err := p.serviceBind(conn); err != nil {
+			return Identity{}, err
+		}
+		res, err := conn.Search(ldap.NewSearchRequest(
+			p.cfg.GroupBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			strings.ReplaceAll(p.cfg.GroupFilter, "%s", ldap.EscapeFilter(entry.DN)),
+			[]string{"dn"},
+			nil,
+		))
+		if err != nil {
+			return Identity{}, fmt.Errorf("LDAP group search failed: %w", err)
+		}
+		for _, g := range res.Entries {
+			groups = append(groups, g.DN)
+		}
+	}
+
+	return Identity{
+		Provider: p.Name(),
+		Username: username,
+		Role:     p.role(groups),
+		Groups:   groups,
+	}, nil
+}
+
+func (p *LDAPProvider) dial() (LDAPConn, error) {
+	conn, err := ldap.DialURL(p.cfg.URL, ldap.DialWithTLSConfig(p.tls))
+	if err != nil {
+		return nil, fmt.Errorf("cannot reach LDAP server: %w", err)
+	}
+	if p.cfg.StartTLS && strings.HasPrefix(strings.ToLower(p.cfg.URL), "ldap://") {
+		if err := conn.StartTLS(p.tls); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("LDAP StartTLS failed: %w", err)
+		}
+	}
+	return conn, nil
+}
+
+func (p *LDAPProvider) serviceBind(conn LDAPConn) error {
+	if p.cfg.BindDN == "" {
+		return nil
+	}
+	if err := conn.Bind(p.cfg.BindDN, p.cfg.BindPassword); err != nil {
+		return fmt.Errorf("LDAP service account bind failed: %w", err)
+	}
+	return nil
+}
+
+// role matches each mapping against the full group DN or its first RDN value,
+// so both "cn=ops,ou=groups,dc=example,dc=org" and "ops" work.
+func (p *LDAPProvider) role(groups []string) string {
+	for _, m := range p.roleMap {
+		for _, g := range groups {
+			if strings.EqualFold(m.group, g) || strings.EqualFold(m.group, firstRDNValue(g)) {
+				return m.role
+			}
+		}
+	}
+	return p.cfg.DefaultRole
+}
+
+func firstRDNValue(dn string) string {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) == 0 || len(parsed.RDNs[0].Attributes) == 0 {
+		return ""
+	}
+	return parsed.RDNs[0].Attributes[0].Value
+}
+
+func ldapHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
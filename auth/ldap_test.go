@@ -0,0 +1,209 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+const (
+	serviceDN = "cn=panel,dc=example,dc=org"
+	aliceDN   = "uid=alice,ou=people,dc=example,dc=org"
+	bobDN     = "uid=bob,ou=people,dc=example,dc=org"
+	opsDN     = "cn=ops,ou=groups,dc=example,dc=org"
+	devsDN    = "cn=devs,ou=groups,dc=example,dc=org"
+)
+
+type fakeEntry struct {
+	dn       string
+	password string
+	attrs    map[string][]string
+}
+
+// fakeDirectory answers equality filters like (uid=alice) over its entries
+// and records what the provider asked for.
+type fakeDirectory struct {
+	entries []fakeEntry
+	binds   []string
+	filters []string
+}
+
+func newFakeDirectory() *fakeDirectory {
+	return &fakeDirectory{entries: []fakeEntry{
+		{dn: serviceDN, password: "service-secret"},
+		{dn: aliceDN, password: "alice-secret", attrs: map[string][]string{"uid": {"alice"}, "memberOf": {opsDN}}},
+		{dn: bobDN, password: "bob-secret", attrs: map[string][]string{"uid": {"bob"}}},
+		{dn: devsDN, attrs: map[string][]string{"member": {bobDN}}},
+	}}
+}
+
+func (d *fakeDirectory) Bind(username, password string) error {
+	d.binds = append(d.binds, username)
+	for _, e := range d.entries {
+		if e.dn == username && e.password != "" && e.password == password {
+			return nil
+		}
+	}
+	return ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+}
+
+func (d *fakeDirectory) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	d.filters = append(d.filters, req.Filter)
+	attr, value, ok := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(req.Filter, "("), ")"), "=")
+	if !ok {
+		return nil, ldap.NewError(ldap.LDAPResultFilterError, errors.New("unsupported filter"))
+	}
+	res := &ldap.SearchResult{}
+	for _, e := range d.entries {
+		if !strings.HasSuffix(e.dn, req.BaseDN) || !slices.Contains(e.attrs[attr], value) {
+			continue
+		}
+		attrs := map[string][]string{}
+		for _, name := range req.Attributes {
+			if values, ok := e.attrs[name]; ok {
+				attrs[name] = values
+			}
+		}
+		res.Entries = append(res.Entries, ldap.NewEntry(e.dn, attrs))
+	}
+	return res, nil
+}
+
+func (d *fakeDirectory) StartTLS(*tls.Config) error { return nil }
+
+func (d *fakeDirectory) Close() error { return nil }
+
+func newTestLDAPProvider(t *testing.T, dir *fakeDirectory, cfg LDAPConfig) (*LDAPProvider, *int) {
+	t.Helper()
+	cfg.URL = "ldap://ldap.example.org"
+	cfg.BaseDN = "ou=people,dc=example,dc=org"
+	cfg.UserFilter = "(uid=%s)"
+	cfg.GroupAttribute = "memberOf"
+	if cfg.BindDN == "" {
+		cfg.BindDN, cfg.BindPassword = serviceDN, "service-secret"
+	}
+	cfg.DefaultRole = "viewer"
+	p, err := NewLDAPProvider(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dials := 0
+	p.Dial = func() (LDAPConn, error) {
+		dials++
+		return dir, nil
+	}
+	return p, &dials
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	dir := newFakeDirectory()
+	p, _ := newTestLDAPProvider(t, dir, LDAPConfig{RoleMap: "ops=admin"})
+
+	id, err := p.Authenticate(context.Background(), "alice", "alice-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Username != "alice" || id.Provider != "ldap" || id.Role != "admin" {
+		t.Errorf("identity = %+v, want the admin alice", id)
+	}
+	if want := []string{serviceDN, aliceDN}; !slices.Equal(dir.binds, want) {
+		t.Errorf("binds = %q, want %q", dir.binds, want)
+	}
+}
+
+func TestLDAPAuthenticateBindFailure(t *testing.T) {
+	ctx := context.Background()
+
+	p, _ := newTestLDAPProvider(t, newFakeDirectory(), LDAPConfig{})
+	if _, err := p.Authenticate(ctx, "alice", "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("wrong password: %v, want ErrInvalidCredentials", err)
+	}
+
+	dir := newFakeDirectory()
+	p, _ = newTestLDAPProvider(t, dir, LDAPConfig{BindDN: serviceDN, BindPassword: "stale"})
+	_, err := p.Authenticate(ctx, "alice", "alice-secret")
+	if err == nil || errors.Is(err, ErrInvalidCredentials) || !strings.Contains(err.Error(), "service account") {
+		t.Errorf("service account bind failure: %v, want a configuration error", err)
+	}
+	if len(dir.filters) != 0 {
+		t.Errorf("searched %q without a service bind", dir.filters)
+	}
+}
+
+func TestLDAPAuthenticateEmptyPassword(t *testing.T) {
+	dir := newFakeDirectory()
+	p, dials := newTestLDAPProvider(t, dir, LDAPConfig{})
+	if _, err := p.Authenticate(context.Background(), "alice", ""); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("empty password: %v, want ErrInvalidCredentials", err)
+	}
+	// an unauthenticated bind as alice would succeed on most servers
+	if *dials != 0 || len(dir.binds) != 0 {
+		t.Errorf("reached the directory: %d dials, binds %q", *dials, dir.binds)
+	}
+}
+
+func TestLDAPAuthenticateUnknownUser(t *testing.T) {
+	dir := newFakeDirectory()
+	p, _ := newTestLDAPProvider(t, dir, LDAPConfig{})
+	if _, err := p.Authenticate(context.Background(), "carol", "secret"); !errors.Is(err, ErrUnknownUser) {
+		t.Errorf("unknown user: %v, want ErrUnknownUser", err)
+	}
+	if want := []string{serviceDN}; !slices.Equal(dir.binds, want) {
+		t.Errorf("binds = %q, want only the service account", dir.binds)
+	}
+}
+
+func TestLDAPRoleMapping(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      LDAPConfig
+		username string
+		password string
+		role     string
+	}{
+		{"memberOf by CN", LDAPConfig{RoleMap: "ops=admin"}, "alice", "alice-secret", "admin"},
+		{"memberOf by DN", LDAPConfig{RoleMap: "CN=Ops,OU=Groups,DC=example,DC=org=admin"}, "alice", "alice-secret", "admin"},
+		{"first mapping wins", LDAPConfig{RoleMap: "devs=user;ops=operator;ops=admin"}, "alice", "alice-secret", "operator"},
+		{"no group", LDAPConfig{RoleMap: "ops=admin"}, "bob", "bob-secret", "viewer"},
+		{"group search", LDAPConfig{RoleMap: "ops=admin;devs=user", GroupBaseDN: "ou=groups,dc=example,dc=org", GroupFilter: "(member=%s)"},
+			"bob", "bob-secret", "user"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, _ := newTestLDAPProvider(t, newFakeDirectory(), tt.cfg)
+			id, err := p.Authenticate(context.Background(), tt.username, tt.password)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id.Role != tt.role {
+				t.Errorf("role = %q with groups %q, want %q", id.Role, id.Groups, tt.role)
+			}
+		})
+	}
+}
+
+func TestLDAPEscapesUsername(t *testing.T) {
+	tests := []struct {
+		username string
+		filter   string
+	}{
+		{"*", `(uid=\2a)`},
+		{"alice)(uid=*", `(uid=alice\29\28uid=\2a)`},
+		{`alice\`, `(uid=alice\5c)`},
+	}
+	for _, tt := range tests {
+		dir := newFakeDirectory()
+		p, _ := newTestLDAPProvider(t, dir, LDAPConfig{})
+		if _, err := p.Authenticate(context.Background(), tt.username, "alice-secret"); !errors.Is(err, ErrUnknownUser) {
+			t.Errorf("%q: %v, want ErrUnknownUser", tt.username, err)
+		}
+		if !slices.Equal(dir.filters, []string{tt.filter}) {
+			t.Errorf("%q searched %q, want %q", tt.username, dir.filters, tt.filter)
+		}
+	}
+}
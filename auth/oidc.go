@@ -0,0 +1,191 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// Cookie carrying state, PKCE verifier and nonce across the IdP redirect
+const OIDCCookie = "oidc_flow"
+
+// OIDCProvider drives the authorization code flow with PKCE against an
+// OpenID Connect identity provider.
+type OIDCProvider struct {
+	Issuer      string
+	oauth       oauth2.Config
+	verifier    *oidc.IDTokenVerifier
+	groupsClaim string
+	roleMap     []roleMapping
+	defaultRole string
+}
+
+type roleMapping struct {
+	group string
+	role  string
+}
+
+// OIDCIdentity is what the panel needs from a verified ID token.
+type OIDCIdentity struct {
+	Subject  string
+	Username string
+	Email    string
+	Groups   []string
+}
+
+// NewOIDCProvider fetches the discovery document of issuer and its JWKS.
+// roleMap is a comma separated list of group=role pairs; the first pair whose
+// group the user belongs to decides the role.
+func NewOIDCProvider(ctx context.Context, issuer, clientID, clientSecret, redirectURL, groupsClaim, roleMap, defaultRole string) (*OIDCProvider, error) {
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("OIDC discovery for %s failed: %w", issuer, err)
+	}
+
+	var methods struct {
+		PKCE []string `json:"code_challenge_methods_supported"`
+	}
+	if err := provider.Claims(&methods); err != nil {
+		return nil, fmt.Errorf("invalid OIDC discovery document: %w", err)
+	}
+	if len(methods.PKCE) > 0 && !containsString(methods.PKCE, "S256") {
+		return nil, fmt.Errorf("OIDC provider %s does not support S256 PKCE", issuer)
+	}
+
+	mappings, err := parseRoleMap(roleMap, ",")
+	if err != nil {
+		return nil, err
+	}
+	return &OIDCProvider{
+		Issuer: issuer,
+		oauth: oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			RedirectURL:  redirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+		},
+		verifier:    provider.Verifier(&oidc.Config{ClientID: clientID}),
+		groupsClaim: groupsClaim,
+		roleMap:     mappings,
+		defaultRole: defaultRole,
+	}, nil
+}
+
+// AuthCodeURL returns the IdP login URL for the given state, nonce and PKCE
+// verifier.
+func (p *OIDCProvider) AuthCodeURL(state, nonce, verifier string) string {
+	return p.oauth.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+}
+
+// Exchange trades the authorization code for tokens and validates the ID
+// token: signature against the JWKS, issuer, audience, expiry and nonce.
+func (p *OIDCProvider) Exchange(ctx context.Context, code, nonce, verifier string) (OIDCIdentity, error) {
+	token, err := p.oauth.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return OIDCIdentity{}, fmt.Errorf("code exchange failed: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok || rawIDToken == "" {
+		return OIDCIdentity{}, errors.New("token response has no id_token")
+	}
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return OIDCIdentity{}, fmt.Errorf("invalid ID token: %w", err)
+	}
+	if idToken.Nonce != nonce {
+		return OIDCIdentity{}, errors.New("ID token nonce mismatch")
+	}
+
+	var claims map[string]any
+	if err := idToken.Claims(&claims); err != nil {
+		return OIDCIdentity{}, err
+	}
+	identity := OIDCIdentity{
+		Subject:  idToken.Subject,
+		Username: stringClaim(claims, "preferred_username"),
+		Email:    stringClaim(claims, "email"),
+		Groups:   stringsClaim(claims, p.groupsClaim),
+	}
+	if identity.Username == "" {
+		identity.Username = identity.Email
+	}
+	if identity.Username == "" {
+		identity.Username = identity.Subject
+	}
+	return identity, nil
+}
+
+// Role maps the identity's groups to a panel role.
+func (p *OIDCProvider) Role(identity OIDCIdentity) string {
+	for _, m := range p.roleMap {
+		if containsString(identity.Groups, m.group) {
+			return m.role
+		}
+	}
+	return p.defaultRole
+}
+
+// RoleMapRoles returns the roles a role map hands out, for checking the
+// settings; sep is "," for OIDC and ";" for LDAP.
+func RoleMapRoles(s, sep string) ([]string, error) {
+	mappings, err := parseRoleMap(s, sep)
+	roles := make([]string, len(mappings))
+	for i, m := range mappings {
+		roles[i] = m.role
+	}
+	return roles, err
+}
+
+// parseRoleMap reads sep separated group=role pairs. The role is taken after
+// the last "=" so groups may be LDAP DNs.
+func parseRoleMap(s, sep string) ([]roleMapping, error) {
+	var mappings []roleMapping
+	for _, pair := range strings.Split(s, sep) {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		i := strings.LastIndex(pair, "=")
+		if i <= 0 || i == len(pair)-1 {
+			return nil, fmt.Errorf("invalid role mapping %q, expected group=role", pair)
+		}
+		mappings = append(mappings, roleMapping{group: strings.TrimSpace(pair[:i]), role: strings.TrimSpace(pair[i+1:])})
+	}
+	return mappings, nil
+}
+
+func stringClaim(claims map[string]any, name string) string {
+	v, _ := claims[name].(string)
+	return v
+}
+
+// stringsClaim accepts both a JSON array and a single string, IdPs differ.
+func stringsClaim(claims map[string]any, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []any:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"context"
+	"errors"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"CipherOps/store"
+)
+
+var (
+	// the provider does not know the user, the next one should be asked
+	ErrUnknownUser = errors.New("unknown user")
+	// the provider knows the user but the password is wrong
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Identity is a successful password authentication.
+type Identity struct {
+	Provider string
+	Username string
+	// Role decided by the provider; empty keeps the role stored for the user
+	Role   string
+	Groups []string
+	// set by providers that authenticate existing panel users
+	UserID int
+}
+
+// PasswordProvider checks a username and password. The login handler asks
+// the configured providers in order until one accepts the credentials.
+type PasswordProvider interface {
+	Name() string
+	Authenticate(ctx context.Context, username, password string) (Identity, error)
+}
+
+// LocalProvider checks the bcrypt hashes of the local users.
+type LocalProvider struct {
+	Users store.UserRepository
+}
+
+func (p *LocalProvider) Name() string { return "local" }
+
+func (p *LocalProvider) Authenticate(ctx context.Context, username, password string) (Identity, error) {
+	user, err := p.Users.GetByUsername(ctx, username)
+	if errors.Is(err, store.ErrNotFound) {
+		return Identity{}, ErrUnknownUser
+	}
+	if err != nil {
+		return Identity{}, err
+	}
+	// users of LDAP and SSO have no password here
+	if user.AuthProvider != p.Name() {
+		return Identity{}, ErrUnknownUser
+	}
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
+		return Identity{}, ErrInvalidCredentials
+	}
+	return Identity{Provider: p.Name(), Username: user.Username, Role: user.Role, UserID: user.ID}, nil
+}
@@ -0,0 +1,36 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+const RecoveryCodeCount = 10
+
+// GenerateRecoveryCodes returns n codes formatted as xxxxx-xxxxx. They are
+// only ever shown to the user once; the database keeps HashRecoveryCode.
+func GenerateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		buf := make([]byte, 7)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		raw := strings.ToLower(b32.EncodeToString(buf))[:10]
+		codes = append(codes, raw[:5]+"-"+raw[5:])
+	}
+	return codes, nil
+}
+
+// HashRecoveryCode normalises and hashes a recovery code. The codes carry 50
+// bits of randomness, so a plain SHA-256 is enough and lets the lookup be a
+// single indexed query.
+func HashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	code = strings.ReplaceAll(code, "-", "")
+	code = strings.ReplaceAll(code, " ", "")
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
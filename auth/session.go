@@ -0,0 +1,152 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cookie names used by the login flow
+const (
+	SessionCookie = "session"
+	MFACookie     = "mfa_pending"
+)
+
+// SessionStage tells how far the login flow went for a session.
+type SessionStage string
+
+const (
+	// password accepted, waiting for the TOTP or recovery code
+	StageMFA SessionStage = "mfa"
+	// the user's role requires 2FA but no authenticator is enrolled yet;
+	// only the enrollment endpoints are reachable
+	StageEnroll SessionStage = "enroll"
+	// fully authorized
+	StageFull SessionStage = "full"
+)
+
+const (
+	SessionTTL    = 12 * time.Hour
+	MFAPendingTTL = 5 * time.Minute
+)
+
+var ErrInvalidSession = errors.New("invalid or expired session")
+
+type Session struct {
+	// random handle of the server-side session, empty for MFA pending tokens
+	ID      string
+	UserID  int
+	Role    string
+	Stage   SessionStage
+	Expires time.Time
+}
+
+// NewSessionKey derives the signing key from the configured secret. Without a
+// secret a random key is used, which logs everybody out on restart.
+func NewSessionKey(secret string) []byte {
+	if secret != "" {
+		sum := sha256.Sum256([]byte(secret))
+		return sum[:]
+	}
+	slog.Warn("SESSION_SECRET is not set, using a random key")
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Fatal(err)
+	}
+	return key
+}
+
+// SignSession encodes s as payload.signature.
+func SignSession(key []byte, s Session) string {
+	payload := strings.Join([]string{
+		s.ID,
+		strconv.Itoa(s.UserID),
+		s.Role,
+		string(s.Stage),
+		strconv.FormatInt(s.Expires.Unix(), 10),
+	}, "|")
+	enc := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	return enc + "." + sign(key, enc)
+}
+
+// ParseSession verifies the signature and expiry of a token made by SignSession.
+func ParseSession(key []byte, token string) (Session, error) {
+	enc, sig, ok := strings.Cut(token, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(sign(key, enc))) {
+		return Session{}, ErrInvalidSession
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil {
+		return Session{}, ErrInvalidSession
+	}
+	parts := strings.Split(string(raw), "|")
+	if len(parts) != 5 {
+		return Session{}, ErrInvalidSession
+	}
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return Session{}, ErrInvalidSession
+	}
+	exp, err := strconv.ParseInt(parts[4], 10, 64)
+	if err != nil {
+		return Session{}, ErrInvalidSession
+	}
+	s := Session{ID: parts[0], UserID: id, Role: parts[2], Stage: SessionStage(parts[3]), Expires: time.Unix(exp, 0)}
+	if time.Now().After(s.Expires) {
+		return Session{}, fmt.Errorf("%w: expired at %s", ErrInvalidSession, s.Expires.Format(time.RFC3339))
+	}
+	return s, nil
+}
+
+func sign(key []byte, data string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// RandomToken returns n random bytes encoded as unpadded base64url.
+func RandomToken(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// SignValue protects a short-lived value stored in a cookie, such as the
+// state of an SSO redirect, against tampering.
+func SignValue(key []byte, value string, ttl time.Duration) string {
+	payload := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10) + "|" + value
+	enc := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	// the prefix keeps these signatures apart from session tokens
+	return enc + "." + sign(key, "value:"+enc)
+}
+
+// VerifyValue returns the value signed by SignValue if it is intact and not expired.
+func VerifyValue(key []byte, signed string) (string, error) {
+	enc, sig, ok := strings.Cut(signed, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(sign(key, "value:"+enc))) {
+		return "", ErrInvalidSession
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(enc)
+	if err != nil {
+		return "", ErrInvalidSession
+	}
+	expStr, value, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return "", ErrInvalidSession
+	}
+	exp, err := strconv.ParseInt(expStr, 10, 64)
+	if err != nil || time.Now().Unix() > exp {
+		return "", ErrInvalidSession
+	}
+	return value, nil
+}
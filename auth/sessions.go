@@ -0,0 +1,199 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"CipherOps/models"
+	"CipherOps/store"
+)
+
+// SessionInfo describes a login for the session management page.
+type SessionInfo struct {
+	ID         int64     `json:"id"`
+	Device     string    `json:"device"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	Stage      string    `json:"stage"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
+
+// SessionStore tracks logins server-side. The cookie only carries a signed
+// random handle; the row decides whether the session is still valid, and the
+// role is read from the user on every request so role changes apply at once.
+type SessionStore struct {
+	Store store.Store
+	Key   []byte
+	// sessions unused for this long end early, 0 keeps them for SessionTTL
+	IdleTimeout time.Duration
+}
+
+// lastSeenResolution limits the last_seen_at writes to one per minute and session.
+const lastSeenResolution = time.Minute
+
+// endedRetention is how long ended sessions stay listed for audits.
+const endedRetention = 7 * 24 * time.Hour
+
+// Create starts a session and returns the signed cookie value.
+func (s *SessionStore) Create(ctx context.Context, userID int, role string, stage SessionStage, ip, userAgent string) (string, error) {
+	handle, err := RandomToken(24)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	row := models.Session{
+		TokenHash: HashAPIToken(handle),
+		UserID:    userID,
+		Stage:     string(stage),
+		IP:        ip,
+		UserAgent: userAgent,
+		CreatedAt: now,
+		ExpiresAt: now.Add(SessionTTL),
+	}
+	if err := s.Store.Sessions().Create(ctx, &row); err != nil {
+		return "", err
+	}
+	if err := s.Store.Sessions().Prune(ctx, userID, now.Add(-endedRetention)); err != nil {
+		return "", err
+	}
+	return SignSession(s.Key, Session{ID: handle, UserID: userID, Role: role, Stage: stage, Expires: row.ExpiresAt}), nil
+}
+
+// Validate checks the cookie against its row. The returned session carries
+// the current role and stage; the int64 is the row id.
+func (s *SessionStore) Validate(ctx context.Context, token string) (Session, int64, error) {
+	session, err := ParseSession(s.Key, token)
+	if err != nil {
+		return Session{}, 0, err
+	}
+	if session.ID == "" {
+		return Session{}, 0, ErrInvalidSession
+	}
+
+	now := time.Now()
+	row, err := s.Store.Sessions().GetActive(ctx, HashAPIToken(session.ID), now)
+	if errors.Is(err, store.ErrNotFound) || (err == nil && row.UserID != session.UserID) {
+		return Session{}, 0, ErrInvalidSession
+	}
+	if err != nil {
+		return Session{}, 0, err
+	}
+	if s.IdleTimeout > 0 && now.Sub(row.LastSeenAt) > s.IdleTimeout {
+		return Session{}, 0, ErrInvalidSession
+	}
+	user, err := s.Store.Users().Get(ctx, row.UserID)
+	if errors.Is(err, store.ErrNotFound) {
+		return Session{}, 0, ErrInvalidSession
+	}
+	if err != nil {
+		return Session{}, 0, err
+	}
+	if now.Sub(row.LastSeenAt) > lastSeenResolution {
+		if err := s.Store.Sessions().Touch(ctx, row.ID, now); err != nil {
+			return Session{}, 0, err
+		}
+	}
+	session.Role = user.Role
+	session.Stage = SessionStage(row.Stage)
+	return session, row.ID, nil
+}
+
+// SetStage moves a session on in the login flow, e.g. from enroll to full.
+func (s *SessionStore) SetStage(ctx context.Context, id int64, stage SessionStage) error {
+	return s.Store.Sessions().SetStage(ctx, id, string(stage))
+}
+
+// List returns the active sessions of a user, most recently used first.
+// current marks the session making the request.
+func (s *SessionStore) List(ctx context.Context, userID int, current int64) ([]SessionInfo, error) {
+	rows, err := s.Store.Sessions().ListActive(ctx, userID, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	sessions := []SessionInfo{}
+	for _, row := range rows {
+		if s.IdleTimeout > 0 && time.Since(row.LastSeenAt) > s.IdleTimeout {
+			continue
+		}
+		sessions = append(sessions, SessionInfo{
+			ID:         row.ID,
+			Device:     DescribeUserAgent(row.UserAgent),
+			IP:         row.IP,
+			UserAgent:  row.UserAgent,
+			Stage:      row.Stage,
+			CreatedAt:  row.CreatedAt,
+			LastSeenAt: row.LastSeenAt,
+			ExpiresAt:  row.ExpiresAt,
+			Current:    row.ID == current,
+		})
+	}
+	return sessions, nil
+}
+
+// Revoke ends one session of a user. It reports whether the session existed.
+func (s *SessionStore) Revoke(ctx context.Context, userID int, id int64) (bool, error) {
+	return s.Store.Sessions().Revoke(ctx, userID, id, time.Now())
+}
+
+// RevokeOthers ends every session of a user except keep and returns how many
+// were ended.
+func (s *SessionStore) RevokeOthers(ctx context.Context, userID int, keep int64) (int64, error) {
+	return s.Store.Sessions().RevokeOthers(ctx, userID, keep, time.Now())
+}
+
+// RevokeAll logs a user out everywhere.
+func (s *SessionStore) RevokeAll(ctx context.Context, userID int) (int64, error) {
+	return s.RevokeOthers(ctx, userID, 0)
+}
+
+// DescribeUserAgent turns a User-Agent header into a short "Browser on OS"
+// label. It only knows the common browsers; anything else is shown as is.
+func DescribeUserAgent(ua string) string {
+	if ua == "" {
+		return "Unknown device"
+	}
+	browser := ""
+	// order matters, Edge and Opera also claim to be Chrome and Safari
+	for _, b := range []struct{ token, name string }{
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+	} {
+		if strings.Contains(ua, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	platform := ""
+	for _, o := range []struct{ token, name string }{
+		{"Android", "Android"},
+		{"iPhone", "iOS"},
+		{"iPad", "iPadOS"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"CrOS", "ChromeOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(ua, o.token) {
+			platform = o.name
+			break
+		}
+	}
+	switch {
+	case browser != "" && platform != "":
+		return browser + " on " + platform
+	case browser != "":
+		return browser
+	case len(ua) > 60:
+		return ua[:60] + "…"
+	}
+	return ua
+}
@@ -0,0 +1,253 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"CipherOps/models"
+	"CipherOps/store"
+)
+
+// ThrottleError tells the client when it may try again.
+type ThrottleError struct {
+	Locked     bool
+	RetryAfter time.Duration
+}
+
+func (e *ThrottleError) Error() string {
+	if e.Locked {
+		return fmt.Sprintf("account temporarily locked, retry in %s", e.RetryAfter.Round(time.Second))
+	}
+	return fmt.Sprintf("too many failed logins, retry in %s", e.RetryAfter.Round(time.Second))
+}
+
+var ErrProofOfWork = errors.New("proof of work required")
+
+// powChallengeTTL is how long a challenge may be solved for.
+const powChallengeTTL = 2 * time.Minute
+
+// ThrottleLimits are the tunables of a LoginThrottle.
+type ThrottleLimits struct {
+	// failures counted for the backoff are those within Window
+	Window    time.Duration
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	MaxFailures     int
+	LockoutDuration time.Duration
+
+	// failures an IP gets before its backoff starts
+	IPFreeFailures int
+
+	// leading zero bits of the proof of work, 0 disables it
+	PoWDifficulty int
+	// IP failures after which the proof of work is required
+	PoWAfter int
+}
+
+// LoginThrottle slows down password guessing. Every failure delays the next
+// attempt for the account and for the client IP exponentially; after
+// MaxFailures the account is locked for LockoutDuration. Clients with many
+// failures additionally have to solve a proof-of-work challenge.
+type LoginThrottle struct {
+	Logins store.LoginRepository
+	PoWKey []byte
+
+	limits    atomic.Pointer[ThrottleLimits]
+	mu        sync.RWMutex
+	listeners []func(models.LoginAttempt)
+}
+
+func NewLoginThrottle(logins store.LoginRepository, powKey []byte, limits ThrottleLimits) *LoginThrottle {
+	t := &LoginThrottle{Logins: logins, PoWKey: powKey}
+	t.SetLimits(limits)
+	return t
+}
+
+// Limits returns the limits in effect.
+func (t *LoginThrottle) Limits() ThrottleLimits {
+	return *t.limits.Load()
+}
+
+// SetLimits replaces the limits, e.g. after a configuration reload. Checks
+// already running finish with the old ones.
+func (t *LoginThrottle) SetLimits(limits ThrottleLimits) {
+	t.limits.Store(&limits)
+}
+
+// OnFailure registers fn to be called for every failed login, for example to
+// feed a firewall ban list. fn runs on the request goroutine and must not block.
+func (t *LoginThrottle) OnFailure(fn func(models.LoginAttempt)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.listeners = append(t.listeners, fn)
+}
+
+// Check returns a *ThrottleError when username or ip must wait before trying
+// again. Without a username, as for a discoverable passkey, only ip is checked.
+func (t *LoginThrottle) Check(ctx context.Context, username, ip string) error {
+	limits := t.Limits()
+	now := time.Now()
+
+	if username != "" {
+		lockout, err := t.Logins.Lockout(ctx, username)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return err
+		}
+		if err == nil {
+			if lockout.LockedUntil != nil && now.Before(*lockout.LockedUntil) {
+				return &ThrottleError{Locked: true, RetryAfter: lockout.LockedUntil.Sub(now)}
+			}
+			lastFailure := lockout.LastFailureAt
+			if wait := lastFailure.Add(limits.delay(lockout.Failures)).Sub(now); wait > 0 && now.Sub(lastFailure) < limits.Window {
+				return &ThrottleError{RetryAfter: wait}
+			}
+		}
+	}
+
+	ipFailures, err := t.Logins.IPFailures(ctx, ip, now.Add(-limits.Window))
+	if err != nil {
+		return err
+	}
+	if ipFailures.Failures > limits.IPFreeFailures {
+		if wait := ipFailures.Last.Add(limits.delay(ipFailures.Failures - limits.IPFreeFailures)).Sub(now); wait > 0 {
+			return &ThrottleError{RetryAfter: wait}
+		}
+	}
+	return nil
+}
+
+// RecordFailure audits a failed login and moves the account towards a
+// lockout. A failure without a username counts against ip only.
+func (t *LoginThrottle) RecordFailure(ctx context.Context, username, ip, reason string) error {
+	limits := t.Limits()
+	now := time.Now()
+	attempt := models.LoginAttempt{Username: username, IP: ip, Reason: reason, CreatedAt: now}
+	if err := t.Logins.RecordAttempt(ctx, attempt); err != nil {
+		return err
+	}
+	// failures older than the window start a new count
+	if username != "" {
+		failures, err := t.Logins.RecordFailure(ctx, username, now, now.Add(-limits.Window))
+		if err != nil {
+			return err
+		}
+		if failures >= limits.MaxFailures {
+			if err := t.Logins.Lock(ctx, username, now.Add(limits.LockoutDuration)); err != nil {
+				return err
+			}
+		}
+	}
+
+	t.mu.RLock()
+	listeners := t.listeners
+	t.mu.RUnlock()
+	for _, fn := range listeners {
+		fn(attempt)
+	}
+	return nil
+}
+
+// RecordSuccess audits a successful login and clears the account's failures.
+func (t *LoginThrottle) RecordSuccess(ctx context.Context, username, ip string) error {
+	attempt := models.LoginAttempt{Username: username, IP: ip, Success: true, CreatedAt: time.Now()}
+	if err := t.Logins.RecordAttempt(ctx, attempt); err != nil {
+		return err
+	}
+	_, err := t.Logins.ClearLockout(ctx, username)
+	return err
+}
+
+// Unlock clears the failures and lockout of an account. It reports whether
+// the account had any.
+func (t *LoginThrottle) Unlock(ctx context.Context, username string) (bool, error) {
+	return t.Logins.ClearLockout(ctx, username)
+}
+
+// FailuresByIP lists the client addresses with at least min failed logins
+// since the given time, worst first.
+func (t *LoginThrottle) FailuresByIP(ctx context.Context, since time.Time, min int) ([]models.IPFailures, error) {
+	return t.Logins.FailuresByIP(ctx, since, min)
+}
+
+// PoWRequired reports whether ip has to solve a challenge before logging in.
+func (t *LoginThrottle) PoWRequired(ctx context.Context, ip string) (bool, error) {
+	limits := t.Limits()
+	if limits.PoWDifficulty <= 0 {
+		return false, nil
+	}
+	failures, err := t.Logins.IPFailures(ctx, ip, time.Now().Add(-limits.Window))
+	return failures.Failures >= limits.PoWAfter, err
+}
+
+// NewPoWChallenge returns a signed challenge bound to ip. The client must find
+// a nonce such that sha256(challenge + ":" + nonce) starts with
+// PoWDifficulty zero bits.
+func (t *LoginThrottle) NewPoWChallenge(ip string) (string, error) {
+	salt, err := RandomToken(16)
+	if err != nil {
+		return "", err
+	}
+	return SignValue(t.PoWKey, ip+"|"+strconv.Itoa(t.Limits().PoWDifficulty)+"|"+salt, powChallengeTTL), nil
+}
+
+// VerifyPoW checks a solved challenge and uses it up, a solution is good for
+// one login attempt. Rejections are ErrProofOfWork.
+func (t *LoginThrottle) VerifyPoW(ctx context.Context, ip, challenge, nonce string) error {
+	value, err := VerifyValue(t.PoWKey, challenge)
+	if err != nil {
+		return ErrProofOfWork
+	}
+	parts := strings.Split(value, "|")
+	if len(parts) != 3 || parts[0] != ip {
+		return ErrProofOfWork
+	}
+	difficulty, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return ErrProofOfWork
+	}
+	sum := sha256.Sum256([]byte(challenge + ":" + nonce))
+	if leadingZeroBits(sum[:]) < difficulty {
+		return ErrProofOfWork
+	}
+	now := time.Now()
+	err = t.Logins.UsePoWSalt(ctx, parts[2], now.Add(powChallengeTTL), now)
+	if errors.Is(err, store.ErrConflict) {
+		return ErrProofOfWork
+	}
+	return err
+}
+
+// delay is BaseDelay doubled for every failure after the first, capped at MaxDelay.
+func (l ThrottleLimits) delay(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+	d := l.BaseDelay
+	for i := 1; i < failures && d < l.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > l.MaxDelay {
+		d = l.MaxDelay
+	}
+	return d
+}
+
+func leadingZeroBits(b []byte) int {
+	n := 0
+	for _, c := range b {
+		if c != 0 {
+			return n + bits.LeadingZeros8(c)
+		}
+		n += 8
+	}
+	return n
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// Cookie holding the id of the pending WebAuthn ceremony
+const WebAuthnCookie = "webauthn_ceremony"
+
+// PasskeyUser adapts a panel user to the webauthn.User interface.
+type PasskeyUser struct {
+	ID          int
+	Username    string
+	Role        string
+	Handle      []byte
+	Credentials []webauthn.Credential
+}
+
+func (u *PasskeyUser) WebAuthnID() []byte                         { return u.Handle }
+func (u *PasskeyUser) WebAuthnName() string                       { return u.Username }
+func (u *PasskeyUser) WebAuthnDisplayName() string                { return u.Username }
+func (u *PasskeyUser) WebAuthnCredentials() []webauthn.Credential { return u.Credentials }
+
+// NewUserHandle returns a random 64 byte WebAuthn user handle. It is not
+// derived from the user id so it leaks nothing to the authenticator.
+func NewUserHandle() ([]byte, error) {
+	handle := make([]byte, 64)
+	if _, err := rand.Read(handle); err != nil {
+		return nil, err
+	}
+	return handle, nil
+}
+
+// DecoyPasskeyUser stands in for a username that cannot log in with a
+// passkey, unknown or without keys, so the login ceremony it gets looks like
+// a real one. Handle and credential are derived from key and the username,
+// the same name gets the same decoy every time.
+func DecoyPasskeyUser(key []byte, username string) *PasskeyUser {
+	derive := func(purpose string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte("passkey-decoy|" + purpose + "|" + username))
+		return mac.Sum(nil)
+	}
+	return &PasskeyUser{
+		Username:    username,
+		Handle:      append(derive("handle"), derive("handle-2")...),
+		Credentials: []webauthn.Credential{{ID: derive("credential")}},
+	}
+}
+
+// NewWebAuthn builds the relying party. origins is a comma separated list.
+func NewWebAuthn(rpID, displayName, origins string) (*webauthn.WebAuthn, error) {
+	var rpOrigins []string
+	for _, o := range strings.Split(origins, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			rpOrigins = append(rpOrigins, o)
+		}
+	}
+	wa, err := webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: displayName,
+		RPOrigins:     rpOrigins,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid WebAuthn configuration: %w", err)
+	}
+	return wa, nil
+}
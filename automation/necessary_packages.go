@@ -1,31 +1,35 @@
 package automate
 
 import (
-	"fmt"
-	"os"
+	"context"
+	"log/slog"
 	"CipherOps/utils"
 )
 
-func SetupNecessaryPkgs() {
-	fmt.Println("------------------------------------------------------------------------------")
-	utils.DryRun = true //testing flag
+// SetupNecessaryPkgs installs and starts what the panel needs, running the
+// commands through e.
+func SetupNecessaryPkgs(ctx context.Context, e utils.Executor) {
+	slog.Info("setting up the necessary packages")
 
-	if err := utils.InstallPackages([]string{"docker", "postgres"}); err != nil {
-		fmt.Fprintf(os.Stderr, "Failed installing: %v\n", err)
+	if err := utils.InstallPackages(ctx, e, []string{"docker", "postgres"}, logOutput); err != nil {
+		slog.Error("installing the necessary packages failed", "error", err)
 		return
 	}
 
-	if err := utils.Service("enable", "docker"); err != nil {
-		fmt.Fprintf(os.Stderr, "Cannot enable docker: %v\n", err)
-		return
-	}
-	if err := utils.Service("restart", "docker"); err != nil {
-		fmt.Fprintf(os.Stderr, "Cannot restart docker: %v\n", err)
-		return
+	for _, action := range []string{"enable", "restart"} {
+		if err := utils.Service(ctx, e, action, "docker"); err != nil {
+			slog.Error("docker service not set up", "action", action, "error", err)
+			return
+		}
 	}
 
-	if err := utils.Service("enable", "postgresql"); err != nil {
-		fmt.Println("Cannot enable postgres:", err)
+	if err := utils.Service(ctx, e, "enable", "postgresql"); err != nil {
+		slog.Warn("postgresql service not enabled", "error", err)
 	}
-	fmt.Println("------------------------------------------------------------------------------")
-}
\ No newline at end of file
+	slog.Info("necessary packages set up")
+}
+
+// logOutput shows the package manager output as it runs.
+func logOutput(line utils.OutputLine) {
+	slog.Info(line.Text, "stream", line.Stream)
+}
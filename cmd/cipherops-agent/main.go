@@ -0,0 +1,107 @@
+// Command cipherops-agent runs on a managed host and carries out the
+// package, service and firewall commands the CipherOps panel sends it. It
+// dials out to the panel, so the host needs no open port.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"CipherOps/agent"
+	"CipherOps/logging"
+	"CipherOps/utils"
+)
+
+const usage = `usage: cipherops-agent <command> [flags]
+
+commands:
+  enroll   trade a one-time token for a client certificate
+           --server URL --ca FILE [--token TOKEN] [--state-dir DIR]
+  renew    trade the current certificate for a new one now; run does this
+           by itself when a third of its lifetime is left
+           [--state-dir DIR]
+  run      connect to the panel and run the commands it sends
+           [--state-dir DIR] [--policy FILE] [--escalation METHOD]
+           [--dry-run] [--log-level LEVEL]
+
+The token comes from POST /admin/hosts/:name/agent/token on the panel, with
+the server URL and the CA certificate to save as --ca. It may also be given
+in CIPHEROPS_AGENT_TOKEN to keep it out of the shell history.
+
+--policy is a command policy file as the panel's COMMAND_POLICY_FILE; only
+what its "agent" rules allow runs, arguments included. Without it the
+built-in policy applies.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	flags := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	stateDir := flags.String("state-dir", "/var/lib/cipherops-agent", "directory of the key and certificates")
+
+	switch os.Args[1] {
+	case "enroll":
+		server := flags.String("server", "", "agent URL of the panel")
+		caFile := flags.String("ca", "", "CA certificate handed out with the token")
+		token := flags.String("token", os.Getenv("CIPHEROPS_AGENT_TOKEN"), "enrollment token")
+		flags.Parse(os.Args[2:])
+		if *server == "" || *caFile == "" || *token == "" {
+			log.Fatal("enroll needs --server, --ca and a token")
+		}
+		caPEM, err := os.ReadFile(*caFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		host, err := agent.Enroll(ctx, *server, *token, caPEM, *stateDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("enrolled as %s, state in %s\n", host, *stateDir)
+
+	case "renew":
+		flags.Parse(os.Args[2:])
+		if err := agent.Renew(ctx, *stateDir); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("certificate renewed, state in %s\n", *stateDir)
+
+	case "run":
+		policyFile := flags.String("policy", "", "command policy file")
+		escalation := flags.String("escalation", utils.EscalateSudo, "sudo, doas, pkexec or run0 when not run as root")
+		dryRun := flags.Bool("dry-run", false, "plan privileged commands instead of running them")
+		logLevel := flags.String("log-level", "info", "debug, info, warn or error")
+		flags.Parse(os.Args[2:])
+		if err := logging.Setup(os.Stderr, "text", *logLevel); err != nil {
+			log.Fatal(err)
+		}
+		switch *escalation {
+		case utils.EscalateSudo, utils.EscalateDoas, utils.EscalatePkexec, utils.EscalateRun0:
+		default:
+			log.Fatalf("--escalation must be sudo, doas, pkexec or run0, got %q", *escalation)
+		}
+		policy, err := utils.LoadCommandPolicy(*policyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		local := utils.LocalExecutor{Escalation: *escalation}
+		a := &agent.Agent{StateDir: *stateDir, Exec: utils.NewExecutor(local, *dryRun), Policy: policy}
+		if err := a.Run(ctx); err != nil {
+			log.Fatal(err)
+		}
+
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,111 @@
+// Command cipherops-helper runs the privileged commands of a CipherOps panel
+// that itself runs as an ordinary user, set up with PRIVILEGE_ESCALATION=helper.
+// Start it as root from the service manager; it needs no setuid bit.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"CipherOps/helper"
+	"CipherOps/logging"
+	"CipherOps/utils"
+)
+
+const usage = `usage: cipherops-helper --user USER [flags]
+
+  --socket PATH     socket to listen on (/run/cipherops/helper.sock)
+  --user USER,...   users whose connections are served, by name or uid
+  --group GROUP     group that may open the socket, normally the panel's
+  --policy FILE     command policy whose "helper" rules say what may run,
+                    arguments included; the built-in policy without one
+  --log-level LEVEL debug, info, warn or error
+`
+
+func main() {
+	flags := flag.NewFlagSet("cipherops-helper", flag.ExitOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	socket := flags.String("socket", "/run/cipherops/helper.sock", "socket to listen on")
+	users := flags.String("user", "", "users whose connections are served")
+	group := flags.String("group", "", "group that may open the socket")
+	policy := flags.String("policy", "", "command policy file")
+	logLevel := flags.String("log-level", "info", "debug, info, warn or error")
+	flags.Parse(os.Args[1:])
+	if err := logging.Setup(os.Stderr, "text", *logLevel); err != nil {
+		log.Fatal(err)
+	}
+	if os.Geteuid() != 0 {
+		log.Fatal("cipherops-helper must run as root")
+	}
+
+	p, err := utils.LoadCommandPolicy(*policy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := &helper.Server{Socket: *socket, Policy: p, Exec: utils.LocalExecutor{}}
+	for _, name := range split(*users) {
+		uid, err := lookupID(name, func(n string) (string, error) {
+			u, err := user.Lookup(n)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.AllowUIDs = append(s.AllowUIDs, uid)
+	}
+	if len(s.AllowUIDs) == 0 {
+		log.Fatal("--user is required")
+	}
+	if *group != "" {
+		gid, err := lookupID(*group, func(n string) (string, error) {
+			g, err := user.LookupGroup(n)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		s.GID = gid
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := s.ListenAndServe(ctx); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// lookupID takes a numeric id as is and looks up anything else by name.
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
+
+func split(list string) []string {
+	var out []string
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
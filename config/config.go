@@ -1,30 +1,332 @@
 package config
 
 import (
-    "os"
+    "time"
 )
 
+// Config holds every setting. Load fills it from, in increasing priority,
+// the defaults in build, a YAML or TOML file, environment variables and
+// command line flags. A setting has the same name everywhere: DB_HOST in the
+// environment is db_host (or host under db) in the file and --db-host on the
+// command line.
 type Config struct {
+ // HTTP server; both TLS files enable HTTPS
+ ListenAddr        string
+ TLSCertFile       string
+ TLSKeyFile        string
+ ReadHeaderTimeout time.Duration
+ ReadTimeout       time.Duration
+ // 0 disables the limit, needed for long exports
+ WriteTimeout time.Duration
+ IdleTimeout  time.Duration
+ // Limit for one system command; DryRun logs commands instead of running them
+ CommandTimeout time.Duration
+ DryRun         bool
+ // How privileged commands run when not root: sudo, doas, pkexec, run0,
+ // or helper to hand them to cipherops-helper listening at HelperSocket
+ PrivilegeEscalation string
+ HelperSocket        string
+
+ // File this configuration was read from, set by Load; not a setting
+ ConfigFile string
+ // How often the config, policy and template files are checked for
+ // changes, 0 reloads on SIGHUP only. See Reloader for what reloads.
+ ConfigWatchInterval time.Duration
+ // YAML firewall policy, container templates and command allowlist,
+ // reloaded when they change
+ FirewallPolicyFile     string
+ ContainerTemplatesFile string
+ CommandPolicyFile      string
+
+ // Managed hosts are reached over SSH: the login for hosts that name
+ // none, the private key (the agent at SSH_AUTH_SOCK when empty), the
+ // known_hosts file (~/.ssh/known_hosts when empty), how privileged
+ // commands run there (sudo, doas, pkexec or run0) and the sudo password
+ // for hosts where sudo asks for one
+ SSHUser           string
+ SSHKeyFile        string
+ SSHKeyPassphrase  string
+ SSHKnownHostsFile string
+ SSHEscalation     string
+ SSHSudoPassword   string
+ SSHConnectTimeout time.Duration
+ // Host facts are gathered this often, 0 only on demand; fleet actions run
+ // on at most FanOutParallelism hosts at once
+ FactsInterval     time.Duration
+ FanOutParallelism int
+
+ // Listener for cipherops-agent connections, off while AgentListenAddr is
+ // empty. The CA that signs agent certificates is created at the two files
+ // on first start. AgentServerNames are the comma separated DNS names or IPs
+ // of the listener certificate and AgentPublicURL is what agents dial.
+ // Enrollment tokens last AgentTokenTTL, certificates AgentCertTTL.
+ AgentListenAddr  string
+ AgentCACertFile  string
+ AgentCAKeyFile   string
+ AgentServerNames string
+ AgentPublicURL   string
+ AgentCertTTL     time.Duration
+ AgentTokenTTL    time.Duration
+
+ // Background jobs such as fleet package installs: workers per server,
+ // how often idle workers look for jobs queued elsewhere, and attempts of
+ // a job with a retry delay that doubles up to JobMaxRetryDelay
+ JobWorkers       int
+ JobPollInterval  time.Duration
+ JobMaxAttempts   int
+ JobRetryDelay    time.Duration
+ JobMaxRetryDelay time.Duration
+
+ // String settings may be secret references instead of values:
+ // file:/run/secrets/db_password, env:OTHER_VAR or enc:v1:... made by
+ // `CipherOps secret encrypt`. MasterKeyFile holds the key for enc: values
+ // unless CIPHEROPS_MASTER_KEY is set.
+ MasterKeyFile string
+
+ // postgres, or sqlite for single-node installs; SQLite keeps the database
+ // in the file DBPath and ignores the other DB settings
+ DBDriver string
+ DBPath   string
+
  DBUser     string
  DBPassword string
  DBName     string
  DBHost     string
  DBPort     string
+ // Apply pending migrations on startup; otherwise run `CipherOps migrate up`
+ DBAutoMigrate bool
+ // TLS to the database: disable, allow, prefer, require, verify-ca or
+ // verify-full. The files are PEM; SSLCert and SSLKey enable client auth.
+ DBSSLMode     string
+ DBSSLRootCert string
+ DBSSLCert     string
+ DBSSLKey      string
+ // Connection pool, 0 keeps the database/sql default
+ DBMaxOpenConns    int
+ DBMaxIdleConns    int
+ DBConnMaxLifetime time.Duration
+ DBConnMaxIdleTime time.Duration
+ // Startup waits for the database with exponential backoff; 0 attempts
+ // keeps trying forever
+ DBConnectAttempts int
+ DBRetryBaseDelay  time.Duration
+ DBRetryMaxDelay   time.Duration
+ // Serve a maintenance page instead of exiting when the database stays
+ // unreachable, and switch to the panel once it is back
+ DBDegradedStartup bool
+
+ // Logging: text or json, and the minimum level (debug, info, warn, error)
+ LogFormat string
+ LogLevel  string
+
+ // Key used to sign session cookies; a random one is generated when empty
+ SessionSecret string
+ // Keys the hash chain of the audit log; without it the chain is plain
+ // SHA-256, which anyone able to write to the database can recompute
+ AuditKey string
+ // Sessions unused for this long end early, 0 disables the idle timeout
+ SessionIdleTimeout time.Duration
+ // Name shown by authenticator apps next to the TOTP account
+ TOTPIssuer    string
+ // WebAuthn relying party: the domain passkeys are bound to and the
+ // comma separated origins the browser may report
+ WebAuthnRPID    string
+ WebAuthnOrigins string
+
+ // OpenID Connect single sign-on, disabled while OIDCIssuer is empty.
+ // OIDCRoleMap is a comma separated list of group=role pairs.
+ OIDCIssuer       string
+ OIDCClientID     string
+ OIDCClientSecret string
+ OIDCRedirectURL  string
+ OIDCGroupsClaim  string
+ OIDCRoleMap      string
+ OIDCDefaultRole  string
+
+ // Comma separated password providers, asked in order: local, ldap
+ AuthProviders string
+
+ // LDAP / Active Directory provider, see auth.LDAPConfig
+ LDAPURL                string
+ LDAPStartTLS           bool
+ LDAPCAFile             string
+ LDAPInsecureSkipVerify bool
+ LDAPBindDN             string
+ LDAPBindPassword       string
+ LDAPBaseDN             string
+ LDAPUserFilter         string
+ LDAPGroupAttribute     string
+ LDAPGroupBaseDN        string
+ LDAPGroupFilter        string
+ LDAPRoleMap            string
+ LDAPDefaultRole        string
+
+ // Brute-force protection of the login form, see auth.LoginThrottle
+ LoginWindow         time.Duration
+ LoginBaseDelay      time.Duration
+ LoginMaxDelay       time.Duration
+ LoginMaxFailures    int
+ LoginLockout        time.Duration
+ LoginIPFreeFailures int
+ LoginPoWDifficulty  int
+ LoginPoWAfter       int
+
+ // Account emails (verification, password reset), see mailer.New
+ RegistrationEnabled bool
+ PublicURL           string
+ Mailer              string
+ MailFrom            string
+ SMTPHost            string
+ SMTPPort            string
+ SMTPUsername        string
+ SMTPPassword        string
+ SMTPRequireTLS      bool
+ MailDropDir         string
+ EmailVerifyTTL      time.Duration
+ PasswordResetTTL    time.Duration
+
+ // Security headers, an empty value disables the header
+ ContentSecurityPolicy   string
+ StrictTransportSecurity string
+ FrameOptions            string
+ ReferrerPolicy          string
+ PermissionsPolicy       string
 }
 
-func LoadConfig() Config {
+// build reads every setting from s. The second argument of each lookup is the
+// default.
+func build(s *source) Config {
  return Config{
-  DBUser:     getEnv("DB_USER", "postgres"),
-  DBPassword: getEnv("DB_PASSWORD", "password"),
-  DBName:     getEnv("DB_NAME", "PepeScale"),
-  DBHost:     getEnv("DB_HOST", "172.17.0.2"),
-  DBPort:     getEnv("DB_PORT", "5432"),
- }
-}
+  ListenAddr:        s.str("LISTEN_ADDR", ":8080"),
+  TLSCertFile:       s.str("TLS_CERT_FILE", ""),
+  TLSKeyFile:        s.str("TLS_KEY_FILE", ""),
+  ReadHeaderTimeout: s.duration("HTTP_READ_HEADER_TIMEOUT", 10*time.Second),
+  ReadTimeout:       s.duration("HTTP_READ_TIMEOUT", 30*time.Second),
+  WriteTimeout:      s.duration("HTTP_WRITE_TIMEOUT", 0),
+  IdleTimeout:       s.duration("HTTP_IDLE_TIMEOUT", 2*time.Minute),
+  CommandTimeout:    s.duration("COMMAND_TIMEOUT", 5*time.Minute),
+  DryRun:            s.boolean("DRY_RUN", true),
+
+  PrivilegeEscalation: s.str("PRIVILEGE_ESCALATION", "sudo"),
+  HelperSocket:        s.str("HELPER_SOCKET", "/run/cipherops/helper.sock"),
+
+  ConfigWatchInterval:    s.duration("CONFIG_WATCH_INTERVAL", 5*time.Second),
+  FirewallPolicyFile:     s.str("FIREWALL_POLICY_FILE", ""),
+  ContainerTemplatesFile: s.str("CONTAINER_TEMPLATES_FILE", ""),
+  CommandPolicyFile:      s.str("COMMAND_POLICY_FILE", ""),
+
+  SSHUser:           s.str("SSH_USER", ""),
+  SSHKeyFile:        s.str("SSH_KEY_FILE", ""),
+  SSHKeyPassphrase:  s.str("SSH_KEY_PASSPHRASE", ""),
+  SSHKnownHostsFile: s.str("SSH_KNOWN_HOSTS_FILE", ""),
+  SSHEscalation:     s.str("SSH_ESCALATION", "sudo"),
+  SSHSudoPassword:   s.str("SSH_SUDO_PASSWORD", ""),
+  SSHConnectTimeout: s.duration("SSH_CONNECT_TIMEOUT", 15*time.Second),
+  FactsInterval:     s.duration("FACTS_INTERVAL", time.Hour),
+  FanOutParallelism: s.integer("FAN_OUT_PARALLELISM", 10),
+
+  AgentListenAddr:  s.str("AGENT_LISTEN_ADDR", ""),
+  AgentCACertFile:  s.str("AGENT_CA_CERT_FILE", "./agent-ca.pem"),
+  AgentCAKeyFile:   s.str("AGENT_CA_KEY_FILE", "./agent-ca-key.pem"),
+  AgentServerNames: s.str("AGENT_SERVER_NAMES", "localhost"),
+  AgentPublicURL:   s.str("AGENT_PUBLIC_URL", "https://localhost:8443"),
+  AgentCertTTL:     s.duration("AGENT_CERT_TTL", 365*24*time.Hour),
+  AgentTokenTTL:    s.duration("AGENT_TOKEN_TTL", time.Hour),
+
+  JobWorkers:       s.integer("JOB_WORKERS", 4),
+  JobPollInterval:  s.duration("JOB_POLL_INTERVAL", 2*time.Second),
+  JobMaxAttempts:   s.integer("JOB_MAX_ATTEMPTS", 3),
+  JobRetryDelay:    s.duration("JOB_RETRY_DELAY", 30*time.Second),
+  JobMaxRetryDelay: s.duration("JOB_MAX_RETRY_DELAY", 10*time.Minute),
+
+  MasterKeyFile: s.str("MASTER_KEY_FILE", ""),
+
+  DBDriver: s.str("DB_DRIVER", "postgres"),
+  DBPath:   s.str("DB_PATH", "cipherops.db"),
+
+  DBUser:     s.str("DB_USER", "postgres"),
+  DBPassword: s.str("DB_PASSWORD", ""),
+  DBName:     s.str("DB_NAME", "PepeScale"),
+  DBHost:     s.str("DB_HOST", "172.17.0.2"),
+  DBPort:     s.str("DB_PORT", "5432"),
+  DBAutoMigrate: s.boolean("DB_AUTO_MIGRATE", true),
+  DBSSLMode:     s.str("DB_SSLMODE", "prefer"),
+  DBSSLRootCert: s.str("DB_SSLROOTCERT", ""),
+  DBSSLCert:     s.str("DB_SSLCERT", ""),
+  DBSSLKey:      s.str("DB_SSLKEY", ""),
+  DBMaxOpenConns:    s.integer("DB_MAX_OPEN_CONNS", 25),
+  DBMaxIdleConns:    s.integer("DB_MAX_IDLE_CONNS", 5),
+  DBConnMaxLifetime: s.duration("DB_CONN_MAX_LIFETIME", 30*time.Minute),
+  DBConnMaxIdleTime: s.duration("DB_CONN_MAX_IDLE_TIME", 5*time.Minute),
+  DBConnectAttempts: s.integer("DB_CONNECT_ATTEMPTS", 10),
+  DBRetryBaseDelay:  s.duration("DB_RETRY_BASE_DELAY", time.Second),
+  DBRetryMaxDelay:   s.duration("DB_RETRY_MAX_DELAY", 30*time.Second),
+  DBDegradedStartup: s.boolean("DB_DEGRADED_STARTUP", false),
+
+  LogFormat: s.str("LOG_FORMAT", "text"),
+  LogLevel:  s.str("LOG_LEVEL", "info"),
+
+  SessionSecret:      s.str("SESSION_SECRET", ""),
+  AuditKey:           s.str("AUDIT_KEY", ""),
+  SessionIdleTimeout: s.duration("SESSION_IDLE_TIMEOUT", 2*time.Hour),
+  TOTPIssuer:    s.str("TOTP_ISSUER", "CipherOps"),
+  WebAuthnRPID:    s.str("WEBAUTHN_RP_ID", "localhost"),
+  WebAuthnOrigins: s.str("WEBAUTHN_ORIGINS", "http://localhost:8080"),
+
+  OIDCIssuer:       s.str("OIDC_ISSUER", ""),
+  OIDCClientID:     s.str("OIDC_CLIENT_ID", ""),
+  OIDCClientSecret: s.str("OIDC_CLIENT_SECRET", ""),
+  OIDCRedirectURL:  s.str("OIDC_REDIRECT_URL", "http://localhost:8080/login/oidc/callback"),
+  OIDCGroupsClaim:  s.str("OIDC_GROUPS_CLAIM", "groups"),
+  OIDCRoleMap:      s.str("OIDC_ROLE_MAP", ""),
+  OIDCDefaultRole:  s.str("OIDC_DEFAULT_ROLE", "user"),
+
+  AuthProviders: s.str("AUTH_PROVIDERS", "local"),
+
+  LDAPURL:                s.str("LDAP_URL", ""),
+  LDAPStartTLS:           s.boolean("LDAP_STARTTLS", false),
+  LDAPCAFile:             s.str("LDAP_CA_FILE", ""),
+  LDAPInsecureSkipVerify: s.boolean("LDAP_INSECURE_SKIP_VERIFY", false),
+  LDAPBindDN:             s.str("LDAP_BIND_DN", ""),
+  LDAPBindPassword:       s.str("LDAP_BIND_PASSWORD", ""),
+  LDAPBaseDN:             s.str("LDAP_BASE_DN", ""),
+  LDAPUserFilter:         s.str("LDAP_USER_FILTER", "(&(objectClass=person)(uid=%s))"),
+  LDAPGroupAttribute:     s.str("LDAP_GROUP_ATTRIBUTE", "memberOf"),
+  LDAPGroupBaseDN:        s.str("LDAP_GROUP_BASE_DN", ""),
+  LDAPGroupFilter:        s.str("LDAP_GROUP_FILTER", "(|(member=%s)(uniqueMember=%s))"),
+  LDAPRoleMap:            s.str("LDAP_ROLE_MAP", ""),
+  LDAPDefaultRole:        s.str("LDAP_DEFAULT_ROLE", "user"),
+
+  LoginWindow:         s.duration("LOGIN_WINDOW", time.Hour),
+  LoginBaseDelay:      s.duration("LOGIN_BASE_DELAY", time.Second),
+  LoginMaxDelay:       s.duration("LOGIN_MAX_DELAY", 5*time.Minute),
+  LoginMaxFailures:    s.integer("LOGIN_MAX_FAILURES", 10),
+  LoginLockout:        s.duration("LOGIN_LOCKOUT", 15*time.Minute),
+  LoginIPFreeFailures: s.integer("LOGIN_IP_FREE_FAILURES", 5),
+  LoginPoWDifficulty:  s.integer("LOGIN_POW_DIFFICULTY", 0),
+  LoginPoWAfter:       s.integer("LOGIN_POW_AFTER", 3),
+
+  RegistrationEnabled: s.boolean("REGISTRATION_ENABLED", false),
+  PublicURL:           s.str("PUBLIC_URL", "http://localhost:8080"),
+  Mailer:              s.str("MAILER", "file"),
+  MailFrom:            s.str("MAIL_FROM", "CipherOps <noreply@localhost>"),
+  SMTPHost:            s.str("SMTP_HOST", "localhost"),
+  SMTPPort:            s.str("SMTP_PORT", "587"),
+  SMTPUsername:        s.str("SMTP_USERNAME", ""),
+  SMTPPassword:        s.str("SMTP_PASSWORD", ""),
+  SMTPRequireTLS:      s.boolean("SMTP_REQUIRE_TLS", true),
+  MailDropDir:         s.str("MAIL_DROP_DIR", "./mail"),
+  EmailVerifyTTL:      s.duration("EMAIL_VERIFY_TTL", 48*time.Hour),
+  PasswordResetTTL:    s.duration("PASSWORD_RESET_TTL", time.Hour),
 
-func getEnv(key, fallback string) string {
- if value := os.Getenv(key); value != "" {
-  return value
+  // the static pages load scripts, styles and icons from /static only; the
+  // Poppins font comes from Google Fonts and the TOTP QR code is a data: URL
+  ContentSecurityPolicy: s.str("CONTENT_SECURITY_POLICY", "default-src 'self'; script-src 'self'; "+
+   "style-src 'self'; font-src 'self' https://fonts.gstatic.com; img-src 'self' data:; connect-src 'self'; "+
+   "object-src 'none'; base-uri 'none'; form-action 'self'; frame-ancestors 'none'"),
+  StrictTransportSecurity: s.str("STRICT_TRANSPORT_SECURITY", "max-age=31536000; includeSubDomains"),
+  FrameOptions:            s.str("FRAME_OPTIONS", "DENY"),
+  ReferrerPolicy:          s.str("REFERRER_POLICY", "same-origin"),
+  PermissionsPolicy:       s.str("PERMISSIONS_POLICY", "camera=(), microphone=(), geolocation=(), payment=(), usb=()"),
  }
- return fallback
 }
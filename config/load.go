@@ -0,0 +1,287 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	"CipherOps/secrets"
+)
+
+// Load builds the configuration from defaults, the config file, environment
+// and flags, and validates it. The config file is named by --config or
+// CONFIG_FILE. Flags come before any subcommand; the remaining arguments are
+// returned.
+func Load(args []string) (Config, []string, error) {
+	// a dry run over the defaults tells which settings exist and their types
+	schema := &source{}
+	build(schema)
+
+	flags, rest, configFile, err := parseFlags(args, schema.kinds)
+	if err != nil {
+		return Config{}, nil, err
+	}
+	if configFile == "" {
+		configFile = os.Getenv("CONFIG_FILE")
+	}
+
+	s := &source{}
+	if configFile != "" {
+		values, spelled, err := readFile(configFile)
+		if err != nil {
+			return Config{}, nil, err
+		}
+		s.layers = append(s.layers, layer{name: configFile, values: values, spelled: spelled})
+	}
+	s.layers = append(s.layers, layer{name: "environment", lookup: func(key string) (string, bool) {
+		// empty variables count as unset, as they always have
+		v := os.Getenv(key)
+		return v, v != ""
+	}})
+	s.layers = append(s.layers, layer{name: "command line", values: flags})
+
+	// settings may be secret references; the master key for enc: values is
+	// the one setting that cannot be one
+	keyFile, _, _ := s.value("MASTER_KEY_FILE", "string")
+	key, err := secrets.LoadMasterKey(keyFile)
+	if err != nil {
+		return Config{}, nil, err
+	}
+	s.resolver = secrets.NewResolver(key)
+
+	cfg := build(s)
+	cfg.ConfigFile = configFile
+	errs := s.errs
+	for _, l := range s.layers {
+		for _, key := range l.sortedKeys() {
+			if _, ok := schema.kinds[key]; !ok {
+				errs = append(errs, fmt.Errorf("%s: unknown setting %s", l.name, l.display(key)))
+			}
+		}
+	}
+	errs = append(errs, cfg.Validate())
+	if err := errors.Join(errs...); err != nil {
+		return Config{}, nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return cfg, rest, nil
+}
+
+// source looks settings up in its layers, the last layer that has a value
+// wins. Parse errors are collected so all of them can be reported at once.
+type source struct {
+	layers []layer
+	// setting name to "string", "bool", "int" or "duration"
+	kinds map[string]string
+	errs  []error
+	// resolves file:, env: and enc: references in string settings
+	resolver *secrets.Resolver
+}
+
+type layer struct {
+	name string
+	// values is keyed by setting name; lookup is used when it is nil
+	values map[string]string
+	lookup func(key string) (string, bool)
+	// keys as the user wrote them, for error messages
+	spelled map[string]string
+}
+
+func (l layer) get(key string) (string, bool) {
+	if l.values == nil {
+		return l.lookup(key)
+	}
+	v, ok := l.values[key]
+	return v, ok
+}
+
+func (l layer) sortedKeys() []string {
+	keys := make([]string, 0, len(l.values))
+	for key := range l.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (l layer) display(key string) string {
+	if spelled, ok := l.spelled[key]; ok {
+		return spelled
+	}
+	return key
+}
+
+func (s *source) value(key, kind string) (string, string, bool) {
+	if s.kinds == nil {
+		s.kinds = map[string]string{}
+	}
+	s.kinds[key] = kind
+	for i := len(s.layers) - 1; i >= 0; i-- {
+		if v, ok := s.layers[i].get(key); ok {
+			return v, s.layers[i].name, true
+		}
+	}
+	return "", "", false
+}
+
+func (s *source) fail(key, origin, format string, args ...any) {
+	s.errs = append(s.errs, fmt.Errorf("%s (from %s): %s", key, origin, fmt.Sprintf(format, args...)))
+}
+
+func (s *source) str(key, fallback string) string {
+	v, origin, ok := s.value(key, "string")
+	if !ok {
+		return fallback
+	}
+	if s.resolver == nil || key == "MASTER_KEY_FILE" {
+		return v
+	}
+	secret, err := s.resolver.Resolve(v)
+	if err != nil {
+		s.fail(key, origin, "%v", err)
+		return fallback
+	}
+	return secret
+}
+
+func (s *source) boolean(key string, fallback bool) bool {
+	v, origin, ok := s.value(key, "bool")
+	if !ok {
+		return fallback
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		s.fail(key, origin, "must be true or false, got %q", v)
+		return fallback
+	}
+	return b
+}
+
+func (s *source) integer(key string, fallback int) int {
+	v, origin, ok := s.value(key, "int")
+	if !ok {
+		return fallback
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		s.fail(key, origin, "must be an integer, got %q", v)
+		return fallback
+	}
+	return n
+}
+
+func (s *source) duration(key string, fallback time.Duration) time.Duration {
+	v, origin, ok := s.value(key, "duration")
+	if !ok {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		s.fail(key, origin, "must be a duration like 15m, got %q", v)
+		return fallback
+	}
+	return d
+}
+
+// settingName maps a flag or file key such as db-host or db.host to DB_HOST.
+func settingName(key string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(key))
+}
+
+// parseFlags reads --name=value and --name value flags up to the first
+// argument that is not a flag. Boolean flags may be given bare.
+func parseFlags(args []string, kinds map[string]string) (map[string]string, []string, string, error) {
+	values := map[string]string{}
+	configFile := ""
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			return values, args[i+1:], configFile, nil
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			return values, args[i:], configFile, nil
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		key := settingName(name)
+		if name == "config" || name == "c" {
+			key = "CONFIG_FILE"
+		} else if _, ok := kinds[key]; !ok {
+			return nil, nil, "", fmt.Errorf("unknown flag %s", arg)
+		}
+		if !hasValue {
+			switch {
+			case kinds[key] == "bool":
+				value = "true"
+			case i+1 < len(args):
+				i++
+				value = args[i]
+			default:
+				return nil, nil, "", fmt.Errorf("flag %s needs a value", arg)
+			}
+		}
+		if key == "CONFIG_FILE" {
+			configFile = value
+			continue
+		}
+		values[key] = value
+	}
+	return values, nil, configFile, nil
+}
+
+// readFile parses a YAML or TOML config file, chosen by extension. Nested
+// tables are flattened, so db: {host: x} sets DB_HOST like db_host: x does.
+// The second map holds the keys as written in the file.
+func readFile(path string) (map[string]string, map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("config file: %w", err)
+	}
+	var doc map[string]any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &doc)
+	case ".toml":
+		err = toml.Unmarshal(data, &doc)
+	default:
+		return nil, nil, fmt.Errorf("config file %s: unsupported format, use .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+	values, spelled := map[string]string{}, map[string]string{}
+	flatten(values, spelled, "", doc)
+	return values, spelled, nil
+}
+
+func flatten(values, spelled map[string]string, prefix string, doc map[string]any) {
+	for key, v := range doc {
+		name := key
+		if prefix != "" {
+			name = prefix + "." + key
+		}
+		switch v := v.(type) {
+		case map[string]any:
+			flatten(values, spelled, name, v)
+			continue
+		case []any:
+			// lists such as auth providers or origins are comma separated
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			values[settingName(name)] = strings.Join(items, ",")
+		case nil:
+			continue
+		default:
+			values[settingName(name)] = fmt.Sprint(v)
+		}
+		spelled[settingName(name)] = name
+	}
+}
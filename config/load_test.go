@@ -0,0 +1,167 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cleanEnv unsets the variables the tests use, so the environment running
+// them does not leak in.
+func cleanEnv(t *testing.T) {
+	t.Helper()
+	for _, key := range []string{"CONFIG_FILE", "CIPHEROPS_MASTER_KEY", "MASTER_KEY_FILE", "DB_HOST", "DB_PASSWORD",
+		"JOB_WORKERS", "LOG_LEVEL", "COMMAND_TIMEOUT", "DRY_RUN", "FACTS_INTERVAL"} {
+		t.Setenv(key, "")
+	}
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	cleanEnv(t)
+	file := writeFile(t, "cipherops.yaml", `
+db:
+  host: file-host
+  password: file-secret
+job_workers: 2
+log_level: debug
+facts_interval: 30m
+`)
+	t.Setenv("DB_HOST", "env-host")
+	t.Setenv("JOB_WORKERS", "3")
+	t.Setenv("FACTS_INTERVAL", "") // empty counts as unset
+
+	cfg, rest, err := Load([]string{"--config", file, "--job-workers=5", "--dry-run", "migrate", "up"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		setting   string
+		got, want any
+	}{
+		{"default", cfg.CommandTimeout, 5 * time.Minute},
+		{"file over default", cfg.LogLevel, "debug"},
+		{"file over an empty variable", cfg.FactsInterval, 30 * time.Minute},
+		{"env over file", cfg.DBHost, "env-host"},
+		{"flag over env", cfg.JobWorkers, 5},
+		{"file only", cfg.DBPassword, "file-secret"},
+		{"bare bool flag", cfg.DryRun, true},
+		{"config file", cfg.ConfigFile, file},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.setting, tt.got, tt.want)
+		}
+	}
+	if !slices.Equal(rest, []string{"migrate", "up"}) {
+		t.Errorf("rest = %q, want the subcommand", rest)
+	}
+}
+
+func TestLoadConfigFileFromEnv(t *testing.T) {
+	cleanEnv(t)
+	t.Setenv("CONFIG_FILE", writeFile(t, "cipherops.yaml", "db_password: secret\nlog_level: warn\n"))
+	cfg, _, err := Load(nil)
+	if err != nil || cfg.LogLevel != "warn" {
+		t.Errorf("Load = %q, %v; want the level of the CONFIG_FILE file", cfg.LogLevel, err)
+	}
+}
+
+func TestLoadYAMLAndTOMLAgree(t *testing.T) {
+	cleanEnv(t)
+	yamlFile := writeFile(t, "cipherops.yaml", `
+listen_addr: ":9090"
+dry_run: false
+command_timeout: 90s
+auth_providers: [local, ldap]
+db:
+  host: db.internal
+  port: 6432
+  password: secret
+ldap:
+  url: ldaps://ldap.internal
+  base_dn: "dc=example,dc=org"
+job_workers: 8
+`)
+	tomlFile := writeFile(t, "cipherops.toml", `
+listen_addr = ":9090"
+dry_run = false
+command_timeout = "90s"
+auth_providers = ["local", "ldap"]
+job_workers = 8
+
+[db]
+host = "db.internal"
+port = 6432
+password = "secret"
+
+[ldap]
+url = "ldaps://ldap.internal"
+base_dn = "dc=example,dc=org"
+`)
+	fromYAML, _, err := Load([]string{"--config=" + yamlFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fromTOML, _, err := Load([]string{"--config=" + tomlFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fromYAML.DBPort != "6432" || fromYAML.AuthProviders != "local,ldap" || fromYAML.CommandTimeout != 90*time.Second || fromYAML.DryRun {
+		t.Errorf("YAML read as %+v", fromYAML)
+	}
+	fromYAML.ConfigFile, fromTOML.ConfigFile = "", ""
+	if !reflect.DeepEqual(fromYAML, fromTOML) {
+		t.Errorf("the YAML and TOML files load differently:\n%+v\n%+v", fromYAML, fromTOML)
+	}
+}
+
+func TestLoadReportsEveryError(t *testing.T) {
+	cleanEnv(t)
+	file := writeFile(t, "cipherops.yaml", "db_pasword: secret\ncommand_timeout: soon\n")
+	t.Setenv("JOB_WORKERS", "many")
+
+	_, _, err := Load([]string{"--config", file, "--log-level", "loud"})
+	if err == nil {
+		t.Fatal("Load accepted the configuration")
+	}
+	for _, want := range []string{
+		"unknown setting db_pasword",
+		"COMMAND_TIMEOUT (from " + file + "): must be a duration",
+		"JOB_WORKERS (from environment): must be an integer",
+		"LOG_LEVEL: must be debug",
+		"DB_PASSWORD: is required",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error does not mention %q:\n%v", want, err)
+		}
+	}
+}
+
+func TestLoadRejects(t *testing.T) {
+	cleanEnv(t)
+	tests := map[string][]string{
+		"unknown flag":          {"--no-such-setting=1"},
+		"flag without a value":  {"--db-host"},
+		"unsupported extension": {"--config", writeFile(t, "cipherops.ini", "db_host=x")},
+		"missing file":          {"--config", filepath.Join(t.TempDir(), "missing.yaml")},
+		"malformed YAML":        {"--config", writeFile(t, "cipherops.yaml", "db: [")},
+	}
+	for name, args := range tests {
+		if _, _, err := Load(args); err == nil {
+			t.Errorf("%s: Load(%q) succeeded", name, args)
+		}
+	}
+}
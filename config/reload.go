@@ -0,0 +1,239 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// reloadable are the Config fields a reload applies. Everything else is
+// structural, such as listen address, database, keys and auth providers, and
+// only changes on restart.
+var reloadable = map[string]bool{
+	"LogLevel":       true,
+	"CommandTimeout": true,
+
+	"DBMaxOpenConns":    true,
+	"DBMaxIdleConns":    true,
+	"DBConnMaxLifetime": true,
+	"DBConnMaxIdleTime": true,
+
+	"LoginWindow":         true,
+	"LoginBaseDelay":      true,
+	"LoginMaxDelay":       true,
+	"LoginMaxFailures":    true,
+	"LoginLockout":        true,
+	"LoginIPFreeFailures": true,
+	"LoginPoWDifficulty":  true,
+	"LoginPoWAfter":       true,
+
+	"FirewallPolicyFile":     true,
+	"ContainerTemplatesFile": true,
+	"CommandPolicyFile":      true,
+}
+
+// watchedFiles are fields naming files whose content counts as part of the
+// setting: editing the file notifies the subscribers of the field.
+var watchedFiles = []string{"FirewallPolicyFile", "ContainerTemplatesFile", "CommandPolicyFile"}
+
+// Reloader holds the live configuration. Reload re-reads all sources, and
+// if the result validates, swaps in the reloadable fields at once and tells
+// the subscribers whose fields changed.
+type Reloader struct {
+	args    []string
+	current atomic.Pointer[Config]
+
+	// serializes reloads and guards subs and stamps
+	mu   sync.Mutex
+	subs []subscription
+	// modification stamps of the watched files
+	stamps map[string]string
+}
+
+type subscription struct {
+	fields []string
+	check  func(Config) error
+	apply  func(Config)
+}
+
+// NewReloader starts from cfg, loaded with args by Load.
+func NewReloader(cfg Config, args []string) *Reloader {
+	r := &Reloader{args: args, stamps: map[string]string{}}
+	r.current.Store(&cfg)
+	for _, path := range r.watchedPaths(cfg) {
+		r.stamps[path] = fileStamp(path)
+	}
+	return r
+}
+
+// Current returns the configuration in effect.
+func (r *Reloader) Current() Config {
+	return *r.current.Load()
+}
+
+// Subscribe calls apply with the new configuration after a reload changed
+// one of fields, named as in Config. check, when not nil, runs first on the
+// candidate; an error rejects the whole reload, e.g. for a policy file that
+// does not parse. apply runs on the reloading goroutine.
+func (r *Reloader) Subscribe(fields []string, check func(Config) error, apply func(Config)) {
+	t := reflect.TypeOf(Config{})
+	for _, f := range fields {
+		if _, ok := t.FieldByName(f); !ok {
+			panic("config: no field " + f)
+		}
+		if !reloadable[f] {
+			panic("config: field " + f + " is not reloadable")
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subs = append(r.subs, subscription{fields: fields, check: check, apply: apply})
+}
+
+// Reload reads the configuration again. On any error the previous
+// configuration stays in effect. It returns the fields that changed.
+func (r *Reloader) Reload() ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// take the file stamps first, so a rejected edit is not retried on every
+	// tick; fixing the file changes the stamp again
+	old := r.Current()
+	prevStamps := r.stamps
+	r.stamps = map[string]string{}
+	for _, path := range r.watchedPaths(old) {
+		r.stamps[path] = fileStamp(path)
+	}
+
+	loaded, _, err := Load(r.args)
+	if err != nil {
+		return nil, err
+	}
+	next := old
+	oldV, loadedV, nextV := reflect.ValueOf(old), reflect.ValueOf(loaded), reflect.ValueOf(&next).Elem()
+	var changed, ignored []string
+	for i := 0; i < oldV.NumField(); i++ {
+		name := oldV.Type().Field(i).Name
+		if reflect.DeepEqual(oldV.Field(i).Interface(), loadedV.Field(i).Interface()) {
+			continue
+		}
+		if !reloadable[name] {
+			ignored = append(ignored, name)
+			continue
+		}
+		nextV.Field(i).Set(loadedV.Field(i))
+		changed = append(changed, name)
+	}
+	if len(ignored) > 0 {
+		slog.Warn("configuration changes need a restart", "fields", ignored)
+	}
+
+	// an edited policy or template file counts as a change of its setting
+	for _, path := range r.watchedPaths(next) {
+		r.stamps[path] = fileStamp(path)
+	}
+	for _, field := range watchedFiles {
+		path := reflect.ValueOf(next).FieldByName(field).String()
+		if path != "" && r.stamps[path] != prevStamps[path] && !slices.Contains(changed, field) {
+			changed = append(changed, field)
+		}
+	}
+
+	var notify []subscription
+	for _, sub := range r.subs {
+		for _, f := range sub.fields {
+			if slices.Contains(changed, f) {
+				notify = append(notify, sub)
+				break
+			}
+		}
+	}
+	for _, sub := range notify {
+		if sub.check == nil {
+			continue
+		}
+		if err := sub.check(next); err != nil {
+			return nil, err
+		}
+	}
+
+	r.current.Store(&next)
+	for _, sub := range notify {
+		sub.apply(next)
+	}
+	return changed, nil
+}
+
+// Watch reloads on SIGHUP and, every ConfigWatchInterval, when the config
+// file or a watched file changed. It returns when ctx ends.
+func (r *Reloader) Watch(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if interval := r.Current().ConfigWatchInterval; interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			r.reloadAndLog("SIGHUP")
+		case <-tick:
+			if r.filesChanged() {
+				r.reloadAndLog("file change")
+			}
+		}
+	}
+}
+
+func (r *Reloader) reloadAndLog(trigger string) {
+	changed, err := r.Reload()
+	if err != nil {
+		slog.Error("configuration reload rejected, keeping the previous one", "trigger", trigger, "error", err)
+		return
+	}
+	slog.Info("configuration reloaded", "trigger", trigger, "changed", changed)
+}
+
+func (r *Reloader) filesChanged() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, path := range r.watchedPaths(r.Current()) {
+		if fileStamp(path) != r.stamps[path] {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Reloader) watchedPaths(cfg Config) []string {
+	var paths []string
+	for _, path := range []string{cfg.ConfigFile, cfg.FirewallPolicyFile, cfg.ContainerTemplatesFile, cfg.CommandPolicyFile} {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// fileStamp changes whenever the file is written or replaced.
+func fileStamp(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "missing"
+	}
+	return fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size())
+}
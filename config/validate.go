@@ -0,0 +1,274 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"CipherOps/auth"
+	"CipherOps/utils"
+)
+
+// Validate checks the settings that would otherwise fail late or silently,
+// and reports every problem at once, each prefixed with the setting name.
+func (c Config) Validate() error {
+	var v validator
+
+	v.hostPort("LISTEN_ADDR", c.ListenAddr)
+	v.pair("TLS_CERT_FILE", c.TLSCertFile, "TLS_KEY_FILE", c.TLSKeyFile)
+	v.file("TLS_CERT_FILE", c.TLSCertFile)
+	v.file("TLS_KEY_FILE", c.TLSKeyFile)
+	v.positive("HTTP_READ_HEADER_TIMEOUT", c.ReadHeaderTimeout)
+	v.notNegative("HTTP_READ_TIMEOUT", c.ReadTimeout)
+	v.notNegative("HTTP_WRITE_TIMEOUT", c.WriteTimeout)
+	v.notNegative("HTTP_IDLE_TIMEOUT", c.IdleTimeout)
+	v.positive("COMMAND_TIMEOUT", c.CommandTimeout)
+	v.oneOf("PRIVILEGE_ESCALATION", c.PrivilegeEscalation, "sudo", "doas", "pkexec", "run0", "helper")
+	if c.PrivilegeEscalation == "helper" {
+		v.required("HELPER_SOCKET", c.HelperSocket)
+	}
+	v.notNegative("CONFIG_WATCH_INTERVAL", c.ConfigWatchInterval)
+	v.file("FIREWALL_POLICY_FILE", c.FirewallPolicyFile)
+	v.file("CONTAINER_TEMPLATES_FILE", c.ContainerTemplatesFile)
+	// SSO and directory users get roles a user may hold, checked against the
+	// command policy so a reload cannot drop a role still handed out
+	if policy, err := utils.LoadCommandPolicy(c.CommandPolicyFile); err != nil {
+		v.add("COMMAND_POLICY_FILE", "%v", err)
+	} else {
+		v.roleMap("OIDC_ROLE_MAP", c.OIDCRoleMap, ",", policy)
+		v.role("OIDC_DEFAULT_ROLE", c.OIDCDefaultRole, policy)
+		v.roleMap("LDAP_ROLE_MAP", c.LDAPRoleMap, ";", policy)
+		v.role("LDAP_DEFAULT_ROLE", c.LDAPDefaultRole, policy)
+	}
+	v.file("SSH_KEY_FILE", c.SSHKeyFile)
+	v.file("SSH_KNOWN_HOSTS_FILE", c.SSHKnownHostsFile)
+	v.positive("SSH_CONNECT_TIMEOUT", c.SSHConnectTimeout)
+	v.oneOf("SSH_ESCALATION", c.SSHEscalation, "sudo", "doas", "pkexec", "run0")
+	if c.SSHSudoPassword != "" && c.SSHEscalation != "sudo" {
+		v.add("SSH_SUDO_PASSWORD", "only answers sudo, SSH_ESCALATION is %s", c.SSHEscalation)
+	}
+	v.notNegative("FACTS_INTERVAL", c.FactsInterval)
+	v.atLeast("FAN_OUT_PARALLELISM", c.FanOutParallelism, 1)
+	if c.AgentListenAddr != "" {
+		v.hostPort("AGENT_LISTEN_ADDR", c.AgentListenAddr)
+		v.required("AGENT_CA_CERT_FILE", c.AgentCACertFile)
+		v.required("AGENT_CA_KEY_FILE", c.AgentCAKeyFile)
+		v.required("AGENT_SERVER_NAMES", c.AgentServerNames)
+		// agents only speak TLS
+		if u, err := url.Parse(c.AgentPublicURL); err != nil || u.Scheme != "https" || u.Host == "" {
+			v.add("AGENT_PUBLIC_URL", "must be an absolute https URL, got %q", c.AgentPublicURL)
+		}
+		v.positive("AGENT_CERT_TTL", c.AgentCertTTL)
+		v.positive("AGENT_TOKEN_TTL", c.AgentTokenTTL)
+	}
+	v.atLeast("JOB_WORKERS", c.JobWorkers, 1)
+	v.positive("JOB_POLL_INTERVAL", c.JobPollInterval)
+	v.atLeast("JOB_MAX_ATTEMPTS", c.JobMaxAttempts, 1)
+	v.positive("JOB_RETRY_DELAY", c.JobRetryDelay)
+	if c.JobMaxRetryDelay < c.JobRetryDelay {
+		v.add("JOB_MAX_RETRY_DELAY", "must not be shorter than JOB_RETRY_DELAY")
+	}
+
+	v.oneOf("DB_DRIVER", c.DBDriver, "postgres", "sqlite")
+	if c.DBDriver == "sqlite" {
+		v.required("DB_PATH", c.DBPath)
+	} else {
+		v.required("DB_HOST", c.DBHost)
+		v.required("DB_NAME", c.DBName)
+		v.required("DB_USER", c.DBUser)
+		if c.DBPassword == "" && c.DBSSLCert == "" {
+			v.add("DB_PASSWORD", "is required unless DB_SSLCERT authenticates, e.g. DB_PASSWORD=file:/run/secrets/db_password")
+		}
+		v.port("DB_PORT", c.DBPort)
+		v.oneOf("DB_SSLMODE", c.DBSSLMode, "disable", "allow", "prefer", "require", "verify-ca", "verify-full")
+		v.pair("DB_SSLCERT", c.DBSSLCert, "DB_SSLKEY", c.DBSSLKey)
+		v.file("DB_SSLROOTCERT", c.DBSSLRootCert)
+		v.file("DB_SSLCERT", c.DBSSLCert)
+		v.file("DB_SSLKEY", c.DBSSLKey)
+		if (c.DBSSLMode == "verify-ca" || c.DBSSLMode == "verify-full") && c.DBSSLRootCert == "" {
+			v.add("DB_SSLROOTCERT", "is required with DB_SSLMODE=%s", c.DBSSLMode)
+		}
+		v.atLeast("DB_MAX_OPEN_CONNS", c.DBMaxOpenConns, 0)
+		v.atLeast("DB_MAX_IDLE_CONNS", c.DBMaxIdleConns, 0)
+		v.notNegative("DB_CONN_MAX_LIFETIME", c.DBConnMaxLifetime)
+		v.notNegative("DB_CONN_MAX_IDLE_TIME", c.DBConnMaxIdleTime)
+		v.atLeast("DB_CONNECT_ATTEMPTS", c.DBConnectAttempts, 0)
+		v.positive("DB_RETRY_BASE_DELAY", c.DBRetryBaseDelay)
+		if c.DBRetryMaxDelay < c.DBRetryBaseDelay {
+			v.add("DB_RETRY_MAX_DELAY", "must not be shorter than DB_RETRY_BASE_DELAY")
+		}
+	}
+
+	v.oneOf("LOG_FORMAT", c.LogFormat, "text", "json")
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		v.add("LOG_LEVEL", "must be debug, info, warn or error, got %q", c.LogLevel)
+	}
+
+	v.notNegative("SESSION_IDLE_TIMEOUT", c.SessionIdleTimeout)
+	v.required("TOTP_ISSUER", c.TOTPIssuer)
+	v.required("WEBAUTHN_RP_ID", c.WebAuthnRPID)
+	for _, origin := range strings.Split(c.WebAuthnOrigins, ",") {
+		v.url("WEBAUTHN_ORIGINS", strings.TrimSpace(origin))
+	}
+
+	if c.OIDCIssuer != "" {
+		v.url("OIDC_ISSUER", c.OIDCIssuer)
+		v.required("OIDC_CLIENT_ID", c.OIDCClientID)
+		v.url("OIDC_REDIRECT_URL", c.OIDCRedirectURL)
+	}
+
+	providers := 0
+	for _, name := range strings.Split(c.AuthProviders, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+			continue
+		case "local":
+		case "ldap":
+			v.required("LDAP_URL", c.LDAPURL)
+			v.required("LDAP_BASE_DN", c.LDAPBaseDN)
+			v.file("LDAP_CA_FILE", c.LDAPCAFile)
+		default:
+			v.add("AUTH_PROVIDERS", "unknown provider %q, use local or ldap", strings.TrimSpace(name))
+		}
+		providers++
+	}
+	if providers == 0 {
+		v.add("AUTH_PROVIDERS", "must name at least one provider")
+	}
+
+	v.positive("LOGIN_WINDOW", c.LoginWindow)
+	v.notNegative("LOGIN_BASE_DELAY", c.LoginBaseDelay)
+	if c.LoginMaxDelay < c.LoginBaseDelay {
+		v.add("LOGIN_MAX_DELAY", "must not be shorter than LOGIN_BASE_DELAY")
+	}
+	v.atLeast("LOGIN_MAX_FAILURES", c.LoginMaxFailures, 1)
+	v.positive("LOGIN_LOCKOUT", c.LoginLockout)
+	v.atLeast("LOGIN_IP_FREE_FAILURES", c.LoginIPFreeFailures, 0)
+	if c.LoginPoWDifficulty < 0 || c.LoginPoWDifficulty > 32 {
+		v.add("LOGIN_POW_DIFFICULTY", "must be between 0 and 32 bits, got %d", c.LoginPoWDifficulty)
+	}
+	v.atLeast("LOGIN_POW_AFTER", c.LoginPoWAfter, 0)
+
+	v.url("PUBLIC_URL", c.PublicURL)
+	v.oneOf("MAILER", c.Mailer, "smtp", "file")
+	if _, err := mail.ParseAddress(c.MailFrom); err != nil {
+		v.add("MAIL_FROM", "is not a mail address: %v", err)
+	}
+	switch c.Mailer {
+	case "smtp":
+		v.required("SMTP_HOST", c.SMTPHost)
+		v.port("SMTP_PORT", c.SMTPPort)
+	case "file":
+		v.required("MAIL_DROP_DIR", c.MailDropDir)
+	}
+	v.positive("EMAIL_VERIFY_TTL", c.EmailVerifyTTL)
+	v.positive("PASSWORD_RESET_TTL", c.PasswordResetTTL)
+
+	if c.FrameOptions != "" {
+		v.oneOf("FRAME_OPTIONS", c.FrameOptions, "DENY", "SAMEORIGIN")
+	}
+	return errors.Join(v.errs...)
+}
+
+type validator struct {
+	errs []error
+}
+
+func (v *validator) add(key, format string, args ...any) {
+	v.errs = append(v.errs, fmt.Errorf("%s: %s", key, fmt.Sprintf(format, args...)))
+}
+
+func (v *validator) required(key, value string) {
+	if strings.TrimSpace(value) == "" {
+		v.add(key, "is required")
+	}
+}
+
+func (v *validator) oneOf(key, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.add(key, "must be one of %s, got %q", strings.Join(allowed, ", "), value)
+}
+
+func (v *validator) port(key, value string) {
+	if n, err := strconv.Atoi(value); err != nil || n < 1 || n > 65535 {
+		v.add(key, "must be a port number, got %q", value)
+	}
+}
+
+func (v *validator) hostPort(key, value string) {
+	if _, port, err := net.SplitHostPort(value); err != nil {
+		v.add(key, "must be host:port or :port, got %q", value)
+	} else {
+		v.port(key, port)
+	}
+}
+
+func (v *validator) url(key, value string) {
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.add(key, "must be an absolute http or https URL, got %q", value)
+	}
+}
+
+// pair requires both settings or neither.
+func (v *validator) pair(keyA, a, keyB, b string) {
+	if (a == "") != (b == "") {
+		v.add(keyA, "and %s must be set together", keyB)
+	}
+}
+
+func (v *validator) file(key, path string) {
+	if path == "" {
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		v.add(key, "%v", err)
+	}
+}
+
+func (v *validator) atLeast(key string, n, lowest int) {
+	if n < lowest {
+		v.add(key, "must be at least %d, got %d", lowest, n)
+	}
+}
+
+func (v *validator) positive(key string, d time.Duration) {
+	if d <= 0 {
+		v.add(key, "must be a positive duration, got %s", d)
+	}
+}
+
+func (v *validator) notNegative(key string, d time.Duration) {
+	if d < 0 {
+		v.add(key, "must not be negative, got %s", d)
+	}
+}
+
+// role requires a role a user may hold, see utils.CommandPolicy.IsUserRole.
+func (v *validator) role(key, role string, policy utils.CommandPolicy) {
+	if !policy.IsUserRole(role) {
+		v.add(key, "%q is not a role a user may hold", role)
+	}
+}
+
+func (v *validator) roleMap(key, roleMap, sep string, policy utils.CommandPolicy) {
+	roles, err := auth.RoleMapRoles(roleMap, sep)
+	if err != nil {
+		v.add(key, "%v", err)
+	}
+	for _, role := range roles {
+		v.role(key, role, policy)
+	}
+}
@@ -0,0 +1,85 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// validConfig is the default configuration with the one setting it lacks.
+func validConfig(t *testing.T) Config {
+	t.Helper()
+	cfg := build(&source{})
+	cfg.DBPassword = "secret"
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("defaults do not validate: %v", err)
+	}
+	return cfg
+}
+
+func TestValidateRoles(t *testing.T) {
+	policy := filepath.Join(t.TempDir(), "commands.yaml")
+	if err := os.WriteFile(policy, []byte("roles: {operator: [{command: uptime}]}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		set   func(*Config)
+		error string
+	}{
+		{"policy role", func(c *Config) { c.CommandPolicyFile, c.LDAPRoleMap = policy, "ops=operator;devs=user" }, ""},
+		{"internal role mapped", func(c *Config) { c.OIDCRoleMap = "ops=admin,robots=system" }, `OIDC_ROLE_MAP: "system"`},
+		{"wildcard default", func(c *Config) { c.OIDCDefaultRole = "*" }, `OIDC_DEFAULT_ROLE: "*"`},
+		{"unknown role mapped", func(c *Config) { c.LDAPRoleMap = "ops=operator" }, `LDAP_ROLE_MAP: "operator"`},
+		{"agent default", func(c *Config) { c.LDAPDefaultRole = "agent" }, `LDAP_DEFAULT_ROLE: "agent"`},
+		{"no default", func(c *Config) { c.LDAPDefaultRole = "" }, `LDAP_DEFAULT_ROLE: ""`},
+		{"malformed map", func(c *Config) { c.LDAPRoleMap = "ops" }, "LDAP_ROLE_MAP: invalid role mapping"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validConfig(t)
+			tt.set(&cfg)
+			err := cfg.Validate()
+			switch {
+			case tt.error == "" && err != nil:
+				t.Errorf("Validate() = %v", err)
+			case tt.error != "" && (err == nil || !strings.Contains(err.Error(), tt.error)):
+				t.Errorf("Validate() = %v, want %s", err, tt.error)
+			}
+		})
+	}
+}
+
+func TestValidateCollectsErrors(t *testing.T) {
+	cfg := validConfig(t)
+	cfg.ListenAddr = "8080"
+	cfg.JobWorkers = 0
+	cfg.JobMaxRetryDelay = time.Second
+	cfg.DBSSLMode = "sometimes"
+	cfg.TLSCertFile = "cert.pem"
+	cfg.Mailer = "pigeon"
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("Validate accepted the configuration")
+	}
+	want := []string{
+		"LISTEN_ADDR: must be host:port",
+		"TLS_CERT_FILE: and TLS_KEY_FILE must be set together",
+		"JOB_WORKERS: must be at least 1",
+		"JOB_MAX_RETRY_DELAY: must not be shorter than JOB_RETRY_DELAY",
+		"DB_SSLMODE: must be one of",
+		"MAILER: must be one of smtp, file",
+	}
+	for _, w := range want {
+		if !strings.Contains(err.Error(), w) {
+			t.Errorf("error does not mention %q", w)
+		}
+	}
+	// one line per problem, the missing certificate file included
+	if lines := strings.Split(err.Error(), "\n"); len(lines) != len(want)+1 {
+		t.Errorf("%d errors, want %d:\n%v", len(lines), len(want)+1, err)
+	}
+}
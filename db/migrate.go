@@ -0,0 +1,284 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLock is the advisory lock key held while migrating, so two
+// instances starting together do not both apply the same migration.
+const migrationLock = 0x6d6967726174 // "migrat"
+
+var migrationName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migration is one numbered schema change with its undo.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+	// SHA-256 of the up and down scripts; an applied migration whose file
+	// changed afterwards is refused
+	Checksum string
+}
+
+// MigrationStatus pairs a migration with its state in the database.
+type MigrationStatus struct {
+	Version   int64
+	Name      string
+	AppliedAt *time.Time
+	// the file differs from what was applied
+	Modified bool
+	// applied, but this build has no file for it
+	Missing bool
+}
+
+// LoadMigrations reads NNNN_name.up.sql and NNNN_name.down.sql pairs from
+// fsys, ordered by version.
+func LoadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int64]*Migration{}
+	for _, entry := range entries {
+		m := migrationName.FindStringSubmatch(entry.Name())
+		if m == nil {
+			return nil, fmt.Errorf("unexpected migration file %s", entry.Name())
+		}
+		version, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		body, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		mig := byVersion[version]
+		if mig == nil {
+			mig = &Migration{Version: version, Name: m[2]}
+			byVersion[version] = mig
+		}
+		if mig.Name != m[2] {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, mig.Name, m[2])
+		}
+		if m[3] == "up" {
+			mig.Up = string(body)
+		} else {
+			mig.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, mig := range byVersion {
+		if mig.Up == "" || mig.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", mig.Version, mig.Name)
+		}
+		sum := sha256.Sum256([]byte(mig.Up + "\x00" + mig.Down))
+		mig.Checksum = hex.EncodeToString(sum[:])
+		migrations = append(migrations, *mig)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Migrator applies migrations to a Postgres database.
+type Migrator struct {
+	DB         *sql.DB
+	Migrations []Migration
+}
+
+// NewMigrator uses the migrations embedded in the binary.
+func NewMigrator(db *sql.DB) (*Migrator, error) {
+	migrations, err := LoadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{DB: db, Migrations: migrations}, nil
+}
+
+type appliedMigration struct {
+	name      string
+	checksum  string
+	appliedAt time.Time
+}
+
+// Up applies the pending migrations up to and including target, or all of
+// them when target is 0. It returns the versions applied.
+func (m *Migrator) Up(ctx context.Context, target int64) ([]int64, error) {
+	var done []int64
+	err := m.locked(ctx, func(conn *sql.Conn, applied map[int64]appliedMigration) error {
+		if err := m.checkApplied(applied); err != nil {
+			return err
+		}
+		for _, mig := range m.Migrations {
+			if target > 0 && mig.Version > target {
+				break
+			}
+			if _, ok := applied[mig.Version]; ok {
+				continue
+			}
+			err := inTx(ctx, conn, func(tx *sql.Tx) error {
+				if _, err := tx.ExecContext(ctx, mig.Up); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name, checksum)
+					VALUES ($1, $2, $3)`, mig.Version, mig.Name, mig.Checksum)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d_%s failed: %w", mig.Version, mig.Name, err)
+			}
+			done = append(done, mig.Version)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down reverts the last steps applied migrations, newest first. It returns
+// the versions reverted.
+func (m *Migrator) Down(ctx context.Context, steps int) ([]int64, error) {
+	var done []int64
+	err := m.locked(ctx, func(conn *sql.Conn, applied map[int64]appliedMigration) error {
+		if err := m.checkApplied(applied); err != nil {
+			return err
+		}
+		for i := len(m.Migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			mig := m.Migrations[i]
+			if _, ok := applied[mig.Version]; !ok {
+				continue
+			}
+			err := inTx(ctx, conn, func(tx *sql.Tx) error {
+				if _, err := tx.ExecContext(ctx, mig.Down); err != nil {
+					return err
+				}
+				_, err := tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = $1`, mig.Version)
+				return err
+			})
+			if err != nil {
+				return fmt.Errorf("reverting migration %d_%s failed: %w", mig.Version, mig.Name, err)
+			}
+			done = append(done, mig.Version)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Status lists every known or applied migration.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	var status []MigrationStatus
+	err := m.locked(ctx, func(conn *sql.Conn, applied map[int64]appliedMigration) error {
+		known := map[int64]bool{}
+		for _, mig := range m.Migrations {
+			known[mig.Version] = true
+			s := MigrationStatus{Version: mig.Version, Name: mig.Name}
+			if a, ok := applied[mig.Version]; ok {
+				appliedAt := a.appliedAt
+				s.AppliedAt = &appliedAt
+				s.Modified = a.checksum != mig.Checksum
+			}
+			status = append(status, s)
+		}
+		for version, a := range applied {
+			if !known[version] {
+				appliedAt := a.appliedAt
+				status = append(status, MigrationStatus{Version: version, Name: a.name, AppliedAt: &appliedAt, Missing: true})
+			}
+		}
+		sort.Slice(status, func(i, j int) bool { return status[i].Version < status[j].Version })
+		return nil
+	})
+	return status, err
+}
+
+// checkApplied refuses to work on a database whose history does not match
+// this build: edited migrations or migrations from a newer build.
+func (m *Migrator) checkApplied(applied map[int64]appliedMigration) error {
+	known := map[int64]Migration{}
+	for _, mig := range m.Migrations {
+		known[mig.Version] = mig
+	}
+	var errs []error
+	for version, a := range applied {
+		mig, ok := known[version]
+		if !ok {
+			errs = append(errs, fmt.Errorf("migration %d_%s is applied but unknown to this build", version, a.name))
+			continue
+		}
+		if mig.Checksum != a.checksum {
+			errs = append(errs, fmt.Errorf("migration %d_%s was edited after it was applied", version, mig.Name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// locked runs fn on a dedicated connection holding the migration lock.
+func (m *Migrator) locked(ctx context.Context, fn func(*sql.Conn, map[int64]appliedMigration) error) error {
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, int64(migrationLock)); err != nil {
+		return fmt.Errorf("cannot take the migration lock: %w", err)
+	}
+	defer conn.ExecContext(context.WithoutCancel(ctx), `SELECT pg_advisory_unlock($1)`, int64(migrationLock))
+
+	_, err = conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    BIGINT PRIMARY KEY,
+		name       TEXT NOT NULL,
+		checksum   TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`)
+	if err != nil {
+		return err
+	}
+	rows, err := conn.QueryContext(ctx, `SELECT version, name, checksum, applied_at FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+	applied := map[int64]appliedMigration{}
+	for rows.Next() {
+		var version int64
+		var a appliedMigration
+		if err := rows.Scan(&version, &a.name, &a.checksum, &a.appliedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		applied[version] = a
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return fn(conn, applied)
+}
+
+func inTx(ctx context.Context, conn *sql.Conn, fn func(*sql.Tx) error) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+)
+
+const migrateUsage = `usage: CipherOps migrate <command>
+
+commands:
+  up [version]   apply pending migrations, up to version if given
+  down [steps]   revert the last steps migrations (default 1)
+  status         list migrations and whether they are applied
+`
+
+// RunMigrateCommand implements the "migrate" subcommand.
+func RunMigrateCommand(ctx context.Context, conn *sql.DB, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprint(out, migrateUsage)
+		return errors.New("missing migrate command")
+	}
+	migrator, err := NewMigrator(conn)
+	if err != nil {
+		return err
+	}
+	arg := func(fallback int64) (int64, error) {
+		if len(args) < 2 {
+			return fallback, nil
+		}
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("%q is not a valid number", args[1])
+		}
+		return n, nil
+	}
+
+	switch args[0] {
+	case "up":
+		target, err := arg(0)
+		if err != nil {
+			return err
+		}
+		applied, err := migrator.Up(ctx, target)
+		for _, v := range applied {
+			fmt.Fprintf(out, "applied %d\n", v)
+		}
+		if err == nil && len(applied) == 0 {
+			fmt.Fprintln(out, "nothing to apply")
+		}
+		return err
+	case "down":
+		steps, err := arg(1)
+		if err != nil {
+			return err
+		}
+		reverted, err := migrator.Down(ctx, int(steps))
+		for _, v := range reverted {
+			fmt.Fprintf(out, "reverted %d\n", v)
+		}
+		return err
+	case "status":
+		status, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED\tNOTE")
+		for _, s := range status {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Local().Format("2006-01-02 15:04:05")
+			}
+			note := ""
+			if s.Modified {
+				note = "file changed since applied"
+			}
+			if s.Missing {
+				note = "unknown to this build"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", s.Version, s.Name, applied, note)
+		}
+		return w.Flush()
+	default:
+		fmt.Fprint(out, migrateUsage)
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
@@ -0,0 +1,11 @@
+-- Panel accounts. Passwords are bcrypt hashes.
+CREATE TABLE IF NOT EXISTS users (
+	id             SERIAL PRIMARY KEY,
+	username       TEXT NOT NULL UNIQUE,
+	password       TEXT NOT NULL,
+	role           TEXT NOT NULL DEFAULT 'user',
+	totp_secret    TEXT NOT NULL DEFAULT '',
+	totp_enabled   BOOLEAN NOT NULL DEFAULT FALSE,
+	totp_last_step BIGINT NOT NULL DEFAULT 0,
+	created_at     TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
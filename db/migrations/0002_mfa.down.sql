@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS role_mfa_policy;
+DROP TABLE IF EXISTS user_recovery_codes;
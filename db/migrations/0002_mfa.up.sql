@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS user_recovery_codes (
+	id        SERIAL PRIMARY KEY,
+	user_id   INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	code_hash TEXT NOT NULL,
+	used_at   TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS user_recovery_codes_user_idx ON user_recovery_codes (user_id);
+
+CREATE TABLE IF NOT EXISTS role_mfa_policy (
+	role        TEXT PRIMARY KEY,
+	require_mfa BOOLEAN NOT NULL DEFAULT FALSE
+);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS webauthn_ceremonies;
+DROP TABLE IF EXISTS webauthn_credentials;
+ALTER TABLE users DROP COLUMN IF EXISTS webauthn_id;
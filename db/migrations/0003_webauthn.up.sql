@@ -0,0 +1,21 @@
+-- WebAuthn user handle, created on the first passkey registration
+ALTER TABLE users ADD COLUMN IF NOT EXISTS webauthn_id BYTEA UNIQUE;
+
+CREATE TABLE IF NOT EXISTS webauthn_credentials (
+	id            SERIAL PRIMARY KEY,
+	user_id       INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	credential_id BYTEA NOT NULL UNIQUE,
+	name          TEXT NOT NULL DEFAULT '',
+	data          JSONB NOT NULL,
+	created_at    TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	last_used_at  TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS webauthn_credentials_user_idx ON webauthn_credentials (user_id);
+
+-- pending registration and login ceremonies, consumed on finish
+CREATE TABLE IF NOT EXISTS webauthn_ceremonies (
+	id         TEXT PRIMARY KEY,
+	user_id    INTEGER REFERENCES users(id) ON DELETE CASCADE,
+	data       JSONB NOT NULL,
+	expires_at TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,13 @@
+-- personal access tokens, only the SHA-256 of the token is kept
+CREATE TABLE IF NOT EXISTS api_tokens (
+	id           SERIAL PRIMARY KEY,
+	user_id      INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	name         TEXT NOT NULL,
+	token_hash   TEXT NOT NULL UNIQUE,
+	scopes       TEXT NOT NULL DEFAULT '',
+	created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	expires_at   TIMESTAMPTZ,
+	last_used_at TIMESTAMPTZ,
+	revoked_at   TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS api_tokens_user_idx ON api_tokens (user_id);
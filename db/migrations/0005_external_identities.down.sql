@@ -0,0 +1,4 @@
+ALTER TABLE users DROP COLUMN IF EXISTS auth_provider;
+DROP INDEX IF EXISTS users_oidc_identity_idx;
+ALTER TABLE users DROP COLUMN IF EXISTS oidc_subject;
+ALTER TABLE users DROP COLUMN IF EXISTS oidc_issuer;
@@ -0,0 +1,7 @@
+-- identity of users provisioned through OpenID Connect
+ALTER TABLE users ADD COLUMN IF NOT EXISTS oidc_issuer TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS oidc_subject TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS users_oidc_identity_idx ON users (oidc_issuer, oidc_subject);
+
+-- which provider owns the account: local, ldap or oidc
+ALTER TABLE users ADD COLUMN IF NOT EXISTS auth_provider TEXT NOT NULL DEFAULT 'local';
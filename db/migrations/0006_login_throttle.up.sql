@@ -0,0 +1,18 @@
+-- audit of every login attempt, also read by the brute-force protection
+CREATE TABLE IF NOT EXISTS login_attempts (
+	id         BIGSERIAL PRIMARY KEY,
+	username   TEXT NOT NULL,
+	ip         TEXT NOT NULL,
+	success    BOOLEAN NOT NULL,
+	reason     TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS login_attempts_ip_idx ON login_attempts (ip, created_at);
+CREATE INDEX IF NOT EXISTS login_attempts_username_idx ON login_attempts (username, created_at);
+
+CREATE TABLE IF NOT EXISTS account_lockouts (
+	username        TEXT PRIMARY KEY,
+	failures        INTEGER NOT NULL DEFAULT 0,
+	last_failure_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	locked_until    TIMESTAMPTZ
+);
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS email_tokens;
+DROP INDEX IF EXISTS users_email_idx;
+ALTER TABLE users DROP COLUMN IF EXISTS email_verified;
+ALTER TABLE users DROP COLUMN IF EXISTS email;
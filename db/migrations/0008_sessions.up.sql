@@ -0,0 +1,14 @@
+-- server-side sessions, the cookie holds a signed handle whose SHA-256 is token_hash
+CREATE TABLE IF NOT EXISTS sessions (
+	id           BIGSERIAL PRIMARY KEY,
+	token_hash   TEXT NOT NULL UNIQUE,
+	user_id      INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	stage        TEXT NOT NULL,
+	ip           TEXT NOT NULL DEFAULT '',
+	user_agent   TEXT NOT NULL DEFAULT '',
+	created_at   TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	last_seen_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	expires_at   TIMESTAMPTZ NOT NULL,
+	revoked_at   TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS sessions_user_idx ON sessions (user_id);
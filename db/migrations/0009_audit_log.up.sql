@@ -0,0 +1,18 @@
+-- hash-chained record of privileged actions, written by audit.Logger only
+CREATE TABLE IF NOT EXISTS audit_log (
+	id         BIGINT PRIMARY KEY,
+	created_at TIMESTAMPTZ NOT NULL,
+	user_id    INTEGER,
+	username   TEXT NOT NULL,
+	ip         TEXT NOT NULL DEFAULT '',
+	action     TEXT NOT NULL,
+	command    TEXT NOT NULL,
+	args       TEXT NOT NULL DEFAULT '[]',
+	success    BOOLEAN NOT NULL,
+	output     TEXT NOT NULL DEFAULT '',
+	error      TEXT NOT NULL DEFAULT '',
+	prev_hash  TEXT NOT NULL,
+	hash       TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS audit_log_user_idx ON audit_log (user_id, created_at);
+CREATE INDEX IF NOT EXISTS audit_log_action_idx ON audit_log (action, created_at);
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS firewall_rules;
+DROP TABLE IF EXISTS containers;
@@ -0,0 +1,29 @@
+-- containers created by the panel from its service templates
+CREATE TABLE IF NOT EXISTS containers (
+	id         SERIAL PRIMARY KEY,
+	name       TEXT NOT NULL UNIQUE,
+	image      TEXT NOT NULL,
+	port       TEXT NOT NULL DEFAULT '',
+	env        TEXT NOT NULL DEFAULT '{}',
+	engine_id  TEXT NOT NULL DEFAULT '',
+	status     TEXT NOT NULL DEFAULT '',
+	created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- firewall rules managed by the panel, applied in position order
+CREATE TABLE IF NOT EXISTS firewall_rules (
+	id         SERIAL PRIMARY KEY,
+	direction  TEXT NOT NULL,
+	protocol   TEXT NOT NULL,
+	port       TEXT NOT NULL DEFAULT '',
+	source     TEXT NOT NULL DEFAULT '',
+	action     TEXT NOT NULL,
+	comment    TEXT NOT NULL DEFAULT '',
+	enabled    BOOLEAN NOT NULL DEFAULT TRUE,
+	position   INTEGER NOT NULL DEFAULT 0,
+	created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS firewall_rules_position_idx ON firewall_rules (position);
@@ -0,0 +1,2 @@
+-- commands run on managed hosts over SSH name the host
+ALTER TABLE audit_log ADD COLUMN IF NOT EXISTS host TEXT NOT NULL DEFAULT '';
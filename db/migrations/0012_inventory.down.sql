@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS host_group_members;
+DROP TABLE IF EXISTS host_groups;
+DROP TABLE IF EXISTS hosts;
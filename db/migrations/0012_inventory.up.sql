@@ -0,0 +1,30 @@
+-- managed hosts; the facts columns are refreshed by facts gathering
+CREATE TABLE IF NOT EXISTS hosts (
+	id               SERIAL PRIMARY KEY,
+	name             TEXT NOT NULL UNIQUE,
+	address          TEXT NOT NULL,
+	port             INTEGER NOT NULL DEFAULT 22,
+	ssh_user         TEXT NOT NULL DEFAULT '',
+	labels           TEXT NOT NULL DEFAULT '{}',
+	distro_id        TEXT NOT NULL DEFAULT '',
+	distro_like      TEXT NOT NULL DEFAULT '',
+	distro_name      TEXT NOT NULL DEFAULT '',
+	distro_version   TEXT NOT NULL DEFAULT '',
+	installer        TEXT NOT NULL DEFAULT '',
+	service_manager  TEXT NOT NULL DEFAULT '',
+	firewall_backend TEXT NOT NULL DEFAULT '',
+	facts_at         TIMESTAMPTZ,
+	facts_error      TEXT NOT NULL DEFAULT '',
+	created_at       TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS host_groups (
+	id   SERIAL PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS host_group_members (
+	group_id INTEGER NOT NULL REFERENCES host_groups(id) ON DELETE CASCADE,
+	host_id  INTEGER NOT NULL REFERENCES hosts(id) ON DELETE CASCADE,
+	PRIMARY KEY (group_id, host_id)
+);
@@ -0,0 +1,20 @@
+-- one-time tokens an agent trades for its client certificate
+CREATE TABLE IF NOT EXISTS agent_tokens (
+	id         SERIAL PRIMARY KEY,
+	host_id    INTEGER NOT NULL REFERENCES hosts(id) ON DELETE CASCADE,
+	token_hash TEXT NOT NULL UNIQUE,
+	expires_at TIMESTAMPTZ NOT NULL,
+	used_at    TIMESTAMPTZ,
+	created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- the enrolled agent of a host, known by the serial of its certificate
+CREATE TABLE IF NOT EXISTS agents (
+	host_id     INTEGER PRIMARY KEY REFERENCES hosts(id) ON DELETE CASCADE,
+	cert_serial TEXT NOT NULL UNIQUE,
+	cert_expiry TIMESTAMPTZ NOT NULL,
+	enrolled_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	last_seen   TIMESTAMPTZ,
+	revoked_at  TIMESTAMPTZ
+);
@@ -0,0 +1,34 @@
+-- background jobs; a worker holds a running job until locked_until and a
+-- job whose lease ran out is picked up again
+CREATE TABLE IF NOT EXISTS jobs (
+	id               BIGSERIAL PRIMARY KEY,
+	kind             TEXT NOT NULL,
+	payload          TEXT NOT NULL DEFAULT '{}',
+	status           TEXT NOT NULL DEFAULT 'queued',
+	attempts         INTEGER NOT NULL DEFAULT 0,
+	max_attempts     INTEGER NOT NULL DEFAULT 1,
+	run_at           TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	progress         INTEGER NOT NULL DEFAULT 0,
+	progress_message TEXT NOT NULL DEFAULT '',
+	result           TEXT,
+	error            TEXT NOT NULL DEFAULT '',
+	cancel_requested BOOLEAN NOT NULL DEFAULT FALSE,
+	user_id          INTEGER REFERENCES users(id) ON DELETE SET NULL,
+	username         TEXT NOT NULL DEFAULT '',
+	ip               TEXT NOT NULL DEFAULT '',
+	locked_by        TEXT NOT NULL DEFAULT '',
+	locked_until     TIMESTAMPTZ,
+	created_at       TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+	started_at       TIMESTAMPTZ,
+	finished_at      TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS jobs_status_idx ON jobs (status, run_at);
+
+CREATE TABLE IF NOT EXISTS job_logs (
+	id     BIGSERIAL PRIMARY KEY,
+	job_id BIGINT NOT NULL REFERENCES jobs(id) ON DELETE CASCADE,
+	at     TIMESTAMPTZ NOT NULL,
+	stream TEXT NOT NULL,
+	text   TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS job_logs_job_idx ON job_logs (job_id, id);
@@ -0,0 +1,2 @@
+-- the role a job was enqueued with decides which commands it may run
+ALTER TABLE jobs ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT '';
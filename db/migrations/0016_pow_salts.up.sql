@@ -0,0 +1,7 @@
+-- salts of solved login challenges, kept until the challenge expires so a
+-- solution cannot be replayed
+CREATE TABLE IF NOT EXISTS used_pow_salts (
+	salt       TEXT PRIMARY KEY,
+	expires_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS used_pow_salts_expires_idx ON used_pow_salts (expires_at);
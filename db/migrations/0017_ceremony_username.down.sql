@@ -0,0 +1 @@
+ALTER TABLE webauthn_ceremonies DROP COLUMN IF EXISTS username;
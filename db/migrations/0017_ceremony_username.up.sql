@@ -0,0 +1,3 @@
+-- the username a passkey login was begun for, kept for the login throttle
+-- and for logins of unknown users, which have no user_id
+ALTER TABLE webauthn_ceremonies ADD COLUMN IF NOT EXISTS username TEXT NOT NULL DEFAULT '';
@@ -1,25 +1,131 @@
 package db
 
 import (
+    "context"
     "database/sql"
     "fmt"
-    "log"
+    "log/slog"
+    "math/rand/v2"
+    "strings"
+    "time"
     _ "github.com/jackc/pgx/v5/stdlib"
     "CipherOps/config"
 )
 
-func InitDB(cfg config.Config) *sql.DB {
-    dsn := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-                        cfg.DBHost, cfg.DBPort, cfg.DBUser, cfg.DBPassword, cfg.DBName)
-    log.Println("BD ENV data: ", dsn)
+var sslModes = map[string]bool{
+    "disable": true, "allow": true, "prefer": true,
+    "require": true, "verify-ca": true, "verify-full": true,
+}
+
+// DSN builds the libpq style connection string pgx understands.
+func DSN(cfg config.Config) (string, error) {
+    if !sslModes[cfg.DBSSLMode] {
+        return "", fmt.Errorf("unknown DB_SSLMODE %q", cfg.DBSSLMode)
+    }
+    if (cfg.DBSSLCert == "") != (cfg.DBSSLKey == "") {
+        return "", fmt.Errorf("DB_SSLCERT and DB_SSLKEY must be set together")
+    }
+    params := [][2]string{
+        {"host", cfg.DBHost},
+        {"port", cfg.DBPort},
+        {"user", cfg.DBUser},
+        {"password", cfg.DBPassword},
+        {"dbname", cfg.DBName},
+        {"sslmode", cfg.DBSSLMode},
+        {"sslrootcert", cfg.DBSSLRootCert},
+        {"sslcert", cfg.DBSSLCert},
+        {"sslkey", cfg.DBSSLKey},
+    }
+    var parts []string
+    for _, p := range params {
+        if p[1] != "" {
+            parts = append(parts, p[0]+"="+quoteDSN(p[1]))
+        }
+    }
+    return strings.Join(parts, " "), nil
+}
+
+// quoteDSN quotes a value so spaces and quotes in passwords survive.
+func quoteDSN(v string) string {
+    v = strings.ReplaceAll(v, `\`, `\\`)
+    v = strings.ReplaceAll(v, `'`, `\'`)
+    return "'" + v + "'"
+}
+
+// Open prepares the pool without connecting.
+func Open(cfg config.Config) (*sql.DB, error) {
+    dsn, err := DSN(cfg)
+    if err != nil {
+        return nil, err
+    }
     db, err := sql.Open("pgx", dsn)
     if err != nil {
-        log.Fatal(err)
+        return nil, err
+    }
+    db.SetMaxOpenConns(cfg.DBMaxOpenConns)
+    db.SetMaxIdleConns(cfg.DBMaxIdleConns)
+    db.SetConnMaxLifetime(cfg.DBConnMaxLifetime)
+    db.SetConnMaxIdleTime(cfg.DBConnMaxIdleTime)
+    return db, nil
+}
+
+// Connect opens the pool and waits until the database answers, retrying
+// with exponential backoff up to cfg.DBConnectAttempts times. It does not
+// touch the schema.
+func Connect(ctx context.Context, cfg config.Config) (*sql.DB, error) {
+    db, err := Open(cfg)
+    if err != nil {
+        return nil, err
+    }
+    slog.Info("connecting to database", "host", cfg.DBHost, "port", cfg.DBPort, "dbname", cfg.DBName, "sslmode", cfg.DBSSLMode)
+    delay := cfg.DBRetryBaseDelay
+    for attempt := 1; ; attempt++ {
+        pingCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+        err = db.PingContext(pingCtx)
+        cancel()
+        if err == nil {
+            slog.Info("connected to the database")
+            return db, nil
+        }
+        if cfg.DBConnectAttempts > 0 && attempt >= cfg.DBConnectAttempts {
+            db.Close()
+            return nil, fmt.Errorf("database unreachable after %d attempts: %w", attempt, err)
+        }
+        // jitter keeps restarted replicas from hitting the database in step
+        wait := delay/2 + rand.N(delay/2+1)
+        slog.Warn("database not reachable", "attempt", attempt, "error", err, "retry_in", wait.Round(time.Millisecond))
+        select {
+        case <-time.After(wait):
+        case <-ctx.Done():
+            db.Close()
+            return nil, ctx.Err()
+        }
+        delay = min(delay*2, cfg.DBRetryMaxDelay)
+    }
+}
+
+// InitDB connects and, when enabled, applies pending migrations.
+func InitDB(ctx context.Context, cfg config.Config) (*sql.DB, error) {
+    db, err := Connect(ctx, cfg)
+    if err != nil {
+        return nil, err
+    }
+    if !cfg.DBAutoMigrate {
+        return db, nil
+    }
+
+    migrator, err := NewMigrator(db)
+    if err != nil {
+        db.Close()
+        return nil, err
+    }
+    applied, err := migrator.Up(ctx, 0)
+    if err != nil {
+        db.Close()
+        return nil, err
     }
-    
-    if err := db.Ping(); err != nil {
-        log.Fatal(err)
+    if len(applied) > 0 {
+        slog.Info("applied migrations", "versions", applied)
     }
-    log.Println("Successfully connected to the database")
-    return db
+    return db, nil
 }
@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"CipherOps/agent"
+	"CipherOps/inventory"
+	"CipherOps/models"
+	"CipherOps/store"
+)
+
+// CreateAgentTokenHandler makes a one-time enrollment token for the agent of
+// a host. The answer has all `cipherops-agent enroll` needs: the token, the
+// URL to dial and the CA certificate to trust. The token is shown only once.
+func CreateAgentTokenHandler(inv *inventory.Inventory, agents *agent.Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		host, ok := hostByName(ctx, inv)
+		if !ok {
+			return
+		}
+		token, t, err := agents.CreateToken(ctx.Request.Context(), host, ctx.GetInt("user_id"))
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		resp := gin.H{
+			"host":       host.Name,
+			"token":      token,
+			"expires_at": t.ExpiresAt,
+			"server":     agents.URL,
+			"ca":         string(agents.CA.CertPEM()),
+		}
+		if host.Address != inventory.AgentAddress {
+			resp["warning"] = "the host's address is not \"agent\", commands keep going over SSH until it is changed"
+		}
+		ctx.JSON(http.StatusCreated, resp)
+	}
+}
+
+// ListAgentsHandler returns the enrolled agents and whether each is
+// connected now.
+func ListAgentsHandler(agents *agent.Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		enrolled, err := agents.Agents.List(ctx.Request.Context())
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		type agentStatus struct {
+			models.Agent
+			Connected bool `json:"connected"`
+		}
+		list := make([]agentStatus, 0, len(enrolled))
+		for _, a := range enrolled {
+			list = append(list, agentStatus{Agent: a, Connected: agents.Connected(a.Host)})
+		}
+		ctx.JSON(http.StatusOK, gin.H{"agents": list})
+	}
+}
+
+// RevokeAgentHandler disowns the certificate of a host's agent and drops
+// its connection.
+func RevokeAgentHandler(inv *inventory.Inventory, agents *agent.Server) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		host, ok := hostByName(ctx, inv)
+		if !ok {
+			return
+		}
+		err := agents.Revoke(ctx.Request.Context(), host)
+		if errors.Is(err, store.ErrNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "no agent enrolled for this host, or already revoked"})
+			return
+		}
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.Status(http.StatusNoContent)
+	}
+}
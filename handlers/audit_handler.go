@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"CipherOps/audit"
+)
+
+// ListAuditHandler queries the audit log. Filters: ?user_id=, ?action=, ?host=,
+// ?since= and ?until= (RFC 3339) and ?limit= (default 100, newest entries).
+func ListAuditHandler(logger *audit.Logger) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		filter, err := auditFilter(ctx, 100)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		entries, err := logger.Query(ctx.Request.Context(), filter)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if entries == nil {
+			entries = []audit.Entry{}
+		}
+		ctx.JSON(http.StatusOK, entries)
+	}
+}
+
+// VerifyAuditHandler checks the hash chain of the whole log. A broken chain
+// answers 409 with the first bad entry.
+func VerifyAuditHandler(logger *audit.Logger) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		res, err := logger.Verify(ctx.Request.Context())
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		status := http.StatusOK
+		if !res.OK {
+			status = http.StatusConflict
+		}
+		ctx.JSON(status, res)
+	}
+}
+
+// ExportAuditHandler streams the log as JSON lines; it takes the same
+// filters as ListAuditHandler but has no default limit.
+func ExportAuditHandler(logger *audit.Logger) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		filter, err := auditFilter(ctx, 0)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.Header("Content-Type", "application/x-ndjson")
+		ctx.Header("Content-Disposition", `attachment; filename="audit-`+time.Now().UTC().Format("20060102T150405Z")+`.jsonl"`)
+		ctx.Status(http.StatusOK)
+		// headers are gone once streaming starts, a failure can only cut the file short
+		if err := logger.Export(ctx.Request.Context(), ctx.Writer, filter); err != nil {
+			ctx.Error(err)
+		}
+	}
+}
+
+func auditFilter(ctx *gin.Context, defaultLimit int) (audit.Filter, error) {
+	filter := audit.Filter{Action: ctx.Query("action"), Host: ctx.Query("host"), Limit: defaultLimit}
+	var err error
+	if v := ctx.Query("user_id"); v != "" {
+		if filter.UserID, err = strconv.Atoi(v); err != nil {
+			return filter, err
+		}
+	}
+	if v := ctx.Query("since"); v != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return filter, err
+		}
+	}
+	if v := ctx.Query("until"); v != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return filter, err
+		}
+	}
+	if v := ctx.Query("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil {
+			return filter, err
+		}
+	}
+	return filter, nil
+}
@@ -0,0 +1,431 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"CipherOps/auth"
+	"CipherOps/models"
+	"CipherOps/store"
+	"CipherOps/utils"
+)
+
+// LoginHandler asks the password providers in order. Users with TOTP enabled
+// get a short-lived pending cookie and are sent to the second step instead of
+// receiving a session.
+func LoginHandler(users store.UserRepository, mfa store.MFARepository, providers []auth.PasswordProvider, throttle *auth.LoginThrottle, sessions *auth.SessionStore) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		username := ctx.PostForm("user")
+		password := ctx.PostForm("pass")
+		ip := ctx.ClientIP()
+
+		if !checkThrottle(ctx, throttle, username, ip) ||
+			!checkProofOfWork(ctx, throttle, ip, ctx.PostForm("pow_challenge"), ctx.PostForm("pow_nonce")) {
+			return
+		}
+
+		identity, err := authenticate(ctx, providers, username, password)
+		if err != nil {
+			recordLoginFailure(ctx, throttle, username, ip, "invalid credentials")
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "invalid username or password"})
+			return
+		}
+		user, err := loginUser(ctx.Request.Context(), users, identity)
+		if errors.Is(err, errUnassignableRole) {
+			slog.Warn("login refused", "username", username, "provider", identity.Provider, "error", err)
+			ctx.JSON(http.StatusForbidden, gin.H{"error": "your directory groups map to a role this panel cannot give, ask an admin"})
+			return
+		}
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if user.TOTPEnabled {
+			// the attempt is recorded once the second factor is checked
+			askSecondFactor(ctx, sessions, user)
+			return
+		}
+
+		if err := throttle.RecordSuccess(ctx.Request.Context(), username, ip); err != nil {
+			slog.Error("cannot record login", "username", username, "ip", ip, "error", err)
+		}
+		startSession(ctx, mfa, sessions, user)
+	}
+}
+
+// askSecondFactor hands out the short-lived cookie of a login waiting for
+// its TOTP or recovery code and sends the browser to that step.
+func askSecondFactor(ctx *gin.Context, sessions *auth.SessionStore, user models.User) {
+	pending := auth.SignSession(sessions.Key, auth.Session{
+		UserID:  user.ID,
+		Role:    user.Role,
+		Stage:   auth.StageMFA,
+		Expires: time.Now().Add(auth.MFAPendingTTL),
+	})
+	ctx.SetCookie(auth.MFACookie, pending, int(auth.MFAPendingTTL.Seconds()), "/login", "", ctx.Request.TLS != nil, true)
+	ctx.Redirect(http.StatusSeeOther, "/login/2fa")
+}
+
+// startSession logs in a user without 2FA. When the role requires 2FA the
+// session only reaches the enrollment until an authenticator is set up.
+func startSession(ctx *gin.Context, mfa store.MFARepository, sessions *auth.SessionStore, user models.User) {
+	required, err := mfa.RequiresMFA(ctx.Request.Context(), user.Role)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if required {
+		if err := setSessionCookie(ctx, sessions, user, auth.StageEnroll); err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.Redirect(http.StatusSeeOther, "/panel/2fa/enroll")
+		return
+	}
+	if err := setSessionCookie(ctx, sessions, user, auth.StageFull); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	ctx.Redirect(http.StatusSeeOther, "/panel")
+}
+
+// LoginMFAHandler is the second login step. It accepts either a TOTP code or
+// one of the user's unused recovery codes.
+func LoginMFAHandler(users store.UserRepository, mfa store.MFARepository, throttle *auth.LoginThrottle, sessions *auth.SessionStore) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		pendingCookie, err := ctx.Cookie(auth.MFACookie)
+		if err != nil {
+			ctx.Redirect(http.StatusSeeOther, "/login")
+			return
+		}
+		pending, err := auth.ParseSession(sessions.Key, pendingCookie)
+		if err != nil || pending.Stage != auth.StageMFA {
+			ctx.SetCookie(auth.MFACookie, "", -1, "/login", "", false, true)
+			ctx.Redirect(http.StatusSeeOther, "/login")
+			return
+		}
+
+		user, err := users.Get(ctx.Request.Context(), pending.UserID)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		username := user.Username
+		ip := ctx.ClientIP()
+		if !checkThrottle(ctx, throttle, username, ip) {
+			return
+		}
+
+		ok, err := verifySecondFactor(ctx.Request.Context(), users, mfa, pending.UserID, ctx.PostForm("code"))
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !ok {
+			recordLoginFailure(ctx, throttle, username, ip, "invalid second factor")
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "invalid authentication code"})
+			return
+		}
+		if err := throttle.RecordSuccess(ctx.Request.Context(), username, ip); err != nil {
+			slog.Error("cannot record login", "username", username, "ip", ip, "error", err)
+		}
+
+		ctx.SetCookie(auth.MFACookie, "", -1, "/login", "", false, true)
+		if err := setSessionCookie(ctx, sessions, models.User{ID: pending.UserID, Role: pending.Role}, auth.StageFull); err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.Redirect(http.StatusSeeOther, "/panel")
+	}
+}
+
+// TOTPEnrollHandler creates a new secret for the current user and returns it
+// with its QR code. 2FA stays disabled until TOTPConfirmHandler sees a valid code.
+func TOTPEnrollHandler(users store.UserRepository, mfa store.MFARepository, issuer string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		userID := ctx.GetInt("user_id")
+
+		user, err := users.Get(ctx.Request.Context(), userID)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if user.TOTPEnabled {
+			ctx.JSON(http.StatusConflict, gin.H{"error": "two-factor authentication is already enabled"})
+			return
+		}
+
+		secret, err := auth.GenerateTOTPSecret()
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := mfa.SetTOTPSecret(ctx.Request.Context(), userID, secret); err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		uri := auth.TOTPURI(issuer, user.Username, secret)
+		png, err := auth.TOTPQRCode(uri)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"secret":      secret,
+			"otpauth_url": uri,
+			"qr_code":     "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+		})
+	}
+}
+
+// TOTPConfirmHandler enables 2FA once the user proves the authenticator works,
+// and returns a fresh set of recovery codes. The codes are not retrievable later.
+func TOTPConfirmHandler(users store.UserRepository, mfa store.MFARepository, sessions *auth.SessionStore) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		userID := ctx.GetInt("user_id")
+		var body struct {
+			Code string `json:"code" binding:"required"`
+		}
+		if err := ctx.ShouldBindJSON(&body); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		user, err := users.Get(ctx.Request.Context(), userID)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if user.TOTPEnabled {
+			ctx.JSON(http.StatusConflict, gin.H{"error": "two-factor authentication is already enabled"})
+			return
+		}
+		if user.TOTPSecret == "" {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "start the enrollment first"})
+			return
+		}
+		step, ok := auth.ValidateTOTP(user.TOTPSecret, body.Code, time.Now())
+		if !ok {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "invalid authentication code"})
+			return
+		}
+
+		codes, hashes, err := newRecoveryCodes()
+		if err == nil {
+			err = mfa.EnableTOTP(ctx.Request.Context(), userID, step, hashes)
+		}
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		// an enroll-only session becomes a full one
+		if ctx.GetString("session_stage") == string(auth.StageEnroll) {
+			if err := sessions.SetStage(ctx.Request.Context(), ctx.GetInt64("session_id"), auth.StageFull); err != nil {
+				ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		ctx.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+	}
+}
+
+// RecoveryCodesHandler replaces all recovery codes of the current user.
+func RecoveryCodesHandler(users store.UserRepository, mfa store.MFARepository) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		userID := ctx.GetInt("user_id")
+		var body struct {
+			Code string `json:"code" binding:"required"`
+		}
+		if err := ctx.ShouldBindJSON(&body); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ok, err := verifySecondFactor(ctx.Request.Context(), users, mfa, userID, body.Code)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !ok {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "invalid authentication code"})
+			return
+		}
+
+		codes, hashes, err := newRecoveryCodes()
+		if err == nil {
+			err = mfa.ReplaceRecoveryCodes(ctx.Request.Context(), userID, hashes)
+		}
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"recovery_codes": codes})
+	}
+}
+
+// TOTPDisableHandler turns 2FA off, unless the user's role requires it.
+func TOTPDisableHandler(users store.UserRepository, mfa store.MFARepository) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		userID := ctx.GetInt("user_id")
+		var body struct {
+			Code string `json:"code" binding:"required"`
+		}
+		if err := ctx.ShouldBindJSON(&body); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		required, err := mfa.RequiresMFA(ctx.Request.Context(), ctx.GetString("role"))
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if required {
+			ctx.JSON(http.StatusForbidden, gin.H{"error": "two-factor authentication is required for your role"})
+			return
+		}
+		ok, err := verifySecondFactor(ctx.Request.Context(), users, mfa, userID, body.Code)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !ok {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "invalid authentication code"})
+			return
+		}
+
+		if err := mfa.DisableTOTP(ctx.Request.Context(), userID); err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"message": "two-factor authentication disabled"})
+	}
+}
+
+// ListMFAPolicyHandler returns the roles for which 2FA is mandatory.
+func ListMFAPolicyHandler(mfa store.MFARepository) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		policy, err := mfa.Policy(ctx.Request.Context())
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, policy)
+	}
+}
+
+// SetMFAPolicyHandler makes 2FA mandatory (or optional) for the role in the URL.
+func SetMFAPolicyHandler(mfa store.MFARepository) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		role := ctx.Param("role")
+		var body struct {
+			RequireMFA bool `json:"require_mfa"`
+		}
+		if err := ctx.ShouldBindJSON(&body); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !utils.CurrentCommandPolicy().IsUserRole(role) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown role %q", role)})
+			return
+		}
+		if err := mfa.SetPolicy(ctx.Request.Context(), role, body.RequireMFA); err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		slog.Info("MFA policy changed", "role", role, "require_mfa", body.RequireMFA, "by_user_id", ctx.GetInt("user_id"))
+		ctx.JSON(http.StatusOK, gin.H{"role": role, "require_mfa": body.RequireMFA})
+	}
+}
+
+// authenticate returns the identity from the first provider accepting the
+// credentials. Providers that fail are logged and skipped so an unreachable
+// directory does not lock out local accounts.
+func authenticate(ctx *gin.Context, providers []auth.PasswordProvider, username, password string) (auth.Identity, error) {
+	for _, provider := range providers {
+		identity, err := provider.Authenticate(ctx.Request.Context(), username, password)
+		if err == nil {
+			return identity, nil
+		}
+		if !errors.Is(err, auth.ErrUnknownUser) && !errors.Is(err, auth.ErrInvalidCredentials) {
+			slog.Warn("auth provider failed", "provider", provider.Name(), "error", err)
+		}
+	}
+	return auth.Identity{}, auth.ErrInvalidCredentials
+}
+
+// errUnassignableRole is returned when an identity provider maps a user to
+// a role no user may hold, see utils.CommandPolicy.IsUserRole.
+var errUnassignableRole = errors.New("role cannot be given to a user")
+
+// checkProviderRole fails with errUnassignableRole for a role no user may
+// hold.
+func checkProviderRole(role string) error {
+	if !utils.CurrentCommandPolicy().IsUserRole(role) {
+		return fmt.Errorf("%w: %q", errUnassignableRole, role)
+	}
+	return nil
+}
+
+// loginUser maps an identity to its panel user. Users of external providers
+// are created on their first login and get their role refreshed afterwards.
+func loginUser(ctx context.Context, users store.UserRepository, identity auth.Identity) (models.User, error) {
+	if identity.UserID != 0 {
+		return users.Get(ctx, identity.UserID)
+	}
+	if err := checkProviderRole(identity.Role); err != nil {
+		return models.User{}, err
+	}
+	user := models.User{Username: identity.Username, Role: identity.Role, AuthProvider: identity.Provider}
+	err := users.SyncExternal(ctx, &user)
+	if errors.Is(err, store.ErrConflict) {
+		return user, fmt.Errorf("username %q belongs to another provider", identity.Username)
+	}
+	return user, err
+}
+
+// verifySecondFactor accepts a TOTP code newer than the last one used, or
+// consumes an unused recovery code.
+func verifySecondFactor(ctx context.Context, users store.UserRepository, mfa store.MFARepository, userID int, code string) (bool, error) {
+	user, err := users.Get(ctx, userID)
+	if err != nil || !user.TOTPEnabled {
+		return false, err
+	}
+	now := time.Now()
+	if step, ok := auth.ValidateTOTP(user.TOTPSecret, code, now); ok && step > user.TOTPLastStep {
+		return mfa.UseTOTPStep(ctx, userID, step)
+	}
+	return mfa.UseRecoveryCode(ctx, userID, auth.HashRecoveryCode(code), now)
+}
+
+// newRecoveryCodes returns fresh plaintext codes and the hashes to store.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes, err := auth.GenerateRecoveryCodes(auth.RecoveryCodeCount)
+	if err != nil {
+		return nil, nil, err
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = auth.HashRecoveryCode(code)
+	}
+	return codes, hashes, nil
+}
+
+// setSessionCookie starts a server-side session and hands its cookie out.
+func setSessionCookie(ctx *gin.Context, sessions *auth.SessionStore, user models.User, stage auth.SessionStage) error {
+	token, err := sessions.Create(ctx.Request.Context(), user.ID, user.Role, stage, ctx.ClientIP(), ctx.Request.UserAgent())
+	if err != nil {
+		return err
+	}
+	ctx.SetCookie(auth.SessionCookie, token, int(auth.SessionTTL.Seconds()), "/", "", ctx.Request.TLS != nil, true)
+	return nil
+}
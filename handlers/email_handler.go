@@ -0,0 +1,304 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+
+	"CipherOps/auth"
+	"CipherOps/mailer"
+	"CipherOps/models"
+	"CipherOps/store"
+)
+
+const (
+	minPasswordLength = 8
+	mailSendTimeout   = 30 * time.Second
+)
+
+// RegisterHandler creates a local account with the default role and mails a
+// verification link to its address.
+func RegisterHandler(users store.UserRepository, tokens *auth.EmailTokens, mail mailer.Mailer, publicURL string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		username := strings.TrimSpace(ctx.PostForm("user"))
+		password := ctx.PostForm("pass")
+		if username == "" {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "username is required"})
+			return
+		}
+		email, err := normalizeEmail(ctx.PostForm("email"))
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err := checkNewPassword(password, ctx.PostForm("confirm")); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		user := models.User{Username: username, Password: string(hash), Role: "user", Email: email}
+		err = users.Create(ctx.Request.Context(), &user)
+		if errors.Is(err, store.ErrConflict) {
+			ctx.JSON(http.StatusConflict, gin.H{"error": "username or email is already registered"})
+			return
+		}
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		slog.Info("user registered", "username", username, "user_id", user.ID)
+
+		// the account exists either way, a failed mail can be resent from the panel
+		if err := sendVerificationMail(ctx.Request.Context(), tokens, mail, publicURL, user.ID, email); err != nil {
+			slog.Error("cannot send verification mail", "user_id", user.ID, "error", err)
+		}
+		ctx.Redirect(http.StatusSeeOther, "/login")
+	}
+}
+
+// SetEmailHandler changes the address of the current user. The new address is
+// unverified until the link mailed to it is opened.
+func SetEmailHandler(users store.UserRepository, tokens *auth.EmailTokens, mail mailer.Mailer, publicURL string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		userID := ctx.GetInt("user_id")
+		var body struct {
+			Email string `json:"email" binding:"required"`
+		}
+		if err := ctx.ShouldBindJSON(&body); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		email, err := normalizeEmail(body.Email)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+
+		err = users.SetEmail(ctx.Request.Context(), userID, email)
+		if errors.Is(err, store.ErrConflict) {
+			ctx.JSON(http.StatusConflict, gin.H{"error": "email is already used by another account"})
+			return
+		}
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := sendVerificationMail(ctx.Request.Context(), tokens, mail, publicURL, userID, email); err != nil {
+			ctx.JSON(http.StatusBadGateway, gin.H{"error": "email saved but the verification mail could not be sent: " + err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"email": email, "email_verified": false})
+	}
+}
+
+// ResendVerificationHandler mails a fresh verification link to the current
+// user's address; earlier links stop working.
+func ResendVerificationHandler(users store.UserRepository, tokens *auth.EmailTokens, mail mailer.Mailer, publicURL string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		userID := ctx.GetInt("user_id")
+		user, err := users.Get(ctx.Request.Context(), userID)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if user.Email == "" {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "no email address set"})
+			return
+		}
+		if user.EmailVerified {
+			ctx.JSON(http.StatusConflict, gin.H{"error": "email is already verified"})
+			return
+		}
+		if err := sendVerificationMail(ctx.Request.Context(), tokens, mail, publicURL, userID, user.Email); err != nil {
+			ctx.JSON(http.StatusBadGateway, gin.H{"error": "cannot send verification mail: " + err.Error()})
+			return
+		}
+		ctx.Status(http.StatusNoContent)
+	}
+}
+
+// VerifyEmailHandler is the target of the verification link. The token only
+// verifies the address it was sent to, so changing the email in between
+// voids it.
+func VerifyEmailHandler(users store.UserRepository, tokens *auth.EmailTokens) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		userID, email, err := tokens.Consume(ctx.Request.Context(), auth.PurposeVerifyEmail, ctx.Query("token"))
+		if errors.Is(err, auth.ErrInvalidEmailToken) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		err = users.VerifyEmail(ctx.Request.Context(), userID, email)
+		if errors.Is(err, store.ErrNotFound) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": auth.ErrInvalidEmailToken.Error()})
+			return
+		}
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.Redirect(http.StatusSeeOther, "/login")
+	}
+}
+
+// ForgotPasswordHandler mails a reset link if the address belongs to a local
+// account. The answer is the same whether or not it does, and the mail is
+// sent in the background so the response time does not tell either.
+func ForgotPasswordHandler(users store.UserRepository, tokens *auth.EmailTokens, mail mailer.Mailer, publicURL string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		email, err := normalizeEmail(ctx.PostForm("email"))
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		response := gin.H{"message": "if the address belongs to an account, a reset link has been sent"}
+
+		user, err := users.GetByEmail(ctx.Request.Context(), email)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		// accounts of LDAP and SSO users have no password here to reset
+		if err != nil || user.AuthProvider != "local" {
+			ctx.JSON(http.StatusOK, response)
+			return
+		}
+
+		go func() {
+			sendCtx, cancel := context.WithTimeout(context.Background(), mailSendTimeout)
+			defer cancel()
+			token, err := tokens.Issue(sendCtx, user.ID, auth.PurposeResetPassword, email)
+			if err != nil {
+				slog.Error("cannot issue password reset token", "user_id", user.ID, "error", err)
+				return
+			}
+			err = mail.Send(sendCtx, mailer.Message{
+				To:      email,
+				Subject: "Reset your CipherOps password",
+				Body: fmt.Sprintf("Hello %s,\n\nsomeone asked to reset the password of your account. "+
+					"Open this link to choose a new one:\n\n%s\n\nThe link works once and expires in %s. "+
+					"If you did not ask for it, ignore this mail.\n",
+					user.Username, linkURL(publicURL, "/reset-password", token), tokens.ResetTTL),
+			})
+			if err != nil {
+				slog.Error("cannot send password reset mail", "user_id", user.ID, "error", err)
+			}
+		}()
+		ctx.JSON(http.StatusOK, response)
+	}
+}
+
+// ResetPasswordHandler sets a new password with a token from the reset mail,
+// ends all sessions of the account and lifts its lockout.
+func ResetPasswordHandler(users store.UserRepository, tokens *auth.EmailTokens, throttle *auth.LoginThrottle, sessions *auth.SessionStore) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		password := ctx.PostForm("pass")
+		if err := checkNewPassword(password, ctx.PostForm("confirm")); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		userID, email, err := tokens.Consume(ctx.Request.Context(), auth.PurposeResetPassword, ctx.PostForm("token"))
+		if errors.Is(err, auth.ErrInvalidEmailToken) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		user, err := users.Get(ctx.Request.Context(), userID)
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil || user.AuthProvider != "local" {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": auth.ErrInvalidEmailToken.Error()})
+			return
+		}
+		if err := users.SetPassword(ctx.Request.Context(), userID, string(hash)); err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		// receiving the link proves the address, unless it changed meanwhile
+		if !user.EmailVerified && strings.EqualFold(user.Email, email) {
+			if err := users.VerifyEmail(ctx.Request.Context(), userID, email); err != nil && !errors.Is(err, store.ErrNotFound) {
+				slog.Error("cannot verify email after password reset", "user_id", userID, "error", err)
+			}
+		}
+		username := user.Username
+		if _, err := sessions.RevokeAll(ctx.Request.Context(), userID); err != nil {
+			slog.Error("cannot end sessions after password reset", "user_id", userID, "error", err)
+		}
+		if _, err := throttle.Unlock(ctx.Request.Context(), username); err != nil {
+			slog.Error("cannot clear lockout after password reset", "username", username, "error", err)
+		}
+		slog.Info("password reset by email", "username", username, "user_id", userID)
+		ctx.Redirect(http.StatusSeeOther, "/login")
+	}
+}
+
+func sendVerificationMail(ctx context.Context, tokens *auth.EmailTokens, mail mailer.Mailer, publicURL string, userID int, email string) error {
+	ctx, cancel := context.WithTimeout(ctx, mailSendTimeout)
+	defer cancel()
+	token, err := tokens.Issue(ctx, userID, auth.PurposeVerifyEmail, email)
+	if err != nil {
+		return err
+	}
+	return mail.Send(ctx, mailer.Message{
+		To:      email,
+		Subject: "Verify your CipherOps email address",
+		Body: fmt.Sprintf("Hello,\n\nplease confirm that this address belongs to your CipherOps account:\n\n%s\n\n"+
+			"The link expires in %s.\n", linkURL(publicURL, "/verify-email", token), tokens.VerifyTTL),
+	})
+}
+
+func linkURL(publicURL, path, token string) string {
+	return strings.TrimRight(publicURL, "/") + path + "?token=" + url.QueryEscape(token)
+}
+
+// normalizeEmail accepts a bare address, no display name.
+func normalizeEmail(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	addr, err := mail.ParseAddress(s)
+	if err != nil || addr.Address != s {
+		return "", errors.New("invalid email address")
+	}
+	return s, nil
+}
+
+func checkNewPassword(password, confirm string) error {
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("password must have at least %d characters", minPasswordLength)
+	}
+	// bcrypt ignores everything after 72 bytes
+	if len(password) > 72 {
+		return errors.New("password must not be longer than 72 bytes")
+	}
+	if password != confirm {
+		return errors.New("passwords do not match")
+	}
+	return nil
+}
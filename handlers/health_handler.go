@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"CipherOps/store"
+)
+
+// DBHealthHandler is the database probe for load balancers and monitoring.
+// It answers 503 while the database does not respond; a nil st means the
+// server runs in maintenance mode.
+func DBHealthHandler(st store.Store) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if st == nil {
+			ctx.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "error": "database not connected"})
+			return
+		}
+		pingCtx, cancel := context.WithTimeout(ctx.Request.Context(), 2*time.Second)
+		defer cancel()
+		start := time.Now()
+		if err := st.Ping(pingCtx); err != nil {
+			// the probe is public, the driver error names hosts and users
+			slog.Warn("database health check failed", "error", err)
+			ctx.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "error": "database not responding"})
+			return
+		}
+		stats := st.Stats()
+		ctx.JSON(http.StatusOK, gin.H{
+			"status":     "ok",
+			"latency_ms": time.Since(start).Milliseconds(),
+			"pool": gin.H{
+				"open":       stats.OpenConnections,
+				"in_use":     stats.InUse,
+				"idle":       stats.Idle,
+				"wait_count": stats.WaitCount,
+			},
+		})
+	}
+}
@@ -0,0 +1,336 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+
+	"CipherOps/inventory"
+	"CipherOps/jobs"
+	"CipherOps/models"
+	"CipherOps/store"
+	"CipherOps/utils"
+)
+
+var inventoryName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,62}$`)
+
+type hostBody struct {
+	Address string            `json:"address" binding:"required"`
+	Port    int               `json:"port"`
+	User    string            `json:"user"`
+	Labels  map[string]string `json:"labels"`
+}
+
+func (b *hostBody) host(name string) (models.Host, error) {
+	if b.Port == 0 {
+		b.Port = 22
+	}
+	if b.Port < 1 || b.Port > 65535 {
+		return models.Host{}, errors.New("port must be between 1 and 65535")
+	}
+	return models.Host{Name: name, Address: b.Address, Port: b.Port, User: b.User, Labels: b.Labels}, nil
+}
+
+// ListHostsHandler returns the managed hosts with their groups and facts.
+func ListHostsHandler(inv *inventory.Inventory) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		hosts, err := inv.Hosts.List(ctx.Request.Context())
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"hosts": hosts})
+	}
+}
+
+// CreateHostHandler adds a host. The address "local" is the panel's own
+// machine and "agent" a host reached through its agent; facts are gathered on the next refresh or through RefreshFactsHandler.
+func CreateHostHandler(inv *inventory.Inventory) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var body struct {
+			Name string `json:"name" binding:"required"`
+			hostBody
+		}
+		if err := ctx.ShouldBindJSON(&body); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !inventoryName.MatchString(body.Name) || body.Name == "all" {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "host names are letters, digits, '.', '_' and '-'"})
+			return
+		}
+		host, err := body.host(body.Name)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		err = inv.Hosts.Create(ctx.Request.Context(), &host)
+		if errors.Is(err, store.ErrConflict) {
+			ctx.JSON(http.StatusConflict, gin.H{"error": "a host with this name exists"})
+			return
+		}
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		host.Groups = []string{}
+		ctx.JSON(http.StatusCreated, host)
+	}
+}
+
+// UpdateHostHandler changes the address, port, user and labels of a host.
+func UpdateHostHandler(inv *inventory.Inventory) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var body hostBody
+		if err := ctx.ShouldBindJSON(&body); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		current, ok := hostByName(ctx, inv)
+		if !ok {
+			return
+		}
+		host, err := body.host(current.Name)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		host.ID = current.ID
+		if err := inv.Hosts.Update(ctx.Request.Context(), host); err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		host.Groups, host.Facts, host.CreatedAt = current.Groups, current.Facts, current.CreatedAt
+		ctx.JSON(http.StatusOK, host)
+	}
+}
+
+// DeleteHostHandler removes a host from the inventory and its groups.
+func DeleteHostHandler(inv *inventory.Inventory) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		host, ok := hostByName(ctx, inv)
+		if !ok {
+			return
+		}
+		if err := inv.Hosts.Delete(ctx.Request.Context(), host.ID); err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.Status(http.StatusNoContent)
+	}
+}
+
+func hostByName(ctx *gin.Context, inv *inventory.Inventory) (models.Host, bool) {
+	host, err := inv.Hosts.GetByName(ctx.Request.Context(), ctx.Param("name"))
+	if errors.Is(err, store.ErrNotFound) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "host not found"})
+		return host, false
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return host, false
+	}
+	return host, true
+}
+
+// ListHostGroupsHandler returns the groups with their hosts.
+func ListHostGroupsHandler(inv *inventory.Inventory) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		groups, err := inv.Hosts.ListGroups(ctx.Request.Context())
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"groups": groups})
+	}
+}
+
+func CreateHostGroupHandler(inv *inventory.Inventory) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var body struct {
+			Name string `json:"name" binding:"required"`
+		}
+		if err := ctx.ShouldBindJSON(&body); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !inventoryName.MatchString(body.Name) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "group names are letters, digits, '.', '_' and '-'"})
+			return
+		}
+		group := models.HostGroup{Name: body.Name}
+		err := inv.Hosts.CreateGroup(ctx.Request.Context(), &group)
+		if errors.Is(err, store.ErrConflict) {
+			ctx.JSON(http.StatusConflict, gin.H{"error": "a group with this name exists"})
+			return
+		}
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusCreated, group)
+	}
+}
+
+func DeleteHostGroupHandler(inv *inventory.Inventory) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		err := inv.Hosts.DeleteGroup(ctx.Request.Context(), ctx.Param("group"))
+		if errors.Is(err, store.ErrNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "group not found"})
+			return
+		}
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.Status(http.StatusNoContent)
+	}
+}
+
+// AddGroupHostHandler puts a host into a group.
+func AddGroupHostHandler(inv *inventory.Inventory) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		err := inv.Hosts.AddToGroup(ctx.Request.Context(), ctx.Param("group"), ctx.Param("name"))
+		switch {
+		case errors.Is(err, store.ErrNotFound):
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "group or host not found"})
+		case errors.Is(err, store.ErrConflict):
+			ctx.Status(http.StatusNoContent)
+		case err != nil:
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		default:
+			ctx.Status(http.StatusNoContent)
+		}
+	}
+}
+
+// RemoveGroupHostHandler takes a host out of a group.
+func RemoveGroupHostHandler(inv *inventory.Inventory) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		err := inv.Hosts.RemoveFromGroup(ctx.Request.Context(), ctx.Param("group"), ctx.Param("name"))
+		if errors.Is(err, store.ErrNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "host is not in the group"})
+			return
+		}
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.Status(http.StatusNoContent)
+	}
+}
+
+// The fleet handlers take a target, see inventory.Inventory.Resolve, and
+// answer with one result per host. The request fails as a whole only when
+// the target does not resolve.
+
+// RefreshFactsHandler gathers the facts of the target hosts now.
+func RefreshFactsHandler(inv *inventory.Inventory) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var body struct {
+			Target string `json:"target" binding:"required"`
+		}
+		if err := ctx.ShouldBindJSON(&body); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		hosts, ok := resolveTarget(ctx, inv, body.Target)
+		if !ok {
+			return
+		}
+		fleetResults(ctx, inv.RefreshFacts(ctx.Request.Context(), hosts))
+	}
+}
+
+// FleetPackagesHandler queues a job that installs or removes programs, by
+// the abstract names of utils.PackageMap, on the target hosts, and answers
+// 202 with the job; see inventory.PackagesJob. The target is checked now and
+// resolved again when the job runs.
+func FleetPackagesHandler(inv *inventory.Inventory, q *jobs.Queue) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var body struct {
+			Target   string   `json:"target" binding:"required"`
+			Action   string   `json:"action" binding:"required,oneof=install remove"`
+			Programs []string `json:"programs" binding:"required,min=1"`
+		}
+		if err := ctx.ShouldBindJSON(&body); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if _, ok := resolveTarget(ctx, inv, body.Target); !ok {
+			return
+		}
+		job, err := q.Enqueue(ctx.Request.Context(), inventory.JobFleetPackages, inventory.PackagesPayload{
+			Target: body.Target, Action: body.Action, Programs: body.Programs,
+		})
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		jobAccepted(ctx, job)
+	}
+}
+
+// FleetServicesHandler starts, stops, restarts, enables, disables or checks
+// a service on the target hosts.
+func FleetServicesHandler(inv *inventory.Inventory) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var body struct {
+			Target  string `json:"target" binding:"required"`
+			Action  string `json:"action" binding:"required,oneof=start stop restart enable disable status"`
+			Service string `json:"service" binding:"required"`
+		}
+		if err := ctx.ShouldBindJSON(&body); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if !inventoryName.MatchString(body.Service) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid service name"})
+			return
+		}
+		fanOut(ctx, inv, body.Target, func(c context.Context, h models.Host, e utils.Executor) (any, error) {
+			sm, err := inventory.ServiceManager(h, e)
+			if err != nil {
+				return nil, err
+			}
+			if body.Action == "status" {
+				return sm.Status(c, body.Service)
+			}
+			return nil, utils.ServiceAction(c, sm, body.Action, body.Service)
+		})
+	}
+}
+
+func fanOut(ctx *gin.Context, inv *inventory.Inventory, target string, action inventory.Action) {
+	hosts, ok := resolveTarget(ctx, inv, target)
+	if !ok {
+		return
+	}
+	fleetResults(ctx, inv.FanOut(ctx.Request.Context(), hosts, action))
+}
+
+func resolveTarget(ctx *gin.Context, inv *inventory.Inventory, target string) ([]models.Host, bool) {
+	hosts, err := inv.Resolve(ctx.Request.Context(), target)
+	if errors.Is(err, store.ErrNotFound) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return hosts, true
+}
+
+func fleetResults(ctx *gin.Context, results []inventory.Result) {
+	failed := 0
+	for _, res := range results {
+		if !res.OK {
+			failed++
+		}
+	}
+	ctx.JSON(http.StatusOK, gin.H{"results": results, "failed": failed})
+}
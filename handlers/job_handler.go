@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+
+	"CipherOps/jobs"
+	"CipherOps/models"
+	"CipherOps/store"
+)
+
+// how often the event stream looks for new output and progress
+const jobPollInterval = 500 * time.Millisecond
+
+// ListJobsHandler returns the newest jobs. Filters: ?status=, ?kind= and
+// ?limit= (default 50).
+func ListJobsHandler(q *jobs.Queue) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		filter := store.JobFilter{Status: ctx.Query("status"), Kind: ctx.Query("kind"), Limit: 50}
+		if v := ctx.Query("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive number"})
+				return
+			}
+			filter.Limit = n
+		}
+		list, err := q.Jobs.List(ctx.Request.Context(), filter)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"jobs": list})
+	}
+}
+
+// GetJobHandler returns a job with its status, progress and result.
+func GetJobHandler(q *jobs.Queue) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if job, ok := jobByID(ctx, q); ok {
+			ctx.JSON(http.StatusOK, job)
+		}
+	}
+}
+
+// JobLogsHandler returns the output of a job: up to ?limit= lines (default
+// 1000) after the line with id ?after=.
+func JobLogsHandler(q *jobs.Queue) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		job, ok := jobByID(ctx, q)
+		if !ok {
+			return
+		}
+		after, _ := strconv.ParseInt(ctx.Query("after"), 10, 64)
+		limit, err := strconv.Atoi(ctx.DefaultQuery("limit", "1000"))
+		if err != nil || limit < 1 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a positive number"})
+			return
+		}
+		lines, err := q.Jobs.Logs(ctx.Request.Context(), job.ID, after, limit)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"lines": lines})
+	}
+}
+
+// JobEventsHandler streams a job as server-sent events: "log" for each line
+// of output, with the line id as event id so a reconnecting EventSource
+// resumes through Last-Event-ID, "progress" with the job whenever its
+// status or progress changes, and a last "done" with the ended job.
+func JobEventsHandler(q *jobs.Queue) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		job, ok := jobByID(ctx, q)
+		if !ok {
+			return
+		}
+		after, _ := strconv.ParseInt(ctx.GetHeader("Last-Event-ID"), 10, 64)
+		ctx.Header("Cache-Control", "no-cache")
+		ctx.Header("X-Accel-Buffering", "no")
+
+		rctx := ctx.Request.Context()
+		var last models.Job
+		first := true
+		ticker := time.NewTicker(jobPollInterval)
+		defer ticker.Stop()
+		ctx.Stream(func(w io.Writer) bool {
+			if !first {
+				select {
+				case <-rctx.Done():
+					return false
+				case <-ticker.C:
+				}
+				var err error
+				if job, err = q.Jobs.Get(rctx, job.ID); err != nil {
+					ctx.SSEvent("error", gin.H{"error": err.Error()})
+					return false
+				}
+			}
+			// read after the job, so no line written before it ended is missed
+			for {
+				lines, err := q.Jobs.Logs(rctx, job.ID, after, 500)
+				if err != nil {
+					ctx.SSEvent("error", gin.H{"error": err.Error()})
+					return false
+				}
+				for _, l := range lines {
+					ctx.Render(-1, sse.Event{Event: "log", Id: strconv.FormatInt(l.ID, 10), Data: l})
+					after = l.ID
+				}
+				if len(lines) < 500 {
+					break
+				}
+			}
+			if first || job.Status != last.Status || job.Progress != last.Progress ||
+				job.ProgressMessage != last.ProgressMessage || job.CancelRequested != last.CancelRequested {
+				ctx.SSEvent("progress", job)
+			}
+			first, last = false, job
+			if job.Final() {
+				ctx.SSEvent("done", job)
+				return false
+			}
+			return true
+		})
+	}
+}
+
+// CancelJobHandler cancels a queued or running job. A job that has already
+// ended answers 409.
+func CancelJobHandler(q *jobs.Queue) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid job id"})
+			return
+		}
+		job, err := q.Cancel(ctx.Request.Context(), id)
+		switch {
+		case errors.Is(err, store.ErrNotFound):
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "job not found"})
+		case errors.Is(err, store.ErrConflict):
+			ctx.JSON(http.StatusConflict, gin.H{"error": "job has already ended", "job": job})
+		case err != nil:
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		default:
+			ctx.JSON(http.StatusAccepted, job)
+		}
+	}
+}
+
+// jobAccepted answers a request whose work was queued as job.
+func jobAccepted(ctx *gin.Context, job models.Job) {
+	ctx.Header("Location", "/admin/jobs/"+strconv.FormatInt(job.ID, 10))
+	ctx.JSON(http.StatusAccepted, gin.H{"job": job})
+}
+
+func jobByID(ctx *gin.Context, q *jobs.Queue) (models.Job, bool) {
+	id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid job id"})
+		return models.Job{}, false
+	}
+	job, err := q.Jobs.Get(ctx.Request.Context(), id)
+	if errors.Is(err, store.ErrNotFound) {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "job not found"})
+		return job, false
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return job, false
+	}
+	return job, true
+}
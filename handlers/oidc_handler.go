@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+
+	"CipherOps/auth"
+	"CipherOps/models"
+	"CipherOps/store"
+)
+
+const oidcFlowTTL = 10 * time.Minute
+
+// OIDCLoginHandler redirects to the identity provider. State, nonce and the
+// PKCE verifier stay in a signed cookie until the callback.
+func OIDCLoginHandler(provider *auth.OIDCProvider, key []byte) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		state, err := auth.RandomToken(24)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		nonce, err := auth.RandomToken(24)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		verifier := oauth2.GenerateVerifier()
+
+		flow := auth.SignValue(key, strings.Join([]string{state, nonce, verifier}, "|"), oidcFlowTTL)
+		ctx.SetCookie(auth.OIDCCookie, flow, int(oidcFlowTTL.Seconds()), "/login/oidc", "", ctx.Request.TLS != nil, true)
+		ctx.Redirect(http.StatusFound, provider.AuthCodeURL(state, nonce, verifier))
+	}
+}
+
+// OIDCCallbackHandler finishes the code flow, provisions the user on first
+// login and refreshes its role from the group claims on every login.
+func OIDCCallbackHandler(users store.UserRepository, mfa store.MFARepository, provider *auth.OIDCProvider, sessions *auth.SessionStore) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		flowCookie, err := ctx.Cookie(auth.OIDCCookie)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "no pending SSO login"})
+			return
+		}
+		ctx.SetCookie(auth.OIDCCookie, "", -1, "/login/oidc", "", false, true)
+		flow, err := auth.VerifyValue(sessions.Key, flowCookie)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "SSO login expired, try again"})
+			return
+		}
+		parts := strings.Split(flow, "|")
+		if len(parts) != 3 || ctx.Query("state") != parts[0] {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "SSO state mismatch"})
+			return
+		}
+		if idpErr := ctx.Query("error"); idpErr != "" {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "identity provider refused the login: " + idpErr})
+			return
+		}
+
+		identity, err := provider.Exchange(ctx.Request.Context(), ctx.Query("code"), parts[1], parts[2])
+		if err != nil {
+			slog.Warn("OIDC login failed", "issuer", provider.Issuer, "error", err)
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "SSO login failed"})
+			return
+		}
+		user, err := provisionOIDCUser(ctx.Request.Context(), users, provider.Issuer, identity, provider.Role(identity))
+		if errors.Is(err, errUnassignableRole) {
+			slog.Warn("SSO login refused", "issuer", provider.Issuer, "username", identity.Username, "error", err)
+			ctx.JSON(http.StatusForbidden, gin.H{"error": "your groups map to a role this panel cannot give, ask an admin"})
+			return
+		}
+		if err != nil {
+			ctx.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+
+		// the panel's 2FA policy applies whatever the IdP checked
+		if user.TOTPEnabled {
+			askSecondFactor(ctx, sessions, user)
+			return
+		}
+		startSession(ctx, mfa, sessions, user)
+	}
+}
+
+// provisionOIDCUser finds the user linked to the issuer and subject or creates
+// it. Existing local accounts with the same name are never linked
+// automatically, that would let the IdP take over any local account. A role
+// no user may hold fails with errUnassignableRole.
+func provisionOIDCUser(ctx context.Context, users store.UserRepository, issuer string, identity auth.OIDCIdentity, role string) (models.User, error) {
+	if err := checkProviderRole(role); err != nil {
+		return models.User{}, err
+	}
+	user, err := users.GetByOIDC(ctx, issuer, identity.Subject)
+	if err == nil {
+		user.Role = role
+		return user, users.SetRole(ctx, user.ID, role)
+	}
+	if !errors.Is(err, store.ErrNotFound) {
+		return user, err
+	}
+
+	// an empty password hash never matches, so these users cannot log in locally
+	user = models.User{
+		Username:     identity.Username,
+		Role:         role,
+		AuthProvider: "oidc",
+		OIDCIssuer:   issuer,
+		OIDCSubject:  identity.Subject,
+	}
+	err = users.Create(ctx, &user)
+	if errors.Is(err, store.ErrConflict) {
+		return user, fmt.Errorf("username %q is already used by another account", identity.Username)
+	}
+	if err == nil {
+		slog.Info("SSO user provisioned", "username", user.Username, "user_id", user.ID, "role", role, "issuer", issuer)
+	}
+	return user, err
+}
@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"CipherOps/auth"
+	"CipherOps/auth/oidctest"
+	"CipherOps/models"
+	"CipherOps/store"
+)
+
+type oidcEnv struct {
+	idp   *oidctest.Server
+	panel *httptest.Server
+	st    store.Store
+}
+
+// newOIDCEnv runs the SSO routes of the panel against the mock IdP. Members
+// of the ops group become admins, of robots the internal system role (a
+// mistake the panel must refuse), everybody else a user.
+func newOIDCEnv(t *testing.T) *oidcEnv {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	idp, err := oidctest.NewServer("panel", "secret", "sub-1", map[string]any{
+		"preferred_username": "alice",
+		"groups":             []string{"ops"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(idp.Close)
+	st, err := store.OpenSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+
+	// the redirect URL needs the panel's address before the routes exist
+	panel := httptest.NewServer(nil)
+	t.Cleanup(panel.Close)
+	provider, err := auth.NewOIDCProvider(context.Background(), idp.URL, "panel", "secret",
+		panel.URL+"/login/oidc/callback", "groups", "ops=admin,robots=system", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := []byte("0123456789abcdef0123456789abcdef")
+	sessions := &auth.SessionStore{Store: st, Key: key}
+	router := gin.New()
+	router.GET("/login/oidc", OIDCLoginHandler(provider, key))
+	router.GET("/login/oidc/callback", OIDCCallbackHandler(st.Users(), st.MFA(), provider, sessions))
+	panel.Config.Handler = router
+	return &oidcEnv{idp: idp, panel: panel, st: st}
+}
+
+// client returns a browser with its own cookies that stops at the first
+// redirect.
+func (e *oidcEnv) client(t *testing.T) *http.Client {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{
+		Jar: jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func get(t *testing.T, c *http.Client, u string) *http.Response {
+	t.Helper()
+	resp, err := c.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+// authorize starts a login and returns the callback URL the IdP sends the
+// browser back to.
+func (e *oidcEnv) authorize(t *testing.T, c *http.Client) *url.URL {
+	t.Helper()
+	resp := get(t, c, e.panel.URL+"/login/oidc")
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("login start: %s", resp.Status)
+	}
+	resp = get(t, c, resp.Header.Get("Location"))
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorization: %s", resp.Status)
+	}
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return callback
+}
+
+// login runs the whole flow and returns the callback's response.
+func (e *oidcEnv) login(t *testing.T) *http.Response {
+	t.Helper()
+	c := e.client(t)
+	return get(t, c, e.authorize(t, c).String())
+}
+
+func TestOIDCCallbackRejectsStateMismatch(t *testing.T) {
+	e := newOIDCEnv(t)
+	c := e.client(t)
+	callback := e.authorize(t, c)
+	q := callback.Query()
+	q.Set("state", "forged")
+	callback.RawQuery = q.Encode()
+
+	if resp := get(t, c, callback.String()); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("forged state: %s, want 400", resp.Status)
+	}
+	if users, _ := e.st.Users().List(context.Background()); len(users) != 0 {
+		t.Errorf("provisioned %+v", users)
+	}
+}
+
+func TestOIDCCallbackRejectsPKCEMismatch(t *testing.T) {
+	e := newOIDCEnv(t)
+	c := e.client(t)
+	first := e.authorize(t, c)
+	// the second login replaces the flow cookie and with it the verifier
+	second := e.authorize(t, c)
+	q := second.Query()
+	q.Set("code", first.Query().Get("code"))
+	second.RawQuery = q.Encode()
+
+	if resp := get(t, c, second.String()); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("code of another flow: %s, want 401", resp.Status)
+	}
+}
+
+func TestOIDCCallbackProvisionsAndMapsRoles(t *testing.T) {
+	e := newOIDCEnv(t)
+	ctx := context.Background()
+
+	resp := e.login(t)
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/panel" {
+		t.Fatalf("login: %s to %q", resp.Status, resp.Header.Get("Location"))
+	}
+	alice, err := e.st.Users().GetByOIDC(ctx, e.idp.URL, "sub-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if alice.Username != "alice" || alice.Role != "admin" || alice.AuthProvider != "oidc" {
+		t.Errorf("provisioned %+v, want the admin alice", alice)
+	}
+
+	// the role follows the groups on every login
+	e.idp.Claims["groups"] = []string{"dev"}
+	if resp := e.login(t); resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("second login: %s", resp.Status)
+	}
+	again, err := e.st.Users().GetByOIDC(ctx, e.idp.URL, "sub-1")
+	if err != nil || again.ID != alice.ID || again.Role != "user" {
+		t.Errorf("after the second login %+v, %v; want the same user with the default role", again, err)
+	}
+}
+
+func TestOIDCCallbackRefusesInternalRoles(t *testing.T) {
+	e := newOIDCEnv(t)
+	e.idp.Claims["groups"] = []string{"robots"}
+
+	if resp := e.login(t); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("login mapped to the system role: %s, want 403", resp.Status)
+	}
+	if users, _ := e.st.Users().List(context.Background()); len(users) != 0 {
+		t.Errorf("provisioned %+v", users)
+	}
+}
+
+func TestOIDCCallbackKeepsLocalAccounts(t *testing.T) {
+	e := newOIDCEnv(t)
+	ctx := context.Background()
+	bob := models.User{Username: "bob", Password: "hash", Role: "user"}
+	if err := e.st.Users().Create(ctx, &bob); err != nil {
+		t.Fatal(err)
+	}
+	e.idp.Subject = "sub-2"
+	e.idp.Claims["preferred_username"] = "bob"
+
+	if resp := e.login(t); resp.StatusCode != http.StatusConflict {
+		t.Errorf("login as a local username: %s, want 409", resp.Status)
+	}
+	if _, err := e.st.Users().GetByOIDC(ctx, e.idp.URL, "sub-2"); !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("linked the local account: %v", err)
+	}
+	if got, _ := e.st.Users().Get(ctx, bob.ID); got.AuthProvider != "local" || got.Role != "user" {
+		t.Errorf("the local account changed to %+v", got)
+	}
+}
+
+func TestOIDCCallbackAppliesMFAPolicy(t *testing.T) {
+	e := newOIDCEnv(t)
+	ctx := context.Background()
+	if err := e.st.MFA().SetPolicy(ctx, "admin", true); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := e.login(t)
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/panel/2fa/enroll" {
+		t.Fatalf("login without an authenticator: %s to %q, want the enrollment", resp.Status, resp.Header.Get("Location"))
+	}
+
+	alice, err := e.st.Users().GetByOIDC(ctx, e.idp.URL, "sub-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.st.MFA().SetTOTPSecret(ctx, alice.ID, "SECRET"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.st.MFA().EnableTOTP(ctx, alice.ID, 1, nil); err != nil {
+		t.Fatal(err)
+	}
+	resp = e.login(t)
+	if resp.StatusCode != http.StatusSeeOther || resp.Header.Get("Location") != "/login/2fa" {
+		t.Errorf("login with TOTP: %s to %q, want the second step", resp.Status, resp.Header.Get("Location"))
+	}
+	for _, c := range resp.Cookies() {
+		if c.Name == auth.SessionCookie && c.MaxAge >= 0 {
+			t.Error("handed out a session before the second factor")
+		}
+	}
+}
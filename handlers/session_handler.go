@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"CipherOps/auth"
+	"CipherOps/store"
+	"CipherOps/utils"
+)
+
+// ListSessionsHandler lists the active sessions of the current user.
+func ListSessionsHandler(sessions *auth.SessionStore) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		list, err := sessions.List(ctx.Request.Context(), ctx.GetInt("user_id"), ctx.GetInt64("session_id"))
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, list)
+	}
+}
+
+// RevokeSessionHandler ends one of the current user's sessions.
+func RevokeSessionHandler(sessions *auth.SessionStore) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id, err := strconv.ParseInt(ctx.Param("id"), 10, 64)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid session id"})
+			return
+		}
+		found, err := sessions.Revoke(ctx.Request.Context(), ctx.GetInt("user_id"), id)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !found {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+			return
+		}
+		if id == ctx.GetInt64("session_id") {
+			ctx.SetCookie(auth.SessionCookie, "", -1, "/", "", false, true)
+		}
+		ctx.Status(http.StatusNoContent)
+	}
+}
+
+// RevokeOtherSessionsHandler logs the current user out everywhere else.
+func RevokeOtherSessionsHandler(sessions *auth.SessionStore) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		n, err := sessions.RevokeOthers(ctx.Request.Context(), ctx.GetInt("user_id"), ctx.GetInt64("session_id"))
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"revoked": n})
+	}
+}
+
+// LogoutHandler ends the current session.
+func LogoutHandler(sessions *auth.SessionStore) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if _, err := sessions.Revoke(ctx.Request.Context(), ctx.GetInt("user_id"), ctx.GetInt64("session_id")); err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.SetCookie(auth.SessionCookie, "", -1, "/", "", false, true)
+		ctx.Redirect(http.StatusSeeOther, "/login")
+	}
+}
+
+// ListUserSessionsHandler shows an admin the active sessions of any user.
+func ListUserSessionsHandler(sessions *auth.SessionStore) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		userID, err := strconv.Atoi(ctx.Param("id"))
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+			return
+		}
+		list, err := sessions.List(ctx.Request.Context(), userID, ctx.GetInt64("session_id"))
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, list)
+	}
+}
+
+// ForceLogoutHandler lets an admin end every session of a user.
+func ForceLogoutHandler(sessions *auth.SessionStore) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		userID, err := strconv.Atoi(ctx.Param("id"))
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+			return
+		}
+		n, err := sessions.RevokeAll(ctx.Request.Context(), userID)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		slog.Info("user logged out", "user_id", userID, "sessions", n, "by_user_id", ctx.GetInt("user_id"))
+		ctx.JSON(http.StatusOK, gin.H{"revoked": n})
+	}
+}
+
+// SetUserRoleHandler changes the role of a user and ends its sessions, so the
+// user logs in again under the new role and its MFA policy.
+func SetUserRoleHandler(users store.UserRepository, sessions *auth.SessionStore) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		userID, err := strconv.Atoi(ctx.Param("id"))
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+			return
+		}
+		var body struct {
+			Role string `json:"role" binding:"required"`
+		}
+		if err := ctx.ShouldBindJSON(&body); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if userID == ctx.GetInt("user_id") {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "admins cannot change their own role"})
+			return
+		}
+		if !utils.CurrentCommandPolicy().IsUserRole(body.Role) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unknown role %q", body.Role)})
+			return
+		}
+
+		err = users.SetRole(ctx.Request.Context(), userID, body.Role)
+		if errors.Is(err, store.ErrNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			return
+		}
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		user, err := users.Get(ctx.Request.Context(), userID)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		n, err := sessions.RevokeAll(ctx.Request.Context(), userID)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		slog.Info("user role changed", "username", user.Username, "user_id", userID, "role", body.Role, "by_user_id", ctx.GetInt("user_id"), "sessions_ended", n)
+		ctx.JSON(http.StatusOK, gin.H{"id": userID, "username": user.Username, "role": body.Role, "revoked_sessions": n})
+	}
+}
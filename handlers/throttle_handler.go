@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"CipherOps/auth"
+	"CipherOps/store"
+)
+
+// LoginChallengeHandler tells the login page whether it has to solve a proof
+// of work and hands out the challenge.
+func LoginChallengeHandler(throttle *auth.LoginThrottle) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ip := ctx.ClientIP()
+		required, err := throttle.PoWRequired(ctx.Request.Context(), ip)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !required {
+			ctx.JSON(http.StatusOK, gin.H{"required": false})
+			return
+		}
+		challenge, err := throttle.NewPoWChallenge(ip)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"required":   true,
+			"challenge":  challenge,
+			"difficulty": throttle.Limits().PoWDifficulty,
+		})
+	}
+}
+
+// ListLockoutsHandler lists accounts with recent failures and their lockout.
+func ListLockoutsHandler(logins store.LoginRepository) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		list, err := logins.ListLockouts(ctx.Request.Context())
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		now := time.Now()
+		lockouts := []gin.H{}
+		for _, l := range list {
+			lockouts = append(lockouts, gin.H{
+				"username":        l.Username,
+				"failures":        l.Failures,
+				"last_failure_at": l.LastFailureAt,
+				"locked_until":    l.LockedUntil,
+				"locked":          l.LockedUntil != nil && now.Before(*l.LockedUntil),
+			})
+		}
+		ctx.JSON(http.StatusOK, lockouts)
+	}
+}
+
+// UnlockAccountHandler lets an admin clear the lockout of an account.
+func UnlockAccountHandler(throttle *auth.LoginThrottle) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		username := ctx.Param("username")
+		found, err := throttle.Unlock(ctx.Request.Context(), username)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if !found {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "account is not locked"})
+			return
+		}
+		slog.Info("account unlocked", "username", username, "by_user_id", ctx.GetInt("user_id"))
+		ctx.Status(http.StatusNoContent)
+	}
+}
+
+// LoginFailuresHandler aggregates failed logins per client IP, e.g. for
+// firewall ban lists. ?since= is a duration (default 1h), ?min= the minimum
+// number of failures (default 1).
+func LoginFailuresHandler(throttle *auth.LoginThrottle) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		since, err := time.ParseDuration(ctx.DefaultQuery("since", "1h"))
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid since: " + err.Error()})
+			return
+		}
+		min, err := strconv.Atoi(ctx.DefaultQuery("min", "1"))
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid min: " + err.Error()})
+			return
+		}
+		failures, err := throttle.FailuresByIP(ctx.Request.Context(), time.Now().Add(-since), min)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, failures)
+	}
+}
+
+// checkThrottle answers 429 with Retry-After when the login has to wait.
+func checkThrottle(ctx *gin.Context, throttle *auth.LoginThrottle, username, ip string) bool {
+	err := throttle.Check(ctx.Request.Context(), username, ip)
+	if err == nil {
+		return true
+	}
+	var throttled *auth.ThrottleError
+	if errors.As(err, &throttled) {
+		ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(throttled.RetryAfter.Seconds()))))
+		ctx.JSON(http.StatusTooManyRequests, gin.H{"error": throttled.Error()})
+		return false
+	}
+	ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	return false
+}
+
+// checkProofOfWork answers 428 when ip has to solve a login challenge and
+// did not send a fresh solution.
+func checkProofOfWork(ctx *gin.Context, throttle *auth.LoginThrottle, ip, challenge, nonce string) bool {
+	required, err := throttle.PoWRequired(ctx.Request.Context(), ip)
+	if err == nil && required {
+		err = throttle.VerifyPoW(ctx.Request.Context(), ip, challenge, nonce)
+	}
+	if errors.Is(err, auth.ErrProofOfWork) {
+		ctx.JSON(http.StatusPreconditionRequired, gin.H{"error": auth.ErrProofOfWork.Error(), "challenge_url": "/login/challenge"})
+		return false
+	}
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+func recordLoginFailure(ctx *gin.Context, throttle *auth.LoginThrottle, username, ip, reason string) {
+	if err := throttle.RecordFailure(ctx.Request.Context(), username, ip, reason); err != nil {
+		slog.Error("cannot record failed login", "username", username, "ip", ip, "error", err)
+	}
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"CipherOps/auth"
+	"CipherOps/models"
+	"CipherOps/store"
+)
+
+const maxTokenLifetimeDays = 365
+
+// ListAPITokensHandler lists the personal access tokens of the logged in user.
+// The token values themselves are never returned.
+func ListAPITokensHandler(tokens store.APITokenRepository) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		list, err := tokens.List(ctx.Request.Context(), ctx.GetInt("user_id"))
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, list)
+	}
+}
+
+// CreateAPITokenHandler issues a new token. The response is the only time the
+// plaintext token is available.
+func CreateAPITokenHandler(tokens store.APITokenRepository) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var body struct {
+			Name          string   `json:"name" binding:"required"`
+			Scopes        []string `json:"scopes" binding:"required"`
+			ExpiresInDays int      `json:"expires_in_days"`
+		}
+		if err := ctx.ShouldBindJSON(&body); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		for _, scope := range body.Scopes {
+			if !auth.ValidScope(scope) {
+				ctx.JSON(http.StatusBadRequest, gin.H{"error": "unknown scope: " + scope, "valid_scopes": auth.APITokenScopes})
+				return
+			}
+			if scope == auth.ScopeAdmin && ctx.GetString("role") != "admin" {
+				ctx.JSON(http.StatusForbidden, gin.H{"error": "only admins can create tokens with the admin scope"})
+				return
+			}
+		}
+		if body.ExpiresInDays < 0 || body.ExpiresInDays > maxTokenLifetimeDays {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "expires_in_days must be between 1 and " + strconv.Itoa(maxTokenLifetimeDays)})
+			return
+		}
+		if body.ExpiresInDays == 0 {
+			body.ExpiresInDays = 90
+		}
+
+		token, hash, err := auth.GenerateAPIToken()
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		expires := time.Now().Add(time.Duration(body.ExpiresInDays) * 24 * time.Hour)
+		apiToken := models.APIToken{
+			UserID:    ctx.GetInt("user_id"),
+			Name:      body.Name,
+			TokenHash: hash,
+			Scopes:    body.Scopes,
+			ExpiresAt: &expires,
+		}
+		if err := tokens.Create(ctx.Request.Context(), &apiToken); err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusCreated, gin.H{
+			"id":         apiToken.ID,
+			"name":       body.Name,
+			"scopes":     body.Scopes,
+			"expires_at": expires,
+			"token":      token,
+		})
+	}
+}
+
+// RevokeAPITokenHandler revokes one of the logged in user's tokens. The row is
+// kept so the token keeps showing up, revoked, in the list.
+func RevokeAPITokenHandler(tokens store.APITokenRepository) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id, err := strconv.Atoi(ctx.Param("id"))
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid token id"})
+			return
+		}
+		err = tokens.Revoke(ctx.Request.Context(), ctx.GetInt("user_id"), id, time.Now())
+		if errors.Is(err, store.ErrNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "token not found"})
+			return
+		}
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.Status(http.StatusNoContent)
+	}
+}
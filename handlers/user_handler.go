@@ -1,7 +1,6 @@
 package handlers
 
 import (
-    "log"
     // "database/sql"
     "net/http"
     "github.com/gin-gonic/gin"
@@ -31,11 +30,9 @@ import (
 // }
 
 func PanelHandler(ctx *gin.Context) {
-	sessionCookie := ctx.GetString("session")
-	log.Println("DEBUG: Handler session =", sessionCookie)
-
 	ctx.JSON(http.StatusOK, gin.H{
 		"message": "welcome to the protected panel",
-		"session": sessionCookie,
+		"user_id": ctx.GetInt("user_id"),
+		"role":    ctx.GetString("role"),
 	})
 }
\ No newline at end of file
@@ -0,0 +1,342 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+
+	"CipherOps/auth"
+	"CipherOps/models"
+	"CipherOps/store"
+)
+
+const ceremonyTTL = 5 * time.Minute
+
+// PasskeyRegisterBeginHandler starts registering a new security key or
+// passkey for the logged in user.
+func PasskeyRegisterBeginHandler(users store.UserRepository, passkeys store.PasskeyRepository, wa *webauthn.WebAuthn) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		user, err := loadPasskeyUser(ctx.Request.Context(), users, passkeys, ctx.GetInt("user_id"))
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		creation, session, err := wa.BeginRegistration(user,
+			webauthn.WithExclusions(webauthn.Credentials(user.Credentials).CredentialDescriptors()),
+			webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred),
+		)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := saveCeremony(ctx, passkeys, models.WebAuthnCeremony{UserID: user.ID}, session); err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, creation)
+	}
+}
+
+// PasskeyRegisterFinishHandler verifies the attestation and stores the new
+// credential. The optional ?name= labels it in the credential list.
+func PasskeyRegisterFinishHandler(users store.UserRepository, passkeys store.PasskeyRepository, wa *webauthn.WebAuthn) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		session, ceremony, err := takeCeremony(ctx, passkeys)
+		if err != nil || ceremony.UserID != ctx.GetInt("user_id") {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "no pending registration"})
+			return
+		}
+		user, err := loadPasskeyUser(ctx.Request.Context(), users, passkeys, ceremony.UserID)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		credential, err := wa.FinishRegistration(user, session, ctx.Request)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		data, err := json.Marshal(credential)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		name := ctx.Query("name")
+		if name == "" {
+			name = "Security key"
+		}
+		key := models.Passkey{UserID: user.ID, CredentialID: credential.ID, Name: name, Data: data}
+		if err := passkeys.Create(ctx.Request.Context(), &key); err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusCreated, gin.H{"id": key.ID, "name": name})
+	}
+}
+
+// ListPasskeysHandler lists the credentials registered by the logged in user.
+func ListPasskeysHandler(passkeys store.PasskeyRepository) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		keys, err := passkeys.List(ctx.Request.Context(), ctx.GetInt("user_id"))
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, keys)
+	}
+}
+
+// DeletePasskeyHandler removes one of the logged in user's credentials.
+func DeletePasskeyHandler(passkeys store.PasskeyRepository) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id, err := strconv.Atoi(ctx.Param("id"))
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid credential id"})
+			return
+		}
+		err = passkeys.Delete(ctx.Request.Context(), ctx.GetInt("user_id"), id)
+		if errors.Is(err, store.ErrNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": "credential not found"})
+			return
+		}
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.Status(http.StatusNoContent)
+	}
+}
+
+// PasskeyLoginBeginHandler starts a login ceremony. With a username only that
+// user's credentials are offered; without one the browser picks a discoverable
+// passkey. A username that cannot log in with a passkey gets a ceremony for a
+// decoy, so the answer does not tell which accounts exist. Every guess needs
+// a ceremony, so this is where the login throttle and proof of work apply.
+func PasskeyLoginBeginHandler(users store.UserRepository, passkeys store.PasskeyRepository, wa *webauthn.WebAuthn, throttle *auth.LoginThrottle, sessions *auth.SessionStore) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var body struct {
+			Username     string `json:"username"`
+			PoWChallenge string `json:"pow_challenge"`
+			PoWNonce     string `json:"pow_nonce"`
+		}
+		_ = ctx.ShouldBindJSON(&body)
+		ip := ctx.ClientIP()
+
+		if !checkThrottle(ctx, throttle, body.Username, ip) ||
+			!checkProofOfWork(ctx, throttle, ip, body.PoWChallenge, body.PoWNonce) {
+			return
+		}
+
+		var assertion *protocol.CredentialAssertion
+		var session *webauthn.SessionData
+		var err error
+		ceremony := models.WebAuthnCeremony{Username: body.Username}
+		// the key replaces the password and the second factor, so the
+		// authenticator has to check the PIN or biometric itself
+		uv := webauthn.WithUserVerification(protocol.VerificationRequired)
+		if body.Username == "" {
+			assertion, session, err = wa.BeginDiscoverableLogin(uv)
+		} else {
+			var user *auth.PasskeyUser
+			user, err = loadPasskeyUserByName(ctx.Request.Context(), users, passkeys, body.Username)
+			if errors.Is(err, store.ErrNotFound) || err == nil && len(user.Credentials) == 0 {
+				user, err = auth.DecoyPasskeyUser(sessions.Key, body.Username), nil
+			}
+			if err != nil {
+				ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			ceremony.UserID = user.ID
+			assertion, session, err = wa.BeginLogin(user, uv)
+		}
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := saveCeremony(ctx, passkeys, ceremony, session); err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, assertion)
+	}
+}
+
+// PasskeyLoginFinishHandler verifies the assertion and creates the same
+// session cookie as the password login. A passkey already proves possession
+// and, with user verification, knowledge, so no second step follows.
+// Failures count towards the lockout of the account like wrong passwords.
+func PasskeyLoginFinishHandler(users store.UserRepository, passkeys store.PasskeyRepository, wa *webauthn.WebAuthn, throttle *auth.LoginThrottle, sessions *auth.SessionStore) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		session, ceremony, err := takeCeremony(ctx, passkeys)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "no pending login"})
+			return
+		}
+		username := ceremony.Username
+		ip := ctx.ClientIP()
+		if !checkThrottle(ctx, throttle, username, ip) {
+			return
+		}
+
+		var user *auth.PasskeyUser
+		var credential *webauthn.Credential
+		switch {
+		case ceremony.UserID != 0:
+			user, err = loadPasskeyUser(ctx.Request.Context(), users, passkeys, ceremony.UserID)
+			if err == nil {
+				credential, err = wa.FinishLogin(user, session, ctx.Request)
+			}
+		case username != "":
+			// the decoy of a user who cannot log in with a passkey
+			err = errors.New("no security keys registered")
+		default:
+			credential, err = wa.FinishDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+				user, err = loadPasskeyUserByHandle(ctx.Request.Context(), users, passkeys, userHandle)
+				return user, err
+			}, session, ctx.Request)
+			if user != nil {
+				username = user.Username
+			}
+		}
+		if err != nil {
+			recordLoginFailure(ctx, throttle, username, ip, "invalid passkey")
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "passkey verification failed"})
+			return
+		}
+		// the account of a discoverable passkey is only known now
+		if ceremony.Username == "" && !checkThrottle(ctx, throttle, username, ip) {
+			return
+		}
+		if !credential.Flags.UserVerified {
+			recordLoginFailure(ctx, throttle, username, ip, "passkey without user verification")
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "the security key did not verify the user"})
+			return
+		}
+		if credential.Authenticator.CloneWarning {
+			recordLoginFailure(ctx, throttle, username, ip, "cloned passkey")
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": "security key signature counter went backwards, it may be cloned"})
+			return
+		}
+
+		// keep the sign counter and flags current
+		data, err := json.Marshal(credential)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err := passkeys.Used(ctx.Request.Context(), credential.ID, data, time.Now()); err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		if err := throttle.RecordSuccess(ctx.Request.Context(), username, ip); err != nil {
+			slog.Error("cannot record login", "username", username, "ip", ip, "error", err)
+		}
+		if err := setSessionCookie(ctx, sessions, models.User{ID: user.ID, Role: user.Role}, auth.StageFull); err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"redirect": "/panel"})
+	}
+}
+
+// loadPasskeyUser loads the user with its credentials, creating the WebAuthn
+// user handle on first use.
+func loadPasskeyUser(ctx context.Context, users store.UserRepository, passkeys store.PasskeyRepository, userID int) (*auth.PasskeyUser, error) {
+	u, err := users.Get(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(u.WebAuthnID) == 0 {
+		handle, err := auth.NewUserHandle()
+		if err != nil {
+			return nil, err
+		}
+		if err := users.SetWebAuthnID(ctx, u.ID, handle); err != nil {
+			return nil, err
+		}
+		u.WebAuthnID = handle
+	}
+	return withCredentials(ctx, passkeys, u)
+}
+
+func loadPasskeyUserByName(ctx context.Context, users store.UserRepository, passkeys store.PasskeyRepository, username string) (*auth.PasskeyUser, error) {
+	u, err := users.GetByUsername(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	return loadPasskeyUser(ctx, users, passkeys, u.ID)
+}
+
+func loadPasskeyUserByHandle(ctx context.Context, users store.UserRepository, passkeys store.PasskeyRepository, handle []byte) (*auth.PasskeyUser, error) {
+	u, err := users.GetByWebAuthnID(ctx, handle)
+	if err != nil {
+		return nil, err
+	}
+	return withCredentials(ctx, passkeys, u)
+}
+
+// withCredentials adapts u to webauthn with its stored credentials.
+func withCredentials(ctx context.Context, passkeys store.PasskeyRepository, u models.User) (*auth.PasskeyUser, error) {
+	keys, err := passkeys.List(ctx, u.ID)
+	if err != nil {
+		return nil, err
+	}
+	user := &auth.PasskeyUser{ID: u.ID, Username: u.Username, Role: u.Role, Handle: u.WebAuthnID}
+	for _, key := range keys {
+		var credential webauthn.Credential
+		if err := json.Unmarshal(key.Data, &credential); err != nil {
+			return nil, err
+		}
+		user.Credentials = append(user.Credentials, credential)
+	}
+	return user, nil
+}
+
+// saveCeremony stores the challenge with the owner in ceremony server side and
+// points the browser at it with a cookie.
+func saveCeremony(ctx *gin.Context, passkeys store.PasskeyRepository, ceremony models.WebAuthnCeremony, session *webauthn.SessionData) error {
+	id, err := auth.RandomToken(32)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	ceremony.ID, ceremony.Data, ceremony.ExpiresAt = id, data, time.Now().Add(ceremonyTTL)
+	if err := passkeys.SaveCeremony(ctx.Request.Context(), ceremony); err != nil {
+		return err
+	}
+	ctx.SetCookie(auth.WebAuthnCookie, id, int(ceremonyTTL.Seconds()), "/", "", ctx.Request.TLS != nil, true)
+	return nil
+}
+
+// takeCeremony consumes the pending ceremony so a challenge is never used twice.
+func takeCeremony(ctx *gin.Context, passkeys store.PasskeyRepository) (webauthn.SessionData, models.WebAuthnCeremony, error) {
+	var session webauthn.SessionData
+	id, err := ctx.Cookie(auth.WebAuthnCookie)
+	if err != nil {
+		return session, models.WebAuthnCeremony{}, err
+	}
+	ctx.SetCookie(auth.WebAuthnCookie, "", -1, "/", "", false, true)
+
+	ceremony, err := passkeys.TakeCeremony(ctx.Request.Context(), id, time.Now())
+	if err != nil {
+		return session, ceremony, err
+	}
+	if err := json.Unmarshal(ceremony.Data, &session); err != nil {
+		return session, ceremony, err
+	}
+	return session, ceremony, nil
+}
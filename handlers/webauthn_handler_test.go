@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/webauthn"
+
+	"CipherOps/auth"
+	"CipherOps/models"
+	"CipherOps/store"
+)
+
+type passkeyEnv struct {
+	router   *gin.Engine
+	st       store.Store
+	throttle *auth.LoginThrottle
+}
+
+// newPasskeyEnv runs the passkey login routes with alice, who has a security
+// key, and bob, who has none.
+func newPasskeyEnv(t *testing.T, limits auth.ThrottleLimits) *passkeyEnv {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	st, err := store.OpenSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+	for _, name := range []string{"alice", "bob"} {
+		if err := st.Users().Create(context.Background(), &models.User{Username: name, Password: "hash", Role: "user"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	alice, err := st.Users().GetByUsername(context.Background(), "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(webauthn.Credential{ID: []byte("alice-key")})
+	key := models.Passkey{UserID: alice.ID, CredentialID: []byte("alice-key"), Name: "Security key", Data: data}
+	if err := st.Passkeys().Create(context.Background(), &key); err != nil {
+		t.Fatal(err)
+	}
+
+	wa, err := auth.NewWebAuthn("localhost", "CipherOps", "https://localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionKey := []byte("0123456789abcdef0123456789abcdef")
+	sessions := &auth.SessionStore{Store: st, Key: sessionKey}
+	throttle := auth.NewLoginThrottle(st.Logins(), sessionKey, limits)
+	router := gin.New()
+	router.POST("/login/webauthn/begin", PasskeyLoginBeginHandler(st.Users(), st.Passkeys(), wa, throttle, sessions))
+	router.POST("/login/webauthn/finish", PasskeyLoginFinishHandler(st.Users(), st.Passkeys(), wa, throttle, sessions))
+	return &passkeyEnv{router: router, st: st, throttle: throttle}
+}
+
+func (e *passkeyEnv) post(path string, body any, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	e.router.ServeHTTP(w, req)
+	return w
+}
+
+// begin starts a login for username and returns the offered credential ids
+// and the ceremony cookie.
+func (e *passkeyEnv) begin(t *testing.T, username string) ([]string, *http.Cookie) {
+	t.Helper()
+	w := e.post("/login/webauthn/begin", gin.H{"username": username})
+	if w.Code != http.StatusOK {
+		t.Fatalf("begin for %q: %d %s", username, w.Code, w.Body)
+	}
+	var assertion struct {
+		PublicKey struct {
+			AllowCredentials []struct {
+				ID string `json:"id"`
+			} `json:"allowCredentials"`
+			UserVerification string `json:"userVerification"`
+		} `json:"publicKey"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &assertion); err != nil {
+		t.Fatal(err)
+	}
+	if assertion.PublicKey.UserVerification != "required" {
+		t.Errorf("begin for %q asks for user verification %q", username, assertion.PublicKey.UserVerification)
+	}
+	var ids []string
+	for _, c := range assertion.PublicKey.AllowCredentials {
+		ids = append(ids, c.ID)
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == auth.WebAuthnCookie {
+			return ids, c
+		}
+	}
+	t.Fatalf("begin for %q set no ceremony cookie", username)
+	return nil, nil
+}
+
+func limits() auth.ThrottleLimits {
+	return auth.ThrottleLimits{Window: time.Hour, MaxFailures: 5, LockoutDuration: time.Hour, IPFreeFailures: 100}
+}
+
+func TestPasskeyLoginBeginHidesAccounts(t *testing.T) {
+	e := newPasskeyEnv(t, limits())
+	offered, _ := e.begin(t, "alice")
+	if len(offered) != 1 {
+		t.Fatalf("alice is offered %d keys", len(offered))
+	}
+	// bob without keys and an unknown user look like alice
+	for _, name := range []string{"bob", "mallory"} {
+		decoy, _ := e.begin(t, name)
+		if len(decoy) != 1 || decoy[0] == offered[0] {
+			t.Errorf("%s is offered %q", name, decoy)
+		}
+		if again, _ := e.begin(t, name); again[0] != decoy[0] {
+			t.Errorf("the decoy key of %s changed from %s to %s", name, decoy[0], again[0])
+		}
+	}
+}
+
+func TestPasskeyLoginFinishFailsUniformly(t *testing.T) {
+	e := newPasskeyEnv(t, limits())
+	var bodies []string
+	for _, name := range []string{"alice", "mallory"} {
+		_, cookie := e.begin(t, name)
+		w := e.post("/login/webauthn/finish", gin.H{"id": "x", "rawId": "eA", "type": "public-key"}, cookie)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("finish for %s: %d %s", name, w.Code, w.Body)
+		}
+		bodies = append(bodies, w.Body.String())
+
+		lockout, err := e.st.Logins().Lockout(context.Background(), name)
+		if err != nil || lockout.Failures != 1 {
+			t.Errorf("failures of %s = %+v, %v; want 1", name, lockout, err)
+		}
+		// the ceremony is gone with the attempt
+		if w := e.post("/login/webauthn/finish", gin.H{}, cookie); w.Code != http.StatusBadRequest {
+			t.Errorf("second finish for %s: %d", name, w.Code)
+		}
+	}
+	if bodies[0] != bodies[1] {
+		t.Errorf("finish answers %s for a real user and %s for an unknown one", bodies[0], bodies[1])
+	}
+}
+
+func TestPasskeyLoginThrottled(t *testing.T) {
+	l := limits()
+	l.MaxFailures = 1
+	e := newPasskeyEnv(t, l)
+	if err := e.throttle.RecordFailure(context.Background(), "alice", "192.0.2.1", "invalid credentials"); err != nil {
+		t.Fatal(err)
+	}
+	if w := e.post("/login/webauthn/begin", gin.H{"username": "alice"}); w.Code != http.StatusTooManyRequests {
+		t.Errorf("begin for a locked account: %d %s", w.Code, w.Body)
+	}
+	// a discoverable login is held back by the IP alone
+	if w := e.post("/login/webauthn/begin", gin.H{}); w.Code != http.StatusOK {
+		t.Errorf("discoverable begin: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestPasskeyLoginRequiresProofOfWork(t *testing.T) {
+	l := limits()
+	l.PoWDifficulty, l.PoWAfter = 1, 1
+	e := newPasskeyEnv(t, l)
+	if err := e.throttle.RecordFailure(context.Background(), "", "192.0.2.1", "invalid credentials"); err != nil {
+		t.Fatal(err)
+	}
+	if w := e.post("/login/webauthn/begin", gin.H{"username": "alice"}); w.Code != http.StatusPreconditionRequired {
+		t.Errorf("begin without a proof of work: %d %s", w.Code, w.Body)
+	}
+}
@@ -0,0 +1,73 @@
+package helper
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+
+	"CipherOps/utils"
+)
+
+// Executor runs privileged commands through the helper at Socket and the
+// others itself, as the panel's user. Privileged commands are recorded in
+// AuditLog, as utils.LocalExecutor does.
+type Executor struct {
+	Socket string
+}
+
+func (e Executor) Run(ctx context.Context, c utils.Command) (utils.CommandResult, error) {
+	if !c.Sudo {
+		return utils.LocalExecutor{}.Run(ctx, c)
+	}
+	res, err := e.run(ctx, c)
+	if err != nil {
+		slog.Warn("command failed", "command", c.Name, "args", c.Args, "exit_code", res.ExitCode, "error", err)
+	}
+	utils.AuditCommand(ctx, "", c.Name, c.Args, res.Output(), err)
+	return res, err
+}
+
+func (e Executor) run(ctx context.Context, c utils.Command) (utils.CommandResult, error) {
+	res := utils.CommandResult{ExitCode: -1}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", e.Socket)
+	if err != nil {
+		return res, fmt.Errorf("privileged helper: %w", err)
+	}
+	defer conn.Close()
+	// anyone could have put a socket there; only root's is the helper
+	if uid, _, err := peerCredentials(conn.(*net.UnixConn)); err != nil {
+		return res, fmt.Errorf("privileged helper: %w", err)
+	} else if uid != 0 {
+		return res, fmt.Errorf("privileged helper: %s is served by uid %d, not root", e.Socket, uid)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if err := json.NewEncoder(conn).Encode(request{Name: c.Name, Args: c.Args}); err != nil {
+		return res, fmt.Errorf("privileged helper: %w", err)
+	}
+	dec := json.NewDecoder(conn)
+	for {
+		var m reply
+		if err := dec.Decode(&m); err != nil {
+			if ctx.Err() != nil {
+				return res, ctx.Err()
+			}
+			return res, fmt.Errorf("privileged helper: %w", err)
+		}
+		if m.Line != nil && c.Output != nil {
+			c.Output(*m.Line)
+		}
+		if m.Result != nil {
+			res = *m.Result
+			if m.Error != "" {
+				return res, errors.New(m.Error)
+			}
+			return res, nil
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package helper
+
+import (
+	"errors"
+	"net"
+)
+
+// peerCredentials needs SO_PEERCRED, which only Linux has.
+func peerCredentials(c *net.UnixConn) (uid, pid int, err error) {
+	return 0, 0, errors.New("peer credentials are only checked on Linux")
+}
@@ -0,0 +1,31 @@
+// Package helper lets the panel run privileged commands without being root
+// or allowed to use sudo. cipherops-helper runs as root under the service
+// manager, with no setuid bit anywhere, and listens on a Unix socket only
+// the panel's group may open. It learns who connected from the kernel
+// (SO_PEERCRED), not from anything the client says, and serves only the
+// users it was told to. The panel in turn only talks to a helper running as
+// root, so a socket put in place by someone else is not trusted.
+//
+// Each connection carries one command: the client sends a request line,
+// the helper answers with output lines and ends with a result. Closing the
+// connection early stops the command.
+package helper
+
+import "CipherOps/utils"
+
+// the largest request the helper reads
+const maxRequest = 1 << 20
+
+// request is the first and only line a client sends.
+type request struct {
+	Name string   `json:"name"`
+	Args []string `json:"args"`
+}
+
+// reply is one JSON line from the helper: a Line of output, or the Result
+// that ends the command.
+type reply struct {
+	Line   *utils.OutputLine    `json:"line,omitempty"`
+	Result *utils.CommandResult `json:"result,omitempty"`
+	Error  string               `json:"error,omitempty"`
+}
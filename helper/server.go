@@ -0,0 +1,130 @@
+package helper
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"time"
+
+	"CipherOps/logging"
+	"CipherOps/utils"
+)
+
+// Role is the role of the command policy every request is checked against.
+// Clients do not get to say who they run commands for.
+const Role = "helper"
+
+// Server runs the commands its clients send, as root.
+type Server struct {
+	// path of the socket; a socket left behind by an earlier run is replaced
+	Socket string
+	// group that may open the socket, mode 0660; without one only root can
+	GID int
+	// the users served, normally the one the panel runs as; everyone else
+	// is refused before sending anything
+	AllowUIDs []int
+	// requests run only if a rule of Role matches them, arguments included;
+	// the zero policy refuses everything
+	Policy utils.CommandPolicy
+	Exec   utils.Executor
+}
+
+// ListenAndServe serves clients until ctx ends.
+func (s *Server) ListenAndServe(ctx context.Context) error {
+	if fi, err := os.Lstat(s.Socket); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("%s exists and is not a socket", s.Socket)
+		}
+		os.Remove(s.Socket)
+	}
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: s.Socket, Net: "unix"})
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	// whoever connects in between is still checked by serve
+	mode := os.FileMode(0o600)
+	if s.GID > 0 {
+		mode = 0o660
+		if err := os.Chown(s.Socket, 0, s.GID); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(s.Socket, mode); err != nil {
+		return err
+	}
+	slog.Info("privileged helper listening", "socket", s.Socket, "uids", s.AllowUIDs)
+
+	stop := context.AfterFunc(ctx, func() { l.Close() })
+	defer stop()
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go s.serve(ctx, conn)
+	}
+}
+
+// serve runs the one command of conn if its peer may ask for it.
+func (s *Server) serve(ctx context.Context, conn *net.UnixConn) {
+	defer conn.Close()
+	uid, pid, err := peerCredentials(conn)
+	if err != nil {
+		slog.Warn("cannot read peer credentials", "error", err)
+		return
+	}
+	enc := json.NewEncoder(conn)
+	if !slices.Contains(s.AllowUIDs, uid) {
+		slog.Warn("refused connection", "uid", uid, "pid", pid)
+		enc.Encode(reply{Result: &utils.CommandResult{ExitCode: -1}, Error: fmt.Sprintf("uid %d may not use the privileged helper", uid)})
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	line, err := bufio.NewReader(io.LimitReader(conn, maxRequest)).ReadBytes('\n')
+	if err != nil {
+		slog.Warn("cannot read request", "uid", uid, "pid", pid, "error", err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	var req request
+	if err := json.Unmarshal(line, &req); err != nil {
+		enc.Encode(reply{Result: &utils.CommandResult{ExitCode: -1}, Error: "bad request: " + err.Error()})
+		return
+	}
+	c := utils.Command{Name: req.Name, Args: req.Args, Sudo: true}
+	if !s.Policy.Allows(Role, c) {
+		err := &utils.CommandDeniedError{Role: Role, Command: c.Name, Args: logging.RedactArgs(c.Args), Sudo: true}
+		slog.Warn("refused command", "uid", uid, "pid", pid, "command", req.Name, "args", err.Args)
+		enc.Encode(reply{Result: &utils.CommandResult{ExitCode: -1}, Error: err.Error()})
+		return
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// the client sends nothing more; a read ending means it hung up
+	go func() {
+		conn.Read(make([]byte, 1))
+		cancel()
+	}()
+	slog.Info("running command", "uid", uid, "pid", pid, "command", req.Name, "args", logging.RedactArgs(req.Args))
+	c.Output = func(line utils.OutputLine) {
+		enc.Encode(reply{Line: &line})
+	}
+	res, err := s.Exec.Run(runCtx, c)
+	final := reply{Result: &res}
+	if err != nil {
+		final.Error = err.Error()
+	}
+	enc.Encode(final)
+}
@@ -0,0 +1,140 @@
+//go:build linux
+
+package helper
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"CipherOps/utils"
+)
+
+// startServer runs s on a socket in a temporary directory until the test
+// ends.
+func startServer(t *testing.T, s *Server) {
+	t.Helper()
+	s.Socket = filepath.Join(t.TempDir(), "helper.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.ListenAndServe(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Error(err)
+		}
+	})
+	for i := 0; i < 100; i++ {
+		if fi, err := os.Stat(s.Socket); err == nil && fi.Mode().Perm() == 0o600 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("helper did not start listening")
+}
+
+// ask sends req to the helper at socket and returns its replies.
+func ask(t *testing.T, socket string, req request) []reply {
+	t.Helper()
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// a refused peer may find the helper gone before the request is out,
+	// the refusal is still there to read
+	json.NewEncoder(conn).Encode(req)
+	var replies []reply
+	dec := json.NewDecoder(conn)
+	for {
+		var m reply
+		if err := dec.Decode(&m); err != nil {
+			t.Fatalf("after %d replies: %v", len(replies), err)
+		}
+		replies = append(replies, m)
+		if m.Result != nil {
+			return replies
+		}
+	}
+}
+
+func defaultPolicy(t *testing.T) utils.CommandPolicy {
+	t.Helper()
+	p, err := utils.LoadCommandPolicy("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestServerRefusesUnknownPeer(t *testing.T) {
+	fake := &utils.FakeExecutor{Responses: map[string]utils.FakeResponse{"systemctl restart nginx": {}}}
+	s := &Server{AllowUIDs: []int{os.Getuid() + 1}, Policy: defaultPolicy(t), Exec: fake}
+	startServer(t, s)
+
+	replies := ask(t, s.Socket, request{Name: "systemctl", Args: []string{"restart", "nginx"}})
+	last := replies[len(replies)-1]
+	if last.Result.ExitCode != -1 || !strings.Contains(last.Error, "may not use the privileged helper") {
+		t.Errorf("reply = %+v, want a refusal", last)
+	}
+	if calls := fake.Calls(); len(calls) != 0 {
+		t.Errorf("ran %v for a refused peer", calls)
+	}
+}
+
+func TestServerChecksArguments(t *testing.T) {
+	tests := []struct {
+		name    string
+		req     request
+		allowed bool
+	}{
+		{"package install", request{Name: "apt-get", Args: []string{"install", "-y", "nginx", "curl"}}, true},
+		{"service restart", request{Name: "systemctl", Args: []string{"restart", "nginx"}}, true},
+		{"apt option injection", request{Name: "apt-get", Args: []string{"install", "-y", "-o", "APT::Update::Pre-Invoke::=sh"}}, false},
+		{"unit file linking", request{Name: "systemctl", Args: []string{"link", "/tmp/evil.service"}}, false},
+		{"extra argument", request{Name: "systemctl", Args: []string{"restart", "nginx", "--now"}}, false},
+		{"unmanaged program", request{Name: "sh", Args: []string{"-c", "id"}}, false},
+	}
+	responses := map[string]utils.FakeResponse{}
+	for _, tt := range tests {
+		responses[strings.Join(append([]string{tt.req.Name}, tt.req.Args...), " ")] = utils.FakeResponse{Stdout: "done\n"}
+	}
+	fake := &utils.FakeExecutor{Responses: responses}
+	s := &Server{AllowUIDs: []int{os.Getuid()}, Policy: defaultPolicy(t), Exec: fake}
+	startServer(t, s)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := len(fake.Calls())
+			replies := ask(t, s.Socket, tt.req)
+			last := replies[len(replies)-1]
+			ran := len(fake.Calls()) > before
+			if tt.allowed {
+				if last.Error != "" || !ran {
+					t.Errorf("reply = %+v, ran %v; want the command run", last, ran)
+				}
+				return
+			}
+			if ran || last.Result.ExitCode != -1 || !strings.Contains(last.Error, `role "helper"`) {
+				t.Errorf("reply = %+v, ran %v; want a policy refusal", last, ran)
+			}
+		})
+	}
+}
+
+func TestServerZeroPolicyRefuses(t *testing.T) {
+	fake := &utils.FakeExecutor{Responses: map[string]utils.FakeResponse{"systemctl restart nginx": {}}}
+	s := &Server{AllowUIDs: []int{os.Getuid()}, Exec: fake}
+	startServer(t, s)
+
+	replies := ask(t, s.Socket, request{Name: "systemctl", Args: []string{"restart", "nginx"}})
+	if last := replies[len(replies)-1]; last.Error == "" || len(fake.Calls()) != 0 {
+		t.Errorf("reply = %+v; want a refusal without any rules", last)
+	}
+}
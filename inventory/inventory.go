@@ -0,0 +1,311 @@
+// Package inventory keeps the managed hosts and their groups, gathers facts
+// about them and runs actions on many hosts at once.
+package inventory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"CipherOps/models"
+	"CipherOps/store"
+	"CipherOps/utils"
+)
+
+// Host addresses with a meaning of their own: the panel's own machine, and
+// hosts reached through their cipherops-agent instead of SSH.
+const (
+	LocalAddress = "local"
+	AgentAddress = "agent"
+)
+
+// Agents hands out executors for hosts with a connected agent, see
+// agent.Server.
+type Agents interface {
+	Executor(host string) (utils.Executor, error)
+}
+
+// Inventory resolves targets to hosts and hosts to executors.
+type Inventory struct {
+	Hosts store.HostRepository
+	// runs the commands of hosts at LocalAddress
+	Local utils.Executor
+	// SSH settings for the other hosts; Host, and User when the host names
+	// one, are filled in per host
+	SSH  utils.SSHConfig
+	Pool *utils.SSHPool
+	// runs the commands of hosts at AgentAddress, nil when the agent
+	// listener is off
+	Agents Agents
+	// plan the privileged commands on remote hosts instead of running them,
+	// as Local does for this machine
+	DryRun bool
+	// hosts FanOut works on at once, 10 when zero
+	Parallelism int
+}
+
+// Executor returns the executor that runs commands on h. Commands on remote
+// hosts are checked against the command policy, Local checks its own.
+func (inv *Inventory) Executor(h models.Host) (utils.Executor, error) {
+	var e utils.Executor
+	var err error
+	switch h.Address {
+	case LocalAddress:
+		return inv.Local, nil
+	case AgentAddress:
+		if inv.Agents == nil {
+			return nil, fmt.Errorf("host %s is reached through its agent but AGENT_LISTEN_ADDR is empty", h.Name)
+		}
+		e, err = inv.Agents.Executor(h.Name)
+	default:
+		cfg := inv.SSH
+		cfg.Host = net.JoinHostPort(h.Address, strconv.Itoa(h.Port))
+		if h.User != "" {
+			cfg.User = h.User
+		}
+		if cfg.User == "" {
+			return nil, fmt.Errorf("host %s names no user and SSH_USER is empty", h.Name)
+		}
+		e, err = inv.Pool.Executor(cfg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if inv.DryRun {
+		e = &utils.DryRunExecutor{Probe: e}
+	}
+	return utils.PolicyExecutor{Exec: e, Host: h.Name}, nil
+}
+
+// Resolve turns a target into hosts: "all", "group:NAME", "label:KEY=VALUE"
+// or a host name. Several targets may be joined with commas; a host matched
+// twice is returned once.
+func (inv *Inventory) Resolve(ctx context.Context, target string) ([]models.Host, error) {
+	hosts, err := inv.Hosts.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var matched []models.Host
+	seen := map[int]bool{}
+	for _, t := range strings.Split(target, ",") {
+		t = strings.TrimSpace(t)
+		match, err := selector(t)
+		if err != nil {
+			return nil, err
+		}
+		found := false
+		for _, h := range hosts {
+			if !match(h) {
+				continue
+			}
+			found = true
+			if !seen[h.ID] {
+				seen[h.ID] = true
+				matched = append(matched, h)
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("target %q: %w", t, store.ErrNotFound)
+		}
+	}
+	return matched, nil
+}
+
+func selector(target string) (func(models.Host) bool, error) {
+	kind, value, _ := strings.Cut(target, ":")
+	switch {
+	case target == "":
+		return nil, errors.New("empty target")
+	case target == "all":
+		return func(models.Host) bool { return true }, nil
+	case kind == "group":
+		return func(h models.Host) bool {
+			for _, g := range h.Groups {
+				if g == value {
+					return true
+				}
+			}
+			return false
+		}, nil
+	case kind == "label":
+		key, want, ok := strings.Cut(value, "=")
+		if !ok {
+			return nil, fmt.Errorf("target %q: labels are matched as label:KEY=VALUE", target)
+		}
+		return func(h models.Host) bool {
+			got, ok := h.Labels[key]
+			return ok && got == want
+		}, nil
+	case strings.Contains(target, ":"):
+		return nil, fmt.Errorf("target %q: use all, group:NAME, label:KEY=VALUE or a host name", target)
+	}
+	return func(h models.Host) bool { return h.Name == target }, nil
+}
+
+// Result is the outcome of an action on one host.
+type Result struct {
+	Host     string        `json:"host"`
+	OK       bool          `json:"ok"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+	// what the action returned, if anything
+	Output any `json:"output,omitempty"`
+}
+
+// Action is run by FanOut for each host with the host's executor.
+type Action func(ctx context.Context, h models.Host, e utils.Executor) (any, error)
+
+// FanOut runs action on hosts, at most Parallelism at a time, and returns one
+// result per host in the order of hosts. A failing host does not stop the
+// others.
+func (inv *Inventory) FanOut(ctx context.Context, hosts []models.Host, action Action) []Result {
+	return inv.each(ctx, hosts, func(ctx context.Context, h models.Host) (any, error) {
+		e, err := inv.Executor(h)
+		if err != nil {
+			return nil, err
+		}
+		return action(ctx, h, e)
+	})
+}
+
+// each is FanOut for actions that find their own executor.
+func (inv *Inventory) each(ctx context.Context, hosts []models.Host, action func(context.Context, models.Host) (any, error)) []Result {
+	parallel := inv.Parallelism
+	if parallel <= 0 {
+		parallel = 10
+	}
+	results := make([]Result, len(hosts))
+	slots := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, h := range hosts {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := &results[i]
+			res.Host = h.Name
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				res.Error = ctx.Err().Error()
+				return
+			}
+			start := time.Now()
+			out, err := inv.run(ctx, h, action)
+			res.Duration = time.Since(start)
+			if err != nil {
+				res.Error = err.Error()
+				return
+			}
+			res.OK, res.Output = true, out
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+func (inv *Inventory) run(ctx context.Context, h models.Host, action func(context.Context, models.Host) (any, error)) (out any, err error) {
+	// one host's bug must not take the whole fan-out down
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return action(ctx, h)
+}
+
+// GatherFacts finds out the distribution, package manager, service manager
+// and firewall of h and stores them. On failure the previous facts stay and
+// the error is recorded with them.
+func (inv *Inventory) GatherFacts(ctx context.Context, h models.Host) (models.HostFacts, error) {
+	facts, err := inv.gather(ctx, h)
+	if err != nil {
+		if storeErr := inv.Hosts.SetFactsError(ctx, h.ID, err.Error()); storeErr != nil {
+			slog.Error("cannot record facts error", "host", h.Name, "error", storeErr)
+		}
+		return h.Facts, err
+	}
+	return facts, inv.Hosts.SetFacts(ctx, h.ID, facts)
+}
+
+func (inv *Inventory) gather(ctx context.Context, h models.Host) (models.HostFacts, error) {
+	e, err := inv.Executor(h)
+	if err != nil {
+		return models.HostFacts{}, err
+	}
+	distro, err := utils.DetectDistro(ctx, e)
+	if err != nil {
+		return models.HostFacts{}, err
+	}
+	return models.HostFacts{
+		DistroID:        distro.ID,
+		DistroLike:      distro.Like,
+		DistroName:      distro.Name,
+		DistroVersion:   distro.Version,
+		Installer:       utils.InstallerName(utils.NewInstallerFor(distro, e, nil)),
+		ServiceManager:  utils.ServiceManagerName(utils.NewServiceManager(ctx, e)),
+		FirewallBackend: utils.DetectFirewallBackend(ctx, e),
+		GatheredAt:      time.Now().UTC(),
+	}, nil
+}
+
+// RefreshFacts gathers the facts of hosts, see GatherFacts.
+func (inv *Inventory) RefreshFacts(ctx context.Context, hosts []models.Host) []Result {
+	return inv.each(ctx, hosts, func(ctx context.Context, h models.Host) (any, error) {
+		return inv.GatherFacts(ctx, h)
+	})
+}
+
+// WatchFacts refreshes the facts of every host now and then each interval
+// until ctx ends.
+func (inv *Inventory) WatchFacts(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		hosts, err := inv.Hosts.List(ctx)
+		if err != nil {
+			slog.Error("cannot list hosts for facts gathering", "error", err)
+		}
+		failed := 0
+		for _, res := range inv.RefreshFacts(ctx, hosts) {
+			if !res.OK {
+				failed++
+				slog.Warn("facts gathering failed", "host", res.Host, "error", res.Error)
+			}
+		}
+		slog.Debug("facts gathered", "failed", failed)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Installer returns the installer recorded in h's facts.
+func Installer(h models.Host, e utils.Executor, output utils.OutputFunc) (utils.Installer, error) {
+	if h.Facts.GatheredAt.IsZero() {
+		return nil, fmt.Errorf("no facts gathered for host %s yet", h.Name)
+	}
+	return utils.NewInstallerByName(h.Facts.Installer, e, output)
+}
+
+// ServiceManager returns the service manager recorded in h's facts.
+func ServiceManager(h models.Host, e utils.Executor) (utils.ServiceManager, error) {
+	if h.Facts.GatheredAt.IsZero() {
+		return nil, fmt.Errorf("no facts gathered for host %s yet", h.Name)
+	}
+	return utils.NewServiceManagerByName(h.Facts.ServiceManager, e)
+}
+
+// Distro is the distribution recorded in h's facts.
+func Distro(h models.Host) utils.DistroInfo {
+	return utils.DistroInfo{ID: h.Facts.DistroID, Like: h.Facts.DistroLike, Name: h.Facts.DistroName,
+		Version: h.Facts.DistroVersion}
+}
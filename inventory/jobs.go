@@ -0,0 +1,83 @@
+package inventory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"CipherOps/jobs"
+	"CipherOps/models"
+	"CipherOps/store"
+	"CipherOps/utils"
+)
+
+// JobFleetPackages is the kind of the job PackagesJob runs.
+const JobFleetPackages = "fleet.packages"
+
+// PackagesPayload asks for programs, by the abstract names of
+// utils.PackageMap, to be installed or removed on the hosts of Target.
+type PackagesPayload struct {
+	Target   string   `json:"target"`
+	Action   string   `json:"action"`
+	Programs []string `json:"programs"`
+}
+
+// PackagesJob runs a PackagesPayload. The package manager output of every
+// host goes to the job log, each line prefixed with the host name, and the
+// result has one Result per host. The job fails, without retries, when
+// any host failed; running it again would repeat the hosts that worked.
+func (inv *Inventory) PackagesJob(ctx context.Context, j *jobs.Job) (any, error) {
+	var p PackagesPayload
+	if err := j.Decode(&p); err != nil {
+		return nil, jobs.Permanent(err)
+	}
+	if p.Action != "install" && p.Action != "remove" {
+		return nil, jobs.Permanent(fmt.Errorf("unknown action %q", p.Action))
+	}
+	hosts, err := inv.Resolve(ctx, p.Target)
+	if errors.Is(err, store.ErrNotFound) {
+		// the hosts were removed since the job was queued
+		return nil, jobs.Permanent(err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	j.Logf("%s %v on %d hosts", p.Action, p.Programs, len(hosts))
+
+	var done atomic.Int32
+	results := inv.FanOut(ctx, hosts, func(ctx context.Context, h models.Host, e utils.Executor) (any, error) {
+		defer func() {
+			n := int(done.Add(1))
+			j.Progress(n*100/len(hosts), fmt.Sprintf("%d of %d hosts done", n, len(hosts)))
+		}()
+		output := func(line utils.OutputLine) {
+			line.Text = h.Name + ": " + line.Text
+			j.Output(line)
+		}
+		installer, err := Installer(h, e, output)
+		if err != nil {
+			return nil, err
+		}
+		if p.Action == "remove" {
+			err = utils.RemovePrograms(ctx, installer, Distro(h), p.Programs)
+		} else {
+			err = utils.InstallPrograms(ctx, installer, Distro(h), p.Programs)
+		}
+		if err != nil {
+			j.Logf("%s: %v", h.Name, err)
+		}
+		return nil, err
+	})
+
+	failed := 0
+	for _, res := range results {
+		if !res.OK {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return results, jobs.Permanent(fmt.Errorf("%d of %d hosts failed", failed, len(hosts)))
+	}
+	return results, nil
+}
@@ -0,0 +1,400 @@
+// Package jobs runs long operations, such as package installs, in the
+// background. Jobs are rows in the database, so they outlive the request
+// that made them and the server that ran them: a worker holds a job on a
+// lease it keeps renewing, and a job whose lease runs out is picked up
+// again by any worker.
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"CipherOps/audit"
+	"CipherOps/models"
+	"CipherOps/store"
+	"CipherOps/utils"
+)
+
+const (
+	// a worker renews the lease of its job this often
+	heartbeatInterval = 10 * time.Second
+	lease             = 6 * heartbeatInterval
+	// buffered output is written at least this often
+	flushInterval = time.Second
+	maxBuffered   = 200
+)
+
+var (
+	errCancelled = errors.New("job cancelled")
+	errLeaseLost = errors.New("job lease lost")
+)
+
+// Handler does the work of one kind of job. The context ends when the job
+// is cancelled; what Handler returns becomes the JSON result of the job.
+type Handler func(ctx context.Context, j *Job) (any, error)
+
+// Queue enqueues jobs and runs them on a pool of workers.
+type Queue struct {
+	Jobs store.JobRepository
+	// jobs run at once, 4 when zero
+	Workers int
+	// how often idle workers look for due jobs, 2s when zero; jobs
+	// enqueued in this process start at once
+	PollInterval time.Duration
+	// attempts of a new job, 1 when zero
+	MaxAttempts int
+	// wait before the first retry, doubled for each further attempt up to
+	// MaxRetryDelay
+	RetryDelay    time.Duration
+	MaxRetryDelay time.Duration
+
+	once     sync.Once
+	worker   string
+	wake     chan struct{}
+	handlers map[string]Handler
+
+	mu      sync.Mutex
+	running map[int64]context.CancelCauseFunc
+}
+
+func (q *Queue) init() {
+	q.once.Do(func() {
+		host, _ := os.Hostname()
+		b := make([]byte, 4)
+		rand.Read(b)
+		q.worker = fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+		q.wake = make(chan struct{}, 1)
+		q.handlers = map[string]Handler{}
+		q.running = map[int64]context.CancelCauseFunc{}
+		if q.Workers <= 0 {
+			q.Workers = 4
+		}
+		if q.PollInterval <= 0 {
+			q.PollInterval = 2 * time.Second
+		}
+		if q.MaxAttempts <= 0 {
+			q.MaxAttempts = 1
+		}
+	})
+}
+
+// Handle registers the handler of a kind of job. Register every kind before
+// Run.
+func (q *Queue) Handle(kind string, h Handler) {
+	q.init()
+	q.handlers[kind] = h
+}
+
+// Enqueue adds a job of kind with payload, to be run by the next free
+// worker of any server. The actor in ctx is kept with the job.
+func (q *Queue) Enqueue(ctx context.Context, kind string, payload any) (models.Job, error) {
+	q.init()
+	if _, ok := q.handlers[kind]; !ok {
+		return models.Job{}, fmt.Errorf("unknown job kind %q", kind)
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return models.Job{}, err
+	}
+	actor := audit.ActorFrom(ctx)
+	j := models.Job{
+		Kind:        kind,
+		Payload:     data,
+		MaxAttempts: q.MaxAttempts,
+		UserID:      actor.UserID,
+		Username:    actor.Username,
+		Role:        actor.Role,
+		IP:          actor.IP,
+	}
+	if err := q.Jobs.Enqueue(ctx, &j); err != nil {
+		return j, err
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return j, nil
+}
+
+// Cancel ends a queued job, or stops a running one: at once when it runs
+// here, on the next heartbeat of its worker otherwise. store.ErrConflict
+// when the job has already ended.
+func (q *Queue) Cancel(ctx context.Context, id int64) (models.Job, error) {
+	q.init()
+	j, err := q.Jobs.Cancel(ctx, id, time.Now())
+	if err != nil {
+		return j, err
+	}
+	q.mu.Lock()
+	if cancel := q.running[id]; cancel != nil {
+		cancel(errCancelled)
+	}
+	q.mu.Unlock()
+	return j, nil
+}
+
+// Run starts the workers and returns when ctx ends and they have stopped.
+// Jobs interrupted by the end of ctx are queued again.
+func (q *Queue) Run(ctx context.Context) {
+	q.init()
+	slog.Info("job workers started", "workers", q.Workers, "worker_id", q.worker)
+	var wg sync.WaitGroup
+	for range q.Workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (q *Queue) work(ctx context.Context) {
+	ticker := time.NewTicker(q.PollInterval)
+	defer ticker.Stop()
+	for {
+		// drain the queue before waiting again
+		for ctx.Err() == nil {
+			j, err := q.Jobs.Claim(ctx, q.worker, time.Now(), time.Now().Add(lease))
+			if errors.Is(err, store.ErrNotFound) {
+				break
+			}
+			if err != nil {
+				if ctx.Err() == nil {
+					slog.Error("cannot claim a job", "error", err)
+				}
+				break
+			}
+			q.run(ctx, j)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// run runs j, which this worker holds, and records how it ended.
+func (q *Queue) run(ctx context.Context, mj models.Job) {
+	log := slog.With("job", mj.ID, "kind", mj.Kind, "attempt", mj.Attempts)
+	switch {
+	case mj.CancelRequested:
+		q.finish(mj, models.JobCancelled, nil, errCancelled)
+		return
+	case mj.Attempts > mj.MaxAttempts:
+		// the previous attempt never ended, its server went away
+		q.finish(mj, models.JobFailed, nil, fmt.Errorf("gave up after %d attempts, the last one did not finish", mj.MaxAttempts))
+		return
+	}
+	handler := q.handlers[mj.Kind]
+	if handler == nil {
+		q.finish(mj, models.JobFailed, nil, fmt.Errorf("unknown job kind %q", mj.Kind))
+		return
+	}
+
+	jobCtx, cancel := context.WithCancelCause(audit.WithActor(ctx, audit.Actor{
+		UserID: mj.UserID, Username: mj.Username, Role: mj.Role, IP: mj.IP,
+	}))
+	defer cancel(nil)
+	q.mu.Lock()
+	q.running[mj.ID] = cancel
+	q.mu.Unlock()
+	defer func() {
+		q.mu.Lock()
+		delete(q.running, mj.ID)
+		q.mu.Unlock()
+	}()
+
+	j := &Job{Job: mj, q: q}
+	stop := make(chan struct{})
+	var keep sync.WaitGroup
+	keep.Add(1)
+	go func() {
+		defer keep.Done()
+		q.keepAlive(jobCtx, j, cancel, stop)
+	}()
+
+	log.Info("job started")
+	result, err := call(jobCtx, handler, j)
+	close(stop)
+	keep.Wait()
+	j.flush()
+
+	switch cause := context.Cause(jobCtx); {
+	case err == nil:
+		j.Progress(100, j.ProgressMessage)
+		q.finish(j.Job, models.JobSucceeded, result, nil)
+	case errors.Is(cause, errLeaseLost):
+		// another worker has the job now
+		log.Warn("job lost to another worker")
+	case errors.Is(cause, errCancelled):
+		q.finish(j.Job, models.JobCancelled, result, errCancelled)
+	case ctx.Err() != nil:
+		q.retry(j.Job, time.Now(), fmt.Errorf("interrupted: %w", err))
+	case isPermanent(err) || mj.Attempts >= mj.MaxAttempts:
+		q.finish(j.Job, models.JobFailed, result, err)
+	default:
+		q.retry(j.Job, time.Now().Add(q.backoff(mj.Attempts)), err)
+	}
+}
+
+// keepAlive renews the lease of j and writes its buffered output until stop
+// closes, cancelling the job when cancelling is asked for or the lease is
+// lost.
+func (q *Queue) keepAlive(ctx context.Context, j *Job, cancel context.CancelCauseFunc, stop chan struct{}) {
+	flush := time.NewTicker(flushInterval)
+	defer flush.Stop()
+	beat := time.NewTicker(heartbeatInterval)
+	defer beat.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-flush.C:
+			j.flush()
+		case <-beat.C:
+			cancelled, err := q.Jobs.Heartbeat(context.WithoutCancel(ctx), j.ID, q.worker, time.Now().Add(lease))
+			switch {
+			case errors.Is(err, store.ErrNotFound):
+				cancel(errLeaseLost)
+			case err != nil:
+				slog.Warn("job heartbeat failed", "job", j.ID, "error", err)
+			case cancelled:
+				cancel(errCancelled)
+			}
+		}
+	}
+}
+
+func (q *Queue) finish(j models.Job, status string, result any, err error) {
+	now := time.Now()
+	j.Status, j.FinishedAt, j.Error = status, &now, ""
+	if err != nil {
+		j.Error = err.Error()
+	}
+	if result != nil {
+		data, merr := json.Marshal(result)
+		if merr != nil {
+			slog.Error("cannot encode job result", "job", j.ID, "error", merr)
+		}
+		j.Result = data
+	}
+	if ferr := q.Jobs.Finish(context.Background(), j, q.worker); ferr != nil {
+		slog.Error("cannot record the end of a job", "job", j.ID, "error", ferr)
+		return
+	}
+	slog.Info("job ended", "job", j.ID, "kind", j.Kind, "status", status, "error", j.Error)
+}
+
+func (q *Queue) retry(j models.Job, at time.Time, err error) {
+	if rerr := q.Jobs.Retry(context.Background(), j.ID, q.worker, at, err.Error()); rerr != nil {
+		slog.Error("cannot queue a job again", "job", j.ID, "error", rerr)
+		return
+	}
+	slog.Warn("job failed, retrying", "job", j.ID, "kind", j.Kind, "attempt", j.Attempts, "at", at, "error", err)
+}
+
+// backoff is the wait before the retry that follows attempt.
+func (q *Queue) backoff(attempt int) time.Duration {
+	d := q.RetryDelay
+	for i := 1; i < attempt && d < q.MaxRetryDelay; i++ {
+		d *= 2
+	}
+	if q.MaxRetryDelay > 0 && d > q.MaxRetryDelay {
+		d = q.MaxRetryDelay
+	}
+	return d
+}
+
+// call runs h, turning a panic into a permanent failure.
+func call(ctx context.Context, h Handler, j *Job) (result any, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			slog.Error("job panicked", "job", j.ID, "panic", p)
+			err = Permanent(fmt.Errorf("panic: %v", p))
+		}
+	}()
+	return h(ctx, j)
+}
+
+// Job is the job a Handler works on.
+type Job struct {
+	models.Job
+	q *Queue
+
+	mu  sync.Mutex
+	buf []models.JobLogLine
+}
+
+// Decode reads the payload into v.
+func (j *Job) Decode(v any) error {
+	return json.Unmarshal(j.Payload, v)
+}
+
+// Progress records how far the job is, in percent, and what it is doing.
+func (j *Job) Progress(percent int, message string) {
+	percent = min(max(percent, 0), 100)
+	j.mu.Lock()
+	j.Job.Progress, j.ProgressMessage = percent, message
+	j.mu.Unlock()
+	if err := j.q.Jobs.SetProgress(context.Background(), j.ID, percent, message); err != nil {
+		slog.Warn("cannot record job progress", "job", j.ID, "error", err)
+	}
+}
+
+// Output adds a line to the log of the job. It is a utils.OutputFunc, so
+// installers can stream into the log directly.
+func (j *Job) Output(line utils.OutputLine) {
+	j.mu.Lock()
+	j.buf = append(j.buf, models.JobLogLine{JobID: j.ID, At: time.Now(), Stream: line.Stream, Text: line.Text})
+	full := len(j.buf) >= maxBuffered
+	j.mu.Unlock()
+	if full {
+		j.flush()
+	}
+}
+
+// Logf adds a line of its own to the log.
+func (j *Job) Logf(format string, args ...any) {
+	j.Output(utils.OutputLine{Stream: "job", Text: fmt.Sprintf(format, args...)})
+}
+
+func (j *Job) flush() {
+	j.mu.Lock()
+	lines := j.buf
+	j.buf = nil
+	j.mu.Unlock()
+	if len(lines) == 0 {
+		return
+	}
+	if err := j.q.Jobs.AppendLog(context.Background(), lines); err != nil {
+		slog.Warn("cannot write job output", "job", j.ID, "lines", len(lines), "error", err)
+	}
+}
+
+// permanentError is a failure a retry would not fix.
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent marks err as a failure a retry would not fix, such as a bad
+// payload; the job fails without using its remaining attempts.
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+func isPermanent(err error) bool {
+	var p permanentError
+	return errors.As(err, &p)
+}
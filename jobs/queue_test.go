@@ -0,0 +1,254 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"CipherOps/audit"
+	"CipherOps/models"
+	"CipherOps/store"
+)
+
+// newTestQueue returns a queue over an in-memory store with handler as the
+// "test" kind. Its workers are not started; tests claim and run jobs
+// themselves with runNext, so no timing is involved.
+func newTestQueue(t *testing.T, maxAttempts int, handler Handler) (*Queue, store.Store) {
+	t.Helper()
+	st, err := store.OpenSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+	q := &Queue{
+		Jobs:          st.Jobs(),
+		MaxAttempts:   maxAttempts,
+		RetryDelay:    time.Minute,
+		MaxRetryDelay: 5 * time.Minute,
+	}
+	q.Handle("test", handler)
+	return q, st
+}
+
+// runNext claims the job due at the given time, as a worker would then, and
+// runs it.
+func runNext(t *testing.T, q *Queue, at time.Time) models.Job {
+	t.Helper()
+	j, err := q.Jobs.Claim(context.Background(), q.worker, at, at.Add(lease))
+	if err != nil {
+		t.Fatalf("claim at %s: %v", at.Format(time.TimeOnly), err)
+	}
+	q.run(context.Background(), j)
+	return get(t, q, j.ID)
+}
+
+func get(t *testing.T, q *Queue, id int64) models.Job {
+	t.Helper()
+	j, err := q.Jobs.Get(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+func enqueue(t *testing.T, q *Queue) models.Job {
+	t.Helper()
+	j, err := q.Enqueue(context.Background(), "test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return j
+}
+
+func TestBackoff(t *testing.T) {
+	q := &Queue{RetryDelay: time.Minute, MaxRetryDelay: 5 * time.Minute}
+	want := []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute}
+	for i, d := range want {
+		if got := q.backoff(i + 1); got != d {
+			t.Errorf("backoff(%d) = %s, want %s", i+1, got, d)
+		}
+	}
+	if got := q.backoff(100); got != 5*time.Minute {
+		t.Errorf("backoff(100) = %s, want the cap", got)
+	}
+}
+
+func TestRetryUntilMaxAttempts(t *testing.T) {
+	calls := 0
+	q, _ := newTestQueue(t, 5, func(context.Context, *Job) (any, error) {
+		calls++
+		return nil, errors.New("mirror unreachable")
+	})
+	j := enqueue(t, q)
+
+	// the retries wait 1, 2 and 4 minutes, then the 5 minute cap
+	at := time.Now()
+	for attempt, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute} {
+		start := time.Now()
+		j = runNext(t, q, at)
+		if j.Status != models.JobQueued || j.Attempts != attempt+1 || j.Error != "mirror unreachable" {
+			t.Fatalf("after attempt %d: %+v", attempt+1, j)
+		}
+		if wait := j.RunAt.Sub(start); wait < want || wait > want+5*time.Second {
+			t.Errorf("retry %d after %s, want %s", attempt+1, wait, want)
+		}
+		if _, err := q.Jobs.Claim(context.Background(), q.worker, j.RunAt.Add(-time.Second), j.RunAt); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("claimed retry %d before it was due: %v", attempt+1, err)
+		}
+		at = j.RunAt
+	}
+
+	j = runNext(t, q, at)
+	if j.Status != models.JobFailed || j.Attempts != 5 || calls != 5 || j.FinishedAt == nil {
+		t.Errorf("after the last attempt: %+v with %d calls, want failed", j, calls)
+	}
+}
+
+func TestPermanentFailureSkipsRetries(t *testing.T) {
+	q, _ := newTestQueue(t, 3, func(context.Context, *Job) (any, error) {
+		return nil, Permanent(errors.New("bad payload"))
+	})
+	enqueue(t, q)
+	if j := runNext(t, q, time.Now()); j.Status != models.JobFailed || j.Attempts != 1 {
+		t.Errorf("job = %+v, want failed after one attempt", j)
+	}
+}
+
+func TestLeaseExpiryReclaims(t *testing.T) {
+	for _, tt := range []struct {
+		maxAttempts int
+		status      string
+	}{
+		{2, models.JobSucceeded},
+		// the attempt that never ended was the last one
+		{1, models.JobFailed},
+	} {
+		calls := 0
+		q, _ := newTestQueue(t, tt.maxAttempts, func(context.Context, *Job) (any, error) {
+			calls++
+			return "done", nil
+		})
+		j := enqueue(t, q)
+
+		// a worker of another server takes the job and goes away
+		now := time.Now()
+		if _, err := q.Jobs.Claim(context.Background(), "gone", now, now.Add(lease)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := q.Jobs.Claim(context.Background(), q.worker, now.Add(lease/2), now.Add(lease)); !errors.Is(err, store.ErrNotFound) {
+			t.Fatalf("claimed a job under a live lease: %v", err)
+		}
+
+		j = runNext(t, q, now.Add(lease+time.Second))
+		if j.Status != tt.status || j.Attempts != 2 {
+			t.Errorf("max attempts %d: reclaimed job %+v, want %s after 2 attempts", tt.maxAttempts, j, tt.status)
+		}
+		if tt.status == models.JobFailed && (calls != 0 || !strings.Contains(j.Error, "did not finish")) {
+			t.Errorf("ran a job out of attempts: %d calls, error %q", calls, j.Error)
+		}
+		// the worker that went away cannot record anything any more
+		if _, err := q.Jobs.Heartbeat(context.Background(), j.ID, "gone", now.Add(2*lease)); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("heartbeat of the old worker: %v", err)
+		}
+	}
+}
+
+func TestCancelRunningJob(t *testing.T) {
+	started := make(chan struct{})
+	var cause error
+	q, _ := newTestQueue(t, 3, func(ctx context.Context, _ *Job) (any, error) {
+		close(started)
+		<-ctx.Done()
+		cause = context.Cause(ctx)
+		return nil, ctx.Err()
+	})
+	j := enqueue(t, q)
+
+	done := make(chan models.Job)
+	go func() {
+		claimed, err := q.Jobs.Claim(context.Background(), q.worker, time.Now(), time.Now().Add(lease))
+		if err != nil {
+			t.Error(err)
+			close(done)
+			return
+		}
+		q.run(context.Background(), claimed)
+		done <- claimed
+	}()
+	<-started
+	if _, err := q.Cancel(context.Background(), j.ID); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the job kept running after the cancel")
+	}
+
+	j = get(t, q, j.ID)
+	if j.Status != models.JobCancelled || j.Attempts != 1 || !errors.Is(cause, errCancelled) {
+		t.Errorf("job = %+v, cause %v; want cancelled without a retry", j, cause)
+	}
+	if _, err := q.Cancel(context.Background(), j.ID); !errors.Is(err, store.ErrConflict) {
+		t.Errorf("cancelling an ended job: %v, want ErrConflict", err)
+	}
+}
+
+func TestCancelQueuedJob(t *testing.T) {
+	calls := 0
+	q, _ := newTestQueue(t, 1, func(context.Context, *Job) (any, error) {
+		calls++
+		return nil, nil
+	})
+	j := enqueue(t, q)
+	if j, err := q.Cancel(context.Background(), j.ID); err != nil || j.Status != models.JobCancelled {
+		t.Fatalf("Cancel = %+v, %v", j, err)
+	}
+	if _, err := q.Jobs.Claim(context.Background(), q.worker, time.Now(), time.Now().Add(lease)); !errors.Is(err, store.ErrNotFound) || calls != 0 {
+		t.Errorf("claimed a cancelled job: %v", err)
+	}
+}
+
+func TestEnqueueKeepsActor(t *testing.T) {
+	var ran audit.Actor
+	q, st := newTestQueue(t, 1, func(ctx context.Context, _ *Job) (any, error) {
+		ran = audit.ActorFrom(ctx)
+		return nil, nil
+	})
+	alice := models.User{Username: "alice", Password: "hash", Role: "admin"}
+	if err := st.Users().Create(context.Background(), &alice); err != nil {
+		t.Fatal(err)
+	}
+	actor := audit.Actor{UserID: alice.ID, Username: "alice", Role: "admin", IP: "192.0.2.7"}
+	j, err := q.Enqueue(audit.WithActor(context.Background(), actor), "test", map[string]string{"package": "nginx"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the role is the one alice had when she asked, not when the job runs
+	if err := st.Users().SetRole(context.Background(), alice.ID, "user"); err != nil {
+		t.Fatal(err)
+	}
+	j = runNext(t, q, time.Now())
+	if j.Status != models.JobSucceeded || j.Role != "admin" || j.UserID != alice.ID {
+		t.Errorf("job = %+v", j)
+	}
+	if ran != actor {
+		t.Errorf("ran as %+v, want %+v", ran, actor)
+	}
+
+	// without an actor the job gets no role, and with it no privileges
+	enqueue(t, q)
+	if runNext(t, q, time.Now()); ran != (audit.Actor{}) {
+		t.Errorf("job enqueued without an actor ran as %+v", ran)
+	}
+}
+
+func TestEnqueueUnknownKind(t *testing.T) {
+	q, _ := newTestQueue(t, 1, func(context.Context, *Job) (any, error) { return nil, nil })
+	if _, err := q.Enqueue(context.Background(), "reboot", nil); err == nil {
+		t.Error("enqueued a kind without a handler")
+	}
+}
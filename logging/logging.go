@@ -0,0 +1,128 @@
+// Package logging sets up the structured logger. Everything logged through
+// slog or the standard log package passes a redaction layer that masks
+// passwords, tokens, cookies and DSNs before they reach the output.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// level is shared by the handlers Setup creates, so SetLevel applies at once.
+var level slog.LevelVar
+
+// Setup installs a redacting slog logger as the default for slog and the
+// standard log package. format is text or json, lvl one of debug, info,
+// warn or error.
+func Setup(w io.Writer, format, lvl string) error {
+	if err := SetLevel(lvl); err != nil {
+		return err
+	}
+	opts := &slog.HandlerOptions{Level: &level}
+	var h slog.Handler
+	switch strings.ToLower(format) {
+	case "text":
+		h = slog.NewTextHandler(w, opts)
+	case "json":
+		h = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("LOG_FORMAT must be text or json, not %q", format)
+	}
+	slog.SetDefault(slog.New(NewRedactingHandler(h)))
+	return nil
+}
+
+// SetLevel changes the minimum level of the default logger.
+func SetLevel(lvl string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(lvl)); err != nil {
+		return fmt.Errorf("LOG_LEVEL: %w", err)
+	}
+	level.Set(l)
+	return nil
+}
+
+// redactingHandler masks secrets in the message and attributes of every
+// record before handing it on.
+type redactingHandler struct {
+	next slog.Handler
+}
+
+func NewRedactingHandler(next slog.Handler) slog.Handler {
+	return redactingHandler{next: next}
+}
+
+func (h redactingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h redactingHandler) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, Redact(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.next.Handle(ctx, out)
+}
+
+func (h redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = redactAttr(a)
+	}
+	return redactingHandler{next: h.next.WithAttrs(redacted)}
+}
+
+func (h redactingHandler) WithGroup(name string) slog.Handler {
+	return redactingHandler{next: h.next.WithGroup(name)}
+}
+
+func redactAttr(a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+	if a.Value.Kind() == slog.KindGroup {
+		attrs := a.Value.Group()
+		redacted := make([]slog.Attr, len(attrs))
+		for i, ga := range attrs {
+			redacted[i] = redactAttr(ga)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(redacted...)}
+	}
+	if IsSecretKey(a.Key) {
+		return slog.String(a.Key, Mask)
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, Redact(a.Value.String()))
+	case slog.KindAny:
+		switch v := a.Value.Any().(type) {
+		case error:
+			return slog.String(a.Key, Redact(v.Error()))
+		case []string:
+			return slog.Any(a.Key, RedactArgs(v))
+		case fmt.Stringer:
+			return slog.String(a.Key, Redact(v.String()))
+		}
+	}
+	return a
+}
+
+// redactingWriter masks secrets in whatever is written through it.
+type redactingWriter struct {
+	w io.Writer
+}
+
+// NewRedactingWriter wraps writers that bypass slog, such as the panic dumps
+// of gin's recovery middleware, which include the request headers.
+func NewRedactingWriter(w io.Writer) io.Writer {
+	return redactingWriter{w: w}
+}
+
+func (rw redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(rw.w, Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
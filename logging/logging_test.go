@@ -0,0 +1,86 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+// record logs through a redacting JSON handler and returns the fields of the
+// line written.
+func record(t *testing.T, log func(*slog.Logger)) map[string]any {
+	t.Helper()
+	var buf bytes.Buffer
+	log(slog.New(NewRedactingHandler(slog.NewJSONHandler(&buf, nil))))
+	var fields map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &fields); err != nil {
+		t.Fatalf("%v in %q", err, buf.String())
+	}
+	return fields
+}
+
+func TestRedactingHandler(t *testing.T) {
+	tests := []struct {
+		name  string
+		log   func(*slog.Logger)
+		key   string
+		value any
+	}{
+		{"secret key", func(l *slog.Logger) { l.Info("login", "password", "hunter2") }, "password", Mask},
+		{"secret key of another kind", func(l *slog.Logger) { l.Info("login", "pin_secret", 1234) }, "pin_secret", Mask},
+		{"plain key", func(l *slog.Logger) { l.Info("login", "username", "alice") }, "username", "alice"},
+		{"secret in a value", func(l *slog.Logger) { l.Info("connect", "dsn_host", "postgres://u:hunter2@db/x") }, "dsn_host", Mask},
+		{"value text", func(l *slog.Logger) { l.Info("connect", "url", "postgres://u:hunter2@db/x") }, "url", "postgres://u:" + Mask + "@db/x"},
+		{"error", func(l *slog.Logger) { l.Warn("failed", "error", errors.New("auth failed for token=abc")) }, "error", "auth failed for token=" + Mask},
+		{"args", func(l *slog.Logger) { l.Info("run", "args", []string{"--password", "hunter2"}) }, "args", []any{"--password", Mask}},
+		{"message", func(l *slog.Logger) { l.Info("bind with password=hunter2") }, "msg", "bind with password=" + Mask},
+		{"with attrs", func(l *slog.Logger) { l.With("api_token", "cop_x").Info("request") }, "api_token", Mask},
+		{"group", func(l *slog.Logger) { l.Info("request", slog.Group("headers", "cookie", "session=abc")) }, "headers", map[string]any{"cookie": Mask}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields := record(t, tt.log)
+			got, _ := json.Marshal(fields[tt.key])
+			want, _ := json.Marshal(tt.value)
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s = %s, want %s", tt.key, got, want)
+			}
+		})
+	}
+}
+
+func TestSetup(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	var buf bytes.Buffer
+	if err := Setup(&buf, "text", "warn"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetLevel("info")
+	slog.Info("hidden")
+	slog.Warn("shown", "token", "abc")
+	if out := buf.String(); strings.Contains(out, "hidden") || !strings.Contains(out, "token="+Mask) {
+		t.Errorf("logged %q", out)
+	}
+
+	if err := Setup(&buf, "xml", "info"); err == nil {
+		t.Error("Setup accepted the xml format")
+	}
+	if err := SetLevel("loud"); err == nil {
+		t.Error("SetLevel accepted loud")
+	}
+}
+
+func TestRedactingWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewRedactingWriter(&buf)
+	n, err := w.Write([]byte("Authorization: Bearer abcdefgh12345678\n"))
+	if err != nil || n != 39 {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	if buf.String() != "Authorization: "+Mask+"\n" {
+		t.Errorf("wrote %q", buf.String())
+	}
+}
@@ -0,0 +1,87 @@
+package mailer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+)
+
+// SMTPMailer sends through an SMTP relay. Port 465 uses implicit TLS, any
+// other port upgrades with STARTTLS when RequireTLS is set or the server
+// offers it.
+type SMTPMailer struct {
+	Host       string
+	Port       string
+	Username   string
+	Password   string
+	From       string
+	RequireTLS bool
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	data, err := render(m.From, msg)
+	if err != nil {
+		return err
+	}
+	addr := net.JoinHostPort(m.Host, m.Port)
+	tlsConfig := &tls.Config{ServerName: m.Host}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return fmt.Errorf("cannot reach SMTP server %s: %w", addr, err)
+	}
+	if m.Port == "465" {
+		conn = tls.Client(conn, tlsConfig)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, m.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if m.Port != "465" {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				return fmt.Errorf("SMTP STARTTLS failed: %w", err)
+			}
+		} else if m.RequireTLS {
+			return fmt.Errorf("SMTP server %s does not offer STARTTLS", addr)
+		}
+	}
+	if m.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.Username, m.Password, m.Host)); err != nil {
+			return fmt.Errorf("SMTP authentication failed: %w", err)
+		}
+	}
+	// the envelope takes the bare address, From may carry a display name
+	sender, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return fmt.Errorf("invalid sender %q: %w", m.From, err)
+	}
+	if err := client.Mail(sender.Address); err != nil {
+		return err
+	}
+	if err := client.Rcpt(msg.To); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -1,24 +1,285 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
 	// local imports
+	"CipherOps/agent"
+	"CipherOps/audit"
 	"CipherOps/automation"
 	"CipherOps/config"
 	"CipherOps/db"
+	"CipherOps/helper"
+	"CipherOps/inventory"
+	"CipherOps/jobs"
+	"CipherOps/logging"
 	"CipherOps/routes"
+	"CipherOps/secrets"
+	"CipherOps/store"
+	"CipherOps/utils"
 )
 
 func main() {
-	// Automate
-	automate.SetupNecessaryPkgs()
+	// needs no configuration, it prepares values for it
+	if len(os.Args) > 1 && os.Args[1] == "secret" {
+		if err := secrets.RunSecretCommand(os.Args[2:], os.Stdin, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	cfg, args, err := config.Load(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := logging.Setup(os.Stderr, cfg.LogFormat, cfg.LogLevel); err != nil {
+		log.Fatal(err)
+	}
+	var local utils.Executor = utils.LocalExecutor{Escalation: cfg.PrivilegeEscalation}
+	if cfg.PrivilegeEscalation == utils.EscalateHelper {
+		local = helper.Executor{Socket: cfg.HelperSocket}
+	}
+	// nothing runs here that the command policy does not allow
+	executor := utils.PolicyExecutor{Exec: utils.NewExecutor(local, cfg.DryRun)}
+	utils.SetCommandTimeout(cfg.CommandTimeout)
+	ctx := context.Background()
+
+	if len(args) > 0 && args[0] == "migrate" {
+		if cfg.DBDriver == "sqlite" {
+			log.Fatal("migrate manages the Postgres schema, SQLite applies its schema on open")
+		}
+		conn, err := db.Connect(ctx, cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := db.RunMigrateCommand(ctx, conn, args[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(args) > 0 {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		os.Exit(2)
+	}
 
-	cfg := config.LoadConfig()
-	dbConnection := db.InitDB(cfg)
-	router := routes.SetupRouter(dbConnection)
+	live := config.NewReloader(cfg, os.Args[1:])
+	if err := watchSettings(live); err != nil {
+		log.Fatal(err)
+	}
+	go live.Watch(ctx)
+
+	// the server always starts; in degraded mode it shows a maintenance page
+	// until the database is reachable and then switches to the panel
+	var handler atomic.Pointer[http.Handler]
+	setHandler := func(h http.Handler) { handler.Store(&h) }
 
-	log.Println("Server: http://localhost:8080")
-	if err := router.Run(":8080"); err != nil {
+	st, err := openStore(ctx, live, cfg)
+	switch {
+	case err == nil:
+		setHandler(startPanel(live, st, executor))
+	case cfg.DBDegradedStartup && cfg.DBDriver != "sqlite":
+		slog.Warn("starting in maintenance mode", "error", err)
+		setHandler(routes.MaintenanceRouter(cfg))
+		go func() {
+			retry := cfg
+			retry.DBConnectAttempts = 0
+			for {
+				st, err := openStore(ctx, live, retry)
+				if err == nil {
+					setHandler(startPanel(live, st, executor))
+					slog.Info("database is back, leaving maintenance mode")
+					return
+				}
+				// reachable but unusable, e.g. a failed migration; keep
+				// the maintenance page up until someone fixes it
+				slog.Error("database not usable, staying in maintenance mode", "error", err, "retry_in", retry.DBRetryMaxDelay)
+				time.Sleep(retry.DBRetryMaxDelay)
+			}
+		}()
+	default:
+		log.Fatal(err)
+	}
+
+	server := &http.Server{
+		Addr: cfg.ListenAddr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			(*handler.Load()).ServeHTTP(w, r)
+		}),
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	if cfg.TLSCertFile != "" {
+		slog.Info("server listening", "url", "https://"+cfg.ListenAddr)
+		err = server.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+	} else {
+		slog.Info("server listening", "url", "http://"+cfg.ListenAddr)
+		err = server.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		log.Fatalf("server failed: %v", err)
 	}
-}
\ No newline at end of file
+}
+
+// openStore opens the database of cfg.DBDriver. The Postgres pool follows
+// configuration reloads.
+func openStore(ctx context.Context, live *config.Reloader, cfg config.Config) (store.Store, error) {
+	if cfg.DBDriver == "sqlite" {
+		return store.OpenSQLite(cfg.DBPath)
+	}
+	dbConnection, err := db.InitDB(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	live.Subscribe([]string{"DBMaxOpenConns", "DBMaxIdleConns", "DBConnMaxLifetime", "DBConnMaxIdleTime"}, nil,
+		func(cfg config.Config) {
+			dbConnection.SetMaxOpenConns(cfg.DBMaxOpenConns)
+			dbConnection.SetMaxIdleConns(cfg.DBMaxIdleConns)
+			dbConnection.SetConnMaxLifetime(cfg.DBConnMaxLifetime)
+			dbConnection.SetConnMaxIdleTime(cfg.DBConnMaxIdleTime)
+		})
+	return store.NewPostgres(dbConnection), nil
+}
+
+// startPanel wires the services that need the database and returns the
+// panel router.
+func startPanel(live *config.Reloader, st store.Store, executor utils.Executor) http.Handler {
+	// privileged commands are audited from the start
+	auditKey := live.Current().AuditKey
+	if auditKey == "" {
+		slog.Warn("AUDIT_KEY is not set, the audit log chain is not keyed")
+	}
+	utils.AuditLog = &audit.Logger{Store: st, Key: audit.NewKey(auditKey)}
+	// what the panel does by itself runs with the system role
+	system := audit.WithActor(context.Background(), audit.SystemActor)
+	if adopted, err := utils.AuditLog.AdoptKey(system); err != nil {
+		slog.Error("cannot adopt the audit key", "error", err)
+	} else if adopted {
+		slog.Warn("audit key adopted, the entries before it stay unkeyed")
+	}
+
+	// Automate
+	automate.SetupNecessaryPkgs(system, executor)
+
+	cfg := live.Current()
+	inv := &inventory.Inventory{
+		Hosts: st.Hosts(),
+		Local: executor,
+		SSH: utils.SSHConfig{
+			User:           cfg.SSHUser,
+			KeyFile:        cfg.SSHKeyFile,
+			KeyPassphrase:  cfg.SSHKeyPassphrase,
+			KnownHostsFile: cfg.SSHKnownHostsFile,
+			Escalation:     cfg.SSHEscalation,
+			SudoPassword:   cfg.SSHSudoPassword,
+			ConnectTimeout: cfg.SSHConnectTimeout,
+		},
+		Pool:        &utils.SSHPool{},
+		DryRun:      cfg.DryRun,
+		Parallelism: cfg.FanOutParallelism,
+	}
+	var agents *agent.Server
+	if cfg.AgentListenAddr != "" {
+		ca, err := agent.LoadOrCreateCA(cfg.AgentCACertFile, cfg.AgentCAKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		agents = &agent.Server{
+			Agents:   st.Agents(),
+			CA:       ca,
+			CertTTL:  cfg.AgentCertTTL,
+			TokenTTL: cfg.AgentTokenTTL,
+			URL:      cfg.AgentPublicURL,
+		}
+		inv.Agents = agents
+		go func() {
+			names := strings.Split(cfg.AgentServerNames, ",")
+			for i := range names {
+				names[i] = strings.TrimSpace(names[i])
+			}
+			if err := agents.ListenAndServe(cfg.AgentListenAddr, names); err != nil {
+				log.Fatalf("agent listener failed: %v", err)
+			}
+		}()
+	}
+	if cfg.FactsInterval > 0 {
+		go inv.WatchFacts(system, cfg.FactsInterval)
+	}
+
+	queue := &jobs.Queue{
+		Jobs:          st.Jobs(),
+		Workers:       cfg.JobWorkers,
+		PollInterval:  cfg.JobPollInterval,
+		MaxAttempts:   cfg.JobMaxAttempts,
+		RetryDelay:    cfg.JobRetryDelay,
+		MaxRetryDelay: cfg.JobMaxRetryDelay,
+	}
+	queue.Handle(inventory.JobFleetPackages, inv.PackagesJob)
+	go queue.Run(system)
+
+	return routes.SetupRouter(st, live, inv, agents, queue)
+}
+
+// watchSettings loads the policy and template files and subscribes the
+// settings that do not need the database to configuration reloads.
+func watchSettings(live *config.Reloader) error {
+	cfg := live.Current()
+	policy, err := utils.LoadFirewallPolicy(cfg.FirewallPolicyFile)
+	if err != nil {
+		return err
+	}
+	utils.SetFirewallPolicy(policy)
+	templates, err := utils.LoadContainerTemplates(cfg.ContainerTemplatesFile)
+	if err != nil {
+		return err
+	}
+	utils.SetContainerTemplates(templates)
+	commands, err := utils.LoadCommandPolicy(cfg.CommandPolicyFile)
+	if err != nil {
+		return err
+	}
+	utils.SetCommandPolicy(commands)
+
+	live.Subscribe([]string{"LogLevel"}, nil, func(cfg config.Config) {
+		if err := logging.SetLevel(cfg.LogLevel); err != nil {
+			slog.Error("log level not changed", "err", err)
+		}
+	})
+	live.Subscribe([]string{"CommandTimeout"}, nil, func(cfg config.Config) {
+		utils.SetCommandTimeout(cfg.CommandTimeout)
+	})
+
+	// the files are parsed in check so a broken edit rejects the reload
+	var nextPolicy utils.FirewallPolicy
+	live.Subscribe([]string{"FirewallPolicyFile"}, func(cfg config.Config) (err error) {
+		nextPolicy, err = utils.LoadFirewallPolicy(cfg.FirewallPolicyFile)
+		return err
+	}, func(config.Config) {
+		utils.SetFirewallPolicy(nextPolicy)
+	})
+	var nextTemplates map[string]utils.ContainerTemplate
+	live.Subscribe([]string{"ContainerTemplatesFile"}, func(cfg config.Config) (err error) {
+		nextTemplates, err = utils.LoadContainerTemplates(cfg.ContainerTemplatesFile)
+		return err
+	}, func(config.Config) {
+		utils.SetContainerTemplates(nextTemplates)
+	})
+	var nextCommands utils.CommandPolicy
+	live.Subscribe([]string{"CommandPolicyFile"}, func(cfg config.Config) (err error) {
+		nextCommands, err = utils.LoadCommandPolicy(cfg.CommandPolicyFile)
+		return err
+	}, func(config.Config) {
+		utils.SetCommandPolicy(nextCommands)
+	})
+	return nil
+}
@@ -0,0 +1,53 @@
+package middlewares
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"CipherOps/audit"
+)
+
+// AuditActor stores the authenticated user and client IP in the request
+// context, so privileged commands run on behalf of the request are
+// attributed to them. Use it after ValidateSession.
+func AuditActor() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		actor := audit.Actor{UserID: ctx.GetInt("user_id"), Role: ctx.GetString("role"), IP: ctx.ClientIP()}
+		ctx.Request = ctx.Request.WithContext(audit.WithActor(ctx.Request.Context(), actor))
+		ctx.Next()
+	}
+}
+
+// AuditRequests records every state-changing request of the group, with its
+// route, path and response status.
+func AuditRequests(logger *audit.Logger) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.Next()
+
+		switch ctx.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return
+		}
+		status := ctx.Writer.Status()
+		entry := audit.Entry{
+			Action:  "http",
+			Command: ctx.Request.Method + " " + ctx.FullPath(),
+			Args:    []string{ctx.Request.URL.Path},
+			Success: status < http.StatusBadRequest,
+			Output:  strconv.Itoa(status),
+		}
+		if len(ctx.Errors) > 0 {
+			entry.Error = ctx.Errors.String()
+		}
+		recordCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx.Request.Context()), 10*time.Second)
+		defer cancel()
+		if _, err := logger.Record(recordCtx, audit.ActorFrom(ctx.Request.Context()), entry); err != nil {
+			slog.Error("cannot write audit record", "path", ctx.Request.URL.Path, "error", err)
+		}
+	}
+}
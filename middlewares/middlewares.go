@@ -1,26 +1,150 @@
 package middlewares
 
 import (
-	"log"
+	"errors"
+	"log/slog"
 	"net/http"
+	"strings"
+	"time"
 	"github.com/gin-gonic/gin"
+	"CipherOps/auth"
+	"CipherOps/store"
 )
 
-func ValidateSession() gin.HandlerFunc {
+// ValidateSession accepts either the session cookie set by the login flow or
+// an "Authorization: Bearer" personal access token. Cookies are checked
+// against the server-side session, so revoked sessions stop working at once.
+func ValidateSession(tokens store.APITokenRepository, sessions *auth.SessionStore) gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		sessionCookie, err := ctx.Cookie("session")
+		if header := ctx.GetHeader("Authorization"); header != "" {
+			validateAPIToken(ctx, tokens, header)
+			return
+		}
+
+		sessionCookie, err := ctx.Cookie(auth.SessionCookie)
 		if err != nil {
 			// ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
 			// 	"error": "missing session cookie",
 			// })
 			// return
 			ctx.Redirect(http.StatusSeeOther, "/login")
-            ctx.Abort()
+			ctx.Abort()
+			return
 		}
-		log.Println("DEBUG: SessionCookie=",sessionCookie)
-		
-		ctx.Set("session", sessionCookie)
+
+		session, sessionID, err := sessions.Validate(ctx.Request.Context(), sessionCookie)
+		if err != nil && !errors.Is(err, auth.ErrInvalidSession) {
+			ctx.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil || session.Stage == auth.StageMFA {
+			ctx.SetCookie(auth.SessionCookie, "", -1, "/", "", false, true)
+			ctx.Redirect(http.StatusSeeOther, "/login")
+			ctx.Abort()
+			return
+		}
+
+		ctx.Set("session_id", sessionID)
+		ctx.Set("user_id", session.UserID)
+		ctx.Set("role", session.Role)
+		ctx.Set("session_stage", string(session.Stage))
+		ctx.Set("auth_method", "session")
 
 		ctx.Next()
 	}
-}
\ No newline at end of file
+}
+
+func validateAPIToken(ctx *gin.Context, tokens store.APITokenRepository, header string) {
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || strings.TrimSpace(token) == "" {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "malformed Authorization header"})
+		return
+	}
+
+	apiToken, err := tokens.GetByHash(ctx.Request.Context(), auth.HashAPIToken(strings.TrimSpace(token)))
+	if errors.Is(err, store.ErrNotFound) {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid API token"})
+		return
+	}
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	now := time.Now()
+	if apiToken.ExpiresAt != nil && now.After(*apiToken.ExpiresAt) {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "API token expired"})
+		return
+	}
+	if err := tokens.Touch(ctx.Request.Context(), apiToken.ID, now); err != nil {
+		slog.Warn("cannot update API token last use", "user_id", apiToken.UserID, "error", err)
+	}
+
+	ctx.Set("user_id", apiToken.UserID)
+	ctx.Set("role", apiToken.Role)
+	ctx.Set("session_stage", string(auth.StageFull))
+	ctx.Set("auth_method", "token")
+	ctx.Set("token_id", apiToken.ID)
+	ctx.Set("token_scopes", apiToken.Scopes)
+
+	ctx.Next()
+}
+
+// RequireScope checks the scopes of API token requests. Browser sessions are
+// not scoped and always pass.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if ctx.GetString("auth_method") == "token" && !auth.HasScope(ctx.GetStringSlice("token_scopes"), scope) {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": "API token lacks the " + scope + " scope",
+			})
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// RequireBrowserSession keeps API tokens away from account management, so a
+// leaked token cannot mint new tokens or change the second factor.
+func RequireBrowserSession() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if ctx.GetString("auth_method") != "session" {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": "this endpoint requires an interactive login",
+			})
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// RequireFullSession rejects sessions that still have to enroll a second
+// factor. Must run after ValidateSession.
+func RequireFullSession() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if ctx.GetString("session_stage") != string(auth.StageFull) {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error":      "two-factor authentication enrollment required",
+				"enroll_url": "/panel/2fa/enroll",
+			})
+			return
+		}
+		ctx.Next()
+	}
+}
+
+// RequireRole only lets through sessions whose role is one of roles.
+// Must run after ValidateSession.
+func RequireRole(roles ...string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		role := ctx.GetString("role")
+		for _, r := range roles {
+			if r == role {
+				ctx.Next()
+				return
+			}
+		}
+		ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"error": "insufficient role",
+		})
+	}
+}
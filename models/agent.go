@@ -0,0 +1,32 @@
+package models
+
+import "time"
+
+// Agent is the enrolled cipherops-agent of a host. The agent proves who it
+// is with the certificate whose serial is recorded here; enrolling again
+// replaces it.
+type Agent struct {
+	HostID int    `json:"host_id"`
+	Host   string `json:"host"`
+	// hex serial of the client certificate issued at enrollment or the last
+	// renewal
+	CertSerial string    `json:"cert_serial"`
+	CertExpiry time.Time `json:"cert_expiry"`
+	EnrolledAt time.Time `json:"enrolled_at"`
+	// last time the agent connected or answered, zero if never
+	LastSeen  time.Time  `json:"last_seen"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// AgentToken is a one-time enrollment token for the agent of a host. Only
+// its hash is stored.
+type AgentToken struct {
+	ID        int        `json:"id"`
+	HostID    int        `json:"host_id"`
+	Host      string     `json:"host"`
+	TokenHash string     `json:"-"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	CreatedBy int        `json:"created_by,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+}
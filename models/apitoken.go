@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// APIToken is a personal access token. Only the SHA-256 of the token is
+// stored.
+type APIToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"-"`
+	Name       string     `json:"name"`
+	TokenHash  string     `json:"-"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	// current role of the owner, filled in on lookup by hash
+	Role string `json:"-"`
+}
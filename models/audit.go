@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// AuditEntry is one link of the audit hash chain, see package audit.
+type AuditEntry struct {
+	ID       int64     `json:"id"`
+	Time     time.Time `json:"time"`
+	UserID   int       `json:"user_id,omitempty"`
+	Username string    `json:"username"`
+	IP       string    `json:"ip,omitempty"`
+	// the managed host a command ran on, empty for this machine
+	Host string `json:"host,omitempty"`
+	// package, service, firewall, container, command or http
+	Action   string   `json:"action"`
+	Command  string   `json:"command"`
+	Args     []string `json:"args"`
+	Success  bool     `json:"success"`
+	Output   string   `json:"output,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	PrevHash string   `json:"prev_hash"`
+	Hash     string   `json:"hash"`
+}
@@ -0,0 +1,19 @@
+package models
+
+import "time"
+
+// Container is a container the panel created from one of its service
+// templates.
+type Container struct {
+	ID    int               `json:"id"`
+	Name  string            `json:"name"`
+	Image string            `json:"image"`
+	Port  string            `json:"port"`
+	Env   map[string]string `json:"env"`
+	// ID assigned by the container engine, empty until created
+	EngineID  string    `json:"engine_id"`
+	Status    string    `json:"status"`
+	CreatedBy int       `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
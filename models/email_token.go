@@ -0,0 +1,13 @@
+package models
+
+import "time"
+
+// EmailToken backs a link sent by mail; the signed link carries the ID.
+type EmailToken struct {
+	ID        string
+	UserID    int
+	Purpose   string
+	Email     string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+}
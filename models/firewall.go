@@ -0,0 +1,23 @@
+package models
+
+import "time"
+
+// FirewallRule is a rule managed by the panel. Rules apply in Position order.
+type FirewallRule struct {
+	ID int `json:"id"`
+	// in or out
+	Direction string `json:"direction"`
+	// tcp, udp, icmp or any
+	Protocol string `json:"protocol"`
+	// single port or range like 8000:8100, empty for all
+	Port string `json:"port"`
+	// CIDR the rule matches, empty for any
+	Source string `json:"source"`
+	// allow or deny
+	Action    string    `json:"action"`
+	Comment   string    `json:"comment"`
+	Enabled   bool      `json:"enabled"`
+	Position  int       `json:"position"`
+	CreatedBy int       `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,47 @@
+package models
+
+import "time"
+
+// Host is a machine the panel manages, over SSH, through its cipherops-agent
+// for the address "agent" or, for the address "local", the panel's own
+// machine.
+type Host struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+	// host name or IP address, "agent" or "local"
+	Address string `json:"address"`
+	Port    int    `json:"port"`
+	// SSH login, SSH_USER when empty
+	User   string            `json:"user,omitempty"`
+	Labels map[string]string `json:"labels"`
+	// names of the groups the host is in
+	Groups    []string  `json:"groups"`
+	Facts     HostFacts `json:"facts"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// HostFacts is what facts gathering last found out about a host.
+type HostFacts struct {
+	DistroID      string `json:"distro_id"`
+	DistroLike    string `json:"distro_like"`
+	DistroName    string `json:"distro_name"`
+	DistroVersion string `json:"distro_version"`
+	// apt, dnf, pacman, zypper or generic
+	Installer string `json:"installer"`
+	// systemd or sysv
+	ServiceManager string `json:"service_manager"`
+	// ufw, firewalld, nftables, iptables or none
+	FirewallBackend string `json:"firewall_backend"`
+	// zero until facts were gathered once
+	GatheredAt time.Time `json:"gathered_at"`
+	// why the last gathering failed; the other facts are from the last
+	// one that worked
+	Error string `json:"error,omitempty"`
+}
+
+// HostGroup is a named set of hosts, a target for fleet-wide actions.
+type HostGroup struct {
+	ID    int      `json:"id"`
+	Name  string   `json:"name"`
+	Hosts []string `json:"hosts"`
+}
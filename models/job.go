@@ -0,0 +1,62 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Job states. A queued job waits for RunAt, a running one is held by a
+// worker; the other three are final.
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+	JobCancelled = "cancelled"
+)
+
+// Job is a long operation, such as a package install, run in the background
+// by a worker of the job queue. Payload and Result are JSON.
+type Job struct {
+	ID          int64           `json:"id"`
+	Kind        string          `json:"kind"`
+	Payload     json.RawMessage `json:"payload"`
+	Status      string          `json:"status"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	// not run before, later for a retry
+	RunAt time.Time `json:"run_at"`
+	// percent done and what is happening, as the job reports it
+	Progress        int             `json:"progress"`
+	ProgressMessage string          `json:"progress_message,omitempty"`
+	Result          json.RawMessage `json:"result,omitempty"`
+	// the last error, kept while a retry is waiting
+	Error           string `json:"error,omitempty"`
+	CancelRequested bool   `json:"cancel_requested,omitempty"`
+	// who enqueued the job; its commands are audited in their name
+	UserID   int    `json:"user_id,omitempty"`
+	Username string `json:"username,omitempty"`
+	Role     string `json:"role,omitempty"`
+	IP       string `json:"-"`
+	// the worker holding a running job, and until when; a job whose lease
+	// runs out, because its server stopped, is picked up again
+	LockedBy    string     `json:"-"`
+	LockedUntil time.Time  `json:"-"`
+	CreatedAt   time.Time  `json:"created_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+}
+
+// Final reports whether the job has ended for good.
+func (j Job) Final() bool {
+	return j.Status == JobSucceeded || j.Status == JobFailed || j.Status == JobCancelled
+}
+
+// JobLogLine is a line of output of a job, kept for as long as the job.
+type JobLogLine struct {
+	ID     int64     `json:"id"`
+	JobID  int64     `json:"-"`
+	At     time.Time `json:"at"`
+	Stream string    `json:"stream"`
+	Text   string    `json:"text"`
+}
@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+// LoginAttempt is one entry of the login audit.
+type LoginAttempt struct {
+	Username  string    `json:"username"`
+	IP        string    `json:"ip"`
+	Success   bool      `json:"success"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// IPFailures aggregates failed logins of one client address.
+type IPFailures struct {
+	IP       string    `json:"ip"`
+	Failures int       `json:"failures"`
+	Last     time.Time `json:"last_failure_at"`
+}
+
+// Lockout counts the recent failed logins of an account.
+type Lockout struct {
+	Username      string     `json:"username"`
+	Failures      int        `json:"failures"`
+	LastFailureAt time.Time  `json:"last_failure_at"`
+	LockedUntil   *time.Time `json:"locked_until"`
+}
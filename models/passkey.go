@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// Passkey is a registered WebAuthn credential. Data is the credential as
+// the webauthn library marshals it.
+type Passkey struct {
+	ID           int        `json:"id"`
+	UserID       int        `json:"-"`
+	CredentialID []byte     `json:"-"`
+	Name         string     `json:"name"`
+	Data         []byte     `json:"-"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastUsedAt   *time.Time `json:"last_used_at"`
+}
+
+// WebAuthnCeremony is a pending registration or login. UserID is 0 for
+// discoverable logins and for logins of a Username that cannot use a passkey.
+type WebAuthnCeremony struct {
+	ID        string
+	UserID    int
+	Username  string
+	Data      []byte
+	ExpiresAt time.Time
+}
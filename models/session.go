@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// Session is a server-side login; the cookie carries a handle whose SHA-256
+// is TokenHash.
+type Session struct {
+	ID         int64
+	TokenHash  string
+	UserID     int
+	Stage      string
+	IP         string
+	UserAgent  string
+	CreatedAt  time.Time
+	LastSeenAt time.Time
+	ExpiresAt  time.Time
+	RevokedAt  *time.Time
+}
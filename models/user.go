@@ -4,4 +4,18 @@ type User struct {
 	ID    int    `json:"id"`
 	Username  string `json:"username"`
 	Password string `json:"password"`
+	Role        string `json:"role"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	TOTPSecret  string `json:"-"`
+	TOTPEnabled bool   `json:"totp_enabled"`
+	// time step of the last TOTP code accepted, older codes are replays
+	TOTPLastStep int64 `json:"-"`
+	// local, ldap or oidc; only local users have a password hash
+	AuthProvider string `json:"auth_provider"`
+	// identity of users provisioned through OpenID Connect
+	OIDCIssuer  string `json:"-"`
+	OIDCSubject string `json:"-"`
+	// WebAuthn user handle, created on the first passkey registration
+	WebAuthnID []byte `json:"-"`
 }
@@ -0,0 +1,43 @@
+package routes
+
+import (
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"CipherOps/config"
+	"CipherOps/handlers"
+	"CipherOps/middlewares"
+)
+
+// MaintenanceRouter is served while the database is unreachable: every page
+// answers 503 with a maintenance notice and the health probe reports the
+// outage.
+func MaintenanceRouter(cfg config.Config) *gin.Engine {
+	router := newEngine()
+	router.Use(middlewares.SecurityHeaders(middlewares.SecurityHeadersConfig{
+		ContentSecurityPolicy:   cfg.ContentSecurityPolicy,
+		StrictTransportSecurity: cfg.StrictTransportSecurity,
+		FrameOptions:            cfg.FrameOptions,
+		ReferrerPolicy:          cfg.ReferrerPolicy,
+		PermissionsPolicy:       cfg.PermissionsPolicy,
+	}))
+	router.Static("/static", "./static")
+	router.GET("/health/db", handlers.DBHealthHandler(nil))
+
+	page, err := os.ReadFile("./static/maintenance.html")
+	if err != nil {
+		page = []byte("The panel is under maintenance, try again in a few minutes.\n")
+	}
+	router.NoRoute(func(ctx *gin.Context) {
+		ctx.Header("Retry-After", "30")
+		if strings.Contains(ctx.GetHeader("Accept"), "text/html") {
+			ctx.Data(http.StatusServiceUnavailable, "text/html; charset=utf-8", page)
+			return
+		}
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": "database unavailable, the panel is in maintenance mode"})
+	})
+	return router
+}
@@ -1,31 +1,260 @@
 package routes
 
 import (
-	"database/sql"
+	"context"
+	"log"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
 	"github.com/gin-gonic/gin"
+	"CipherOps/agent"
+	"CipherOps/audit"
+	"CipherOps/auth"
+	"CipherOps/config"
 	"CipherOps/handlers"
+	"CipherOps/inventory"
+	"CipherOps/jobs"
+	"CipherOps/logging"
+	"CipherOps/mailer"
 	"CipherOps/middlewares"
+	"CipherOps/store"
 )
 
-func SetupRouter(db *sql.DB) *gin.Engine {
-	router := gin.Default()
+// SetupRouter builds the panel router. agents is nil while the agent
+// listener is off, and the agent routes are left out.
+func SetupRouter(st store.Store, live *config.Reloader, inv *inventory.Inventory, agents *agent.Server, queue *jobs.Queue) *gin.Engine {
+	cfg := live.Current()
+	router := newEngine()
+	sessionKey := auth.NewSessionKey(cfg.SessionSecret)
+	router.Use(middlewares.SecurityHeaders(middlewares.SecurityHeadersConfig{
+		ContentSecurityPolicy:   cfg.ContentSecurityPolicy,
+		StrictTransportSecurity: cfg.StrictTransportSecurity,
+		FrameOptions:            cfg.FrameOptions,
+		ReferrerPolicy:          cfg.ReferrerPolicy,
+		PermissionsPolicy:       cfg.PermissionsPolicy,
+	}))
+	router.Use(middlewares.CSRF(sessionKey))
 	router.Static("/static", "./static")
 
+	webAuthn, err := auth.NewWebAuthn(cfg.WebAuthnRPID, cfg.TOTPIssuer, cfg.WebAuthnOrigins)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	router.GET("/health/db", handlers.DBHealthHandler(st))
+
 	router.GET("/", func (ctx *gin.Context) {
 		ctx.File("./static/index.html")
 	})
 	router.GET("/login", func (ctx *gin.Context) {
 		ctx.File("./static/login.html")
 	})
+	throttle := auth.NewLoginThrottle(st.Logins(), sessionKey, throttleLimits(cfg))
+	live.Subscribe([]string{"LoginWindow", "LoginBaseDelay", "LoginMaxDelay", "LoginMaxFailures", "LoginLockout",
+		"LoginIPFreeFailures", "LoginPoWDifficulty", "LoginPoWAfter"}, nil, func(cfg config.Config) {
+		throttle.SetLimits(throttleLimits(cfg))
+	})
+	sessions := &auth.SessionStore{Store: st, Key: sessionKey, IdleTimeout: cfg.SessionIdleTimeout}
+	router.POST("/login", handlers.LoginHandler(st.Users(), st.MFA(), passwordProviders(st, cfg), throttle, sessions))
+	router.GET("/login/challenge", handlers.LoginChallengeHandler(throttle))
+	router.GET("/login/2fa", func (ctx *gin.Context) {
+		ctx.File("./static/login-2fa.html")
+	})
+	router.POST("/login/2fa", handlers.LoginMFAHandler(st.Users(), st.MFA(), throttle, sessions))
+	router.POST("/login/webauthn/begin", handlers.PasskeyLoginBeginHandler(st.Users(), st.Passkeys(), webAuthn, throttle, sessions))
+	router.POST("/login/webauthn/finish", handlers.PasskeyLoginFinishHandler(st.Users(), st.Passkeys(), webAuthn, throttle, sessions))
+	if cfg.OIDCIssuer != "" {
+		discoveryCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		provider, err := auth.NewOIDCProvider(discoveryCtx, cfg.OIDCIssuer, cfg.OIDCClientID, cfg.OIDCClientSecret,
+			cfg.OIDCRedirectURL, cfg.OIDCGroupsClaim, cfg.OIDCRoleMap, cfg.OIDCDefaultRole)
+		cancel()
+		if err != nil {
+			slog.Warn("SSO login disabled", "issuer", cfg.OIDCIssuer, "error", err)
+		} else {
+			router.GET("/login/oidc", handlers.OIDCLoginHandler(provider, sessionKey))
+			router.GET("/login/oidc/callback", handlers.OIDCCallbackHandler(st.Users(), st.MFA(), provider, sessions))
+		}
+	}
 	router.GET("/register", func (ctx *gin.Context) {
 		ctx.File("./static/register.html")
 	})
+	mail, err := mailer.New(cfg.Mailer, cfg.MailFrom, mailer.SMTPMailer{
+		Host:       cfg.SMTPHost,
+		Port:       cfg.SMTPPort,
+		Username:   cfg.SMTPUsername,
+		Password:   cfg.SMTPPassword,
+		RequireTLS: cfg.SMTPRequireTLS,
+	}, cfg.MailDropDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	emailTokens := &auth.EmailTokens{
+		Tokens:    st.EmailTokens(),
+		Key:       sessionKey,
+		VerifyTTL: cfg.EmailVerifyTTL,
+		ResetTTL:  cfg.PasswordResetTTL,
+	}
+	if cfg.RegistrationEnabled {
+		router.POST("/register", handlers.RegisterHandler(st.Users(), emailTokens, mail, cfg.PublicURL))
+	} else {
+		router.POST("/register", func (ctx *gin.Context) {
+			ctx.JSON(http.StatusForbidden, gin.H{"error": "registration is disabled, ask an admin for an account"})
+		})
+	}
+	router.GET("/verify-email", handlers.VerifyEmailHandler(st.Users(), emailTokens))
+	router.GET("/forgot-password", func (ctx *gin.Context) {
+		ctx.File("./static/forgot-password.html")
+	})
+	router.POST("/forgot-password", handlers.ForgotPasswordHandler(st.Users(), emailTokens, mail, cfg.PublicURL))
+	router.GET("/reset-password", func (ctx *gin.Context) {
+		ctx.File("./static/reset-password.html")
+	})
+	router.POST("/reset-password", handlers.ResetPasswordHandler(st.Users(), emailTokens, throttle, sessions))
 
+	auditLog := &audit.Logger{Store: st, Key: audit.NewKey(cfg.AuditKey)}
 	protected := router.Group("/")
-	protected.Use(middlewares.ValidateSession()) 
+	protected.Use(middlewares.ValidateSession(st.APITokens(), sessions), middlewares.AuditActor())
 	{
-		protected.GET("/panel", handlers.PanelHandler)
+		protected.POST("/logout", handlers.LogoutHandler(sessions))
+
+		// reachable by sessions that still have to enroll a second factor
+		enroll := protected.Group("/panel/2fa")
+		enroll.Use(middlewares.RequireBrowserSession())
+		enroll.GET("/enroll", func (ctx *gin.Context) {
+			ctx.File("./static/2fa-enroll.html")
+		})
+		enroll.POST("/enroll", handlers.TOTPEnrollHandler(st.Users(), st.MFA(), cfg.TOTPIssuer))
+		enroll.POST("/confirm", handlers.TOTPConfirmHandler(st.Users(), st.MFA(), sessions))
+
+		full := protected.Group("/")
+		full.Use(middlewares.RequireFullSession())
+		full.GET("/panel", middlewares.RequireScope(auth.ScopeRead), handlers.PanelHandler)
+
+		// account management is not available to API tokens
+		account := full.Group("/panel")
+		account.Use(middlewares.RequireBrowserSession())
+		account.POST("/2fa/recovery-codes", handlers.RecoveryCodesHandler(st.Users(), st.MFA()))
+		account.POST("/2fa/disable", handlers.TOTPDisableHandler(st.Users(), st.MFA()))
+		account.GET("/passkeys", func (ctx *gin.Context) {
+			ctx.File("./static/passkeys.html")
+		})
+		account.GET("/webauthn/credentials", handlers.ListPasskeysHandler(st.Passkeys()))
+		account.DELETE("/webauthn/credentials/:id", handlers.DeletePasskeyHandler(st.Passkeys()))
+		account.POST("/webauthn/register/begin", handlers.PasskeyRegisterBeginHandler(st.Users(), st.Passkeys(), webAuthn))
+		account.POST("/webauthn/register/finish", handlers.PasskeyRegisterFinishHandler(st.Users(), st.Passkeys(), webAuthn))
+		account.GET("/tokens", handlers.ListAPITokensHandler(st.APITokens()))
+		account.POST("/tokens", handlers.CreateAPITokenHandler(st.APITokens()))
+		account.DELETE("/tokens/:id", handlers.RevokeAPITokenHandler(st.APITokens()))
+		account.PUT("/email", handlers.SetEmailHandler(st.Users(), emailTokens, mail, cfg.PublicURL))
+		account.POST("/email/verify", handlers.ResendVerificationHandler(st.Users(), emailTokens, mail, cfg.PublicURL))
+		account.GET("/sessions", func (ctx *gin.Context) {
+			ctx.File("./static/sessions.html")
+		})
+		account.GET("/sessions/active", handlers.ListSessionsHandler(sessions))
+		account.DELETE("/sessions/:id", handlers.RevokeSessionHandler(sessions))
+		account.POST("/sessions/revoke-others", handlers.RevokeOtherSessionsHandler(sessions))
+
+		// API tokens reach the package and service routes with the matching
+		// scope, everything else needs the admin scope
+		manage := full.Group("/admin")
+		manage.Use(middlewares.RequireRole("admin"), middlewares.AuditRequests(auditLog))
+		admin := manage.Group("/", middlewares.RequireScope(auth.ScopeAdmin))
+		packages := manage.Group("/", middlewares.RequireScope(auth.ScopePackages))
+		services := manage.Group("/", middlewares.RequireScope(auth.ScopeServices))
+		admin.GET("/mfa-policy", handlers.ListMFAPolicyHandler(st.MFA()))
+		admin.PUT("/mfa-policy/:role", handlers.SetMFAPolicyHandler(st.MFA()))
+		admin.GET("/lockouts", handlers.ListLockoutsHandler(st.Logins()))
+		admin.DELETE("/lockouts/:username", handlers.UnlockAccountHandler(throttle))
+		admin.GET("/login-failures", handlers.LoginFailuresHandler(throttle))
+		admin.PUT("/users/:id/role", handlers.SetUserRoleHandler(st.Users(), sessions))
+		admin.GET("/users/:id/sessions", handlers.ListUserSessionsHandler(sessions))
+		admin.DELETE("/users/:id/sessions", handlers.ForceLogoutHandler(sessions))
+		admin.GET("/audit", handlers.ListAuditHandler(auditLog))
+		admin.GET("/audit/verify", handlers.VerifyAuditHandler(auditLog))
+		admin.GET("/audit/export", handlers.ExportAuditHandler(auditLog))
+
+		admin.GET("/hosts", handlers.ListHostsHandler(inv))
+		admin.POST("/hosts", handlers.CreateHostHandler(inv))
+		admin.PUT("/hosts/:name", handlers.UpdateHostHandler(inv))
+		admin.DELETE("/hosts/:name", handlers.DeleteHostHandler(inv))
+		admin.GET("/host-groups", handlers.ListHostGroupsHandler(inv))
+		admin.POST("/host-groups", handlers.CreateHostGroupHandler(inv))
+		admin.DELETE("/host-groups/:group", handlers.DeleteHostGroupHandler(inv))
+		admin.PUT("/host-groups/:group/hosts/:name", handlers.AddGroupHostHandler(inv))
+		admin.DELETE("/host-groups/:group/hosts/:name", handlers.RemoveGroupHostHandler(inv))
+		admin.POST("/fleet/facts", handlers.RefreshFactsHandler(inv))
+		services.POST("/fleet/services", handlers.FleetServicesHandler(inv))
+		// fleet package installs run as jobs
+		packages.POST("/fleet/packages", handlers.FleetPackagesHandler(inv, queue))
+		packages.GET("/jobs", handlers.ListJobsHandler(queue))
+		packages.GET("/jobs/:id", handlers.GetJobHandler(queue))
+		packages.GET("/jobs/:id/logs", handlers.JobLogsHandler(queue))
+		packages.GET("/jobs/:id/events", handlers.JobEventsHandler(queue))
+		packages.POST("/jobs/:id/cancel", handlers.CancelJobHandler(queue))
+		if agents != nil {
+			admin.GET("/agents", handlers.ListAgentsHandler(agents))
+			admin.POST("/hosts/:name/agent/token", handlers.CreateAgentTokenHandler(inv, agents))
+			admin.DELETE("/hosts/:name/agent", handlers.RevokeAgentHandler(inv, agents))
+		}
 	}
 
 	return router
 }
+
+// newEngine is gin.Default with the redacting access log; the recovery dump
+// includes the request headers, so it is redacted as well.
+func newEngine() *gin.Engine {
+	router := gin.New()
+	router.Use(middlewares.AccessLog(), gin.RecoveryWithWriter(logging.NewRedactingWriter(gin.DefaultErrorWriter)))
+	return router
+}
+
+// throttleLimits takes the login rate limits from cfg.
+func throttleLimits(cfg config.Config) auth.ThrottleLimits {
+	return auth.ThrottleLimits{
+		Window:          cfg.LoginWindow,
+		BaseDelay:       cfg.LoginBaseDelay,
+		MaxDelay:        cfg.LoginMaxDelay,
+		MaxFailures:     cfg.LoginMaxFailures,
+		LockoutDuration: cfg.LoginLockout,
+		IPFreeFailures:  cfg.LoginIPFreeFailures,
+		PoWDifficulty:   cfg.LoginPoWDifficulty,
+		PoWAfter:        cfg.LoginPoWAfter,
+	}
+}
+
+// passwordProviders builds the providers listed in cfg.AuthProviders, in order.
+func passwordProviders(st store.Store, cfg config.Config) []auth.PasswordProvider {
+	var providers []auth.PasswordProvider
+	for _, name := range strings.Split(cfg.AuthProviders, ",") {
+		switch strings.TrimSpace(name) {
+		case "local":
+			providers = append(providers, &auth.LocalProvider{Users: st.Users()})
+		case "ldap":
+			ldapProvider, err := auth.NewLDAPProvider(auth.LDAPConfig{
+				URL:                cfg.LDAPURL,
+				StartTLS:           cfg.LDAPStartTLS,
+				CAFile:             cfg.LDAPCAFile,
+				InsecureSkipVerify: cfg.LDAPInsecureSkipVerify,
+				BindDN:             cfg.LDAPBindDN,
+				BindPassword:       cfg.LDAPBindPassword,
+				BaseDN:             cfg.LDAPBaseDN,
+				UserFilter:         cfg.LDAPUserFilter,
+				GroupAttribute:     cfg.LDAPGroupAttribute,
+				GroupBaseDN:        cfg.LDAPGroupBaseDN,
+				GroupFilter:        cfg.LDAPGroupFilter,
+				RoleMap:            cfg.LDAPRoleMap,
+				DefaultRole:        cfg.LDAPDefaultRole,
+			})
+			if err != nil {
+				log.Fatal(err)
+			}
+			providers = append(providers, ldapProvider)
+		case "":
+		default:
+			log.Fatalf("unknown auth provider %q", name)
+		}
+	}
+	return providers
+}
\ No newline at end of file
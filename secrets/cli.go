@@ -0,0 +1,125 @@
+package secrets
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const secretUsage = `usage: CipherOps secret <command> [--key-file path]
+
+commands:
+  keygen    print a new master key; keep it in CIPHEROPS_MASTER_KEY or MASTER_KEY_FILE
+  encrypt   read a value from stdin and print its enc: reference for the config
+  decrypt   read an enc: reference from stdin and print the value
+
+The master key comes from CIPHEROPS_MASTER_KEY, --key-file or MASTER_KEY_FILE.
+Values are read from stdin so they stay out of the shell history.
+`
+
+// RunSecretCommand implements the "secret" subcommand.
+func RunSecretCommand(args []string, in io.Reader, out io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprint(out, secretUsage)
+		return errors.New("missing secret command")
+	}
+	keyFile := os.Getenv("MASTER_KEY_FILE")
+	for i := 1; i < len(args); i++ {
+		switch {
+		case args[i] == "--key-file" && i+1 < len(args):
+			i++
+			keyFile = args[i]
+		case strings.HasPrefix(args[i], "--key-file="):
+			keyFile = strings.TrimPrefix(args[i], "--key-file=")
+		default:
+			return fmt.Errorf("unexpected argument %q", args[i])
+		}
+	}
+	masterKey := func() ([]byte, error) {
+		key, err := LoadMasterKey(keyFile)
+		if err == nil && key == nil {
+			err = ErrNoMasterKey
+		}
+		return key, err
+	}
+
+	switch args[0] {
+	case "keygen":
+		key, err := GenerateKey()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, key)
+		return nil
+	case "encrypt":
+		key, err := masterKey()
+		if err != nil {
+			return err
+		}
+		value, err := readValue(in)
+		if err != nil {
+			return err
+		}
+		ref, err := Encrypt(key, value)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, ref)
+		return nil
+	case "decrypt":
+		key, err := masterKey()
+		if err != nil {
+			return err
+		}
+		ref, err := readValue(in)
+		if err != nil {
+			return err
+		}
+		payload, ok := strings.CutPrefix(strings.TrimSpace(ref), "enc:")
+		if !ok {
+			return errors.New("not an enc: reference")
+		}
+		value, err := Decrypt(key, payload)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, value)
+		return nil
+	default:
+		fmt.Fprint(out, secretUsage)
+		return fmt.Errorf("unknown secret command %q", args[0])
+	}
+}
+
+// readValue reads stdin up to EOF, without the final line break. A value
+// typed at a terminal ends with Enter.
+func readValue(in io.Reader) (string, error) {
+	var data string
+	if f, ok := in.(*os.File); ok && isTerminal(f) {
+		fmt.Fprint(os.Stderr, "value: ")
+		line, err := bufio.NewReader(f).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", err
+		}
+		data = line
+	} else {
+		all, err := io.ReadAll(in)
+		if err != nil {
+			return "", err
+		}
+		data = string(all)
+	}
+	value := strings.TrimRight(data, "\r\n")
+	if value == "" {
+		return "", errors.New("empty value on stdin")
+	}
+	return value, nil
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,122 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// KeySize is the master key length, AES-256.
+const KeySize = 32
+
+// encVersion prefixes ciphertexts so the format can change later.
+const encVersion = "v1:"
+
+// additionalData binds ciphertexts to their use, so they cannot be passed off
+// as other AES-GCM payloads of the panel.
+var additionalData = []byte("cipherops secret v1")
+
+// MasterKeyEnv holds the base64 master key; MASTER_KEY_FILE in the
+// configuration names a file holding it instead.
+const MasterKeyEnv = "CIPHEROPS_MASTER_KEY"
+
+var ErrNoMasterKey = errors.New("no master key, set " + MasterKeyEnv + " or MASTER_KEY_FILE")
+
+// EncProvider decrypts enc:v1:... values with AES-256-GCM.
+type EncProvider struct {
+	Key []byte
+}
+
+func (p *EncProvider) Resolve(ref string) (string, error) {
+	if p.Key == nil {
+		return "", ErrNoMasterKey
+	}
+	return Decrypt(p.Key, ref)
+}
+
+// Encrypt seals plaintext and returns the enc: reference for it.
+func Encrypt(key []byte, plaintext string) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), additionalData)
+	return "enc:" + encVersion + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens the part of an enc: reference after "enc:".
+func Decrypt(key []byte, ref string) (string, error) {
+	payload, ok := strings.CutPrefix(ref, encVersion)
+	if !ok {
+		return "", errors.New("unsupported format, expected enc:v1:...")
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", fmt.Errorf("malformed ciphertext: %w", err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("malformed ciphertext: too short")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additionalData)
+	if err != nil {
+		return "", errors.New("cannot decrypt, wrong master key or corrupted value")
+	}
+	return string(plaintext), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("master key must be %d bytes, got %d", KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// GenerateKey returns a new random master key, base64 encoded.
+func GenerateKey() (string, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// LoadMasterKey reads the key from MasterKeyEnv, or else from file. It
+// returns nil without error when neither is set.
+func LoadMasterKey(file string) ([]byte, error) {
+	encoded, source := os.Getenv(MasterKeyEnv), MasterKeyEnv
+	if encoded == "" && file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("master key: %w", err)
+		}
+		encoded, source = strings.TrimSpace(string(data)), file
+	}
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("master key from %s is not base64: %w", source, err)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("master key from %s must be %d bytes, got %d", source, KeySize, len(key))
+	}
+	return key, nil
+}
@@ -0,0 +1,124 @@
+package secrets
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testKey(t *testing.T) []byte {
+	t.Helper()
+	encoded, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestEncProviderRoundTrip(t *testing.T) {
+	key := testKey(t)
+	for _, value := range []string{"hunter2", "", "späte Grüße: 🔑", strings.Repeat("x", 4096)} {
+		ref, err := Encrypt(key, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(ref, "enc:v1:") || (value != "" && strings.Contains(ref, value)) {
+			t.Fatalf("Encrypt(%q) = %q", value, ref)
+		}
+		got, err := NewResolver(key).Resolve(ref)
+		if err != nil || got != value {
+			t.Errorf("Resolve(Encrypt(%q)) = %q, %v", value, got, err)
+		}
+	}
+
+	// a fresh nonce every time
+	a, _ := Encrypt(key, "hunter2")
+	b, _ := Encrypt(key, "hunter2")
+	if a == b {
+		t.Error("the same value encrypted twice gave the same reference")
+	}
+}
+
+func TestEncProviderRejects(t *testing.T) {
+	key := testKey(t)
+	ref, err := Encrypt(key, "hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := strings.TrimPrefix(ref, "enc:")
+	sealed, _ := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(payload, encVersion))
+
+	tampered := bytes.Clone(sealed)
+	tampered[len(tampered)-1] ^= 1
+	// sealed with the same key for another use of AES-GCM
+	aead, err := newAEAD(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := sealed[:aead.NonceSize()]
+	otherAAD := aead.Seal(bytes.Clone(nonce), nonce, []byte("hunter2"), []byte("cipherops session v1"))
+
+	tests := []struct {
+		name    string
+		key     []byte
+		payload string
+		error   string
+	}{
+		{"wrong master key", testKey(t), payload, "wrong master key"},
+		{"tampered ciphertext", key, encVersion + base64.RawURLEncoding.EncodeToString(tampered), "wrong master key or corrupted"},
+		{"additional data mismatch", key, encVersion + base64.RawURLEncoding.EncodeToString(otherAAD), "wrong master key or corrupted"},
+		{"unknown version", key, "v2:" + strings.TrimPrefix(payload, encVersion), "unsupported format"},
+		{"not base64", key, encVersion + "***", "malformed ciphertext"},
+		{"too short", key, encVersion + "AAAA", "too short"},
+		{"short key", key[:16], payload, "must be 32 bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := (&EncProvider{Key: tt.key}).Resolve(tt.payload)
+			if err == nil || !strings.Contains(err.Error(), tt.error) {
+				t.Errorf("Resolve = %q, %v; want an error with %q", got, err, tt.error)
+			}
+		})
+	}
+
+	if _, err := (&EncProvider{}).Resolve(payload); !errors.Is(err, ErrNoMasterKey) {
+		t.Errorf("without a key: %v, want ErrNoMasterKey", err)
+	}
+}
+
+func TestLoadMasterKey(t *testing.T) {
+	key, _ := GenerateKey()
+	file := filepath.Join(t.TempDir(), "master.key")
+	if err := os.WriteFile(file, []byte(key+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(MasterKeyEnv, "")
+	if got, err := LoadMasterKey(""); got != nil || err != nil {
+		t.Errorf("without a key: %v, %v", got, err)
+	}
+	if got, err := LoadMasterKey(file); err != nil || base64.StdEncoding.EncodeToString(got) != key {
+		t.Errorf("from the file: %v", err)
+	}
+	if _, err := LoadMasterKey(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("a missing key file loaded")
+	}
+
+	// the environment wins over the file
+	t.Setenv(MasterKeyEnv, base64.StdEncoding.EncodeToString(make([]byte, 16)))
+	if _, err := LoadMasterKey(file); err == nil || !strings.Contains(err.Error(), MasterKeyEnv) {
+		t.Errorf("short key from the environment: %v", err)
+	}
+	t.Setenv(MasterKeyEnv, "not base64!")
+	if _, err := LoadMasterKey(""); err == nil {
+		t.Error("a key that is not base64 loaded")
+	}
+}
@@ -0,0 +1,74 @@
+// Package secrets resolves secret references in configuration values, so
+// credentials can live in files, other environment variables or encrypted
+// form instead of in plain text next to the rest of the settings.
+package secrets
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// SecretProvider resolves the references of one scheme. ref is the part
+// after "scheme:".
+type SecretProvider interface {
+	Resolve(ref string) (string, error)
+}
+
+// Resolver dispatches references to the provider of their scheme. Values
+// without a registered scheme are returned unchanged, so plain settings and
+// URLs such as https://... keep working.
+type Resolver struct {
+	providers map[string]SecretProvider
+}
+
+// NewResolver knows file:, env: and enc:. key is the master key for enc:
+// values; when it is nil enc: values fail to resolve with a hint.
+func NewResolver(key []byte) *Resolver {
+	r := &Resolver{providers: map[string]SecretProvider{}}
+	r.Register("file", FileProvider{})
+	r.Register("env", EnvProvider{})
+	r.Register("enc", &EncProvider{Key: key})
+	return r
+}
+
+// Register adds or replaces the provider of scheme, e.g. for a vault.
+func (r *Resolver) Register(scheme string, p SecretProvider) {
+	r.providers[scheme] = p
+}
+
+func (r *Resolver) Resolve(value string) (string, error) {
+	scheme, ref, ok := strings.Cut(value, ":")
+	p, known := r.providers[scheme]
+	if !ok || !known {
+		return value, nil
+	}
+	secret, err := p.Resolve(ref)
+	if err != nil {
+		return "", fmt.Errorf("%s reference: %w", scheme, err)
+	}
+	return secret, nil
+}
+
+// FileProvider reads file:/path references, such as Docker and Kubernetes
+// secrets. A trailing newline is dropped.
+type FileProvider struct{}
+
+func (FileProvider) Resolve(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// EnvProvider reads env:NAME references from another environment variable.
+type EnvProvider struct{}
+
+func (EnvProvider) Resolve(name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return value, nil
+}
@@ -0,0 +1,73 @@
+package secrets
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type fakeProvider map[string]string
+
+func (p fakeProvider) Resolve(ref string) (string, error) {
+	if v, ok := p[ref]; ok {
+		return v, nil
+	}
+	return "", errors.New("no such secret")
+}
+
+func TestResolverDispatch(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "db_password")
+	if err := os.WriteFile(file, []byte("from-file\r\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CIPHEROPS_TEST_SECRET", "from-env")
+	r := NewResolver(nil)
+	r.Register("vault", fakeProvider{"db/password": "from-vault"})
+
+	tests := []struct {
+		value, want string
+	}{
+		{"file:" + file, "from-file"},
+		{"env:CIPHEROPS_TEST_SECRET", "from-env"},
+		{"vault:db/password", "from-vault"},
+		// values without a known scheme are settings, not references
+		{"plain", "plain"},
+		{"https://idp.example.org/realms/ops", "https://idp.example.org/realms/ops"},
+		{"s3:bucket/key", "s3:bucket/key"},
+		{"FILE:" + file, "FILE:" + file},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got, err := r.Resolve(tt.value); err != nil || got != tt.want {
+			t.Errorf("Resolve(%q) = %q, %v; want %q", tt.value, got, err, tt.want)
+		}
+	}
+}
+
+func TestResolverErrors(t *testing.T) {
+	t.Setenv("CIPHEROPS_TEST_EMPTY", "")
+	r := NewResolver(nil)
+	r.Register("vault", fakeProvider{})
+
+	tests := []struct {
+		value, error string
+	}{
+		{"file:" + filepath.Join(t.TempDir(), "missing"), "file reference: open"},
+		{"env:CIPHEROPS_TEST_UNSET", "env reference: environment variable CIPHEROPS_TEST_UNSET is not set"},
+		{"enc:v1:AAAA", "enc reference: no master key"},
+		{"vault:db/password", "vault reference: no such secret"},
+	}
+	for _, tt := range tests {
+		got, err := r.Resolve(tt.value)
+		if err == nil || !strings.Contains(err.Error(), tt.error) {
+			t.Errorf("Resolve(%q) = %q, %v; want an error with %q", tt.value, got, err, tt.error)
+		}
+	}
+
+	// set but empty is a value
+	if got, err := r.Resolve("env:CIPHEROPS_TEST_EMPTY"); err != nil || got != "" {
+		t.Errorf("empty variable: %q, %v", got, err)
+	}
+}
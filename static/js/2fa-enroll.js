@@ -0,0 +1,39 @@
+// Drives /panel/2fa/enroll: fetch a new secret, then confirm it with a code
+// and show the recovery codes once.
+(async function () {
+    const form = document.getElementById("enroll-form");
+    const qr = document.getElementById("qr");
+    const secret = document.getElementById("secret");
+    const list = document.getElementById("recovery-codes");
+
+    const res = await fetch("/panel/2fa/enroll", { method: "POST" });
+    const data = await res.json();
+    if (!res.ok) {
+        secret.textContent = data.error;
+        return;
+    }
+    qr.src = data.qr_code;
+    qr.hidden = false;
+    secret.textContent = data.secret;
+
+    form.addEventListener("submit", async function (ev) {
+        ev.preventDefault();
+        const confirm = await fetch("/panel/2fa/confirm", {
+            method: "POST",
+            headers: { "Content-Type": "application/json" },
+            body: JSON.stringify({ code: document.getElementById("code").value }),
+        });
+        const result = await confirm.json();
+        if (!confirm.ok) {
+            secret.textContent = result.error;
+            return;
+        }
+        list.replaceChildren(...result.recovery_codes.map(function (code) {
+            const li = document.createElement("li");
+            li.textContent = code;
+            return li;
+        }));
+        list.hidden = false;
+        secret.textContent = "Save these recovery codes, they will not be shown again.";
+    });
+})();
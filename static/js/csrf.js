@@ -0,0 +1,39 @@
+// Double-submit CSRF protection: the server sets the csrf_token cookie and
+// expects it back on every state-changing request. Load this before the
+// other scripts so their fetch calls carry the header.
+(function () {
+    function csrfToken() {
+        const match = document.cookie.match(/(?:^|;\s*)csrf_token=([^;]*)/);
+        return match ? decodeURIComponent(match[1]) : "";
+    }
+
+    const safeMethods = ["GET", "HEAD", "OPTIONS", "TRACE"];
+    const originalFetch = window.fetch;
+    window.fetch = function (input, init) {
+        init = init || {};
+        const method = (init.method || (input instanceof Request ? input.method : "GET")).toUpperCase();
+        const url = new URL(input instanceof Request ? input.url : input, window.location.href);
+        if (!safeMethods.includes(method) && url.origin === window.location.origin) {
+            const headers = new Headers(init.headers || (input instanceof Request ? input.headers : undefined));
+            headers.set("X-CSRF-Token", csrfToken());
+            init.headers = headers;
+        }
+        return originalFetch.call(this, input, init);
+    };
+
+    document.addEventListener("DOMContentLoaded", function () {
+        for (const form of document.querySelectorAll("form[method='post']")) {
+            const input = document.createElement("input");
+            input.type = "hidden";
+            input.name = "csrf_token";
+            form.appendChild(input);
+        }
+        // read at submit time, the cookie may only arrive with a later response
+        document.addEventListener("submit", function (event) {
+            const input = event.target.querySelector("input[name='csrf_token']");
+            if (input) {
+                input.value = csrfToken();
+            }
+        }, true);
+    });
+})();
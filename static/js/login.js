@@ -0,0 +1,44 @@
+// After repeated failed logins the server asks for a proof of work: find a
+// nonce so that sha256(challenge + ":" + nonce) starts with `difficulty`
+// zero bits. It costs a browser a second or two and a password sprayer a lot.
+function leadingZeroBits(bytes) {
+    let n = 0;
+    for (const b of bytes) {
+        if (b !== 0) {
+            return n + Math.clz32(b) - 24;
+        }
+        n += 8;
+    }
+    return n;
+}
+
+async function solveChallenge(challenge, difficulty) {
+    const encoder = new TextEncoder();
+    for (let nonce = 0; ; nonce++) {
+        const digest = await crypto.subtle.digest("SHA-256", encoder.encode(challenge + ":" + nonce));
+        if (leadingZeroBits(new Uint8Array(digest)) >= difficulty) {
+            return String(nonce);
+        }
+    }
+}
+
+document.addEventListener("DOMContentLoaded", async function () {
+    const form = document.querySelector("form[action='/login']");
+    const res = await fetch("/login/challenge");
+    const data = await res.json();
+    if (!res.ok || !data.required) {
+        return;
+    }
+
+    const submit = form.querySelector("button[type=submit]");
+    submit.disabled = true;
+    const nonce = await solveChallenge(data.challenge, data.difficulty);
+    for (const [name, value] of [["pow_challenge", data.challenge], ["pow_nonce", nonce]]) {
+        const input = document.createElement("input");
+        input.type = "hidden";
+        input.name = name;
+        input.value = value;
+        form.appendChild(input);
+    }
+    submit.disabled = false;
+});
@@ -0,0 +1,2 @@
+// The reset link carries the token in the query string; the form posts it.
+document.getElementById("token").value = new URLSearchParams(window.location.search).get("token") || "";
@@ -0,0 +1,35 @@
+// Drives /panel/sessions: list the user's logins and end them.
+async function sessionList(list) {
+    const res = await fetch("/panel/sessions/active");
+    const sessions = await res.json();
+    list.replaceChildren(...sessions.map(function (s) {
+        const li = document.createElement("li");
+        li.textContent = s.device + " from " + s.ip +
+            ", signed in " + new Date(s.created_at).toLocaleString() +
+            ", last seen " + new Date(s.last_seen_at).toLocaleString() +
+            (s.current ? " (this session) " : " ");
+        const revoke = document.createElement("button");
+        revoke.type = "button";
+        revoke.textContent = s.current ? "Log out" : "Revoke";
+        revoke.addEventListener("click", async function () {
+            await fetch("/panel/sessions/" + s.id, { method: "DELETE" });
+            if (s.current) {
+                window.location.href = "/login";
+                return;
+            }
+            sessionList(list);
+        });
+        li.appendChild(revoke);
+        return li;
+    }));
+}
+
+document.addEventListener("DOMContentLoaded", function () {
+    const list = document.getElementById("session-list");
+    sessionList(list);
+    document.getElementById("sessions-form").addEventListener("submit", async function (ev) {
+        ev.preventDefault();
+        await fetch("/panel/sessions/revoke-others", { method: "POST" });
+        sessionList(list);
+    });
+});
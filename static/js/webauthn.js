@@ -0,0 +1,123 @@
+// WebAuthn ceremonies for /login (passkey sign in) and /panel/passkeys
+// (registering and removing security keys). The server speaks base64url,
+// the browser API wants ArrayBuffers.
+const b64url = {
+    decode(value) {
+        const base64 = value.replace(/-/g, "+").replace(/_/g, "/");
+        const padded = base64 + "===".slice((base64.length + 3) % 4);
+        return Uint8Array.from(atob(padded), c => c.charCodeAt(0)).buffer;
+    },
+    encode(buffer) {
+        const bytes = String.fromCharCode(...new Uint8Array(buffer));
+        return btoa(bytes).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+    },
+};
+
+function credentialToJSON(cred) {
+    const response = {
+        clientDataJSON: b64url.encode(cred.response.clientDataJSON),
+    };
+    if (cred.response.attestationObject) {
+        response.attestationObject = b64url.encode(cred.response.attestationObject);
+        if (cred.response.getTransports) {
+            response.transports = cred.response.getTransports();
+        }
+    } else {
+        response.authenticatorData = b64url.encode(cred.response.authenticatorData);
+        response.signature = b64url.encode(cred.response.signature);
+        if (cred.response.userHandle) {
+            response.userHandle = b64url.encode(cred.response.userHandle);
+        }
+    }
+    return {
+        id: cred.id,
+        rawId: b64url.encode(cred.rawId),
+        type: cred.type,
+        authenticatorAttachment: cred.authenticatorAttachment,
+        response: response,
+    };
+}
+
+async function postJSON(url, body) {
+    const res = await fetch(url, {
+        method: "POST",
+        headers: { "Content-Type": "application/json" },
+        body: JSON.stringify(body || {}),
+    });
+    const data = res.status === 204 ? {} : await res.json();
+    if (!res.ok) {
+        throw new Error(data.error || res.statusText);
+    }
+    return data;
+}
+
+async function passkeyLogin(username) {
+    const body = { username: username };
+    // a solution is good for one attempt, the password form keeps its own
+    // (solveChallenge is in login.js)
+    const res = await fetch("/login/challenge");
+    const challenge = await res.json();
+    if (res.ok && challenge.required) {
+        body.pow_challenge = challenge.challenge;
+        body.pow_nonce = await solveChallenge(challenge.challenge, challenge.difficulty);
+    }
+    const options = await postJSON("/login/webauthn/begin", body);
+    const pk = options.publicKey;
+    pk.challenge = b64url.decode(pk.challenge);
+    (pk.allowCredentials || []).forEach(c => { c.id = b64url.decode(c.id); });
+
+    const cred = await navigator.credentials.get({ publicKey: pk });
+    const result = await postJSON("/login/webauthn/finish", credentialToJSON(cred));
+    window.location = result.redirect;
+}
+
+async function passkeyRegister(name) {
+    const options = await postJSON("/panel/webauthn/register/begin");
+    const pk = options.publicKey;
+    pk.challenge = b64url.decode(pk.challenge);
+    pk.user.id = b64url.decode(pk.user.id);
+    (pk.excludeCredentials || []).forEach(c => { c.id = b64url.decode(c.id); });
+
+    const cred = await navigator.credentials.create({ publicKey: pk });
+    return postJSON("/panel/webauthn/register/finish?name=" + encodeURIComponent(name), credentialToJSON(cred));
+}
+
+async function passkeyList(list) {
+    const res = await fetch("/panel/webauthn/credentials");
+    const keys = await res.json();
+    list.replaceChildren(...keys.map(function (key) {
+        const li = document.createElement("li");
+        li.textContent = key.name + " (added " + new Date(key.created_at).toLocaleDateString() + ") ";
+        const remove = document.createElement("button");
+        remove.type = "button";
+        remove.textContent = "Remove";
+        remove.addEventListener("click", async function () {
+            await fetch("/panel/webauthn/credentials/" + key.id, { method: "DELETE" });
+            passkeyList(list);
+        });
+        li.appendChild(remove);
+        return li;
+    }));
+}
+
+document.addEventListener("DOMContentLoaded", function () {
+    const loginButton = document.getElementById("passkey-login");
+    if (loginButton) {
+        loginButton.addEventListener("click", function () {
+            passkeyLogin(document.getElementById("username").value)
+                .catch(err => alert(err.message));
+        });
+    }
+
+    const registerForm = document.getElementById("passkey-register");
+    if (registerForm) {
+        const list = document.getElementById("passkey-list");
+        passkeyList(list);
+        registerForm.addEventListener("submit", function (ev) {
+            ev.preventDefault();
+            passkeyRegister(document.getElementById("passkey-name").value)
+                .then(() => passkeyList(list))
+                .catch(err => alert(err.message));
+        });
+    }
+});
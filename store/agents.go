@@ -0,0 +1,87 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"CipherOps/models"
+)
+
+type agentRepo struct{ s *sqlStore }
+
+const agentColumns = `a.host_id, h.name, a.cert_serial, a.cert_expiry, a.enrolled_at, a.last_seen, a.revoked_at`
+
+func scanAgent(row interface{ Scan(...any) error }) (models.Agent, error) {
+	var a models.Agent
+	var lastSeen, revoked sql.NullTime
+	err := row.Scan(&a.HostID, &a.Host, &a.CertSerial, &a.CertExpiry, &a.EnrolledAt, &lastSeen, &revoked)
+	if lastSeen.Valid {
+		a.LastSeen = lastSeen.Time
+	}
+	if revoked.Valid {
+		a.RevokedAt = &revoked.Time
+	}
+	return a, err
+}
+
+func (r agentRepo) CreateToken(ctx context.Context, t *models.AgentToken) error {
+	t.CreatedAt = time.Now()
+	err := r.s.queryRow(ctx, r.s.db, `INSERT INTO agent_tokens (host_id, token_hash, expires_at, created_by, created_at)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		t.HostID, t.TokenHash, t.ExpiresAt, sql0(t.CreatedBy), t.CreatedAt).Scan(&t.ID)
+	return r.s.mapErr(err)
+}
+
+func (r agentRepo) UseToken(ctx context.Context, tokenHash string, now time.Time) (models.AgentToken, error) {
+	t := models.AgentToken{TokenHash: tokenHash, UsedAt: &now}
+	err := r.s.queryRow(ctx, r.s.db, `UPDATE agent_tokens SET used_at = $1
+		WHERE token_hash = $2 AND used_at IS NULL AND expires_at > $1
+		RETURNING id, host_id, (SELECT name FROM hosts WHERE id = host_id),
+			expires_at, COALESCE(created_by, 0), created_at`, now, tokenHash).
+		Scan(&t.ID, &t.HostID, &t.Host, &t.ExpiresAt, &t.CreatedBy, &t.CreatedAt)
+	return t, r.s.mapErr(err)
+}
+
+func (r agentRepo) Enroll(ctx context.Context, a models.Agent) error {
+	_, err := r.s.exec(ctx, r.s.db, `INSERT INTO agents (host_id, cert_serial, cert_expiry, enrolled_at)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (host_id) DO UPDATE SET cert_serial = excluded.cert_serial,
+			cert_expiry = excluded.cert_expiry, enrolled_at = excluded.enrolled_at,
+			last_seen = NULL, revoked_at = NULL`,
+		a.HostID, a.CertSerial, a.CertExpiry, a.EnrolledAt)
+	return err
+}
+
+func (r agentRepo) GetBySerial(ctx context.Context, serial string) (models.Agent, error) {
+	a, err := scanAgent(r.s.queryRow(ctx, r.s.db, `SELECT `+agentColumns+` FROM agents a
+		JOIN hosts h ON h.id = a.host_id WHERE a.cert_serial = $1`, serial))
+	return a, r.s.mapErr(err)
+}
+
+func (r agentRepo) List(ctx context.Context) ([]models.Agent, error) {
+	rows, err := r.s.query(ctx, r.s.db, `SELECT `+agentColumns+` FROM agents a
+		JOIN hosts h ON h.id = a.host_id ORDER BY h.name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	agents := []models.Agent{}
+	for rows.Next() {
+		a, err := scanAgent(rows)
+		if err != nil {
+			return nil, err
+		}
+		agents = append(agents, a)
+	}
+	return agents, rows.Err()
+}
+
+func (r agentRepo) Touch(ctx context.Context, hostID int, at time.Time) error {
+	return affected(r.s.exec(ctx, r.s.db, `UPDATE agents SET last_seen = $1 WHERE host_id = $2`, at, hostID))
+}
+
+func (r agentRepo) Revoke(ctx context.Context, hostID int, at time.Time) error {
+	return affected(r.s.exec(ctx, r.s.db, `UPDATE agents SET revoked_at = $1
+		WHERE host_id = $2 AND revoked_at IS NULL`, at, hostID))
+}
@@ -0,0 +1,76 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"CipherOps/models"
+)
+
+type apiTokenRepo struct{ s *sqlStore }
+
+// scopes are stored as a comma separated column
+func joinScopes(scopes []string) string { return strings.Join(scopes, ",") }
+
+func splitScopes(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+func (r apiTokenRepo) Create(ctx context.Context, t *models.APIToken) error {
+	t.CreatedAt = time.Now()
+	err := r.s.queryRow(ctx, r.s.db, `INSERT INTO api_tokens (user_id, name, token_hash, scopes, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		t.UserID, t.Name, t.TokenHash, joinScopes(t.Scopes), t.CreatedAt, t.ExpiresAt).Scan(&t.ID)
+	return r.s.mapErr(err)
+}
+
+func (r apiTokenRepo) List(ctx context.Context, userID int) ([]models.APIToken, error) {
+	rows, err := r.s.query(ctx, r.s.db, `SELECT id, user_id, name, scopes, created_at, expires_at, last_used_at, revoked_at
+		FROM api_tokens WHERE user_id = $1 ORDER BY created_at DESC, id DESC`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tokens := []models.APIToken{}
+	for rows.Next() {
+		var t models.APIToken
+		var scopes string
+		var expires, lastUsed, revoked sql.NullTime
+		if err := rows.Scan(&t.ID, &t.UserID, &t.Name, &scopes, &t.CreatedAt, &expires, &lastUsed, &revoked); err != nil {
+			return nil, err
+		}
+		t.Scopes = splitScopes(scopes)
+		t.ExpiresAt, t.LastUsedAt, t.RevokedAt = optionalTime(expires), optionalTime(lastUsed), optionalTime(revoked)
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+func (r apiTokenRepo) GetByHash(ctx context.Context, tokenHash string) (models.APIToken, error) {
+	t := models.APIToken{TokenHash: tokenHash}
+	var scopes string
+	var expires, lastUsed sql.NullTime
+	err := r.s.queryRow(ctx, r.s.db, `SELECT t.id, t.user_id, t.name, t.scopes, t.created_at, t.expires_at,
+			t.last_used_at, u.role
+		FROM api_tokens t JOIN users u ON u.id = t.user_id
+		WHERE t.token_hash = $1 AND t.revoked_at IS NULL`, tokenHash).
+		Scan(&t.ID, &t.UserID, &t.Name, &scopes, &t.CreatedAt, &expires, &lastUsed, &t.Role)
+	t.Scopes = splitScopes(scopes)
+	t.ExpiresAt, t.LastUsedAt = optionalTime(expires), optionalTime(lastUsed)
+	return t, r.s.mapErr(err)
+}
+
+func (r apiTokenRepo) Touch(ctx context.Context, id int, at time.Time) error {
+	_, err := r.s.exec(ctx, r.s.db, `UPDATE api_tokens SET last_used_at = $1 WHERE id = $2`, at, id)
+	return err
+}
+
+func (r apiTokenRepo) Revoke(ctx context.Context, userID, id int, at time.Time) error {
+	return affected(r.s.exec(ctx, r.s.db, `UPDATE api_tokens SET revoked_at = $1
+		WHERE id = $2 AND user_id = $3 AND revoked_at IS NULL`, at, id, userID))
+}
@@ -0,0 +1,115 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"CipherOps/models"
+)
+
+type auditRepo struct{ s *sqlStore }
+
+const auditColumns = `id, created_at, COALESCE(user_id, 0), username, ip, host, action, command, args,
+	success, output, error, prev_hash, hash`
+
+func (r auditRepo) Append(ctx context.Context, build func(lastID int64, lastHash string) (models.AuditEntry, error)) (models.AuditEntry, error) {
+	tx, err := r.s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return models.AuditEntry{}, err
+	}
+	defer tx.Rollback()
+	if err := r.s.d.lockAudit(ctx, tx); err != nil {
+		return models.AuditEntry{}, err
+	}
+
+	var lastID int64
+	var lastHash string
+	err = r.s.queryRow(ctx, tx, `SELECT id, hash FROM audit_log ORDER BY id DESC LIMIT 1`).Scan(&lastID, &lastHash)
+	if err = r.s.mapErr(err); err != nil && !errors.Is(err, ErrNotFound) {
+		return models.AuditEntry{}, err
+	}
+	e, err := build(lastID, lastHash)
+	if err != nil {
+		return e, err
+	}
+	args, err := json.Marshal(e.Args)
+	if err != nil {
+		return e, err
+	}
+	_, err = r.s.exec(ctx, tx, `INSERT INTO audit_log
+		(id, created_at, user_id, username, ip, host, action, command, args, success, output, error, prev_hash, hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`,
+		e.ID, e.Time, sql0(e.UserID), e.Username, e.IP, e.Host, e.Action, e.Command, string(args),
+		e.Success, e.Output, e.Error, e.PrevHash, e.Hash)
+	if err != nil {
+		return e, err
+	}
+	return e, tx.Commit()
+}
+
+func (r auditRepo) Each(ctx context.Context, f AuditFilter, fn func(models.AuditEntry) error) error {
+	var where []string
+	var args []any
+	add := func(cond string, v any) {
+		args = append(args, v)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+	if f.UserID != 0 {
+		add("user_id = $%d", f.UserID)
+	}
+	if f.Action != "" {
+		add("action = $%d", f.Action)
+	}
+	if f.Host != "" {
+		add("host = $%d", f.Host)
+	}
+	if !f.Since.IsZero() {
+		add("created_at >= $%d", f.Since)
+	}
+	if !f.Until.IsZero() {
+		add("created_at < $%d", f.Until)
+	}
+	query := `SELECT ` + auditColumns + ` FROM audit_log`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id"
+	if f.Limit > 0 {
+		// the newest entries are the interesting ones
+		query = "SELECT * FROM (" + query + " DESC LIMIT " + strconv.Itoa(f.Limit) + ") newest ORDER BY id"
+	}
+
+	rows, err := r.s.query(ctx, r.s.db, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e models.AuditEntry
+		var rawArgs string
+		if err := rows.Scan(&e.ID, &e.Time, &e.UserID, &e.Username, &e.IP, &e.Host, &e.Action, &e.Command, &rawArgs,
+			&e.Success, &e.Output, &e.Error, &e.PrevHash, &e.Hash); err != nil {
+			return err
+		}
+		if err := json.Unmarshal([]byte(rawArgs), &e.Args); err != nil {
+			return fmt.Errorf("audit entry %d: %w", e.ID, err)
+		}
+		e.Time = e.Time.UTC()
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// sql0 stores a zero user id as NULL, system actions have no user.
+func sql0(id int) any {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"CipherOps/models"
+)
+
+type containerRepo struct{ s *sqlStore }
+
+const containerColumns = `id, name, image, port, env, engine_id, status, COALESCE(created_by, 0), created_at, updated_at`
+
+func scanContainer(row interface{ Scan(...any) error }) (models.Container, error) {
+	var c models.Container
+	var env string
+	if err := row.Scan(&c.ID, &c.Name, &c.Image, &c.Port, &env, &c.EngineID, &c.Status,
+		&c.CreatedBy, &c.CreatedAt, &c.UpdatedAt); err != nil {
+		return c, err
+	}
+	return c, json.Unmarshal([]byte(env), &c.Env)
+}
+
+func (r containerRepo) Create(ctx context.Context, c *models.Container) error {
+	env, err := json.Marshal(c.Env)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	c.CreatedAt, c.UpdatedAt = now, now
+	err = r.s.queryRow(ctx, r.s.db, `INSERT INTO containers
+		(name, image, port, env, engine_id, status, created_by, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`,
+		c.Name, c.Image, c.Port, string(env), c.EngineID, c.Status, sql0(c.CreatedBy), now, now).Scan(&c.ID)
+	return r.s.mapErr(err)
+}
+
+func (r containerRepo) Get(ctx context.Context, id int) (models.Container, error) {
+	c, err := scanContainer(r.s.queryRow(ctx, r.s.db, `SELECT `+containerColumns+` FROM containers WHERE id = $1`, id))
+	return c, r.s.mapErr(err)
+}
+
+func (r containerRepo) GetByName(ctx context.Context, name string) (models.Container, error) {
+	c, err := scanContainer(r.s.queryRow(ctx, r.s.db, `SELECT `+containerColumns+` FROM containers WHERE name = $1`, name))
+	return c, r.s.mapErr(err)
+}
+
+func (r containerRepo) List(ctx context.Context) ([]models.Container, error) {
+	rows, err := r.s.query(ctx, r.s.db, `SELECT `+containerColumns+` FROM containers ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	containers := []models.Container{}
+	for rows.Next() {
+		c, err := scanContainer(rows)
+		if err != nil {
+			return nil, err
+		}
+		containers = append(containers, c)
+	}
+	return containers, rows.Err()
+}
+
+func (r containerRepo) SetState(ctx context.Context, id int, engineID, status string) error {
+	return affected(r.s.exec(ctx, r.s.db, `UPDATE containers SET engine_id = $1, status = $2, updated_at = $3
+		WHERE id = $4`, engineID, status, time.Now(), id))
+}
+
+func (r containerRepo) Delete(ctx context.Context, id int) error {
+	return affected(r.s.exec(ctx, r.s.db, `DELETE FROM containers WHERE id = $1`, id))
+}
@@ -0,0 +1,32 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"CipherOps/models"
+)
+
+type emailTokenRepo struct{ s *sqlStore }
+
+func (r emailTokenRepo) Issue(ctx context.Context, t models.EmailToken) error {
+	return r.s.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := r.s.exec(ctx, tx, `UPDATE email_tokens SET used_at = $1
+			WHERE user_id = $2 AND purpose = $3 AND used_at IS NULL`, time.Now(), t.UserID, t.Purpose)
+		if err != nil {
+			return err
+		}
+		_, err = r.s.exec(ctx, tx, `INSERT INTO email_tokens (id, user_id, purpose, email, expires_at)
+			VALUES ($1, $2, $3, $4, $5)`, t.ID, t.UserID, t.Purpose, t.Email, t.ExpiresAt)
+		return err
+	})
+}
+
+func (r emailTokenRepo) Consume(ctx context.Context, id, purpose string, now time.Time) (models.EmailToken, error) {
+	t := models.EmailToken{ID: id, Purpose: purpose, UsedAt: &now}
+	err := r.s.queryRow(ctx, r.s.db, `UPDATE email_tokens SET used_at = $1
+		WHERE id = $2 AND purpose = $3 AND used_at IS NULL AND expires_at > $1
+		RETURNING user_id, email, expires_at`, now, id, purpose).Scan(&t.UserID, &t.Email, &t.ExpiresAt)
+	return t, r.s.mapErr(err)
+}
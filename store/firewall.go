@@ -0,0 +1,63 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"CipherOps/models"
+)
+
+type firewallRepo struct{ s *sqlStore }
+
+const firewallColumns = `id, direction, protocol, port, source, action, comment, enabled, position,
+	COALESCE(created_by, 0), created_at`
+
+func scanFirewallRule(row interface{ Scan(...any) error }) (models.FirewallRule, error) {
+	var r models.FirewallRule
+	err := row.Scan(&r.ID, &r.Direction, &r.Protocol, &r.Port, &r.Source, &r.Action, &r.Comment,
+		&r.Enabled, &r.Position, &r.CreatedBy, &r.CreatedAt)
+	return r, err
+}
+
+func (r firewallRepo) Create(ctx context.Context, rule *models.FirewallRule) error {
+	rule.CreatedAt = time.Now()
+	err := r.s.queryRow(ctx, r.s.db, `INSERT INTO firewall_rules
+		(direction, protocol, port, source, action, comment, enabled, position, created_by, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id`,
+		rule.Direction, rule.Protocol, rule.Port, rule.Source, rule.Action, rule.Comment,
+		rule.Enabled, rule.Position, sql0(rule.CreatedBy), rule.CreatedAt).Scan(&rule.ID)
+	return r.s.mapErr(err)
+}
+
+func (r firewallRepo) Get(ctx context.Context, id int) (models.FirewallRule, error) {
+	rule, err := scanFirewallRule(r.s.queryRow(ctx, r.s.db, `SELECT `+firewallColumns+` FROM firewall_rules WHERE id = $1`, id))
+	return rule, r.s.mapErr(err)
+}
+
+func (r firewallRepo) List(ctx context.Context) ([]models.FirewallRule, error) {
+	rows, err := r.s.query(ctx, r.s.db, `SELECT `+firewallColumns+` FROM firewall_rules ORDER BY position, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rules := []models.FirewallRule{}
+	for rows.Next() {
+		rule, err := scanFirewallRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+func (r firewallRepo) Update(ctx context.Context, rule models.FirewallRule) error {
+	return affected(r.s.exec(ctx, r.s.db, `UPDATE firewall_rules SET direction = $1, protocol = $2, port = $3,
+		source = $4, action = $5, comment = $6, enabled = $7, position = $8 WHERE id = $9`,
+		rule.Direction, rule.Protocol, rule.Port, rule.Source, rule.Action, rule.Comment,
+		rule.Enabled, rule.Position, rule.ID))
+}
+
+func (r firewallRepo) Delete(ctx context.Context, id int) error {
+	return affected(r.s.exec(ctx, r.s.db, `DELETE FROM firewall_rules WHERE id = $1`, id))
+}
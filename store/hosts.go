@@ -0,0 +1,178 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"CipherOps/models"
+)
+
+type hostRepo struct{ s *sqlStore }
+
+const hostColumns = `id, name, address, port, ssh_user, labels, distro_id, distro_like, distro_name,
+	distro_version, installer, service_manager, firewall_backend, facts_at, facts_error, created_at`
+
+func scanHost(row interface{ Scan(...any) error }) (models.Host, error) {
+	var h models.Host
+	var labels string
+	var factsAt sql.NullTime
+	if err := row.Scan(&h.ID, &h.Name, &h.Address, &h.Port, &h.User, &labels, &h.Facts.DistroID,
+		&h.Facts.DistroLike, &h.Facts.DistroName, &h.Facts.DistroVersion, &h.Facts.Installer,
+		&h.Facts.ServiceManager, &h.Facts.FirewallBackend, &factsAt, &h.Facts.Error, &h.CreatedAt); err != nil {
+		return h, err
+	}
+	if factsAt.Valid {
+		h.Facts.GatheredAt = factsAt.Time
+	}
+	h.Groups = []string{}
+	return h, json.Unmarshal([]byte(labels), &h.Labels)
+}
+
+func (r hostRepo) Create(ctx context.Context, h *models.Host) error {
+	if h.Labels == nil {
+		h.Labels = map[string]string{}
+	}
+	labels, err := json.Marshal(h.Labels)
+	if err != nil {
+		return err
+	}
+	h.CreatedAt = time.Now()
+	err = r.s.queryRow(ctx, r.s.db, `INSERT INTO hosts (name, address, port, ssh_user, labels, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		h.Name, h.Address, h.Port, h.User, string(labels), h.CreatedAt).Scan(&h.ID)
+	return r.s.mapErr(err)
+}
+
+func (r hostRepo) GetByName(ctx context.Context, name string) (models.Host, error) {
+	h, err := scanHost(r.s.queryRow(ctx, r.s.db, `SELECT `+hostColumns+` FROM hosts WHERE name = $1`, name))
+	if err != nil {
+		return h, r.s.mapErr(err)
+	}
+	hosts := []models.Host{h}
+	err = r.withGroups(ctx, hosts)
+	return hosts[0], err
+}
+
+func (r hostRepo) List(ctx context.Context) ([]models.Host, error) {
+	rows, err := r.s.query(ctx, r.s.db, `SELECT `+hostColumns+` FROM hosts ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hosts := []models.Host{}
+	for rows.Next() {
+		h, err := scanHost(rows)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return hosts, r.withGroups(ctx, hosts)
+}
+
+// withGroups fills in the group names of hosts.
+func (r hostRepo) withGroups(ctx context.Context, hosts []models.Host) error {
+	byID := make(map[int]*models.Host, len(hosts))
+	for i := range hosts {
+		byID[hosts[i].ID] = &hosts[i]
+	}
+	rows, err := r.s.query(ctx, r.s.db, `SELECT m.host_id, g.name FROM host_group_members m
+		JOIN host_groups g ON g.id = m.group_id ORDER BY g.name`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hostID int
+		var group string
+		if err := rows.Scan(&hostID, &group); err != nil {
+			return err
+		}
+		if h, ok := byID[hostID]; ok {
+			h.Groups = append(h.Groups, group)
+		}
+	}
+	return rows.Err()
+}
+
+func (r hostRepo) Update(ctx context.Context, h models.Host) error {
+	if h.Labels == nil {
+		h.Labels = map[string]string{}
+	}
+	labels, err := json.Marshal(h.Labels)
+	if err != nil {
+		return err
+	}
+	return affected(r.s.exec(ctx, r.s.db, `UPDATE hosts SET address = $1, port = $2, ssh_user = $3, labels = $4
+		WHERE id = $5`, h.Address, h.Port, h.User, string(labels), h.ID))
+}
+
+func (r hostRepo) SetFacts(ctx context.Context, id int, f models.HostFacts) error {
+	return affected(r.s.exec(ctx, r.s.db, `UPDATE hosts SET distro_id = $1, distro_like = $2, distro_name = $3,
+		distro_version = $4, installer = $5, service_manager = $6, firewall_backend = $7, facts_at = $8,
+		facts_error = $9 WHERE id = $10`,
+		f.DistroID, f.DistroLike, f.DistroName, f.DistroVersion, f.Installer, f.ServiceManager,
+		f.FirewallBackend, f.GatheredAt, f.Error, id))
+}
+
+func (r hostRepo) SetFactsError(ctx context.Context, id int, msg string) error {
+	return affected(r.s.exec(ctx, r.s.db, `UPDATE hosts SET facts_error = $1 WHERE id = $2`, msg, id))
+}
+
+func (r hostRepo) Delete(ctx context.Context, id int) error {
+	return affected(r.s.exec(ctx, r.s.db, `DELETE FROM hosts WHERE id = $1`, id))
+}
+
+func (r hostRepo) CreateGroup(ctx context.Context, g *models.HostGroup) error {
+	g.Hosts = []string{}
+	err := r.s.queryRow(ctx, r.s.db, `INSERT INTO host_groups (name) VALUES ($1) RETURNING id`, g.Name).Scan(&g.ID)
+	return r.s.mapErr(err)
+}
+
+func (r hostRepo) ListGroups(ctx context.Context) ([]models.HostGroup, error) {
+	rows, err := r.s.query(ctx, r.s.db, `SELECT g.id, g.name, h.name FROM host_groups g
+		LEFT JOIN host_group_members m ON m.group_id = g.id
+		LEFT JOIN hosts h ON h.id = m.host_id
+		ORDER BY g.name, h.name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	groups := []models.HostGroup{}
+	for rows.Next() {
+		var g models.HostGroup
+		var host sql.NullString
+		if err := rows.Scan(&g.ID, &g.Name, &host); err != nil {
+			return nil, err
+		}
+		if n := len(groups); n == 0 || groups[n-1].ID != g.ID {
+			g.Hosts = []string{}
+			groups = append(groups, g)
+		}
+		if host.Valid {
+			last := &groups[len(groups)-1]
+			last.Hosts = append(last.Hosts, host.String)
+		}
+	}
+	return groups, rows.Err()
+}
+
+func (r hostRepo) DeleteGroup(ctx context.Context, name string) error {
+	return affected(r.s.exec(ctx, r.s.db, `DELETE FROM host_groups WHERE name = $1`, name))
+}
+
+func (r hostRepo) AddToGroup(ctx context.Context, group, host string) error {
+	return affected(r.s.exec(ctx, r.s.db, `INSERT INTO host_group_members (group_id, host_id)
+		SELECT g.id, h.id FROM host_groups g, hosts h WHERE g.name = $1 AND h.name = $2`, group, host))
+}
+
+func (r hostRepo) RemoveFromGroup(ctx context.Context, group, host string) error {
+	return affected(r.s.exec(ctx, r.s.db, `DELETE FROM host_group_members
+		WHERE group_id = (SELECT id FROM host_groups WHERE name = $1)
+		AND host_id = (SELECT id FROM hosts WHERE name = $2)`, group, host))
+}
@@ -0,0 +1,198 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"CipherOps/models"
+)
+
+type jobRepo struct{ s *sqlStore }
+
+const jobColumns = `id, kind, payload, status, attempts, max_attempts, run_at, progress, progress_message,
+	COALESCE(result, ''), error, cancel_requested, COALESCE(user_id, 0), username, role, ip, locked_by,
+	locked_until, created_at, started_at, finished_at`
+
+func scanJob(row interface{ Scan(...any) error }) (models.Job, error) {
+	var j models.Job
+	var payload, result string
+	var lockedUntil, started, finished sql.NullTime
+	err := row.Scan(&j.ID, &j.Kind, &payload, &j.Status, &j.Attempts, &j.MaxAttempts, &j.RunAt, &j.Progress,
+		&j.ProgressMessage, &result, &j.Error, &j.CancelRequested, &j.UserID, &j.Username, &j.Role, &j.IP,
+		&j.LockedBy, &lockedUntil, &j.CreatedAt, &started, &finished)
+	j.Payload = []byte(payload)
+	if result != "" {
+		j.Result = []byte(result)
+	}
+	if lockedUntil.Valid {
+		j.LockedUntil = lockedUntil.Time
+	}
+	if started.Valid {
+		j.StartedAt = &started.Time
+	}
+	if finished.Valid {
+		j.FinishedAt = &finished.Time
+	}
+	return j, err
+}
+
+func (r jobRepo) Enqueue(ctx context.Context, j *models.Job) error {
+	j.Status = models.JobQueued
+	j.CreatedAt = time.Now()
+	if j.RunAt.IsZero() {
+		j.RunAt = j.CreatedAt
+	}
+	if len(j.Payload) == 0 {
+		j.Payload = []byte("{}")
+	}
+	err := r.s.queryRow(ctx, r.s.db, `INSERT INTO jobs
+		(kind, payload, status, max_attempts, run_at, user_id, username, role, ip, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id`,
+		j.Kind, string(j.Payload), j.Status, j.MaxAttempts, j.RunAt, sql0(j.UserID), j.Username, j.Role,
+		j.IP, j.CreatedAt).Scan(&j.ID)
+	return r.s.mapErr(err)
+}
+
+func (r jobRepo) Get(ctx context.Context, id int64) (models.Job, error) {
+	j, err := scanJob(r.s.queryRow(ctx, r.s.db, `SELECT `+jobColumns+` FROM jobs WHERE id = $1`, id))
+	return j, r.s.mapErr(err)
+}
+
+func (r jobRepo) List(ctx context.Context, f JobFilter) ([]models.Job, error) {
+	var where []string
+	var args []any
+	add := func(cond string, v any) {
+		args = append(args, v)
+		where = append(where, fmt.Sprintf(cond, len(args)))
+	}
+	if f.Status != "" {
+		add("status = $%d", f.Status)
+	}
+	if f.Kind != "" {
+		add("kind = $%d", f.Kind)
+	}
+	if f.UserID != 0 {
+		add("user_id = $%d", f.UserID)
+	}
+	query := `SELECT ` + jobColumns + ` FROM jobs`
+	if len(where) > 0 {
+		query += ` WHERE ` + strings.Join(where, " AND ")
+	}
+	query += ` ORDER BY id DESC`
+	if f.Limit > 0 {
+		query += fmt.Sprintf(` LIMIT %d`, f.Limit)
+	}
+	rows, err := r.s.query(ctx, r.s.db, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	jobs := []models.Job{}
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+func (r jobRepo) Claim(ctx context.Context, worker string, now, lockedUntil time.Time) (models.Job, error) {
+	j, err := scanJob(r.s.queryRow(ctx, r.s.db, `UPDATE jobs SET status = 'running', attempts = attempts + 1,
+			locked_by = $1, locked_until = $2, started_at = COALESCE(started_at, $3)
+		WHERE id = (SELECT id FROM jobs
+			WHERE (status = 'queued' AND run_at <= $3) OR (status = 'running' AND locked_until < $3)
+			ORDER BY run_at, id LIMIT 1 `+r.s.d.skipLocked+`)
+		RETURNING `+jobColumns, worker, lockedUntil, now))
+	return j, r.s.mapErr(err)
+}
+
+func (r jobRepo) Heartbeat(ctx context.Context, id int64, worker string, lockedUntil time.Time) (bool, error) {
+	var cancel bool
+	err := r.s.queryRow(ctx, r.s.db, `UPDATE jobs SET locked_until = $1
+		WHERE id = $2 AND locked_by = $3 AND status = 'running' RETURNING cancel_requested`,
+		lockedUntil, id, worker).Scan(&cancel)
+	return cancel, r.s.mapErr(err)
+}
+
+func (r jobRepo) SetProgress(ctx context.Context, id int64, percent int, message string) error {
+	return affected(r.s.exec(ctx, r.s.db, `UPDATE jobs SET progress = $1, progress_message = $2 WHERE id = $3`,
+		percent, message, id))
+}
+
+func (r jobRepo) Finish(ctx context.Context, j models.Job, worker string) error {
+	var result any
+	if len(j.Result) > 0 {
+		result = string(j.Result)
+	}
+	return affected(r.s.exec(ctx, r.s.db, `UPDATE jobs SET status = $1, progress = $2, progress_message = $3,
+			result = $4, error = $5, finished_at = $6, locked_by = '', locked_until = NULL
+		WHERE id = $7 AND locked_by = $8 AND status = 'running'`,
+		j.Status, j.Progress, j.ProgressMessage, result, j.Error, j.FinishedAt, j.ID, worker))
+}
+
+func (r jobRepo) Retry(ctx context.Context, id int64, worker string, runAt time.Time, msg string) error {
+	return affected(r.s.exec(ctx, r.s.db, `UPDATE jobs SET status = 'queued', run_at = $1, error = $2,
+			locked_by = '', locked_until = NULL
+		WHERE id = $3 AND locked_by = $4 AND status = 'running'`, runAt, msg, id, worker))
+}
+
+func (r jobRepo) Cancel(ctx context.Context, id int64, at time.Time) (models.Job, error) {
+	// a waiting job ends now, a running one when its worker notices
+	err := affected(r.s.exec(ctx, r.s.db, `UPDATE jobs SET status = 'cancelled', finished_at = $1
+		WHERE id = $2 AND status = 'queued'`, at, id))
+	if errors.Is(err, ErrNotFound) {
+		err = affected(r.s.exec(ctx, r.s.db, `UPDATE jobs SET cancel_requested = TRUE
+			WHERE id = $1 AND status = 'running'`, id))
+	}
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return models.Job{}, err
+	}
+	j, getErr := r.Get(ctx, id)
+	if getErr != nil {
+		return j, getErr
+	}
+	if errors.Is(err, ErrNotFound) {
+		return j, ErrConflict
+	}
+	return j, nil
+}
+
+func (r jobRepo) AppendLog(ctx context.Context, lines []models.JobLogLine) error {
+	tx, err := r.s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, l := range lines {
+		_, err := r.s.exec(ctx, tx, `INSERT INTO job_logs (job_id, at, stream, text) VALUES ($1, $2, $3, $4)`,
+			l.JobID, l.At, l.Stream, l.Text)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (r jobRepo) Logs(ctx context.Context, jobID, after int64, limit int) ([]models.JobLogLine, error) {
+	rows, err := r.s.query(ctx, r.s.db, `SELECT id, job_id, at, stream, text FROM job_logs
+		WHERE job_id = $1 AND id > $2 ORDER BY id LIMIT $3`, jobID, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	lines := []models.JobLogLine{}
+	for rows.Next() {
+		var l models.JobLogLine
+		if err := rows.Scan(&l.ID, &l.JobID, &l.At, &l.Stream, &l.Text); err != nil {
+			return nil, err
+		}
+		lines = append(lines, l)
+	}
+	return lines, rows.Err()
+}
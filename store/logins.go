@@ -0,0 +1,115 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"CipherOps/models"
+)
+
+type loginRepo struct{ s *sqlStore }
+
+func (r loginRepo) RecordAttempt(ctx context.Context, a models.LoginAttempt) error {
+	if a.CreatedAt.IsZero() {
+		a.CreatedAt = time.Now()
+	}
+	_, err := r.s.exec(ctx, r.s.db, `INSERT INTO login_attempts (username, ip, success, reason, created_at)
+		VALUES ($1, $2, $3, $4, $5)`, a.Username, a.IP, a.Success, a.Reason, a.CreatedAt)
+	return err
+}
+
+func (r loginRepo) IPFailures(ctx context.Context, ip string, since time.Time) (models.IPFailures, error) {
+	f := models.IPFailures{IP: ip}
+	var last textTime
+	err := r.s.queryRow(ctx, r.s.db, `SELECT COUNT(*), MAX(created_at) FROM login_attempts
+		WHERE ip = $1 AND NOT success AND created_at > $2`, ip, since).Scan(&f.Failures, &last)
+	f.Last = last.Time
+	return f, err
+}
+
+func (r loginRepo) FailuresByIP(ctx context.Context, since time.Time, min int) ([]models.IPFailures, error) {
+	rows, err := r.s.query(ctx, r.s.db, `SELECT ip, COUNT(*), MAX(created_at) FROM login_attempts
+		WHERE NOT success AND created_at > $1
+		GROUP BY ip HAVING COUNT(*) >= $2 ORDER BY COUNT(*) DESC, ip`, since, min)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	failures := []models.IPFailures{}
+	for rows.Next() {
+		var f models.IPFailures
+		var last textTime
+		if err := rows.Scan(&f.IP, &f.Failures, &last); err != nil {
+			return nil, err
+		}
+		f.Last = last.Time
+		failures = append(failures, f)
+	}
+	return failures, rows.Err()
+}
+
+const lockoutColumns = `username, failures, last_failure_at, locked_until`
+
+func scanLockout(row interface{ Scan(...any) error }) (models.Lockout, error) {
+	var l models.Lockout
+	var lockedUntil sql.NullTime
+	err := row.Scan(&l.Username, &l.Failures, &l.LastFailureAt, &lockedUntil)
+	l.LockedUntil = optionalTime(lockedUntil)
+	return l, err
+}
+
+func (r loginRepo) Lockout(ctx context.Context, username string) (models.Lockout, error) {
+	l, err := scanLockout(r.s.queryRow(ctx, r.s.db, `SELECT `+lockoutColumns+` FROM account_lockouts
+		WHERE username = $1`, username))
+	return l, r.s.mapErr(err)
+}
+
+func (r loginRepo) ListLockouts(ctx context.Context) ([]models.Lockout, error) {
+	rows, err := r.s.query(ctx, r.s.db, `SELECT `+lockoutColumns+` FROM account_lockouts ORDER BY last_failure_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	lockouts := []models.Lockout{}
+	for rows.Next() {
+		l, err := scanLockout(rows)
+		if err != nil {
+			return nil, err
+		}
+		lockouts = append(lockouts, l)
+	}
+	return lockouts, rows.Err()
+}
+
+func (r loginRepo) RecordFailure(ctx context.Context, username string, at, windowStart time.Time) (int, error) {
+	var failures int
+	err := r.s.queryRow(ctx, r.s.db, `INSERT INTO account_lockouts (username, failures, last_failure_at)
+		VALUES ($1, 1, $2)
+		ON CONFLICT (username) DO UPDATE SET
+			failures = CASE WHEN account_lockouts.last_failure_at < $3 THEN 1 ELSE account_lockouts.failures + 1 END,
+			last_failure_at = excluded.last_failure_at
+		RETURNING failures`, username, at, windowStart).Scan(&failures)
+	return failures, r.s.mapErr(err)
+}
+
+func (r loginRepo) Lock(ctx context.Context, username string, until time.Time) error {
+	return affected(r.s.exec(ctx, r.s.db, `UPDATE account_lockouts SET locked_until = $1 WHERE username = $2`, until, username))
+}
+
+func (r loginRepo) ClearLockout(ctx context.Context, username string) (bool, error) {
+	res, err := r.s.exec(ctx, r.s.db, `DELETE FROM account_lockouts WHERE username = $1`, username)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (r loginRepo) UsePoWSalt(ctx context.Context, salt string, expires, now time.Time) error {
+	if _, err := r.s.exec(ctx, r.s.db, `DELETE FROM used_pow_salts WHERE expires_at < $1`, now); err != nil {
+		return err
+	}
+	_, err := r.s.exec(ctx, r.s.db, `INSERT INTO used_pow_salts (salt, expires_at) VALUES ($1, $2)`, salt, expires)
+	return err
+}
@@ -0,0 +1,110 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"CipherOps/models"
+)
+
+func TestLoginAttempts(t *testing.T) {
+	st := openTest(t)
+	ctx := context.Background()
+	logins := st.Logins()
+	now := time.Now().Truncate(time.Millisecond)
+
+	for _, a := range []models.LoginAttempt{
+		{Username: "alice", IP: "10.0.0.1", CreatedAt: now.Add(-2 * time.Hour)},
+		{Username: "alice", IP: "10.0.0.1", CreatedAt: now.Add(-time.Minute)},
+		{Username: "bob", IP: "10.0.0.1", CreatedAt: now},
+		{Username: "bob", IP: "10.0.0.2", CreatedAt: now.Add(-time.Second)},
+		{Username: "bob", IP: "10.0.0.2", Success: true, CreatedAt: now},
+	} {
+		if err := logins.RecordAttempt(ctx, a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	since := now.Add(-time.Hour)
+	f, err := logins.IPFailures(ctx, "10.0.0.1", since)
+	if err != nil || f.Failures != 2 || !f.Last.Equal(now) {
+		t.Errorf("IPFailures = %+v, %v; want 2 failures, the last at %s", f, err, now)
+	}
+	if f, err := logins.IPFailures(ctx, "10.0.0.9", since); err != nil || f.Failures != 0 {
+		t.Errorf("IPFailures of an unknown address = %+v, %v", f, err)
+	}
+
+	failures, err := logins.FailuresByIP(ctx, since, 1)
+	if err != nil || len(failures) != 2 || failures[0].IP != "10.0.0.1" || failures[1].Failures != 1 {
+		t.Errorf("FailuresByIP = %+v, %v", failures, err)
+	}
+	if failures, _ := logins.FailuresByIP(ctx, since, 2); len(failures) != 1 {
+		t.Errorf("FailuresByIP with min 2 = %+v", failures)
+	}
+}
+
+func TestLockouts(t *testing.T) {
+	st := openTest(t)
+	ctx := context.Background()
+	logins := st.Logins()
+	now := time.Now()
+	window := 15 * time.Minute
+
+	if _, err := logins.Lockout(ctx, "alice"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Lockout without failures: %v, want ErrNotFound", err)
+	}
+	for i := 1; i <= 3; i++ {
+		at := now.Add(time.Duration(i) * time.Second)
+		n, err := logins.RecordFailure(ctx, "alice", at, at.Add(-window))
+		if err != nil || n != i {
+			t.Fatalf("failure %d counted as %d, %v", i, n, err)
+		}
+	}
+	// a failure after a quiet window starts over
+	later := now.Add(time.Hour)
+	if n, err := logins.RecordFailure(ctx, "alice", later, later.Add(-window)); n != 1 || err != nil {
+		t.Errorf("failure after the window counted as %d, %v", n, err)
+	}
+
+	if err := logins.Lock(ctx, "alice", later.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	l, err := logins.Lockout(ctx, "alice")
+	if err != nil || l.Failures != 1 || l.LockedUntil == nil || !l.LastFailureAt.Equal(later) {
+		t.Errorf("Lockout = %+v, %v", l, err)
+	}
+	if list, err := logins.ListLockouts(ctx); err != nil || len(list) != 1 {
+		t.Errorf("ListLockouts = %+v, %v", list, err)
+	}
+
+	if ok, err := logins.ClearLockout(ctx, "alice"); !ok || err != nil {
+		t.Errorf("ClearLockout = %v, %v", ok, err)
+	}
+	if ok, _ := logins.ClearLockout(ctx, "alice"); ok {
+		t.Error("cleared a lockout twice")
+	}
+	if err := logins.Lock(ctx, "alice", later); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Lock without failures: %v, want ErrNotFound", err)
+	}
+}
+
+func TestPoWSalts(t *testing.T) {
+	st := openTest(t)
+	ctx := context.Background()
+	logins := st.Logins()
+	now := time.Now()
+
+	if err := logins.UsePoWSalt(ctx, "salt", now.Add(time.Minute), now); err != nil {
+		t.Fatal(err)
+	}
+	if err := logins.UsePoWSalt(ctx, "salt", now.Add(time.Minute), now); !errors.Is(err, ErrConflict) {
+		t.Errorf("replayed salt: %v, want ErrConflict", err)
+	}
+	// expired salts are dropped, their challenges fail the signature check
+	later := now.Add(2 * time.Minute)
+	if err := logins.UsePoWSalt(ctx, "salt", later.Add(time.Minute), later); err != nil {
+		t.Errorf("salt after expiry: %v", err)
+	}
+}
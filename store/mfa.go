@@ -0,0 +1,108 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+type mfaRepo struct{ s *sqlStore }
+
+func (r mfaRepo) SetTOTPSecret(ctx context.Context, userID int, secret string) error {
+	return affected(r.s.exec(ctx, r.s.db, `UPDATE users SET totp_secret = $1, totp_last_step = 0 WHERE id = $2`, secret, userID))
+}
+
+func (r mfaRepo) EnableTOTP(ctx context.Context, userID int, step int64, recoveryHashes []string) error {
+	return r.s.inTx(ctx, func(tx *sql.Tx) error {
+		err := affected(r.s.exec(ctx, tx, `UPDATE users SET totp_enabled = TRUE, totp_last_step = $1 WHERE id = $2`, step, userID))
+		if err != nil {
+			return err
+		}
+		return r.replaceCodes(ctx, tx, userID, recoveryHashes)
+	})
+}
+
+func (r mfaRepo) DisableTOTP(ctx context.Context, userID int) error {
+	return r.s.inTx(ctx, func(tx *sql.Tx) error {
+		err := affected(r.s.exec(ctx, tx, `UPDATE users SET totp_enabled = FALSE, totp_secret = '', totp_last_step = 0
+			WHERE id = $1`, userID))
+		if err != nil {
+			return err
+		}
+		_, err = r.s.exec(ctx, tx, `DELETE FROM user_recovery_codes WHERE user_id = $1`, userID)
+		return err
+	})
+}
+
+func (r mfaRepo) UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error) {
+	res, err := r.s.exec(ctx, r.s.db, `UPDATE users SET totp_last_step = $1
+		WHERE id = $2 AND totp_enabled AND totp_last_step < $1`, step, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (r mfaRepo) ReplaceRecoveryCodes(ctx context.Context, userID int, hashes []string) error {
+	return r.s.inTx(ctx, func(tx *sql.Tx) error {
+		return r.replaceCodes(ctx, tx, userID, hashes)
+	})
+}
+
+func (r mfaRepo) replaceCodes(ctx context.Context, tx *sql.Tx, userID int, hashes []string) error {
+	if _, err := r.s.exec(ctx, tx, `DELETE FROM user_recovery_codes WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		if _, err := r.s.exec(ctx, tx, `INSERT INTO user_recovery_codes (user_id, code_hash) VALUES ($1, $2)`,
+			userID, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r mfaRepo) UseRecoveryCode(ctx context.Context, userID int, hash string, at time.Time) (bool, error) {
+	res, err := r.s.exec(ctx, r.s.db, `UPDATE user_recovery_codes SET used_at = $1
+		WHERE user_id = $2 AND code_hash = $3 AND used_at IS NULL`, at, userID, hash)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (r mfaRepo) RequiresMFA(ctx context.Context, role string) (bool, error) {
+	var required bool
+	err := r.s.mapErr(r.s.queryRow(ctx, r.s.db, `SELECT require_mfa FROM role_mfa_policy WHERE role = $1`, role).Scan(&required))
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	return required, err
+}
+
+func (r mfaRepo) Policy(ctx context.Context) (map[string]bool, error) {
+	rows, err := r.s.query(ctx, r.s.db, `SELECT role, require_mfa FROM role_mfa_policy ORDER BY role`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	policy := map[string]bool{}
+	for rows.Next() {
+		var role string
+		var required bool
+		if err := rows.Scan(&role, &required); err != nil {
+			return nil, err
+		}
+		policy[role] = required
+	}
+	return policy, rows.Err()
+}
+
+func (r mfaRepo) SetPolicy(ctx context.Context, role string, require bool) error {
+	_, err := r.s.exec(ctx, r.s.db, `INSERT INTO role_mfa_policy (role, require_mfa) VALUES ($1, $2)
+		ON CONFLICT (role) DO UPDATE SET require_mfa = excluded.require_mfa`, role, require)
+	return err
+}
@@ -0,0 +1,67 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"CipherOps/models"
+)
+
+type passkeyRepo struct{ s *sqlStore }
+
+func (r passkeyRepo) Create(ctx context.Context, p *models.Passkey) error {
+	p.CreatedAt = time.Now()
+	err := r.s.queryRow(ctx, r.s.db, `INSERT INTO webauthn_credentials (user_id, credential_id, name, data, created_at)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id`, p.UserID, p.CredentialID, p.Name, p.Data, p.CreatedAt).Scan(&p.ID)
+	return r.s.mapErr(err)
+}
+
+func (r passkeyRepo) List(ctx context.Context, userID int) ([]models.Passkey, error) {
+	rows, err := r.s.query(ctx, r.s.db, `SELECT id, user_id, credential_id, name, data, created_at, last_used_at
+		FROM webauthn_credentials WHERE user_id = $1 ORDER BY created_at, id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	keys := []models.Passkey{}
+	for rows.Next() {
+		var p models.Passkey
+		var lastUsed sql.NullTime
+		if err := rows.Scan(&p.ID, &p.UserID, &p.CredentialID, &p.Name, &p.Data, &p.CreatedAt, &lastUsed); err != nil {
+			return nil, err
+		}
+		if lastUsed.Valid {
+			p.LastUsedAt = &lastUsed.Time
+		}
+		keys = append(keys, p)
+	}
+	return keys, rows.Err()
+}
+
+func (r passkeyRepo) Used(ctx context.Context, credentialID, data []byte, at time.Time) error {
+	return affected(r.s.exec(ctx, r.s.db, `UPDATE webauthn_credentials SET data = $1, last_used_at = $2
+		WHERE credential_id = $3`, data, at, credentialID))
+}
+
+func (r passkeyRepo) Delete(ctx context.Context, userID, id int) error {
+	return affected(r.s.exec(ctx, r.s.db, `DELETE FROM webauthn_credentials WHERE id = $1 AND user_id = $2`, id, userID))
+}
+
+func (r passkeyRepo) SaveCeremony(ctx context.Context, c models.WebAuthnCeremony) error {
+	if _, err := r.s.exec(ctx, r.s.db, `DELETE FROM webauthn_ceremonies WHERE expires_at < $1`, time.Now()); err != nil {
+		return err
+	}
+	_, err := r.s.exec(ctx, r.s.db, `INSERT INTO webauthn_ceremonies (id, user_id, username, data, expires_at) VALUES ($1, $2, $3, $4, $5)`,
+		c.ID, sql0(c.UserID), c.Username, c.Data, c.ExpiresAt)
+	return err
+}
+
+func (r passkeyRepo) TakeCeremony(ctx context.Context, id string, now time.Time) (models.WebAuthnCeremony, error) {
+	c := models.WebAuthnCeremony{ID: id}
+	var owner sql.NullInt64
+	err := r.s.queryRow(ctx, r.s.db, `DELETE FROM webauthn_ceremonies WHERE id = $1 AND expires_at > $2
+		RETURNING user_id, username, data, expires_at`, id, now).Scan(&owner, &c.Username, &c.Data, &c.ExpiresAt)
+	c.UserID = int(owner.Int64)
+	return c, r.s.mapErr(err)
+}
@@ -0,0 +1,29 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// auditLock is the advisory lock serializing audit appends across instances.
+const auditLock = 0x617564697400 // "audit\0"
+
+// NewPostgres wraps a connection opened with the pgx driver. The schema is
+// managed by the db package migrations.
+func NewPostgres(db *sql.DB) Store {
+	return &sqlStore{db: db, d: dialect{
+		rebind: func(query string) string { return query },
+		isUnique: func(err error) bool {
+			var pgErr *pgconn.PgError
+			return errors.As(err, &pgErr) && pgErr.Code == "23505"
+		},
+		lockAudit: func(ctx context.Context, tx *sql.Tx) error {
+			_, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, int64(auditLock))
+			return err
+		},
+		skipLocked: "FOR UPDATE SKIP LOCKED",
+	}}
+}
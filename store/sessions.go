@@ -0,0 +1,97 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"CipherOps/models"
+)
+
+type sessionRepo struct{ s *sqlStore }
+
+const sessionColumns = `id, token_hash, user_id, stage, ip, user_agent, created_at, last_seen_at, expires_at, revoked_at`
+
+func scanSession(row interface{ Scan(...any) error }) (models.Session, error) {
+	var s models.Session
+	var revoked sql.NullTime
+	err := row.Scan(&s.ID, &s.TokenHash, &s.UserID, &s.Stage, &s.IP, &s.UserAgent,
+		&s.CreatedAt, &s.LastSeenAt, &s.ExpiresAt, &revoked)
+	if revoked.Valid {
+		s.RevokedAt = &revoked.Time
+	}
+	return s, err
+}
+
+func (r sessionRepo) Create(ctx context.Context, s *models.Session) error {
+	if s.CreatedAt.IsZero() {
+		s.CreatedAt = time.Now()
+	}
+	if s.LastSeenAt.IsZero() {
+		s.LastSeenAt = s.CreatedAt
+	}
+	err := r.s.queryRow(ctx, r.s.db, `INSERT INTO sessions
+		(token_hash, user_id, stage, ip, user_agent, created_at, last_seen_at, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`,
+		s.TokenHash, s.UserID, s.Stage, s.IP, s.UserAgent, s.CreatedAt, s.LastSeenAt, s.ExpiresAt).Scan(&s.ID)
+	return r.s.mapErr(err)
+}
+
+func (r sessionRepo) GetActive(ctx context.Context, tokenHash string, now time.Time) (models.Session, error) {
+	s, err := scanSession(r.s.queryRow(ctx, r.s.db, `SELECT `+sessionColumns+` FROM sessions
+		WHERE token_hash = $1 AND revoked_at IS NULL AND expires_at > $2`, tokenHash, now))
+	return s, r.s.mapErr(err)
+}
+
+func (r sessionRepo) Touch(ctx context.Context, id int64, at time.Time) error {
+	_, err := r.s.exec(ctx, r.s.db, `UPDATE sessions SET last_seen_at = $1 WHERE id = $2`, at, id)
+	return err
+}
+
+func (r sessionRepo) SetStage(ctx context.Context, id int64, stage string) error {
+	return affected(r.s.exec(ctx, r.s.db, `UPDATE sessions SET stage = $1 WHERE id = $2`, stage, id))
+}
+
+func (r sessionRepo) ListActive(ctx context.Context, userID int, now time.Time) ([]models.Session, error) {
+	rows, err := r.s.query(ctx, r.s.db, `SELECT `+sessionColumns+` FROM sessions
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > $2
+		ORDER BY last_seen_at DESC`, userID, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []models.Session{}
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+func (r sessionRepo) Revoke(ctx context.Context, userID int, id int64, at time.Time) (bool, error) {
+	res, err := r.s.exec(ctx, r.s.db, `UPDATE sessions SET revoked_at = $1
+		WHERE id = $2 AND user_id = $3 AND revoked_at IS NULL`, at, id, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (r sessionRepo) RevokeOthers(ctx context.Context, userID int, keep int64, at time.Time) (int64, error) {
+	res, err := r.s.exec(ctx, r.s.db, `UPDATE sessions SET revoked_at = $1
+		WHERE user_id = $2 AND id <> $3 AND revoked_at IS NULL`, at, userID, keep)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (r sessionRepo) Prune(ctx context.Context, userID int, before time.Time) error {
+	_, err := r.s.exec(ctx, r.s.db, `DELETE FROM sessions WHERE user_id = $1
+		AND COALESCE(revoked_at, expires_at) < $2`, userID, before)
+	return err
+}
@@ -0,0 +1,158 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// dialect holds what differs between the SQL databases. Queries are written
+// with Postgres $N placeholders and rewritten where needed.
+type dialect struct {
+	rebind func(query string) string
+	// bind converts arguments the driver would store unsuitably, nil keeps them
+	bind func(args []any) []any
+	// isUnique recognizes unique constraint violations
+	isUnique func(err error) bool
+	// lockAudit serializes audit appends inside tx
+	lockAudit func(ctx context.Context, tx *sql.Tx) error
+	// skipLocked ends the row lock of a job claim, so workers do not wait
+	// on each other; empty where writes are serialized anyway
+	skipLocked string
+}
+
+// sqlStore implements every repository on database/sql.
+type sqlStore struct {
+	db *sql.DB
+	d  dialect
+}
+
+func (s *sqlStore) Users() UserRepository                 { return userRepo{s} }
+func (s *sqlStore) Sessions() SessionRepository           { return sessionRepo{s} }
+func (s *sqlStore) Audit() AuditRepository                { return auditRepo{s} }
+func (s *sqlStore) Containers() ContainerRepository       { return containerRepo{s} }
+func (s *sqlStore) FirewallRules() FirewallRuleRepository { return firewallRepo{s} }
+func (s *sqlStore) Hosts() HostRepository                 { return hostRepo{s} }
+func (s *sqlStore) Agents() AgentRepository               { return agentRepo{s} }
+func (s *sqlStore) Jobs() JobRepository                   { return jobRepo{s} }
+func (s *sqlStore) MFA() MFARepository                    { return mfaRepo{s} }
+func (s *sqlStore) Passkeys() PasskeyRepository           { return passkeyRepo{s} }
+func (s *sqlStore) APITokens() APITokenRepository         { return apiTokenRepo{s} }
+func (s *sqlStore) EmailTokens() EmailTokenRepository     { return emailTokenRepo{s} }
+func (s *sqlStore) Logins() LoginRepository               { return loginRepo{s} }
+func (s *sqlStore) Ping(ctx context.Context) error        { return s.db.PingContext(ctx) }
+func (s *sqlStore) Stats() sql.DBStats                    { return s.db.Stats() }
+func (s *sqlStore) Close() error                          { return s.db.Close() }
+
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func (s *sqlStore) exec(ctx context.Context, q querier, query string, args ...any) (sql.Result, error) {
+	res, err := q.ExecContext(ctx, s.d.rebind(query), s.args(args)...)
+	return res, s.mapErr(err)
+}
+
+func (s *sqlStore) query(ctx context.Context, q querier, query string, args ...any) (*sql.Rows, error) {
+	return q.QueryContext(ctx, s.d.rebind(query), s.args(args)...)
+}
+
+func (s *sqlStore) queryRow(ctx context.Context, q querier, query string, args ...any) *sql.Row {
+	return q.QueryRowContext(ctx, s.d.rebind(query), s.args(args)...)
+}
+
+func (s *sqlStore) args(args []any) []any {
+	if s.d.bind == nil {
+		return args
+	}
+	return s.d.bind(args)
+}
+
+// mapErr turns driver errors into the package errors.
+func (s *sqlStore) mapErr(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, sql.ErrNoRows):
+		return ErrNotFound
+	case s.d.isUnique(err):
+		return ErrConflict
+	}
+	return err
+}
+
+// affected turns "no row changed" into ErrNotFound.
+func affected(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+var dollarParam = regexp.MustCompile(`\$(\d+)`)
+
+// numberedParams rewrites $N to ?N for SQLite.
+func numberedParams(query string) string {
+	return dollarParam.ReplaceAllString(query, "?$1")
+}
+
+// inTx runs fn in a transaction and commits when it succeeds.
+func (s *sqlStore) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// textTime scans timestamps computed by aggregates, which SQLite returns as
+// the text it stored rather than as a time.
+type textTime struct{ sql.NullTime }
+
+var textTimeLayouts = []string{"2006-01-02 15:04:05.999999999-07:00", "2006-01-02 15:04:05.999999999 -0700 MST", time.RFC3339Nano}
+
+func (t *textTime) Scan(v any) error {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case []byte:
+		s = string(v)
+	default:
+		return t.NullTime.Scan(v)
+	}
+	for _, layout := range textTimeLayouts {
+		if parsed, err := time.Parse(layout, s); err == nil {
+			t.Time, t.Valid = parsed, true
+			return nil
+		}
+	}
+	return fmt.Errorf("cannot parse time %q", s)
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func optionalTime(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
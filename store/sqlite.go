@@ -0,0 +1,51 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	_ "embed"
+	"fmt"
+	"strings"
+	"time"
+)
+
+//go:embed sqlite_schema.sql
+var sqliteSchema string
+
+// OpenSQLite opens or creates the database at path and applies the schema.
+// ":memory:" gives a private in-memory database, handy in tests.
+func OpenSQLite(path string) (Store, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows one writer, and every connection to :memory: would be a
+	// separate database
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sqlite schema: %w", err)
+	}
+	return &sqlStore{db: db, d: dialect{
+		rebind: numberedParams,
+		// times are stored as text, keep one offset so they compare in order
+		bind: func(args []any) []any {
+			for i, a := range args {
+				switch t := a.(type) {
+				case time.Time:
+					args[i] = t.UTC()
+				case *time.Time:
+					if t != nil {
+						args[i] = t.UTC()
+					}
+				}
+			}
+			return args
+		},
+		isUnique: func(err error) bool {
+			return strings.Contains(err.Error(), "UNIQUE constraint failed")
+		},
+		// the single connection already serializes appends
+		lockAudit: func(context.Context, *sql.Tx) error { return nil },
+	}}, nil
+}
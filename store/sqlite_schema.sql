@@ -0,0 +1,241 @@
+-- Schema of the SQLite store. It mirrors the Postgres migrations for the
+-- tables the repositories use and is applied on open.
+CREATE TABLE IF NOT EXISTS users (
+	id             INTEGER PRIMARY KEY AUTOINCREMENT,
+	username       TEXT NOT NULL UNIQUE,
+	password       TEXT NOT NULL,
+	role           TEXT NOT NULL DEFAULT 'user',
+	totp_secret    TEXT NOT NULL DEFAULT '',
+	totp_enabled   BOOLEAN NOT NULL DEFAULT FALSE,
+	totp_last_step INTEGER NOT NULL DEFAULT 0,
+	email          TEXT,
+	email_verified BOOLEAN NOT NULL DEFAULT FALSE,
+	auth_provider  TEXT NOT NULL DEFAULT 'local',
+	oidc_issuer    TEXT,
+	oidc_subject   TEXT,
+	webauthn_id    BLOB UNIQUE,
+	created_at     TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_idx ON users (LOWER(email));
+CREATE UNIQUE INDEX IF NOT EXISTS users_oidc_identity_idx ON users (oidc_issuer, oidc_subject);
+
+CREATE TABLE IF NOT EXISTS user_recovery_codes (
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id   INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	code_hash TEXT NOT NULL,
+	used_at   TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS user_recovery_codes_user_idx ON user_recovery_codes (user_id);
+
+CREATE TABLE IF NOT EXISTS role_mfa_policy (
+	role        TEXT PRIMARY KEY,
+	require_mfa BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE IF NOT EXISTS webauthn_credentials (
+	id            INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id       INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	credential_id BLOB NOT NULL UNIQUE,
+	name          TEXT NOT NULL DEFAULT '',
+	data          BLOB NOT NULL,
+	created_at    TIMESTAMP NOT NULL,
+	last_used_at  TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS webauthn_credentials_user_idx ON webauthn_credentials (user_id);
+
+CREATE TABLE IF NOT EXISTS webauthn_ceremonies (
+	id         TEXT PRIMARY KEY,
+	user_id    INTEGER REFERENCES users(id) ON DELETE CASCADE,
+	username   TEXT NOT NULL DEFAULT '',
+	data       BLOB NOT NULL,
+	expires_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS api_tokens (
+	id           INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id      INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	name         TEXT NOT NULL,
+	token_hash   TEXT NOT NULL UNIQUE,
+	scopes       TEXT NOT NULL DEFAULT '',
+	created_at   TIMESTAMP NOT NULL,
+	expires_at   TIMESTAMP,
+	last_used_at TIMESTAMP,
+	revoked_at   TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS api_tokens_user_idx ON api_tokens (user_id);
+
+CREATE TABLE IF NOT EXISTS login_attempts (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	username   TEXT NOT NULL,
+	ip         TEXT NOT NULL,
+	success    BOOLEAN NOT NULL,
+	reason     TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS login_attempts_ip_idx ON login_attempts (ip, created_at);
+CREATE INDEX IF NOT EXISTS login_attempts_username_idx ON login_attempts (username, created_at);
+
+CREATE TABLE IF NOT EXISTS account_lockouts (
+	username        TEXT PRIMARY KEY,
+	failures        INTEGER NOT NULL DEFAULT 0,
+	last_failure_at TIMESTAMP NOT NULL,
+	locked_until    TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS used_pow_salts (
+	salt       TEXT PRIMARY KEY,
+	expires_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS used_pow_salts_expires_idx ON used_pow_salts (expires_at);
+
+CREATE TABLE IF NOT EXISTS email_tokens (
+	id         TEXT PRIMARY KEY,
+	user_id    INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	purpose    TEXT NOT NULL,
+	email      TEXT NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	used_at    TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS email_tokens_user_idx ON email_tokens (user_id, purpose);
+
+CREATE TABLE IF NOT EXISTS sessions (
+	id           INTEGER PRIMARY KEY AUTOINCREMENT,
+	token_hash   TEXT NOT NULL UNIQUE,
+	user_id      INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	stage        TEXT NOT NULL,
+	ip           TEXT NOT NULL DEFAULT '',
+	user_agent   TEXT NOT NULL DEFAULT '',
+	created_at   TIMESTAMP NOT NULL,
+	last_seen_at TIMESTAMP NOT NULL,
+	expires_at   TIMESTAMP NOT NULL,
+	revoked_at   TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS sessions_user_idx ON sessions (user_id);
+
+CREATE TABLE IF NOT EXISTS audit_log (
+	id         INTEGER PRIMARY KEY,
+	created_at TIMESTAMP NOT NULL,
+	user_id    INTEGER,
+	username   TEXT NOT NULL,
+	ip         TEXT NOT NULL DEFAULT '',
+	host       TEXT NOT NULL DEFAULT '',
+	action     TEXT NOT NULL,
+	command    TEXT NOT NULL,
+	args       TEXT NOT NULL DEFAULT '[]',
+	success    BOOLEAN NOT NULL,
+	output     TEXT NOT NULL DEFAULT '',
+	error      TEXT NOT NULL DEFAULT '',
+	prev_hash  TEXT NOT NULL,
+	hash       TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS containers (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	name       TEXT NOT NULL UNIQUE,
+	image      TEXT NOT NULL,
+	port       TEXT NOT NULL DEFAULT '',
+	env        TEXT NOT NULL DEFAULT '{}',
+	engine_id  TEXT NOT NULL DEFAULT '',
+	status     TEXT NOT NULL DEFAULT '',
+	created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+	created_at TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS firewall_rules (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	direction  TEXT NOT NULL,
+	protocol   TEXT NOT NULL,
+	port       TEXT NOT NULL DEFAULT '',
+	source     TEXT NOT NULL DEFAULT '',
+	action     TEXT NOT NULL,
+	comment    TEXT NOT NULL DEFAULT '',
+	enabled    BOOLEAN NOT NULL DEFAULT TRUE,
+	position   INTEGER NOT NULL DEFAULT 0,
+	created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+	created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS firewall_rules_position_idx ON firewall_rules (position);
+
+CREATE TABLE IF NOT EXISTS hosts (
+	id               INTEGER PRIMARY KEY AUTOINCREMENT,
+	name             TEXT NOT NULL UNIQUE,
+	address          TEXT NOT NULL,
+	port             INTEGER NOT NULL DEFAULT 22,
+	ssh_user         TEXT NOT NULL DEFAULT '',
+	labels           TEXT NOT NULL DEFAULT '{}',
+	distro_id        TEXT NOT NULL DEFAULT '',
+	distro_like      TEXT NOT NULL DEFAULT '',
+	distro_name      TEXT NOT NULL DEFAULT '',
+	distro_version   TEXT NOT NULL DEFAULT '',
+	installer        TEXT NOT NULL DEFAULT '',
+	service_manager  TEXT NOT NULL DEFAULT '',
+	firewall_backend TEXT NOT NULL DEFAULT '',
+	facts_at         TIMESTAMP,
+	facts_error      TEXT NOT NULL DEFAULT '',
+	created_at       TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS host_groups (
+	id   INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS host_group_members (
+	group_id INTEGER NOT NULL REFERENCES host_groups(id) ON DELETE CASCADE,
+	host_id  INTEGER NOT NULL REFERENCES hosts(id) ON DELETE CASCADE,
+	PRIMARY KEY (group_id, host_id)
+);
+
+CREATE TABLE IF NOT EXISTS agent_tokens (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	host_id    INTEGER NOT NULL REFERENCES hosts(id) ON DELETE CASCADE,
+	token_hash TEXT NOT NULL UNIQUE,
+	expires_at TIMESTAMP NOT NULL,
+	used_at    TIMESTAMP,
+	created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+	created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS agents (
+	host_id     INTEGER PRIMARY KEY REFERENCES hosts(id) ON DELETE CASCADE,
+	cert_serial TEXT NOT NULL UNIQUE,
+	cert_expiry TIMESTAMP NOT NULL,
+	enrolled_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	last_seen   TIMESTAMP,
+	revoked_at  TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS jobs (
+	id               INTEGER PRIMARY KEY AUTOINCREMENT,
+	kind             TEXT NOT NULL,
+	payload          TEXT NOT NULL DEFAULT '{}',
+	status           TEXT NOT NULL DEFAULT 'queued',
+	attempts         INTEGER NOT NULL DEFAULT 0,
+	max_attempts     INTEGER NOT NULL DEFAULT 1,
+	run_at           TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	progress         INTEGER NOT NULL DEFAULT 0,
+	progress_message TEXT NOT NULL DEFAULT '',
+	result           TEXT,
+	error            TEXT NOT NULL DEFAULT '',
+	cancel_requested BOOLEAN NOT NULL DEFAULT FALSE,
+	user_id          INTEGER REFERENCES users(id) ON DELETE SET NULL,
+	username         TEXT NOT NULL DEFAULT '',
+	role             TEXT NOT NULL DEFAULT '',
+	ip               TEXT NOT NULL DEFAULT '',
+	locked_by        TEXT NOT NULL DEFAULT '',
+	locked_until     TIMESTAMP,
+	created_at       TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	started_at       TIMESTAMP,
+	finished_at      TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS jobs_status_idx ON jobs (status, run_at);
+
+CREATE TABLE IF NOT EXISTS job_logs (
+	id     INTEGER PRIMARY KEY AUTOINCREMENT,
+	job_id INTEGER NOT NULL REFERENCES jobs(id) ON DELETE CASCADE,
+	at     TIMESTAMP NOT NULL,
+	stream TEXT NOT NULL,
+	text   TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS job_logs_job_idx ON job_logs (job_id, id);
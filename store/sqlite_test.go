@@ -0,0 +1,168 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"CipherOps/models"
+)
+
+// openTest returns an empty in-memory store closed at the end of the test.
+func openTest(t *testing.T) Store {
+	t.Helper()
+	st, err := OpenSQLite(":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+	return st
+}
+
+// createUser inserts a local user with the given name.
+func createUser(t *testing.T, st Store, username string) models.User {
+	t.Helper()
+	u := models.User{Username: username, Password: "hash", Role: "user"}
+	if err := st.Users().Create(context.Background(), &u); err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+func TestSessions(t *testing.T) {
+	st := openTest(t)
+	ctx := context.Background()
+	user := createUser(t, st, "alice")
+	now := time.Now()
+
+	var ids []int64
+	for _, hash := range []string{"a", "b", "c"} {
+		s := models.Session{TokenHash: hash, UserID: user.ID, Stage: "full", ExpiresAt: now.Add(time.Hour)}
+		if err := st.Sessions().Create(ctx, &s); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, s.ID)
+	}
+	if err := st.Sessions().Create(ctx, &models.Session{TokenHash: "a", UserID: user.ID, ExpiresAt: now}); !errors.Is(err, ErrConflict) {
+		t.Errorf("duplicate token hash: %v, want ErrConflict", err)
+	}
+
+	s, err := st.Sessions().GetActive(ctx, "a", now)
+	if err != nil || s.ID != ids[0] || s.UserID != user.ID {
+		t.Fatalf("GetActive = %+v, %v", s, err)
+	}
+	if _, err := st.Sessions().GetActive(ctx, "a", now.Add(2*time.Hour)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expired session: %v, want ErrNotFound", err)
+	}
+	if err := st.Sessions().SetStage(ctx, ids[0], "enroll"); err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := st.Sessions().Revoke(ctx, user.ID, ids[1], now); !ok || err != nil {
+		t.Errorf("Revoke = %v, %v", ok, err)
+	}
+	if ok, _ := st.Sessions().Revoke(ctx, user.ID, ids[1], now); ok {
+		t.Error("revoked a session twice")
+	}
+	if n, err := st.Sessions().RevokeOthers(ctx, user.ID, ids[0], now); n != 1 || err != nil {
+		t.Errorf("RevokeOthers = %d, %v; want the one other active session", n, err)
+	}
+	active, err := st.Sessions().ListActive(ctx, user.ID, now)
+	if err != nil || len(active) != 1 || active[0].Stage != "enroll" {
+		t.Errorf("ListActive = %+v, %v", active, err)
+	}
+
+	if err := st.Sessions().Prune(ctx, user.ID, now.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if active, _ := st.Sessions().ListActive(ctx, user.ID, now); len(active) != 1 {
+		t.Errorf("Prune removed the active session")
+	}
+}
+
+func TestContainers(t *testing.T) {
+	st := openTest(t)
+	ctx := context.Background()
+	user := createUser(t, st, "alice")
+	repo := st.Containers()
+
+	c := models.Container{Name: "web", Image: "nginx:1", Port: "8080", Env: map[string]string{"A": "1"}, CreatedBy: user.ID}
+	if err := repo.Create(ctx, &c); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Create(ctx, &models.Container{Name: "web", Image: "nginx:2"}); !errors.Is(err, ErrConflict) {
+		t.Errorf("duplicate name: %v, want ErrConflict", err)
+	}
+	if err := repo.SetState(ctx, c.ID, "abc123", "running"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := repo.GetByName(ctx, "web")
+	if err != nil || got.EngineID != "abc123" || got.Status != "running" || got.Env["A"] != "1" || got.CreatedBy != user.ID {
+		t.Fatalf("GetByName = %+v, %v", got, err)
+	}
+
+	// the container outlives its creator
+	if err := st.Users().Delete(ctx, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := repo.Get(ctx, c.ID); err != nil || got.CreatedBy != 0 {
+		t.Errorf("after deleting the creator Get = %+v, %v", got, err)
+	}
+
+	if err := repo.Delete(ctx, c.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Delete(ctx, c.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second Delete: %v, want ErrNotFound", err)
+	}
+	if list, err := repo.List(ctx); err != nil || len(list) != 0 {
+		t.Errorf("List = %+v, %v", list, err)
+	}
+}
+
+func TestFirewallRules(t *testing.T) {
+	st := openTest(t)
+	ctx := context.Background()
+	repo := st.FirewallRules()
+
+	for _, r := range []models.FirewallRule{
+		{Direction: "in", Protocol: "tcp", Port: "443", Action: "allow", Enabled: true, Position: 2},
+		{Direction: "in", Protocol: "tcp", Port: "22", Source: "10.0.0.0/8", Action: "allow", Enabled: true, Position: 1},
+		{Direction: "in", Protocol: "any", Action: "deny", Position: 3},
+	} {
+		if err := repo.Create(ctx, &r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rules, err := repo.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ports []string
+	for _, r := range rules {
+		ports = append(ports, r.Port)
+	}
+	if len(ports) != 3 || ports[0] != "22" || ports[1] != "443" || ports[2] != "" {
+		t.Errorf("rules in order %q, want by position", ports)
+	}
+
+	ssh := rules[0]
+	ssh.Enabled = false
+	ssh.Comment = "maintenance"
+	if err := repo.Update(ctx, ssh); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := repo.Get(ctx, ssh.ID); err != nil || got.Enabled || got.Comment != "maintenance" || got.Source != "10.0.0.0/8" {
+		t.Errorf("after Update Get = %+v, %v", got, err)
+	}
+	if err := repo.Update(ctx, models.FirewallRule{ID: 999}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Update of a missing rule: %v, want ErrNotFound", err)
+	}
+	if err := repo.Delete(ctx, ssh.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Get(ctx, ssh.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get after Delete: %v, want ErrNotFound", err)
+	}
+}
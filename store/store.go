@@ -0,0 +1,276 @@
+// Package store is the typed data access layer. Handlers and services use
+// the repository interfaces; Postgres backs production, SQLite backs tests
+// and single-node installs.
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"CipherOps/models"
+)
+
+var (
+	ErrNotFound = errors.New("not found")
+	// a unique column such as a username or email is already taken
+	ErrConflict = errors.New("already exists")
+)
+
+// Store bundles the repositories of one database.
+type Store interface {
+	Users() UserRepository
+	Sessions() SessionRepository
+	Audit() AuditRepository
+	Containers() ContainerRepository
+	FirewallRules() FirewallRuleRepository
+	Hosts() HostRepository
+	Agents() AgentRepository
+	Jobs() JobRepository
+	MFA() MFARepository
+	Passkeys() PasskeyRepository
+	APITokens() APITokenRepository
+	EmailTokens() EmailTokenRepository
+	Logins() LoginRepository
+	// Ping checks that the database answers, Stats describes the pool.
+	Ping(ctx context.Context) error
+	Stats() sql.DBStats
+	Close() error
+}
+
+type UserRepository interface {
+	// Create inserts u and sets its ID.
+	Create(ctx context.Context, u *models.User) error
+	Get(ctx context.Context, id int) (models.User, error)
+	GetByUsername(ctx context.Context, username string) (models.User, error)
+	// GetByEmail matches case-insensitively.
+	GetByEmail(ctx context.Context, email string) (models.User, error)
+	List(ctx context.Context) ([]models.User, error)
+	SetRole(ctx context.Context, id int, role string) error
+	SetPassword(ctx context.Context, id int, hash string) error
+	// SetEmail stores an unverified address; ErrConflict when another
+	// account has it.
+	SetEmail(ctx context.Context, id int, email string) error
+	// VerifyEmail marks the address verified if it still is email,
+	// ErrNotFound otherwise.
+	VerifyEmail(ctx context.Context, id int, email string) error
+	// SyncExternal creates the user of an external provider on its first
+	// login or refreshes its role, and fills in u. ErrConflict when the
+	// username belongs to another provider.
+	SyncExternal(ctx context.Context, u *models.User) error
+	GetByOIDC(ctx context.Context, issuer, subject string) (models.User, error)
+	GetByWebAuthnID(ctx context.Context, handle []byte) (models.User, error)
+	SetWebAuthnID(ctx context.Context, id int, handle []byte) error
+	Delete(ctx context.Context, id int) error
+}
+
+// MFARepository keeps the second factors of users and the roles that
+// require one.
+type MFARepository interface {
+	// SetTOTPSecret starts an enrollment, the secret is not used before
+	// EnableTOTP.
+	SetTOTPSecret(ctx context.Context, userID int, secret string) error
+	// EnableTOTP turns the secret on with step as the last code used and
+	// replaces the recovery codes, all at once.
+	EnableTOTP(ctx context.Context, userID int, step int64, recoveryHashes []string) error
+	// DisableTOTP drops the secret and the recovery codes.
+	DisableTOTP(ctx context.Context, userID int) error
+	// UseTOTPStep records step as used. It reports false when the step or a
+	// later one was used already, so concurrent replays lose.
+	UseTOTPStep(ctx context.Context, userID int, step int64) (bool, error)
+	ReplaceRecoveryCodes(ctx context.Context, userID int, hashes []string) error
+	// UseRecoveryCode reports whether an unused code matched; it is used up.
+	UseRecoveryCode(ctx context.Context, userID int, hash string, at time.Time) (bool, error)
+	// RequiresMFA is false for roles without a policy.
+	RequiresMFA(ctx context.Context, role string) (bool, error)
+	Policy(ctx context.Context) (map[string]bool, error)
+	SetPolicy(ctx context.Context, role string, require bool) error
+}
+
+type PasskeyRepository interface {
+	// Create inserts p and sets its ID and CreatedAt.
+	Create(ctx context.Context, p *models.Passkey) error
+	// List returns the user's credentials, oldest first.
+	List(ctx context.Context, userID int) ([]models.Passkey, error)
+	// Used stores the credential data after a login.
+	Used(ctx context.Context, credentialID, data []byte, at time.Time) error
+	Delete(ctx context.Context, userID, id int) error
+	// SaveCeremony stores a pending ceremony and drops the expired ones.
+	SaveCeremony(ctx context.Context, c models.WebAuthnCeremony) error
+	// TakeCeremony deletes and returns the ceremony; ErrNotFound when it is
+	// unknown or expired at now.
+	TakeCeremony(ctx context.Context, id string, now time.Time) (models.WebAuthnCeremony, error)
+}
+
+type APITokenRepository interface {
+	// Create inserts t and sets its ID and CreatedAt.
+	Create(ctx context.Context, t *models.APIToken) error
+	// List returns the user's tokens, newest first.
+	List(ctx context.Context, userID int) ([]models.APIToken, error)
+	// GetByHash returns an unrevoked token with the role of its owner.
+	// Expiry is left to the caller, which tells it apart.
+	GetByHash(ctx context.Context, tokenHash string) (models.APIToken, error)
+	Touch(ctx context.Context, id int, at time.Time) error
+	// Revoke keeps the row, ErrNotFound when the user has no such active token.
+	Revoke(ctx context.Context, userID, id int, at time.Time) error
+}
+
+type EmailTokenRepository interface {
+	// Issue stores t and ends the unused tokens of the same user and purpose.
+	Issue(ctx context.Context, t models.EmailToken) error
+	// Consume marks the token used and returns it; ErrNotFound when it is
+	// unknown, used or expired at now.
+	Consume(ctx context.Context, id, purpose string, now time.Time) (models.EmailToken, error)
+}
+
+// LoginRepository keeps the login audit and the failure counts of accounts.
+type LoginRepository interface {
+	RecordAttempt(ctx context.Context, a models.LoginAttempt) error
+	// IPFailures counts the failed logins of ip since the given time.
+	IPFailures(ctx context.Context, ip string, since time.Time) (models.IPFailures, error)
+	// FailuresByIP lists the addresses with at least min failed logins
+	// since the given time, worst first.
+	FailuresByIP(ctx context.Context, since time.Time, min int) ([]models.IPFailures, error)
+	// Lockout returns ErrNotFound for accounts without failures.
+	Lockout(ctx context.Context, username string) (models.Lockout, error)
+	// ListLockouts returns the most recent failures first.
+	ListLockouts(ctx context.Context) ([]models.Lockout, error)
+	// RecordFailure counts a failure at the given time, starting over when
+	// the last one was before windowStart, and returns the count.
+	RecordFailure(ctx context.Context, username string, at, windowStart time.Time) (int, error)
+	Lock(ctx context.Context, username string, until time.Time) error
+	// ClearLockout reports whether the account had failures.
+	ClearLockout(ctx context.Context, username string) (bool, error)
+	// UsePoWSalt marks the salt of a solved login challenge used until
+	// expires; ErrConflict when it was used already.
+	UsePoWSalt(ctx context.Context, salt string, expires, now time.Time) error
+}
+
+type SessionRepository interface {
+	// Create inserts s and sets its ID.
+	Create(ctx context.Context, s *models.Session) error
+	// GetActive returns the session unless it was revoked or expired at now.
+	GetActive(ctx context.Context, tokenHash string, now time.Time) (models.Session, error)
+	Touch(ctx context.Context, id int64, at time.Time) error
+	SetStage(ctx context.Context, id int64, stage string) error
+	ListActive(ctx context.Context, userID int, now time.Time) ([]models.Session, error)
+	// Revoke reports whether an active session of the user was ended.
+	Revoke(ctx context.Context, userID int, id int64, at time.Time) (bool, error)
+	// RevokeOthers ends all sessions of the user but keep; keep 0 ends all.
+	RevokeOthers(ctx context.Context, userID int, keep int64, at time.Time) (int64, error)
+	// Prune deletes the user's sessions that ended before the given time.
+	Prune(ctx context.Context, userID int, before time.Time) error
+}
+
+// AuditFilter selects audit entries; zero fields match everything.
+type AuditFilter struct {
+	UserID int
+	Action string
+	Host   string
+	Since  time.Time
+	Until  time.Time
+	// the newest Limit entries, 0 means no limit
+	Limit int
+}
+
+type AuditRepository interface {
+	// Append serializes writers, calls build with the id and hash of the
+	// last entry (0 and "" for an empty log) and stores the entry it returns.
+	Append(ctx context.Context, build func(lastID int64, lastHash string) (models.AuditEntry, error)) (models.AuditEntry, error)
+	// Each calls fn for the matching entries, oldest first; an error from fn
+	// stops the iteration and is returned.
+	Each(ctx context.Context, f AuditFilter, fn func(models.AuditEntry) error) error
+}
+
+type ContainerRepository interface {
+	Create(ctx context.Context, c *models.Container) error
+	Get(ctx context.Context, id int) (models.Container, error)
+	GetByName(ctx context.Context, name string) (models.Container, error)
+	List(ctx context.Context) ([]models.Container, error)
+	SetState(ctx context.Context, id int, engineID, status string) error
+	Delete(ctx context.Context, id int) error
+}
+
+type FirewallRuleRepository interface {
+	Create(ctx context.Context, r *models.FirewallRule) error
+	Get(ctx context.Context, id int) (models.FirewallRule, error)
+	// List returns the rules in the order they apply.
+	List(ctx context.Context) ([]models.FirewallRule, error)
+	Update(ctx context.Context, r models.FirewallRule) error
+	Delete(ctx context.Context, id int) error
+}
+
+type HostRepository interface {
+	// Create inserts h and sets its ID; Groups and Facts are not stored.
+	Create(ctx context.Context, h *models.Host) error
+	GetByName(ctx context.Context, name string) (models.Host, error)
+	// List returns the hosts by name, with their groups.
+	List(ctx context.Context) ([]models.Host, error)
+	// Update changes the address, port, user and labels.
+	Update(ctx context.Context, h models.Host) error
+	SetFacts(ctx context.Context, id int, f models.HostFacts) error
+	// SetFactsError keeps the last facts and records why gathering failed.
+	SetFactsError(ctx context.Context, id int, msg string) error
+	Delete(ctx context.Context, id int) error
+
+	CreateGroup(ctx context.Context, g *models.HostGroup) error
+	// ListGroups returns the groups by name, with their hosts.
+	ListGroups(ctx context.Context) ([]models.HostGroup, error)
+	DeleteGroup(ctx context.Context, name string) error
+	// AddToGroup returns ErrNotFound for an unknown group or host and
+	// ErrConflict when the host is in the group already.
+	AddToGroup(ctx context.Context, group, host string) error
+	RemoveFromGroup(ctx context.Context, group, host string) error
+}
+
+type AgentRepository interface {
+	// CreateToken inserts t and sets its ID.
+	CreateToken(ctx context.Context, t *models.AgentToken) error
+	// UseToken marks a token used and returns it; ErrNotFound when it is
+	// unknown, used or expired at now.
+	UseToken(ctx context.Context, tokenHash string, now time.Time) (models.AgentToken, error)
+	// Enroll records the agent of a host, replacing and so disowning an
+	// earlier certificate.
+	Enroll(ctx context.Context, a models.Agent) error
+	GetBySerial(ctx context.Context, serial string) (models.Agent, error)
+	List(ctx context.Context) ([]models.Agent, error)
+	Touch(ctx context.Context, hostID int, at time.Time) error
+	Revoke(ctx context.Context, hostID int, at time.Time) error
+}
+
+// JobFilter selects jobs; empty fields match all. Limit 0 means no limit.
+type JobFilter struct {
+	Status string
+	Kind   string
+	UserID int
+	Limit  int
+}
+
+// JobRepository keeps the job queue. Claim, Heartbeat, Finish and Retry
+// only touch a job the calling worker holds.
+type JobRepository interface {
+	// Enqueue inserts j as queued and sets its ID.
+	Enqueue(ctx context.Context, j *models.Job) error
+	Get(ctx context.Context, id int64) (models.Job, error)
+	// List returns the newest jobs first.
+	List(ctx context.Context, f JobFilter) ([]models.Job, error)
+	// Claim takes the next job due at now, or one whose lease ran out, for
+	// worker until lockedUntil. ErrNotFound when there is none.
+	Claim(ctx context.Context, worker string, now, lockedUntil time.Time) (models.Job, error)
+	// Heartbeat extends the lease and reports whether cancelling was
+	// asked for; ErrNotFound when the worker lost the job.
+	Heartbeat(ctx context.Context, id int64, worker string, lockedUntil time.Time) (bool, error)
+	SetProgress(ctx context.Context, id int64, percent int, message string) error
+	// Finish stores the final Status, Progress, Result, Error and
+	// FinishedAt of j.
+	Finish(ctx context.Context, j models.Job, worker string) error
+	// Retry queues the job again for runAt, keeping msg as its error.
+	Retry(ctx context.Context, id int64, worker string, runAt time.Time, msg string) error
+	// Cancel ends a queued job and asks the worker of a running one to stop.
+	// ErrConflict, with the job, when it has already ended.
+	Cancel(ctx context.Context, id int64, at time.Time) (models.Job, error)
+	AppendLog(ctx context.Context, lines []models.JobLogLine) error
+	// Logs returns up to limit lines of a job after the line with ID after.
+	Logs(ctx context.Context, jobID, after int64, limit int) ([]models.JobLogLine, error)
+}
@@ -0,0 +1,117 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"CipherOps/models"
+)
+
+type userRepo struct{ s *sqlStore }
+
+const userColumns = `id, username, password, role, email, email_verified, totp_secret, totp_enabled, totp_last_step,
+	auth_provider, COALESCE(oidc_issuer, ''), COALESCE(oidc_subject, ''), webauthn_id`
+
+func scanUser(row interface{ Scan(...any) error }) (models.User, error) {
+	var u models.User
+	var email sql.NullString
+	err := row.Scan(&u.ID, &u.Username, &u.Password, &u.Role, &email, &u.EmailVerified, &u.TOTPSecret, &u.TOTPEnabled,
+		&u.TOTPLastStep, &u.AuthProvider, &u.OIDCIssuer, &u.OIDCSubject, &u.WebAuthnID)
+	u.Email = email.String
+	return u, err
+}
+
+// Create inserts a local user unless u names another provider. Users of
+// external providers have an empty password hash, which never matches.
+func (r userRepo) Create(ctx context.Context, u *models.User) error {
+	if u.AuthProvider == "" {
+		u.AuthProvider = "local"
+	}
+	err := r.s.queryRow(ctx, r.s.db, `INSERT INTO users
+		(username, password, role, email, email_verified, auth_provider, oidc_issuer, oidc_subject)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`,
+		u.Username, u.Password, u.Role, nullString(u.Email), u.EmailVerified, u.AuthProvider,
+		nullString(u.OIDCIssuer), nullString(u.OIDCSubject)).Scan(&u.ID)
+	return r.s.mapErr(err)
+}
+
+func (r userRepo) Get(ctx context.Context, id int) (models.User, error) {
+	u, err := scanUser(r.s.queryRow(ctx, r.s.db, `SELECT `+userColumns+` FROM users WHERE id = $1`, id))
+	return u, r.s.mapErr(err)
+}
+
+func (r userRepo) GetByUsername(ctx context.Context, username string) (models.User, error) {
+	u, err := scanUser(r.s.queryRow(ctx, r.s.db, `SELECT `+userColumns+` FROM users WHERE username = $1`, username))
+	return u, r.s.mapErr(err)
+}
+
+func (r userRepo) GetByEmail(ctx context.Context, email string) (models.User, error) {
+	u, err := scanUser(r.s.queryRow(ctx, r.s.db, `SELECT `+userColumns+` FROM users WHERE LOWER(email) = LOWER($1)`, email))
+	return u, r.s.mapErr(err)
+}
+
+func (r userRepo) List(ctx context.Context) ([]models.User, error) {
+	rows, err := r.s.query(ctx, r.s.db, `SELECT `+userColumns+` FROM users ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	users := []models.User{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+func (r userRepo) SetRole(ctx context.Context, id int, role string) error {
+	return affected(r.s.exec(ctx, r.s.db, `UPDATE users SET role = $1 WHERE id = $2`, role, id))
+}
+
+func (r userRepo) SetPassword(ctx context.Context, id int, hash string) error {
+	return affected(r.s.exec(ctx, r.s.db, `UPDATE users SET password = $1 WHERE id = $2`, hash, id))
+}
+
+func (r userRepo) SetEmail(ctx context.Context, id int, email string) error {
+	return affected(r.s.exec(ctx, r.s.db, `UPDATE users SET email = $1, email_verified = FALSE WHERE id = $2`, email, id))
+}
+
+func (r userRepo) VerifyEmail(ctx context.Context, id int, email string) error {
+	return affected(r.s.exec(ctx, r.s.db, `UPDATE users SET email_verified = TRUE
+		WHERE id = $1 AND LOWER(email) = LOWER($2)`, id, email))
+}
+
+func (r userRepo) SyncExternal(ctx context.Context, u *models.User) error {
+	// the WHERE leaves a name taken by another provider alone and returns no row
+	err := r.s.queryRow(ctx, r.s.db, `INSERT INTO users (username, password, role, auth_provider) VALUES ($1, '', $2, $3)
+		ON CONFLICT (username) DO UPDATE SET role = excluded.role
+		WHERE users.auth_provider = excluded.auth_provider
+		RETURNING id, totp_enabled`, u.Username, u.Role, u.AuthProvider).Scan(&u.ID, &u.TOTPEnabled)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrConflict
+	}
+	return r.s.mapErr(err)
+}
+
+func (r userRepo) GetByOIDC(ctx context.Context, issuer, subject string) (models.User, error) {
+	u, err := scanUser(r.s.queryRow(ctx, r.s.db, `SELECT `+userColumns+` FROM users
+		WHERE oidc_issuer = $1 AND oidc_subject = $2`, issuer, subject))
+	return u, r.s.mapErr(err)
+}
+
+func (r userRepo) GetByWebAuthnID(ctx context.Context, handle []byte) (models.User, error) {
+	u, err := scanUser(r.s.queryRow(ctx, r.s.db, `SELECT `+userColumns+` FROM users WHERE webauthn_id = $1`, handle))
+	return u, r.s.mapErr(err)
+}
+
+func (r userRepo) SetWebAuthnID(ctx context.Context, id int, handle []byte) error {
+	return affected(r.s.exec(ctx, r.s.db, `UPDATE users SET webauthn_id = $1 WHERE id = $2`, handle, id))
+}
+
+func (r userRepo) Delete(ctx context.Context, id int) error {
+	return affected(r.s.exec(ctx, r.s.db, `DELETE FROM users WHERE id = $1`, id))
+}
@@ -0,0 +1,292 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"CipherOps/models"
+)
+
+func TestUsers(t *testing.T) {
+	st := openTest(t)
+	ctx := context.Background()
+	users := st.Users()
+
+	alice := models.User{Username: "alice", Password: "hash", Role: "admin", Email: "Alice@example.com"}
+	if err := users.Create(ctx, &alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Create(ctx, &models.User{Username: "alice", Password: "x", Role: "user"}); !errors.Is(err, ErrConflict) {
+		t.Errorf("duplicate username: %v, want ErrConflict", err)
+	}
+	got, err := users.GetByEmail(ctx, "alice@EXAMPLE.com")
+	if err != nil || got.ID != alice.ID || got.AuthProvider != "local" || got.EmailVerified {
+		t.Fatalf("GetByEmail = %+v, %v", got, err)
+	}
+
+	bob := createUser(t, st, "bob")
+	if err := users.SetEmail(ctx, bob.ID, "alice@example.com"); !errors.Is(err, ErrConflict) {
+		t.Errorf("taken address: %v, want ErrConflict", err)
+	}
+	if err := users.SetEmail(ctx, bob.ID, "bob@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.VerifyEmail(ctx, bob.ID, "old@example.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("verifying a changed address: %v, want ErrNotFound", err)
+	}
+	if err := users.VerifyEmail(ctx, bob.ID, "BOB@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := users.Get(ctx, bob.ID); !got.EmailVerified {
+		t.Error("address not verified")
+	}
+
+	if err := users.SetWebAuthnID(ctx, bob.ID, []byte{1, 2, 3}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := users.GetByWebAuthnID(ctx, []byte{1, 2, 3}); err != nil || got.ID != bob.ID || !bytes.Equal(got.WebAuthnID, []byte{1, 2, 3}) {
+		t.Errorf("GetByWebAuthnID = %+v, %v", got, err)
+	}
+
+	if err := users.SetRole(ctx, 999, "admin"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetRole of a missing user: %v, want ErrNotFound", err)
+	}
+	if list, err := users.List(ctx); err != nil || len(list) != 2 {
+		t.Errorf("List = %+v, %v", list, err)
+	}
+}
+
+func TestUsersExternal(t *testing.T) {
+	st := openTest(t)
+	ctx := context.Background()
+	users := st.Users()
+	createUser(t, st, "alice")
+
+	carol := models.User{Username: "carol", Role: "user", AuthProvider: "ldap"}
+	if err := users.SyncExternal(ctx, &carol); err != nil || carol.ID == 0 {
+		t.Fatalf("first login: %+v, %v", carol, err)
+	}
+	again := models.User{Username: "carol", Role: "admin", AuthProvider: "ldap"}
+	if err := users.SyncExternal(ctx, &again); err != nil || again.ID != carol.ID {
+		t.Fatalf("second login: %+v, %v", again, err)
+	}
+	if got, _ := users.Get(ctx, carol.ID); got.Role != "admin" || got.Password != "" {
+		t.Errorf("after the second login %+v, want the new role and no password", got)
+	}
+	// a directory user must not take over a local account
+	takeover := models.User{Username: "alice", Role: "admin", AuthProvider: "ldap"}
+	if err := users.SyncExternal(ctx, &takeover); !errors.Is(err, ErrConflict) {
+		t.Errorf("local username: %v, want ErrConflict", err)
+	}
+	if got, _ := users.GetByUsername(ctx, "alice"); got.Role != "user" {
+		t.Errorf("the local account changed to %+v", got)
+	}
+
+	dave := models.User{Username: "dave", Role: "user", AuthProvider: "oidc", OIDCIssuer: "https://idp", OIDCSubject: "42"}
+	if err := users.Create(ctx, &dave); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := users.GetByOIDC(ctx, "https://idp", "42"); err != nil || got.ID != dave.ID || got.AuthProvider != "oidc" {
+		t.Errorf("GetByOIDC = %+v, %v", got, err)
+	}
+	if _, err := users.GetByOIDC(ctx, "https://other", "42"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("other issuer: %v, want ErrNotFound", err)
+	}
+}
+
+func TestMFA(t *testing.T) {
+	st := openTest(t)
+	ctx := context.Background()
+	mfa := st.MFA()
+	user := createUser(t, st, "alice")
+	now := time.Now()
+
+	if err := mfa.SetTOTPSecret(ctx, user.ID, "SECRET"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := mfa.UseTOTPStep(ctx, user.ID, 10); ok {
+		t.Error("accepted a code before TOTP was enabled")
+	}
+	if err := mfa.EnableTOTP(ctx, user.ID, 10, []string{"h1", "h2"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := st.Users().Get(ctx, user.ID); !got.TOTPEnabled || got.TOTPSecret != "SECRET" || got.TOTPLastStep != 10 {
+		t.Errorf("after EnableTOTP %+v", got)
+	}
+	if ok, _ := mfa.UseTOTPStep(ctx, user.ID, 10); ok {
+		t.Error("accepted the step of the enrollment code again")
+	}
+	if ok, err := mfa.UseTOTPStep(ctx, user.ID, 11); !ok || err != nil {
+		t.Errorf("UseTOTPStep(11) = %v, %v", ok, err)
+	}
+
+	if ok, err := mfa.UseRecoveryCode(ctx, user.ID, "h1", now); !ok || err != nil {
+		t.Errorf("UseRecoveryCode = %v, %v", ok, err)
+	}
+	if ok, _ := mfa.UseRecoveryCode(ctx, user.ID, "h1", now); ok {
+		t.Error("used a recovery code twice")
+	}
+	if err := mfa.ReplaceRecoveryCodes(ctx, user.ID, []string{"h3"}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := mfa.UseRecoveryCode(ctx, user.ID, "h2", now); ok {
+		t.Error("a replaced recovery code still works")
+	}
+
+	if err := mfa.DisableTOTP(ctx, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := st.Users().Get(ctx, user.ID); got.TOTPEnabled || got.TOTPSecret != "" {
+		t.Errorf("after DisableTOTP %+v", got)
+	}
+	if ok, _ := mfa.UseRecoveryCode(ctx, user.ID, "h3", now); ok {
+		t.Error("recovery codes survived DisableTOTP")
+	}
+
+	if required, err := mfa.RequiresMFA(ctx, "admin"); required || err != nil {
+		t.Errorf("RequiresMFA without a policy = %v, %v", required, err)
+	}
+	for _, require := range []bool{true, false, true} {
+		if err := mfa.SetPolicy(ctx, "admin", require); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if required, _ := mfa.RequiresMFA(ctx, "admin"); !required {
+		t.Error("admin does not require MFA")
+	}
+	if policy, err := mfa.Policy(ctx); err != nil || len(policy) != 1 || !policy["admin"] {
+		t.Errorf("Policy = %v, %v", policy, err)
+	}
+}
+
+func TestPasskeys(t *testing.T) {
+	st := openTest(t)
+	ctx := context.Background()
+	passkeys := st.Passkeys()
+	alice := createUser(t, st, "alice")
+	bob := createUser(t, st, "bob")
+	now := time.Now()
+
+	key := models.Passkey{UserID: alice.ID, CredentialID: []byte("cred"), Name: "yubikey", Data: []byte(`{"id":"cred"}`)}
+	if err := passkeys.Create(ctx, &key); err != nil {
+		t.Fatal(err)
+	}
+	if err := passkeys.Create(ctx, &models.Passkey{UserID: bob.ID, CredentialID: []byte("cred"), Data: []byte("{}")}); !errors.Is(err, ErrConflict) {
+		t.Errorf("duplicate credential: %v, want ErrConflict", err)
+	}
+	if err := passkeys.Used(ctx, []byte("cred"), []byte(`{"id":"cred","count":2}`), now); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := passkeys.List(ctx, alice.ID)
+	if err != nil || len(keys) != 1 || string(keys[0].Data) != `{"id":"cred","count":2}` || keys[0].LastUsedAt == nil {
+		t.Fatalf("List = %+v, %v", keys, err)
+	}
+	if err := passkeys.Delete(ctx, bob.ID, key.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("deleting another user's key: %v, want ErrNotFound", err)
+	}
+
+	for _, c := range []models.WebAuthnCeremony{
+		{ID: "login", Data: []byte("{}"), ExpiresAt: now.Add(time.Minute)},
+		{ID: "register", UserID: alice.ID, Data: []byte("{}"), ExpiresAt: now.Add(time.Minute)},
+		{ID: "stale", Data: []byte("{}"), ExpiresAt: now.Add(-time.Minute)},
+	} {
+		if err := passkeys.SaveCeremony(ctx, c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c, err := passkeys.TakeCeremony(ctx, "register", now); err != nil || c.UserID != alice.ID {
+		t.Errorf("TakeCeremony = %+v, %v", c, err)
+	}
+	if _, err := passkeys.TakeCeremony(ctx, "register", now); !errors.Is(err, ErrNotFound) {
+		t.Errorf("ceremony taken twice: %v", err)
+	}
+	if c, err := passkeys.TakeCeremony(ctx, "login", now); err != nil || c.UserID != 0 {
+		t.Errorf("discoverable login ceremony = %+v, %v", c, err)
+	}
+	if _, err := passkeys.TakeCeremony(ctx, "stale", now); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expired ceremony: %v", err)
+	}
+}
+
+func TestAPITokens(t *testing.T) {
+	st := openTest(t)
+	ctx := context.Background()
+	tokens := st.APITokens()
+	alice := createUser(t, st, "alice")
+	bob := createUser(t, st, "bob")
+	now := time.Now()
+
+	expires := now.Add(time.Hour)
+	tok := models.APIToken{UserID: alice.ID, Name: "ci", TokenHash: "h", Scopes: []string{"read", "packages"}, ExpiresAt: &expires}
+	if err := tokens.Create(ctx, &tok); err != nil {
+		t.Fatal(err)
+	}
+	got, err := tokens.GetByHash(ctx, "h")
+	if err != nil || got.ID != tok.ID || got.Role != "user" || len(got.Scopes) != 2 || got.ExpiresAt == nil {
+		t.Fatalf("GetByHash = %+v, %v", got, err)
+	}
+	// the role is the owner's current one
+	if err := st.Users().SetRole(ctx, alice.ID, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := tokens.GetByHash(ctx, "h"); got.Role != "admin" {
+		t.Errorf("role %q, want admin", got.Role)
+	}
+	if err := tokens.Touch(ctx, tok.ID, now); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tokens.Revoke(ctx, bob.ID, tok.ID, now); !errors.Is(err, ErrNotFound) {
+		t.Errorf("revoking another user's token: %v, want ErrNotFound", err)
+	}
+	if err := tokens.Revoke(ctx, alice.ID, tok.ID, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokens.GetByHash(ctx, "h"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("revoked token: %v, want ErrNotFound", err)
+	}
+	list, err := tokens.List(ctx, alice.ID)
+	if err != nil || len(list) != 1 || list[0].RevokedAt == nil || list[0].LastUsedAt == nil {
+		t.Errorf("List = %+v, %v", list, err)
+	}
+}
+
+func TestEmailTokens(t *testing.T) {
+	st := openTest(t)
+	ctx := context.Background()
+	tokens := st.EmailTokens()
+	user := createUser(t, st, "alice")
+	now := time.Now()
+
+	issue := func(id, purpose string, expires time.Time) {
+		t.Helper()
+		err := tokens.Issue(ctx, models.EmailToken{ID: id, UserID: user.ID, Purpose: purpose, Email: "a@example.com", ExpiresAt: expires})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	issue("first", "verify_email", now.Add(time.Hour))
+	issue("reset", "reset_password", now.Add(time.Hour))
+	issue("second", "verify_email", now.Add(time.Hour))
+	issue("expired", "reset_password", now.Add(-time.Minute))
+
+	if _, err := tokens.Consume(ctx, "first", "verify_email", now); !errors.Is(err, ErrNotFound) {
+		t.Errorf("superseded token: %v, want ErrNotFound", err)
+	}
+	if _, err := tokens.Consume(ctx, "second", "reset_password", now); !errors.Is(err, ErrNotFound) {
+		t.Errorf("token of another purpose: %v, want ErrNotFound", err)
+	}
+	got, err := tokens.Consume(ctx, "second", "verify_email", now)
+	if err != nil || got.UserID != user.ID || got.Email != "a@example.com" {
+		t.Errorf("Consume = %+v, %v", got, err)
+	}
+	if _, err := tokens.Consume(ctx, "second", "verify_email", now); !errors.Is(err, ErrNotFound) {
+		t.Errorf("token used twice: %v", err)
+	}
+	if _, err := tokens.Consume(ctx, "expired", "reset_password", now); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expired token: %v", err)
+	}
+}
@@ -1,38 +1,228 @@
 package utils
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 	"os/exec"
 	"strings"
-	"bytes"
+	"sync"
+	"time"
+
+	"CipherOps/audit"
+	"CipherOps/logging"
 )
 
-func runCmd(ctx context.Context, sudo bool, name string, args ...string) (string, error) {
-	if DryRun {
-		cmdLine := name + " " + strings.Join(args, " ")
-		if sudo {
-			cmdLine = "sudo " + cmdLine
+// Command is one program for an Executor to run.
+type Command struct {
+	Name string
+	Args []string
+	// run through sudo unless already root; privileged commands are audited
+	Sudo bool
+	// Output, when set, receives every line as the command prints it
+	Output OutputFunc
+}
+
+// OutputFunc receives output lines one at a time, never concurrently.
+type OutputFunc func(OutputLine)
+
+// OutputLine is one line of command output with secrets masked.
+type OutputLine struct {
+	// "stdout" or "stderr"
+	Stream string `json:"stream"`
+	Text   string `json:"text"`
+}
+
+// CommandResult is what a command did. Stdout and Stderr are kept as
+// printed, for callers that parse them.
+type CommandResult struct {
+	// the command line as run, with secrets masked
+	CommandLine string        `json:"command_line"`
+	ExitCode    int           `json:"exit_code"`
+	Stdout      string        `json:"stdout"`
+	Stderr      string        `json:"stderr"`
+	Duration    time.Duration `json:"duration"`
+	// the command was only planned, see DryRunExecutor
+	DryRun bool `json:"dry_run,omitempty"`
+}
+
+// Output is the trimmed standard output.
+func (r CommandResult) Output() string {
+	return strings.TrimSpace(r.Stdout)
+}
+
+// Executor runs commands. Installers and service managers get one injected,
+// so the same logic can run for real, as a dry run or against a FakeExecutor.
+type Executor interface {
+	// Run runs c and waits for it. A command that exits non-zero returns
+	// its result together with an error carrying the (masked) stderr;
+	// ExitCode is -1 when the command did not start or was killed.
+	Run(ctx context.Context, c Command) (CommandResult, error)
+}
+
+// LocalExecutor runs commands on this machine. Privileged commands go
+// through Escalation, see EscalateSudo, and are recorded in AuditLog.
+type LocalExecutor struct {
+	// sudo, doas, pkexec or run0; sudo when empty
+	Escalation string
+}
+
+func (l LocalExecutor) Run(ctx context.Context, c Command) (CommandResult, error) {
+	name, args := escalate(l.Escalation, c, os.Geteuid() == 0)
+	res := CommandResult{CommandLine: commandLine(name, args), ExitCode: -1}
+
+	cmd := exec.CommandContext(ctx, name, args...)
+	// a child that keeps the pipes open must not hold up a cancelled command
+	cmd.WaitDelay = 5 * time.Second
+	var mu sync.Mutex
+	stdout := &lineWriter{stream: "stdout", mu: &mu, output: c.Output}
+	stderr := &lineWriter{stream: "stderr", mu: &mu, output: c.Output}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	start := time.Now()
+	err := cmd.Run()
+	res.Duration = time.Since(start)
+	stdout.flush()
+	stderr.flush()
+	res.Stdout, res.Stderr = stdout.all.String(), stderr.all.String()
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		res.ExitCode = 0
+	case errors.As(err, &exitErr):
+		res.ExitCode = exitErr.ExitCode()
+	}
+	if err != nil {
+		// stderr often echoes the command line, secrets included
+		err = fmt.Errorf("%w: %s", err, logging.Redact(strings.TrimSpace(res.Stderr)))
+		err = escalationError(l.Escalation, c, res.Stderr, err)
+		slog.Warn("command failed", "command", name, "args", args, "exit_code", res.ExitCode, "error", err)
+	}
+	if c.Sudo {
+		AuditCommand(ctx, "", c.Name, c.Args, res.Output(), err)
+	}
+	return res, err
+}
+
+// sudoCommand is how a plan shows c: through sudo for a privileged command
+// unless already root, whatever the escalation method.
+func sudoCommand(c Command, root bool) (string, []string) {
+	if c.Sudo && !root {
+		return "sudo", append([]string{c.Name}, c.Args...)
+	}
+	return c.Name, c.Args
+}
+
+// commandLine joins a command for display with secrets masked.
+func commandLine(name string, args []string) string {
+	return strings.Join(logging.RedactArgs(append([]string{name}, args...)), " ")
+}
+
+// lineWriter keeps everything written to it and hands complete lines to
+// output.
+type lineWriter struct {
+	stream  string
+	mu      *sync.Mutex // shared by stdout and stderr so output is serial
+	output  OutputFunc
+	all     bytes.Buffer
+	partial []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.all.Write(p)
+	if w.output == nil {
+		return len(p), nil
+	}
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
 		}
-		fmt.Println("[DRYRUN]", cmdLine)
-		return cmdLine, nil
+		w.emit(w.partial[:i])
+		w.partial = w.partial[i+1:]
 	}
+	return len(p), nil
+}
 
-	if sudo && os.Geteuid() != 0 {
-		// intentamos con sudo
-		args = append([]string{name}, args...)
-		name = "sudo"
+// flush hands on a last line without a newline.
+func (w *lineWriter) flush() {
+	if w.output != nil && len(w.partial) > 0 {
+		w.emit(w.partial)
+		w.partial = nil
+	}
+}
+
+func (w *lineWriter) emit(line []byte) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.output(OutputLine{Stream: w.stream, Text: logging.Redact(strings.TrimRight(string(line), "\r"))})
+}
+
+// runCmd runs a command through e and returns its trimmed stdout.
+func runCmd(ctx context.Context, e Executor, sudo bool, name string, args ...string) (string, error) {
+	res, err := e.Run(ctx, Command{Name: name, Args: args, Sudo: sudo})
+	return res.Output(), err
+}
+
+// streamCmd runs a privileged command that may take long, handing its output
+// to output as it comes.
+func streamCmd(ctx context.Context, e Executor, output OutputFunc, name string, args ...string) (CommandResult, error) {
+	return e.Run(ctx, Command{Name: name, Args: args, Sudo: true, Output: output})
+}
+
+// hasCommand reports whether name is installed where e runs commands.
+func hasCommand(ctx context.Context, e Executor, name string) bool {
+	_, err := e.Run(ctx, Command{Name: "sh", Args: []string{"-c", "command -v " + name}})
+	return err == nil
+}
+
+// AuditCommand records a privileged command run on host, empty for this
+// machine, in AuditLog. A failing audit write is logged but does not undo the
+// command, which already ran.
+func AuditCommand(ctx context.Context, host, name string, args []string, output string, err error) {
+	recordCommand(ctx, host, commandAction(name), name, args, output, err)
+}
+
+func recordCommand(ctx context.Context, host, action, name string, args []string, output string, err error) {
+	if AuditLog == nil {
+		return
+	}
+	// the audit log is read by admins and exported, keep secrets out of it
+	entry := audit.Entry{
+		Host:    host,
+		Action:  action,
+		Command: name,
+		Args:    logging.RedactArgs(args),
+		Success: err == nil,
+		Output:  logging.Redact(output),
 	}
-	cmd := exec.CommandContext(ctx, name, args...)
-	var out bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
-	err := cmd.Run()
-	outStr := strings.TrimSpace(out.String())
 	if err != nil {
-		return outStr, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+		entry.Error = err.Error()
+	}
+	// the command's context may be cancelled already, the record must still land
+	auditCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+	defer cancel()
+	if _, auditErr := AuditLog.Record(auditCtx, audit.ActorFrom(ctx), entry); auditErr != nil {
+		slog.Error("cannot write audit record", "command", name, "error", auditErr)
+	}
+}
+
+// commandAction groups commands by what they change.
+func commandAction(name string) string {
+	switch name {
+	case "apt-get", "dpkg", "dnf", "yum", "rpm", "pacman", "zypper":
+		return "package"
+	case "systemctl", "service", "chkconfig", "update-rc.d":
+		return "service"
+	case "iptables", "ip6tables", "nft", "ufw", "firewall-cmd":
+		return "firewall"
+	case "docker", "podman":
+		return "container"
 	}
-	return outStr, nil
-}
\ No newline at end of file
+	return "command"
+}
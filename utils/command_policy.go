@@ -0,0 +1,245 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+
+	"gopkg.in/yaml.v3"
+
+	"CipherOps/audit"
+	"CipherOps/logging"
+)
+
+// CommandPolicy is the allowlist kept in COMMAND_POLICY_FILE. A command runs
+// only if a rule of the role it runs for, or of "*", matches it:
+//
+//	roles:
+//	  "*":
+//	    - {command: cat, args: [/etc/os-release], sudo: false}
+//	  admin:
+//	    - {command: apt-get, args: [install, -y, '[a-z0-9][a-z0-9.+-]*'], rest: '[a-z0-9][a-z0-9.+-]*', sudo: true}
+//	    - {command: systemctl, args: ['start|stop|restart', 'nginx|postgresql'], sudo: true}
+//
+// Requests run as the role of their user, jobs as the role of the user who
+// enqueued them, and what the server starts itself as "system". The
+// privileged helper and the agent check what the panel sends them as the
+// roles "helper" and "agent".
+type CommandPolicy struct {
+	Roles map[string][]CommandRule `yaml:"roles"`
+}
+
+type CommandRule struct {
+	// program as run, without a path
+	Command string `yaml:"command"`
+	// one pattern per argument, each matching the argument at its place in
+	// full
+	Args []string `yaml:"args"`
+	// pattern every further argument must match; without it the command
+	// takes exactly as many arguments as Args has
+	Rest string `yaml:"rest"`
+	// when set, the rule only matches commands run with (true) or without
+	// (false) privileges
+	Sudo *bool `yaml:"sudo"`
+
+	args []*regexp.Regexp
+	rest *regexp.Regexp
+}
+
+// defaultCommandPolicy is in effect without COMMAND_POLICY_FILE: every role
+// may run the probes the panel makes, admins and the server itself the
+// package and service commands of the installers and service managers,
+// with package and service names that cannot pass for options.
+const defaultCommandPolicy = `
+roles:
+  "*":
+    - {command: cat, args: [/etc/os-release], sudo: false}
+    - {command: sh, args: [-c, 'command -v [A-Za-z0-9._+-]+'], sudo: false}
+    - {command: dpkg, args: [-s, &pkg '[A-Za-z0-9][A-Za-z0-9.+_:@-]*'], sudo: false}
+    - {command: rpm, args: [-q, *pkg], sudo: false}
+    - {command: pacman, args: [-Qi, *pkg], sudo: false}
+    - {command: systemctl, args: [status, &svc '[A-Za-z0-9][A-Za-z0-9@._:-]*', --no-pager], sudo: false}
+    - {command: service, args: [*svc, status], sudo: false}
+  admin: &manage
+    - {command: apt-get, args: [update, -y], sudo: true}
+    - {command: apt-get, args: ['install|remove', -y, *pkg], rest: *pkg, sudo: true}
+    - {command: dnf, args: [update, -y], sudo: true}
+    - {command: dnf, args: ['install|remove', -y, *pkg], rest: *pkg, sudo: true}
+    - {command: yum, args: ['install|remove', -y, *pkg], rest: *pkg, sudo: true}
+    - {command: pacman, args: [-Sy, --noconfirm], sudo: true}
+    - {command: pacman, args: ['-S|-R', --noconfirm, *pkg], rest: *pkg, sudo: true}
+    - {command: zypper, args: [update, --non-interactive], sudo: true}
+    - {command: zypper, args: [--non-interactive, 'install|remove', *pkg], rest: *pkg, sudo: true}
+    - {command: systemctl, args: ['start|restart|stop', *svc], sudo: true}
+    - {command: systemctl, args: ['enable|disable', --now, *svc], sudo: true}
+    - {command: service, args: [*svc, 'start|restart|stop'], sudo: true}
+    - {command: chkconfig, args: [*svc, 'on|off'], sudo: true}
+    - {command: update-rc.d, args: [*svc, defaults], sudo: true}
+  system: *manage
+  helper: *manage
+  agent: *manage
+`
+
+// LoadCommandPolicy reads and checks a policy file. An empty path gives the
+// default policy.
+func LoadCommandPolicy(path string) (CommandPolicy, error) {
+	var policy CommandPolicy
+	data := []byte(defaultCommandPolicy)
+	if path != "" {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return policy, err
+		}
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&policy); err != nil && !errors.Is(err, io.EOF) {
+		return policy, fmt.Errorf("%s: %w", path, err)
+	}
+	for role, rules := range policy.Roles {
+		for i := range rules {
+			if err := rules[i].compile(); err != nil {
+				return policy, fmt.Errorf("%s: role %s, rule %d: %w", path, role, i+1, err)
+			}
+		}
+	}
+	return policy, nil
+}
+
+func (r *CommandRule) compile() error {
+	if r.Command == "" || strings.ContainsAny(r.Command, "/ ") {
+		return fmt.Errorf("command must be a program name without a path, got %q", r.Command)
+	}
+	r.args = make([]*regexp.Regexp, 0, len(r.Args))
+	for i, pattern := range r.Args {
+		re, err := compileArg(pattern)
+		if err != nil {
+			return fmt.Errorf("args %d: %w", i+1, err)
+		}
+		r.args = append(r.args, re)
+	}
+	if r.Rest != "" {
+		re, err := compileArg(r.Rest)
+		if err != nil {
+			return fmt.Errorf("rest: %w", err)
+		}
+		r.rest = re
+	}
+	return nil
+}
+
+func compileArg(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile(`^(?:` + pattern + `)$`)
+}
+
+func (r CommandRule) matches(c Command) bool {
+	if r.Command != c.Name || (r.Sudo != nil && *r.Sudo != c.Sudo) {
+		return false
+	}
+	if len(c.Args) < len(r.args) || (len(c.Args) > len(r.args) && r.rest == nil) {
+		return false
+	}
+	for i, arg := range c.Args {
+		re := r.rest
+		if i < len(r.args) {
+			re = r.args[i]
+		}
+		if !re.MatchString(arg) {
+			return false
+		}
+	}
+	return true
+}
+
+// Allows reports whether role may run c.
+func (p CommandPolicy) Allows(role string, c Command) bool {
+	for _, r := range [][]CommandRule{p.Roles[role], p.Roles["*"]} {
+		for _, rule := range r {
+			if rule.matches(c) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// internalRoles run the commands of the panel itself, the privileged helper
+// and the agent; no user may hold them.
+var internalRoles = []string{"system", "helper", "agent"}
+
+// IsUserRole reports whether role can be given to a user: "admin", "user"
+// and any other role the policy has rules for, except "*" and the internal
+// roles.
+func (p CommandPolicy) IsUserRole(role string) bool {
+	if role == "" || role == "*" || slices.Contains(internalRoles, role) {
+		return false
+	}
+	if role == "admin" || role == "user" {
+		return true
+	}
+	_, ok := p.Roles[role]
+	return ok
+}
+
+var commandPolicy atomic.Pointer[CommandPolicy]
+
+// SetCommandPolicy makes policy the one in effect.
+func SetCommandPolicy(policy CommandPolicy) {
+	commandPolicy.Store(&policy)
+}
+
+// CurrentCommandPolicy returns the policy in effect, or the default.
+func CurrentCommandPolicy() CommandPolicy {
+	if p := commandPolicy.Load(); p != nil {
+		return *p
+	}
+	policy, _ := LoadCommandPolicy("")
+	SetCommandPolicy(policy)
+	return policy
+}
+
+// CommandDeniedError is returned for a command the command policy does not
+// allow the role to run. Args are masked.
+type CommandDeniedError struct {
+	Role    string
+	Command string
+	Args    []string
+	Sudo    bool
+}
+
+func (e *CommandDeniedError) Error() string {
+	line := strings.Join(append([]string{e.Command}, e.Args...), " ")
+	if e.Sudo {
+		line = "sudo " + line
+	}
+	return fmt.Sprintf("command policy does not allow role %q to run %s", e.Role, line)
+}
+
+// PolicyExecutor checks every command against the command policy in effect
+// before Exec runs it, for the role of the actor in the command's context.
+// A denied command is audited and fails with a *CommandDeniedError.
+type PolicyExecutor struct {
+	Exec Executor
+	// the host Exec runs commands on, for the audit log; empty for this
+	// machine
+	Host string
+}
+
+func (p PolicyExecutor) Run(ctx context.Context, c Command) (CommandResult, error) {
+	role := audit.ActorFrom(ctx).Role
+	if CurrentCommandPolicy().Allows(role, c) {
+		return p.Exec.Run(ctx, c)
+	}
+	err := &CommandDeniedError{Role: role, Command: c.Name, Args: logging.RedactArgs(c.Args), Sudo: c.Sudo}
+	slog.Warn("command denied by policy", "host", p.Host, "role", role, "command", c.Name)
+	recordCommand(ctx, p.Host, "denied", c.Name, c.Args, "", err)
+	return CommandResult{CommandLine: commandLine(c.Name, c.Args), ExitCode: -1}, err
+}
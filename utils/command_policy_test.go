@@ -0,0 +1,136 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"CipherOps/audit"
+)
+
+func TestDefaultCommandPolicy(t *testing.T) {
+	policy, err := LoadCommandPolicy("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		role  string
+		c     Command
+		allow bool
+	}{
+		{"probe for anyone", "user", Command{Name: "sh", Args: []string{"-c", "command -v ufw"}}, true},
+		{"probe with a second command", "user", Command{Name: "sh", Args: []string{"-c", "command -v ufw; id"}}, false},
+		{"os-release", "user", Command{Name: "cat", Args: []string{"/etc/os-release"}}, true},
+		{"other file", "user", Command{Name: "cat", Args: []string{"/etc/shadow"}}, false},
+		{"install as admin", "admin", Command{Name: "apt-get", Args: []string{"install", "-y", "nginx", "postgresql"}, Sudo: true}, true},
+		{"install as user", "user", Command{Name: "apt-get", Args: []string{"install", "-y", "nginx"}, Sudo: true}, false},
+		{"install nothing", "admin", Command{Name: "apt-get", Args: []string{"install", "-y"}, Sudo: true}, false},
+		{"option as a package", "admin", Command{Name: "apt-get", Args: []string{"install", "-y", "-oAPT::Update::Pre-Invoke::=sh"}, Sudo: true}, false},
+		{"option among packages", "admin", Command{Name: "apt-get", Args: []string{"install", "-y", "nginx", "-o", "x"}, Sudo: true}, false},
+		{"space inside one argument", "admin", Command{Name: "apt-get", Args: []string{"install", "-y", "nginx -o x"}, Sudo: true}, false},
+		{"update", "system", Command{Name: "apt-get", Args: []string{"update", "-y"}, Sudo: true}, true},
+		{"update with extra options", "system", Command{Name: "apt-get", Args: []string{"update", "-y", "-o", "x"}, Sudo: true}, false},
+		{"update without sudo", "system", Command{Name: "apt-get", Args: []string{"update", "-y"}}, false},
+		{"start a service", "admin", Command{Name: "systemctl", Args: []string{"start", "nginx"}, Sudo: true}, true},
+		{"link a unit", "admin", Command{Name: "systemctl", Args: []string{"link", "/tmp/x.service"}, Sudo: true}, false},
+		{"enable", "admin", Command{Name: "systemctl", Args: []string{"enable", "--now", "docker"}, Sudo: true}, true},
+		{"sysv", "helper", Command{Name: "service", Args: []string{"nginx", "restart"}, Sudo: true}, true},
+		{"unknown role", "", Command{Name: "systemctl", Args: []string{"start", "nginx"}, Sudo: true}, false},
+		{"a shell", "admin", Command{Name: "bash", Args: []string{"-c", "id"}, Sudo: true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.Allows(tt.role, tt.c); got != tt.allow {
+				t.Errorf("Allows(%q, %s %v) = %v, want %v", tt.role, tt.c.Name, tt.c.Args, got, tt.allow)
+			}
+		})
+	}
+}
+
+func TestLoadCommandPolicyRejects(t *testing.T) {
+	tests := map[string]string{
+		"path":          "roles: {admin: [{command: /bin/sh}]}",
+		"bad pattern":   "roles: {admin: [{command: sh, args: ['(']}]}",
+		"bad rest":      "roles: {admin: [{command: sh, rest: '[']}]}",
+		"unknown field": "roles: {admin: [{command: sh, argv: [x]}]}",
+	}
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "commands.yaml")
+			if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := LoadCommandPolicy(path); err == nil {
+				t.Error("policy loaded")
+			}
+		})
+	}
+}
+
+func TestPolicyExecutor(t *testing.T) {
+	fake := &FakeExecutor{Responses: map[string]FakeResponse{"cat /etc/os-release": {Stdout: "ID=debian\n"}}}
+	e := PolicyExecutor{Exec: fake, Host: "web1"}
+	ctx := audit.WithActor(context.Background(), audit.Actor{UserID: 2, Role: "user"})
+
+	_, err := e.Run(ctx, Command{Name: "systemctl", Args: []string{"stop", "sshd"}, Sudo: true})
+	var denied *CommandDeniedError
+	if !errors.As(err, &denied) || denied.Role != "user" || denied.Command != "systemctl" {
+		t.Fatalf("err = %v, want a CommandDeniedError for role user", err)
+	}
+	if !strings.Contains(err.Error(), "systemctl stop sshd") {
+		t.Errorf("error %q does not name the command", err)
+	}
+	if len(fake.Calls()) != 0 {
+		t.Errorf("denied command ran: %v", fake.Calls())
+	}
+
+	if _, err := e.Run(ctx, Command{Name: "cat", Args: []string{"/etc/os-release"}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.Calls()) != 1 {
+		t.Errorf("allowed command did not run: %v", fake.Calls())
+	}
+}
+
+func TestPolicyExecutorWithoutActor(t *testing.T) {
+	fake := &FakeExecutor{Responses: map[string]FakeResponse{"apt-get install -y nginx": {}}}
+	e := PolicyExecutor{Exec: fake}
+	install := Command{Name: "apt-get", Args: []string{"install", "-y", "nginx"}, Sudo: true}
+
+	var denied *CommandDeniedError
+	if _, err := e.Run(context.Background(), install); !errors.As(err, &denied) {
+		t.Fatalf("err = %v without an actor, want a CommandDeniedError", err)
+	}
+	if len(fake.Calls()) != 0 {
+		t.Errorf("command without an actor ran: %v", fake.Calls())
+	}
+
+	ctx := audit.WithActor(context.Background(), audit.SystemActor)
+	if _, err := e.Run(ctx, install); err != nil {
+		t.Errorf("the system actor: %v", err)
+	}
+}
+
+func TestIsUserRole(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	policy := "roles: {operator: [{command: uptime}], system: [{command: uptime}], '*': [{command: id}]}"
+	if err := os.WriteFile(path, []byte(policy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := LoadCommandPolicy(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for role, want := range map[string]bool{
+		"admin": true, "user": true, "operator": true,
+		"system": false, "helper": false, "agent": false, "*": false, "": false, "root": false,
+	} {
+		if got := p.IsUserRole(role); got != want {
+			t.Errorf("IsUserRole(%q) = %v, want %v", role, got, want)
+		}
+	}
+}
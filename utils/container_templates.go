@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sync/atomic"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ContainerTemplate is a service the panel can start, kept in
+// CONTAINER_TEMPLATES_FILE by name:
+//
+//	postgres:
+//	  image: postgres:16
+//	  port: "5432"
+//	  env: {POSTGRES_PASSWORD: change-me}
+type ContainerTemplate struct {
+	Image string            `yaml:"image"`
+	Port  string            `yaml:"port"`
+	Env   map[string]string `yaml:"env"`
+}
+
+var templateName = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+
+// LoadContainerTemplates reads and checks a templates file. An empty path
+// gives no templates.
+func LoadContainerTemplates(path string) (map[string]ContainerTemplate, error) {
+	templates := map[string]ContainerTemplate{}
+	if path == "" {
+		return templates, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&templates); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for name, t := range templates {
+		switch {
+		case !templateName.MatchString(name):
+			return nil, fmt.Errorf("%s: template name %q must be lower case letters, digits, '.', '_' or '-'", path, name)
+		case t.Image == "":
+			return nil, fmt.Errorf("%s: template %s has no image", path, name)
+		case t.Port != "" && !portSpec.MatchString(t.Port):
+			return nil, fmt.Errorf("%s: template %s: port must look like 5432, got %q", path, name, t.Port)
+		}
+	}
+	return templates, nil
+}
+
+var containerTemplates atomic.Pointer[map[string]ContainerTemplate]
+
+// SetContainerTemplates makes templates the ones in effect.
+func SetContainerTemplates(templates map[string]ContainerTemplate) {
+	containerTemplates.Store(&templates)
+}
+
+// ContainerTemplates returns the templates in effect. The map is shared,
+// callers must not modify it.
+func ContainerTemplates() map[string]ContainerTemplate {
+	if t := containerTemplates.Load(); t != nil {
+		return *t
+	}
+	return nil
+}
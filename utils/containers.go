@@ -1,24 +1,20 @@
 package utils
 
-import (
-	"CipherOps/config"
-)
-
 // Container config
 type ContainerConfig struct {
-	ID string
+	ID        string
 	ImageName string
-	Port string
-	EnvVars map[string]string
+	Port      string
+	EnvVars   map[string]string
 }
 
-var ContainerRegistry = map[string]ContainerConfig {
+var ContainerRegistry = map[string]ContainerConfig{
 	"postgres": {},
-	"mysql": {},
-	"web": {}
+	"mysql":    {},
+	"web":      {},
 }
 
-// Define Docker actions 
+// Define Docker actions
 type DockerManager interface {
 	Create(service string) (string, error)
 	Remove(containerID string) error
@@ -26,9 +22,21 @@ type DockerManager interface {
 	Start(containerID string) error
 	Stop(ContainerID string) error
 	ListContainers(all bool) ([]ContainerInfo, error)
-    ListImages() ([]ImageInfo, error)
+	ListImages() ([]ImageInfo, error)
+}
+
+// ContainerInfo is a container as the engine lists it.
+type ContainerInfo struct {
+	ID     string
+	Name   string
+	Image  string
+	Status string
 }
 
-func (*config.Config) Create(service string) (string, error) {
-	
-}
\ No newline at end of file
+// ImageInfo is an image as the engine lists it.
+type ImageInfo struct {
+	ID         string
+	Repository string
+	Tag        string
+	Size       int64
+}
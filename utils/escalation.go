@@ -0,0 +1,67 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Ways to run a privileged command when not root. All of them are told not
+// to prompt: nobody is there to answer, a command waiting for a password
+// would only run into COMMAND_TIMEOUT. EscalateHelper hands the command to
+// cipherops-helper instead, see package helper.
+const (
+	EscalateSudo   = "sudo"
+	EscalateDoas   = "doas"
+	EscalatePkexec = "pkexec"
+	EscalateRun0   = "run0"
+	EscalateHelper = "helper"
+)
+
+// ErrEscalationRefused is returned, wrapped, for a privileged command the
+// escalation method would only run after asking for a password or an
+// interactive authorization.
+var ErrEscalationRefused = errors.New("privilege escalation needs a password or interactive authorization")
+
+// What each method prints when it refuses to run without asking
+var escalationRefusals = map[string][]string{
+	EscalateSudo:   {"a password is required", "a terminal is required"},
+	EscalateDoas:   {"Authorization required", "a password is required"},
+	EscalatePkexec: {"Not authorized", "No authentication agent found"},
+	EscalateRun0:   {"Interactive authentication required", "Access denied"},
+}
+
+// escalate is the program and arguments to run for c, going through method
+// ("sudo" when empty) for a privileged command unless already root.
+func escalate(method string, c Command, root bool) (string, []string) {
+	if !c.Sudo || root {
+		return c.Name, c.Args
+	}
+	cmd := append([]string{c.Name}, c.Args...)
+	switch method {
+	case EscalateDoas:
+		return "doas", append([]string{"-n", "--"}, cmd...)
+	case EscalatePkexec:
+		return "pkexec", append([]string{"--disable-internal-agent"}, cmd...)
+	case EscalateRun0:
+		return "run0", append([]string{"--no-ask-password", "--"}, cmd...)
+	}
+	return "sudo", append([]string{"-n", "--"}, cmd...)
+}
+
+// escalationError turns the failure of a privileged command whose stderr
+// shows method refused to run it without asking into ErrEscalationRefused.
+func escalationError(method string, c Command, stderr string, err error) error {
+	if err == nil || !c.Sudo {
+		return err
+	}
+	if method == "" {
+		method = EscalateSudo
+	}
+	for _, refusal := range escalationRefusals[method] {
+		if strings.Contains(stderr, refusal) {
+			return fmt.Errorf("%w: %s would ask to run %s", ErrEscalationRefused, method, c.Name)
+		}
+	}
+	return err
+}
@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// NewExecutor returns the executor for the DRY_RUN setting around local,
+// which runs commands on this machine. A dry run still probes with local,
+// so the plan matches what would run here.
+func NewExecutor(local Executor, dryRun bool) Executor {
+	if dryRun {
+		return &DryRunExecutor{Probe: local}
+	}
+	return local
+}
+
+// DryRunExecutor runs no privileged command. It logs each one and keeps it in
+// the plan; each one succeeds with its command line as output.
+type DryRunExecutor struct {
+	// runs the unprivileged commands, which only look (dpkg -s, command -v,
+	// reading /etc/os-release), when set; otherwise they are planned too
+	// and succeed
+	Probe Executor
+
+	mu   sync.Mutex
+	plan []string
+}
+
+func (d *DryRunExecutor) Run(ctx context.Context, c Command) (CommandResult, error) {
+	if !c.Sudo && d.Probe != nil {
+		return d.Probe.Run(ctx, c)
+	}
+	// as root or not, the plan shows which commands need privileges
+	res := CommandResult{CommandLine: commandLine(sudoCommand(c, false)), DryRun: true}
+	res.Stdout = res.CommandLine
+	slog.Info("dry run", "command", c.Name, "args", c.Args, "sudo", c.Sudo)
+	d.mu.Lock()
+	d.plan = append(d.plan, res.CommandLine)
+	d.mu.Unlock()
+	return res, nil
+}
+
+// Plan returns the command lines run so far, in order.
+func (d *DryRunExecutor) Plan() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.plan...)
+}
+
+// FakeExecutor answers commands from a script instead of running them, for
+// unit tests of installers and service managers.
+type FakeExecutor struct {
+	// keyed by the command line without sudo, e.g. "dpkg -s nginx"; a
+	// command that is not listed fails
+	Responses map[string]FakeResponse
+
+	mu    sync.Mutex
+	calls []Command
+}
+
+// FakeResponse is the scripted outcome of one command.
+type FakeResponse struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+	// returned as is when set, like a command that could not start
+	Err error
+}
+
+func (f *FakeExecutor) Run(ctx context.Context, c Command) (CommandResult, error) {
+	f.mu.Lock()
+	f.calls = append(f.calls, c)
+	f.mu.Unlock()
+
+	line := strings.Join(append([]string{c.Name}, c.Args...), " ")
+	resp, ok := f.Responses[line]
+	if !ok {
+		return CommandResult{CommandLine: line, ExitCode: -1}, fmt.Errorf("fake executor: unexpected command %q", line)
+	}
+	res := CommandResult{CommandLine: line, ExitCode: resp.ExitCode, Stdout: resp.Stdout, Stderr: resp.Stderr}
+	if c.Output != nil {
+		for _, s := range []struct{ stream, text string }{{"stdout", resp.Stdout}, {"stderr", resp.Stderr}} {
+			for _, text := range strings.Split(strings.TrimSuffix(s.text, "\n"), "\n") {
+				if text != "" {
+					c.Output(OutputLine{Stream: s.stream, Text: text})
+				}
+			}
+		}
+	}
+	switch {
+	case resp.Err != nil:
+		res.ExitCode = -1
+		return res, resp.Err
+	case resp.ExitCode != 0:
+		return res, fmt.Errorf("exit status %d: %s", resp.ExitCode, strings.TrimSpace(resp.Stderr))
+	}
+	return res, nil
+}
+
+// Calls returns the commands run so far, in order.
+func (f *FakeExecutor) Calls() []Command {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Command(nil), f.calls...)
+}
@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"context"
+	"slices"
+	"testing"
+)
+
+func TestDryRunExecutorPlan(t *testing.T) {
+	probe := &FakeExecutor{Responses: map[string]FakeResponse{
+		"sh -c command -v systemctl": ok,
+		"dpkg -s nginx":              missing,
+	}}
+	dry := &DryRunExecutor{Probe: probe}
+	ctx := context.Background()
+
+	installer := &AptInstaller{Exec: dry}
+	installed, err := installer.IsInstalled(ctx, "nginx")
+	if err != nil || installed {
+		t.Fatalf("IsInstalled = %v, %v; want false from the probe", installed, err)
+	}
+	if err := installer.Install(ctx, []string{"nginx"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Service(ctx, dry, "enable", "nginx"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"sudo apt-get update -y", "sudo apt-get install -y nginx", "sudo systemctl enable --now nginx"}
+	if got := dry.Plan(); !slices.Equal(got, want) {
+		t.Errorf("plan = %q, want %q", got, want)
+	}
+	// only the probes reached the machine
+	wantProbes := []string{"dpkg -s nginx", "sh -c command -v systemctl"}
+	if got := commandLines(probe.Calls()); !slices.Equal(got, wantProbes) {
+		t.Errorf("probes = %q, want %q", got, wantProbes)
+	}
+}
+
+func TestDryRunExecutorWithoutProbe(t *testing.T) {
+	dry := &DryRunExecutor{}
+	res, err := dry.Run(context.Background(), Command{Name: "dpkg", Args: []string{"-s", "nginx"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.DryRun || res.CommandLine != "dpkg -s nginx" {
+		t.Errorf("result = %+v, want a planned dpkg -s nginx", res)
+	}
+	if got := dry.Plan(); !slices.Equal(got, []string{"dpkg -s nginx"}) {
+		t.Errorf("plan = %q", got)
+	}
+}
@@ -1 +1,123 @@
-package utils
\ No newline at end of file
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"sync/atomic"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FirewallPolicy is the rule set kept in FIREWALL_POLICY_FILE:
+//
+//	default_incoming: deny
+//	default_outgoing: allow
+//	rules:
+//	  - {direction: in, protocol: tcp, port: "22", source: 10.0.0.0/8, action: allow}
+type FirewallPolicy struct {
+	// allow or deny for traffic no rule matches
+	DefaultIncoming string               `yaml:"default_incoming"`
+	DefaultOutgoing string               `yaml:"default_outgoing"`
+	Rules           []FirewallPolicyRule `yaml:"rules"`
+}
+
+type FirewallPolicyRule struct {
+	// in or out
+	Direction string `yaml:"direction"`
+	// tcp, udp, icmp or any
+	Protocol string `yaml:"protocol"`
+	// single port or range like 8000:8100, empty for all
+	Port string `yaml:"port"`
+	// CIDR or address the rule matches, empty for any
+	Source  string `yaml:"source"`
+	Action  string `yaml:"action"`
+	Comment string `yaml:"comment"`
+}
+
+var portSpec = regexp.MustCompile(`^\d{1,5}(:\d{1,5})?$`)
+
+// LoadFirewallPolicy reads and checks a policy file. An empty path gives the
+// empty policy.
+func LoadFirewallPolicy(path string) (FirewallPolicy, error) {
+	policy := FirewallPolicy{DefaultIncoming: "deny", DefaultOutgoing: "allow"}
+	if path == "" {
+		return policy, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return policy, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&policy); err != nil && !errors.Is(err, io.EOF) {
+		return policy, fmt.Errorf("%s: %w", path, err)
+	}
+	for _, def := range []string{policy.DefaultIncoming, policy.DefaultOutgoing} {
+		if def != "allow" && def != "deny" {
+			return policy, fmt.Errorf("%s: default policy must be allow or deny, got %q", path, def)
+		}
+	}
+	for i, r := range policy.Rules {
+		if err := r.check(); err != nil {
+			return policy, fmt.Errorf("%s: rule %d: %w", path, i+1, err)
+		}
+	}
+	return policy, nil
+}
+
+func (r FirewallPolicyRule) check() error {
+	switch {
+	case r.Direction != "in" && r.Direction != "out":
+		return fmt.Errorf("direction must be in or out, got %q", r.Direction)
+	case r.Protocol != "tcp" && r.Protocol != "udp" && r.Protocol != "icmp" && r.Protocol != "any":
+		return fmt.Errorf("protocol must be tcp, udp, icmp or any, got %q", r.Protocol)
+	case r.Action != "allow" && r.Action != "deny":
+		return fmt.Errorf("action must be allow or deny, got %q", r.Action)
+	case r.Port != "" && !portSpec.MatchString(r.Port):
+		return fmt.Errorf("port must look like 22 or 8000:8100, got %q", r.Port)
+	}
+	if r.Source != "" {
+		if _, _, err := net.ParseCIDR(r.Source); err != nil && net.ParseIP(r.Source) == nil {
+			return fmt.Errorf("source must be an address or CIDR, got %q", r.Source)
+		}
+	}
+	return nil
+}
+
+var firewallPolicy atomic.Pointer[FirewallPolicy]
+
+// SetFirewallPolicy makes policy the one in effect.
+func SetFirewallPolicy(policy FirewallPolicy) {
+	firewallPolicy.Store(&policy)
+}
+
+// CurrentFirewallPolicy returns the policy in effect, or the empty default.
+func CurrentFirewallPolicy() FirewallPolicy {
+	if p := firewallPolicy.Load(); p != nil {
+		return *p
+	}
+	return FirewallPolicy{DefaultIncoming: "deny", DefaultOutgoing: "allow"}
+}
+
+// DetectFirewallBackend names the firewall tool found where e runs commands:
+// ufw, firewalld or the nftables and iptables they build on, or "none". The
+// front ends come first, rules added beneath them would be overwritten.
+func DetectFirewallBackend(ctx context.Context, e Executor) string {
+	for _, backend := range []struct{ name, command string }{
+		{"ufw", "ufw"},
+		{"firewalld", "firewall-cmd"},
+		{"nftables", "nft"},
+		{"iptables", "iptables"},
+	} {
+		if hasCommand(ctx, e, backend.command) {
+			return backend.name
+		}
+	}
+	return "none"
+}
@@ -5,8 +5,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"os"
-	"os/exec"
+	"log/slog"
 	"strings"
 	"time"
 )
@@ -19,13 +18,13 @@ type DistroInfo struct {
 	Version string
 }
 
-func DetectDistro() (DistroInfo, error) {
-	f, err := os.Open("/etc/os-release")
+// DetectDistro reads /etc/os-release where e runs commands.
+func DetectDistro(ctx context.Context, e Executor) (DistroInfo, error) {
+	out, err := runCmd(ctx, e, false, "cat", "/etc/os-release")
 	if err != nil {
-		return DistroInfo{}, err
+		return DistroInfo{}, fmt.Errorf("The distribution could not be detected: %w", err)
 	}
-	defer f.Close()
-	scanner := bufio.NewScanner(f)
+	scanner := bufio.NewScanner(strings.NewReader(out))
 	info := DistroInfo{}
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -50,76 +49,106 @@ func DetectDistro() (DistroInfo, error) {
 
 // ----- Installer interface and some implemetations -----
 type Installer interface {
-	Install(packages []string) error
-	Remove(packages []string) error
-	IsInstalled(pkg string) (bool, error)
+	Install(ctx context.Context, packages []string) error
+	Remove(ctx context.Context, packages []string) error
+	IsInstalled(ctx context.Context, pkg string) (bool, error)
 }
 
-func NewInstallerFor(d DistroInfo) Installer {
+// NewInstallerFor picks the installer for d, running its commands through e;
+// output, which may be nil, receives the package manager output while it runs.
+func NewInstallerFor(d DistroInfo, e Executor, output OutputFunc) Installer {
 	id := strings.ToLower(d.ID)
 	like := strings.ToLower(d.Like)
 	// simple heuristic
 	if id == "ubuntu" || id == "debian" || strings.Contains(like, "debian") {
-		return &AptInstaller{}
+		return &AptInstaller{Exec: e, Output: output}
 	}
 	if id == "fedora" || id == "centos" || id == "rhel" || strings.Contains(like, "rhel") {
-		return &DnfInstaller{}
+		return &DnfInstaller{Exec: e, Output: output}
 	}
 	if id == "arch" || id == "manjaro" || strings.Contains(like, "arch") {
-		return &PacmanInstaller{}
+		return &PacmanInstaller{Exec: e, Output: output}
 	}
 	if id == "opensuse" || strings.Contains(like, "suse") {
-		return &ZypperInstaller{}
+		return &ZypperInstaller{Exec: e, Output: output}
 	}
 	// fallback: try sh and let commands fall back
-	return &GenericShellInstaller{}
+	return &GenericShellInstaller{Exec: e, Output: output}
+}
+
+// InstallerName is the short name of an installer, e.g. "apt", as kept in
+// host facts.
+func InstallerName(i Installer) string {
+	switch i.(type) {
+	case *AptInstaller:
+		return "apt"
+	case *DnfInstaller:
+		return "dnf"
+	case *PacmanInstaller:
+		return "pacman"
+	case *ZypperInstaller:
+		return "zypper"
+	}
+	return "generic"
+}
+
+// NewInstallerByName returns the installer InstallerName calls name.
+func NewInstallerByName(name string, e Executor, output OutputFunc) (Installer, error) {
+	switch name {
+	case "apt":
+		return &AptInstaller{Exec: e, Output: output}, nil
+	case "dnf":
+		return &DnfInstaller{Exec: e, Output: output}, nil
+	case "pacman":
+		return &PacmanInstaller{Exec: e, Output: output}, nil
+	case "zypper":
+		return &ZypperInstaller{Exec: e, Output: output}, nil
+	case "generic":
+		return &GenericShellInstaller{Exec: e, Output: output}, nil
+	}
+	return nil, fmt.Errorf("unknown installer %q", name)
 }
 
 // implement the methods defined on the installer interface
 // ----- APT -----
-type AptInstaller struct {}
+type AptInstaller struct {
+	Exec Executor
+	// receives the package manager output while it runs, may be nil
+	Output OutputFunc
+}
 
-func (a *AptInstaller) Install(pkgs []string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+func (a *AptInstaller) Install(ctx context.Context, pkgs []string) error {
+	ctx, cancel := context.WithTimeout(ctx, CommandTimeout())
 	defer cancel()
 
-	var output string
-	var err error
-	
 	// Update
-	if output, err = runCmd(ctx, true, "apt-get", "update", "-y"); err != nil {
-		fmt.Printf("Warning: apt update failed: %v\nOutput: %s\n", err, output)
+	if _, err := streamCmd(ctx, a.Exec, a.Output, "apt-get", "update", "-y"); err != nil {
+		slog.Warn("apt update failed", "error", err)
 	}
-	fmt.Println(output)
 
 	args := append([]string{"install", "-y"}, pkgs...)
-	if output, err = runCmd(ctx, true, "apt-get", args...); err != nil {
-		return fmt.Errorf("failed to install packages %v: %w\nOutput: %s", pkgs, err, output)
+	if _, err := streamCmd(ctx, a.Exec, a.Output, "apt-get", args...); err != nil {
+		return fmt.Errorf("failed to install packages %v: %w", pkgs, err)
 	}
-	fmt.Printf("apt-get install output: %s\n", output)
 	return nil
 }
 
-func (a *AptInstaller) Remove(pkgs []string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+func (a *AptInstaller) Remove(ctx context.Context, pkgs []string) error {
+	ctx, cancel := context.WithTimeout(ctx, CommandTimeout())
 	defer cancel()
 
-	var output string
-	var err error
-
 	args := append([]string{"remove", "-y"}, pkgs...)
-	if output, err = runCmd(ctx, true, "apt-get", args...); err != nil {
-		return fmt.Errorf("failed to remove packages: %v\nOutput: %s", pkgs, output)
+	if _, err := streamCmd(ctx, a.Exec, a.Output, "apt-get", args...); err != nil {
+		return fmt.Errorf("failed to remove packages %v: %w", pkgs, err)
 	}
-	fmt.Println(output)
 	return nil
 }
 
-func (a *AptInstaller) IsInstalled(pkg string) (bool, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+func (a *AptInstaller) IsInstalled(ctx context.Context, pkg string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
-	if _, err := runCmd(ctx, false, "dpkg", "-s", pkg); err != nil {
+	if _, err := runCmd(ctx, a.Exec, false, "dpkg", "-s", pkg); err != nil {
 		// dpkg -s returns an error if it is not installed
 		return false, nil
 	}
@@ -127,52 +156,48 @@ func (a *AptInstaller) IsInstalled(pkg string) (bool, error) {
 }
 
 // ----- DNF / YUM -----
-type DnfInstaller struct {}
+type DnfInstaller struct {
+	Exec Executor
+	// receives the package manager output while it runs, may be nil
+	Output OutputFunc
+}
 
-func (d *DnfInstaller) Install(pkgs []string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+func (d *DnfInstaller) Install(ctx context.Context, pkgs []string) error {
+	ctx, cancel := context.WithTimeout(ctx, CommandTimeout())
 	defer cancel()
 
-	var output string
-	var err error
-	
 	// Update
-	if output, err = runCmd(ctx, true, "dnf", "update", "-y"); err != nil {
-		fmt.Printf("Warning: dnf update failed: %v\nOutput: %s\n", err, output)
+	if _, err := streamCmd(ctx, d.Exec, d.Output, "dnf", "update", "-y"); err != nil {
+		slog.Warn("dnf update failed", "error", err)
 	}
 
 	args := append([]string{"install", "-y"}, pkgs...)
-	if output, err = runCmd(ctx, true, "dnf", args...); err != nil {
-		if output, err = runCmd(ctx, true, "yum", args...); err != nil {
-			return fmt.Errorf("failed to install packages: %v\nOutput: %s", pkgs, output)
+	if _, err := streamCmd(ctx, d.Exec, d.Output, "dnf", args...); err != nil {
+		if _, err = streamCmd(ctx, d.Exec, d.Output, "yum", args...); err != nil {
+			return fmt.Errorf("failed to install packages %v: %w", pkgs, err)
 		}
 	}
-	fmt.Printf("dnf/yum install output: %s\n", output)
 	return nil
 }
 
-func (d *DnfInstaller) Remove(pkgs []string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+func (d *DnfInstaller) Remove(ctx context.Context, pkgs []string) error {
+	ctx, cancel := context.WithTimeout(ctx, CommandTimeout())
 	defer cancel()
 
-	var output string
-	var err error
-
 	args := append([]string{"remove", "-y"}, pkgs...)
-	if output, err = runCmd(ctx, true, "dnf", args...); err != nil {
-		if output, err = runCmd(ctx, true, "yum", args...); err != nil {
-			return fmt.Errorf("failed to remove packages: %v\nOutput: %s", pkgs, output)
+	if _, err := streamCmd(ctx, d.Exec, d.Output, "dnf", args...); err != nil {
+		if _, err = streamCmd(ctx, d.Exec, d.Output, "yum", args...); err != nil {
+			return fmt.Errorf("failed to remove packages %v: %w", pkgs, err)
 		}
 	}
-	fmt.Println(output)
 	return nil
 }
 
-func (d *DnfInstaller) IsInstalled(pkg string) (bool, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+func (d *DnfInstaller) IsInstalled(ctx context.Context, pkg string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
-	if _, err := runCmd(ctx, false, "rpm", "-q", pkg); err != nil {
+	if _, err := runCmd(ctx, d.Exec, false, "rpm", "-q", pkg); err != nil {
 		// rpm returns an error if the package is not installed
 		return false, nil
 	}
@@ -180,48 +205,44 @@ func (d *DnfInstaller) IsInstalled(pkg string) (bool, error) {
 }
 
 // ----- PACMAN -----
-type PacmanInstaller struct {}
+type PacmanInstaller struct {
+	Exec Executor
+	// receives the package manager output while it runs, may be nil
+	Output OutputFunc
+}
 
-func (p *PacmanInstaller) Install(pkgs []string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+func (p *PacmanInstaller) Install(ctx context.Context, pkgs []string) error {
+	ctx, cancel := context.WithTimeout(ctx, CommandTimeout())
 	defer cancel()
 
-	var output string
-	var err error
-	
-		// Update
-	if output, err = runCmd(ctx, true, "pacman", "-Sy", "--noconfirm"); err != nil {
-		fmt.Printf("Warning: pacman update failed: %v\nOutput: %s\n", err, output)
+	// Update
+	if _, err := streamCmd(ctx, p.Exec, p.Output, "pacman", "-Sy", "--noconfirm"); err != nil {
+		slog.Warn("pacman update failed", "error", err)
 	}
 
 	args := append([]string{"-S", "--noconfirm"}, pkgs...)
-	if output, err = runCmd(ctx, true, "pacman", args...); err != nil {
-		return fmt.Errorf("failed to install packages: %v\nOutput: %s", pkgs, output)
+	if _, err := streamCmd(ctx, p.Exec, p.Output, "pacman", args...); err != nil {
+		return fmt.Errorf("failed to install packages %v: %w", pkgs, err)
 	}
-	fmt.Printf("pacman install output: %s\n", output)
 	return nil
 }
 
-func (p *PacmanInstaller) Remove(pkgs []string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+func (p *PacmanInstaller) Remove(ctx context.Context, pkgs []string) error {
+	ctx, cancel := context.WithTimeout(ctx, CommandTimeout())
 	defer cancel()
 
-	var output string
-	var err error
-
 	args := append([]string{"-R", "--noconfirm"}, pkgs...)
-	if output, err = runCmd(ctx, true, "pacman", args...); err != nil {
-		return fmt.Errorf("failed to remove packages: %v\nOutput: %s", pkgs, output)
+	if _, err := streamCmd(ctx, p.Exec, p.Output, "pacman", args...); err != nil {
+		return fmt.Errorf("failed to remove packages %v: %w", pkgs, err)
 	}
-	fmt.Println(output)
 	return nil
 }
 
-func (p *PacmanInstaller) IsInstalled(pkg string) (bool, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+func (p *PacmanInstaller) IsInstalled(ctx context.Context, pkg string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
-	if _, err := runCmd(ctx, false, "pacman", "-Qi", pkg); err != nil {
+	if _, err := runCmd(ctx, p.Exec, false, "pacman", "-Qi", pkg); err != nil {
 		// pacman -Qi returns an error if the package is not installed
 		return false, nil
 	}
@@ -229,48 +250,44 @@ func (p *PacmanInstaller) IsInstalled(pkg string) (bool, error) {
 }
 
 // ----- ZYPPER -----
-type ZypperInstaller struct{}
+type ZypperInstaller struct {
+	Exec Executor
+	// receives the package manager output while it runs, may be nil
+	Output OutputFunc
+}
 
-func (z *ZypperInstaller) Install(pkgs []string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+func (z *ZypperInstaller) Install(ctx context.Context, pkgs []string) error {
+	ctx, cancel := context.WithTimeout(ctx, CommandTimeout())
 	defer cancel()
 
-	var output string
-	var err error
-	
 	// Update
-	if output, err = runCmd(ctx, true, "zypper", "update", "--non-interactive"); err != nil {
-		fmt.Printf("Warning: zypper update failed: %v\nOutput: %s\n", err, output)
+	if _, err := streamCmd(ctx, z.Exec, z.Output, "zypper", "update", "--non-interactive"); err != nil {
+		slog.Warn("zypper update failed", "error", err)
 	}
 
 	args := append([]string{"--non-interactive", "install"}, pkgs...)
-	if output, err = runCmd(ctx, true, "zypper", args...); err != nil {
-		return fmt.Errorf("failed to install packages: %v\nOutput: %s", pkgs, output)
+	if _, err := streamCmd(ctx, z.Exec, z.Output, "zypper", args...); err != nil {
+		return fmt.Errorf("failed to install packages %v: %w", pkgs, err)
 	}
-	fmt.Printf("zypper install output: %s\n", output)
 	return nil
 }
 
-func (z *ZypperInstaller) Remove(pkgs []string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), DefaultTimeout)
+func (z *ZypperInstaller) Remove(ctx context.Context, pkgs []string) error {
+	ctx, cancel := context.WithTimeout(ctx, CommandTimeout())
 	defer cancel()
 
-	var output string
-	var err error
-
 	args := append([]string{"--non-interactive", "remove"}, pkgs...)
-	if output, err = runCmd(ctx, true, "zypper", args...); err != nil {
-		return fmt.Errorf("failed to remove packages: %v\nOutput: %s", pkgs, output)
+	if _, err := streamCmd(ctx, z.Exec, z.Output, "zypper", args...); err != nil {
+		return fmt.Errorf("failed to remove packages %v: %w", pkgs, err)
 	}
-	fmt.Println(output)
 	return nil
 }
 
-func (z *ZypperInstaller) IsInstalled(pkg string) (bool, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+func (z *ZypperInstaller) IsInstalled(ctx context.Context, pkg string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
-	if _, err := runCmd(ctx, false, "rpm", "-q", pkg); err != nil {
+	if _, err := runCmd(ctx, z.Exec, false, "rpm", "-q", pkg); err != nil {
 		// rpm returns an error if the package is not installed
 		return false, nil
 	}
@@ -279,158 +296,198 @@ func (z *ZypperInstaller) IsInstalled(pkg string) (bool, error) {
 
 
 // --- Generic fallback ---
-type GenericShellInstaller struct{}
+type GenericShellInstaller struct {
+	Exec   Executor
+	Output OutputFunc
+}
 
-func (g *GenericShellInstaller) Install(pkgs []string) error {
+// probeCommand looks for a package manager within 30 seconds; the install
+// or removal that follows runs on the caller's context.
+func probeCommand(ctx context.Context, e Executor, name string) bool {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	return hasCommand(ctx, e, name)
+}
+
+func (g *GenericShellInstaller) Install(ctx context.Context, pkgs []string) error {
 	// Try apt, dns, and pacman in order to maximize compatibility.
-	if _, err := exec.LookPath("apt-get"); err == nil {
-		return (&AptInstaller{}).Install(pkgs)
+	if probeCommand(ctx, g.Exec, "apt-get") {
+		return (&AptInstaller{Exec: g.Exec, Output: g.Output}).Install(ctx, pkgs)
 	}
-	if _, err := exec.LookPath("dnf"); err == nil {
-		return (&DnfInstaller{}).Install(pkgs)
+	if probeCommand(ctx, g.Exec, "dnf") {
+		return (&DnfInstaller{Exec: g.Exec, Output: g.Output}).Install(ctx, pkgs)
 	}
-	if _, err := exec.LookPath("pacman"); err == nil {
-		return (&PacmanInstaller{}).Install(pkgs)
+	if probeCommand(ctx, g.Exec, "pacman") {
+		return (&PacmanInstaller{Exec: g.Exec, Output: g.Output}).Install(ctx, pkgs)
 	}
 	return errors.New("No known package manager available")
 }
-func (g *GenericShellInstaller) Remove(pkgs []string) error {
+func (g *GenericShellInstaller) Remove(ctx context.Context, pkgs []string) error {
 	// Try apt, dns, and pacman in order to maximize compatibility.
-	if _, err := exec.LookPath("apt-get"); err == nil {
-		return (&AptInstaller{}).Remove(pkgs)
+	if probeCommand(ctx, g.Exec, "apt-get") {
+		return (&AptInstaller{Exec: g.Exec, Output: g.Output}).Remove(ctx, pkgs)
 	}
-	if _, err := exec.LookPath("dnf"); err == nil {
-		return (&DnfInstaller{}).Remove(pkgs)
+	if probeCommand(ctx, g.Exec, "dnf") {
+		return (&DnfInstaller{Exec: g.Exec, Output: g.Output}).Remove(ctx, pkgs)
 	}
-	if _, err := exec.LookPath("pacman"); err == nil {
-		return (&PacmanInstaller{}).Remove(pkgs)
+	if probeCommand(ctx, g.Exec, "pacman") {
+		return (&PacmanInstaller{Exec: g.Exec, Output: g.Output}).Remove(ctx, pkgs)
 	}
 	return errors.New("No known package manager available")
 }
-func (g *GenericShellInstaller) IsInstalled(pkg string) (bool, error) {
+func (g *GenericShellInstaller) IsInstalled(ctx context.Context, pkg string) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
 	// Try apt, dns, and pacman in order to maximize compatibility.
-	if _, err := exec.LookPath("dpkg"); err == nil {
-		return (&AptInstaller{}).IsInstalled(pkg)
+	if hasCommand(ctx, g.Exec, "dpkg") {
+		return (&AptInstaller{Exec: g.Exec}).IsInstalled(ctx, pkg)
 	}
-	if _, err := exec.LookPath("rpm"); err == nil {
-		return (&DnfInstaller{}).IsInstalled(pkg)
+	if hasCommand(ctx, g.Exec, "rpm") {
+		return (&DnfInstaller{Exec: g.Exec}).IsInstalled(ctx, pkg)
 	}
-	if _, err := exec.LookPath("pacman"); err == nil {
-		return (&PacmanInstaller{}).IsInstalled(pkg)
+	if hasCommand(ctx, g.Exec, "pacman") {
+		return (&PacmanInstaller{Exec: g.Exec}).IsInstalled(ctx, pkg)
 	}
 	return false, errors.New("Cannot determine if the package is installed")
 }
 
 // ----- Service Manager (systemd, sysv) -----
 type ServiceManager interface {
-	Start(name string) error
-	Restart(name string) error
-	Stop(name string) error
-	Enable(name string) error
-	Disable(name string) error
-	Status(name string) (string, error)
+	Start(ctx context.Context, name string) error
+	Restart(ctx context.Context, name string) error
+	Stop(ctx context.Context, name string) error
+	Enable(ctx context.Context, name string) error
+	Disable(ctx context.Context, name string) error
+	Status(ctx context.Context, name string) (string, error)
 }
 
-func NewServiceManager() ServiceManager {
+// NewServiceManager picks the service manager found where e runs commands.
+func NewServiceManager(ctx context.Context, e Executor) ServiceManager {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
 	// If exists systemctl -> systemd
-	if _, err := exec.LookPath("systemctl"); err == nil {
-		return &SystemdService{}
+	if hasCommand(ctx, e, "systemctl") {
+		return &SystemdService{Exec: e}
 	}
 	// fallback a service
-	return &SysVService{}
+	return &SysVService{Exec: e}
+}
+
+// ServiceManagerName is "systemd" or "sysv", as kept in host facts.
+func ServiceManagerName(sm ServiceManager) string {
+	if _, ok := sm.(*SystemdService); ok {
+		return "systemd"
+	}
+	return "sysv"
+}
+
+// NewServiceManagerByName returns the service manager ServiceManagerName
+// calls name.
+func NewServiceManagerByName(name string, e Executor) (ServiceManager, error) {
+	switch name {
+	case "systemd":
+		return &SystemdService{Exec: e}, nil
+	case "sysv":
+		return &SysVService{Exec: e}, nil
+	}
+	return nil, fmt.Errorf("unknown service manager %q", name)
 }
 
-type SystemdService struct{}
+type SystemdService struct {
+	Exec Executor
+}
 
-func (s *SystemdService) Start(name string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+func (s *SystemdService) Start(ctx context.Context, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
 	defer cancel()
-	_, err := runCmd(ctx, true, "systemctl", "start", name)
+	_, err := runCmd(ctx, s.Exec, true, "systemctl", "start", name)
 	return err
 }
-func (s *SystemdService) Restart(name string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+func (s *SystemdService) Restart(ctx context.Context, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
 	defer cancel()
-	_, err := runCmd(ctx, true, "systemctl", "restart", name)
+	_, err := runCmd(ctx, s.Exec, true, "systemctl", "restart", name)
 	return err
 }
-func (s *SystemdService) Stop(name string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+func (s *SystemdService) Stop(ctx context.Context, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
 	defer cancel()
-	_, err := runCmd(ctx, true, "systemctl", "stop", name)
+	_, err := runCmd(ctx, s.Exec, true, "systemctl", "stop", name)
 	return err
 }
-func (s *SystemdService) Enable(name string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+func (s *SystemdService) Enable(ctx context.Context, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
 	defer cancel()
-	_, err := runCmd(ctx, true, "systemctl", "enable", "--now", name)
+	_, err := runCmd(ctx, s.Exec, true, "systemctl", "enable", "--now", name)
 	return err
 }
-func (s *SystemdService) Disable(name string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+func (s *SystemdService) Disable(ctx context.Context, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
 	defer cancel()
-	_, err := runCmd(ctx, true, "systemctl", "disable", "--now", name)
+	_, err := runCmd(ctx, s.Exec, true, "systemctl", "disable", "--now", name)
 	return err
 }
-func (s *SystemdService) Status(name string) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+func (s *SystemdService) Status(ctx context.Context, name string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
-	out, err := runCmd(ctx, false, "systemctl", "status", name, "--no-pager")
+	out, err := runCmd(ctx, s.Exec, false, "systemctl", "status", name, "--no-pager")
 	return out, err
 }
 
-type SysVService struct{}
+type SysVService struct {
+	Exec Executor
+}
 
-func (s *SysVService) Start(name string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+func (s *SysVService) Start(ctx context.Context, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
 	defer cancel()
-	_, err := runCmd(ctx, true, "service", name, "start")
+	_, err := runCmd(ctx, s.Exec, true, "service", name, "start")
 	return err
 }
-func (s *SysVService) Restart(name string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+func (s *SysVService) Restart(ctx context.Context, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
 	defer cancel()
-	_, err := runCmd(ctx, true, "service", name, "restart")
+	_, err := runCmd(ctx, s.Exec, true, "service", name, "restart")
 	return err
 }
-func (s *SysVService) Stop(name string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+func (s *SysVService) Stop(ctx context.Context, name string) error {
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
 	defer cancel()
-	_, err := runCmd(ctx, true, "service", name, "stop")
+	_, err := runCmd(ctx, s.Exec, true, "service", name, "stop")
 	return err
 }
-func (s *SysVService) Enable(name string) error {
+func (s *SysVService) Enable(ctx context.Context, name string) error {
 	// Not all sysv have enable; we will try chkconfig or update-rc.d
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
 	defer cancel()
-	if _, err := exec.LookPath("chkconfig"); err == nil {
-		_, err2 := runCmd(ctx, true, "chkconfig", name, "on")
+	if hasCommand(ctx, s.Exec, "chkconfig") {
+		_, err2 := runCmd(ctx, s.Exec, true, "chkconfig", name, "on")
 		return err2
 	}
-	if _, err := exec.LookPath("update-rc.d"); err == nil {
-		_, err2 := runCmd(ctx, true, "update-rc.d", name, "defaults")
+	if hasCommand(ctx, s.Exec, "update-rc.d") {
+		_, err2 := runCmd(ctx, s.Exec, true, "update-rc.d", name, "defaults")
 		return err2
 	}
 	return errors.New("habilitar servicio no soportado en este sistema")
 }
-func (s *SysVService) Disable(name string) error {
+func (s *SysVService) Disable(ctx context.Context, name string) error {
 	// Not all sysv have enable; we will try chkconfig or update-rc.d
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
 	defer cancel()
-	if _, err := exec.LookPath("chkconfig"); err == nil {
-		_, err2 := runCmd(ctx, true, "chkconfig", name, "off")
+	if hasCommand(ctx, s.Exec, "chkconfig") {
+		_, err2 := runCmd(ctx, s.Exec, true, "chkconfig", name, "off")
 		return err2
 	}
-	if _, err := exec.LookPath("update-rc.d"); err == nil {
-		_, err2 := runCmd(ctx, true, "update-rc.d", name, "defaults")
+	if hasCommand(ctx, s.Exec, "update-rc.d") {
+		_, err2 := runCmd(ctx, s.Exec, true, "update-rc.d", name, "defaults")
 		return err2
 	}
 	return errors.New("habilitar servicio no soportado en este sistema")
 }
-func (s *SysVService) Status(name string) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+func (s *SysVService) Status(ctx context.Context, name string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
-	return runCmd(ctx, false, "service", name, "status")
+	return runCmd(ctx, s.Exec, false, "service", name, "status")
 }
 
 // ----- Package name mapping -----
@@ -457,32 +514,30 @@ var PackageMap = map[string]map[string][]string{
 
 // --- High-level helpers that your code can call ---
 // InstallPackages receives a list of “abstract names” (docker, postgres, etc.)
-func InstallPackages(programs []string) error {
-	distro, err := DetectDistro()
+// and runs the package manager through e, streaming its output to output,
+// which may be nil.
+func InstallPackages(ctx context.Context, e Executor, programs []string, output OutputFunc) error {
+	detectCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	distro, err := DetectDistro(detectCtx, e)
+	cancel()
 	if err != nil {
 		return err
 	}
-	installer := NewInstallerFor(distro)
+	return InstallPrograms(ctx, NewInstallerFor(distro, e, output), distro, programs)
+}
+
+// InstallPrograms installs the packages PackageMap gives for programs on
+// distro with installer, skipping those already installed.
+func InstallPrograms(ctx context.Context, installer Installer, distro DistroInfo, programs []string) error {
 	for _, prog := range programs {
-		pmap, ok := PackageMap[prog]
-		if !ok {
-			return fmt.Errorf("There is no packet mapping for '%s'", prog)
-		}
-		// try exact ID first, then ID_LIKE heuristic, then fallback to “any”
-		var toInstall []string
-		if v, exists := pmap[strings.ToLower(distro.ID)]; exists {
-			toInstall = v
-		} else if v, exists := pmap[strings.ToLower(distro.Like)]; exists {
-			toInstall = v
-		} else {
-			// TODO
-			// if there is a “default” key, you could use it; for now, error if it does not match
-			return fmt.Errorf("There is no known package for %s in %s", prog, distro.ID)
+		toInstall, err := packagesFor(prog, distro)
+		if err != nil {
+			return err
 		}
 		// comprobar si ya está instalado
 		filtered := make([]string, 0, len(toInstall))
 		for _, pkg := range toInstall {
-			ok, _ := installer.IsInstalled(pkg)
+			ok, _ := installer.IsInstalled(ctx, pkg)
 			if ok {
 				continue
 			}
@@ -491,27 +546,65 @@ func InstallPackages(programs []string) error {
 		if len(filtered) == 0 {
 			continue
 		}
-		if err := installer.Install(filtered); err != nil {
+		if err := installer.Install(ctx, filtered); err != nil {
 			return fmt.Errorf("Error installing %s: %w", prog, err)
 		}
 	}
 	return nil
 }
 
+// RemovePrograms removes the packages PackageMap gives for programs.
+func RemovePrograms(ctx context.Context, installer Installer, distro DistroInfo, programs []string) error {
+	for _, prog := range programs {
+		toRemove, err := packagesFor(prog, distro)
+		if err != nil {
+			return err
+		}
+		if err := installer.Remove(ctx, toRemove); err != nil {
+			return fmt.Errorf("Error removing %s: %w", prog, err)
+		}
+	}
+	return nil
+}
+
+func packagesFor(prog string, distro DistroInfo) ([]string, error) {
+	pmap, ok := PackageMap[prog]
+	if !ok {
+		return nil, fmt.Errorf("There is no packet mapping for '%s'", prog)
+	}
+	// try exact ID first, then ID_LIKE heuristic, then fallback to “any”
+	if v, exists := pmap[strings.ToLower(distro.ID)]; exists {
+		return v, nil
+	}
+	if v, exists := pmap[strings.ToLower(distro.Like)]; exists {
+		return v, nil
+	}
+	// TODO
+	// if there is a “default” key, you could use it; for now, error if it does not match
+	return nil, fmt.Errorf("There is no known package for %s in %s", prog, distro.ID)
+}
+
 // Service helper simple:
-func Service(action, serviceName string) error {
-	sm := NewServiceManager()
+func Service(ctx context.Context, e Executor, action, serviceName string) error {
+	return ServiceAction(ctx, NewServiceManager(ctx, e), action, serviceName)
+}
+
+// ServiceAction runs action (start, restart, stop, enable, disable or status)
+// on a service.
+func ServiceAction(ctx context.Context, sm ServiceManager, action, serviceName string) error {
 	switch action {
 	case "start":
-		return sm.Start(serviceName)
+		return sm.Start(ctx, serviceName)
 	case "restart":
-		return sm.Restart(serviceName)
+		return sm.Restart(ctx, serviceName)
 	case "stop":
-		return sm.Stop(serviceName)
+		return sm.Stop(ctx, serviceName)
 	case "enable":
-		return sm.Enable(serviceName)
+		return sm.Enable(ctx, serviceName)
+	case "disable":
+		return sm.Disable(ctx, serviceName)
 	case "status":
-		_, err := sm.Status(serviceName)
+		_, err := sm.Status(ctx, serviceName)
 		return err
 	default:
 		return fmt.Errorf("Unknown service action: %s", action)
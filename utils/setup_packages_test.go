@@ -0,0 +1,346 @@
+package utils
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	ok      = FakeResponse{}
+	failed  = FakeResponse{ExitCode: 1, Stderr: "failed"}
+	missing = FakeResponse{ExitCode: 1}
+)
+
+// commandLines shows calls as "sudo apt-get install -y nginx" for privileged
+// commands and "dpkg -s nginx" for the others.
+func commandLines(calls []Command) []string {
+	lines := make([]string, len(calls))
+	for i, c := range calls {
+		lines[i] = strings.Join(append([]string{c.Name}, c.Args...), " ")
+		if c.Sudo {
+			lines[i] = "sudo " + lines[i]
+		}
+	}
+	return lines
+}
+
+func TestInstallers(t *testing.T) {
+	apt := func(e Executor) Installer { return &AptInstaller{Exec: e} }
+	dnf := func(e Executor) Installer { return &DnfInstaller{Exec: e} }
+	pacman := func(e Executor) Installer { return &PacmanInstaller{Exec: e} }
+	zypper := func(e Executor) Installer { return &ZypperInstaller{Exec: e} }
+	generic := func(e Executor) Installer { return &GenericShellInstaller{Exec: e} }
+
+	tests := []struct {
+		name      string
+		installer func(Executor) Installer
+		// install, remove or installed
+		op        string
+		responses map[string]FakeResponse
+		want      []string
+		wantErr   bool
+		// the answer of IsInstalled
+		installed bool
+	}{
+		{
+			name: "apt install", installer: apt, op: "install",
+			responses: map[string]FakeResponse{"apt-get update -y": ok, "apt-get install -y nginx": ok},
+			want:      []string{"sudo apt-get update -y", "sudo apt-get install -y nginx"},
+		},
+		{
+			name: "apt install after a failed update", installer: apt, op: "install",
+			responses: map[string]FakeResponse{"apt-get update -y": failed, "apt-get install -y nginx": ok},
+			want:      []string{"sudo apt-get update -y", "sudo apt-get install -y nginx"},
+		},
+		{
+			name: "apt install fails", installer: apt, op: "install",
+			responses: map[string]FakeResponse{"apt-get update -y": ok, "apt-get install -y nginx": failed},
+			want:      []string{"sudo apt-get update -y", "sudo apt-get install -y nginx"},
+			wantErr:   true,
+		},
+		{
+			name: "apt remove", installer: apt, op: "remove",
+			responses: map[string]FakeResponse{"apt-get remove -y nginx": ok},
+			want:      []string{"sudo apt-get remove -y nginx"},
+		},
+		{
+			name: "apt installed", installer: apt, op: "installed",
+			responses: map[string]FakeResponse{"dpkg -s nginx": ok},
+			want:      []string{"dpkg -s nginx"},
+			installed: true,
+		},
+		{
+			name: "apt not installed", installer: apt, op: "installed",
+			responses: map[string]FakeResponse{"dpkg -s nginx": missing},
+			want:      []string{"dpkg -s nginx"},
+		},
+		{
+			name: "dnf install", installer: dnf, op: "install",
+			responses: map[string]FakeResponse{"dnf update -y": ok, "dnf install -y nginx": ok},
+			want:      []string{"sudo dnf update -y", "sudo dnf install -y nginx"},
+		},
+		{
+			name: "dnf falls back to yum", installer: dnf, op: "install",
+			responses: map[string]FakeResponse{"dnf update -y": failed, "dnf install -y nginx": failed, "yum install -y nginx": ok},
+			want:      []string{"sudo dnf update -y", "sudo dnf install -y nginx", "sudo yum install -y nginx"},
+		},
+		{
+			name: "dnf and yum fail", installer: dnf, op: "install",
+			responses: map[string]FakeResponse{"dnf update -y": ok, "dnf install -y nginx": failed, "yum install -y nginx": failed},
+			want:      []string{"sudo dnf update -y", "sudo dnf install -y nginx", "sudo yum install -y nginx"},
+			wantErr:   true,
+		},
+		{
+			name: "dnf remove", installer: dnf, op: "remove",
+			responses: map[string]FakeResponse{"dnf remove -y nginx": ok},
+			want:      []string{"sudo dnf remove -y nginx"},
+		},
+		{
+			name: "dnf installed", installer: dnf, op: "installed",
+			responses: map[string]FakeResponse{"rpm -q nginx": ok},
+			want:      []string{"rpm -q nginx"},
+			installed: true,
+		},
+		{
+			name: "pacman install", installer: pacman, op: "install",
+			responses: map[string]FakeResponse{"pacman -Sy --noconfirm": ok, "pacman -S --noconfirm nginx": ok},
+			want:      []string{"sudo pacman -Sy --noconfirm", "sudo pacman -S --noconfirm nginx"},
+		},
+		{
+			name: "pacman remove fails", installer: pacman, op: "remove",
+			responses: map[string]FakeResponse{"pacman -R --noconfirm nginx": failed},
+			want:      []string{"sudo pacman -R --noconfirm nginx"},
+			wantErr:   true,
+		},
+		{
+			name: "pacman not installed", installer: pacman, op: "installed",
+			responses: map[string]FakeResponse{"pacman -Qi nginx": missing},
+			want:      []string{"pacman -Qi nginx"},
+		},
+		{
+			name: "zypper install", installer: zypper, op: "install",
+			responses: map[string]FakeResponse{"zypper update --non-interactive": ok, "zypper --non-interactive install nginx": ok},
+			want:      []string{"sudo zypper update --non-interactive", "sudo zypper --non-interactive install nginx"},
+		},
+		{
+			name: "zypper remove", installer: zypper, op: "remove",
+			responses: map[string]FakeResponse{"zypper --non-interactive remove nginx": ok},
+			want:      []string{"sudo zypper --non-interactive remove nginx"},
+		},
+		{
+			name: "zypper installed", installer: zypper, op: "installed",
+			responses: map[string]FakeResponse{"rpm -q nginx": ok},
+			want:      []string{"rpm -q nginx"},
+			installed: true,
+		},
+		{
+			name: "generic finds dnf", installer: generic, op: "install",
+			responses: map[string]FakeResponse{
+				"sh -c command -v apt-get": missing, "sh -c command -v dnf": ok,
+				"dnf update -y": ok, "dnf install -y nginx": ok,
+			},
+			want: []string{"sh -c command -v apt-get", "sh -c command -v dnf", "sudo dnf update -y", "sudo dnf install -y nginx"},
+		},
+		{
+			name: "generic finds apt", installer: generic, op: "remove",
+			responses: map[string]FakeResponse{"sh -c command -v apt-get": ok, "apt-get remove -y nginx": ok},
+			want:      []string{"sh -c command -v apt-get", "sudo apt-get remove -y nginx"},
+		},
+		{
+			name: "generic finds nothing", installer: generic, op: "install",
+			responses: map[string]FakeResponse{
+				"sh -c command -v apt-get": missing, "sh -c command -v dnf": missing, "sh -c command -v pacman": missing,
+			},
+			want:    []string{"sh -c command -v apt-get", "sh -c command -v dnf", "sh -c command -v pacman"},
+			wantErr: true,
+		},
+		{
+			name: "generic asks rpm", installer: generic, op: "installed",
+			responses: map[string]FakeResponse{"sh -c command -v dpkg": missing, "sh -c command -v rpm": ok, "rpm -q nginx": ok},
+			want:      []string{"sh -c command -v dpkg", "sh -c command -v rpm", "rpm -q nginx"},
+			installed: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &FakeExecutor{Responses: tt.responses}
+			installer := tt.installer(fake)
+			ctx := context.Background()
+			var err error
+			switch tt.op {
+			case "install":
+				err = installer.Install(ctx, []string{"nginx"})
+			case "remove":
+				err = installer.Remove(ctx, []string{"nginx"})
+			case "installed":
+				var installed bool
+				installed, err = installer.IsInstalled(ctx, "nginx")
+				if installed != tt.installed {
+					t.Errorf("IsInstalled = %v, want %v", installed, tt.installed)
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if got := commandLines(fake.Calls()); !slices.Equal(got, tt.want) {
+				t.Errorf("ran %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServiceManagers(t *testing.T) {
+	systemd := func(e Executor) ServiceManager { return &SystemdService{Exec: e} }
+	sysv := func(e Executor) ServiceManager { return &SysVService{Exec: e} }
+
+	tests := []struct {
+		name      string
+		manager   func(Executor) ServiceManager
+		action    string
+		responses map[string]FakeResponse
+		want      []string
+		wantErr   bool
+	}{
+		{"systemd start", systemd, "start", map[string]FakeResponse{"systemctl start nginx": ok}, []string{"sudo systemctl start nginx"}, false},
+		{"systemd restart", systemd, "restart", map[string]FakeResponse{"systemctl restart nginx": ok}, []string{"sudo systemctl restart nginx"}, false},
+		{"systemd stop fails", systemd, "stop", map[string]FakeResponse{"systemctl stop nginx": failed}, []string{"sudo systemctl stop nginx"}, true},
+		{"systemd enable", systemd, "enable", map[string]FakeResponse{"systemctl enable --now nginx": ok}, []string{"sudo systemctl enable --now nginx"}, false},
+		{"systemd disable", systemd, "disable", map[string]FakeResponse{"systemctl disable --now nginx": ok}, []string{"sudo systemctl disable --now nginx"}, false},
+		{"systemd status", systemd, "status", map[string]FakeResponse{"systemctl status nginx --no-pager": ok}, []string{"systemctl status nginx --no-pager"}, false},
+		{"sysv start", sysv, "start", map[string]FakeResponse{"service nginx start": ok}, []string{"sudo service nginx start"}, false},
+		{"sysv restart", sysv, "restart", map[string]FakeResponse{"service nginx restart": ok}, []string{"sudo service nginx restart"}, false},
+		{"sysv stop", sysv, "stop", map[string]FakeResponse{"service nginx stop": ok}, []string{"sudo service nginx stop"}, false},
+		{
+			"sysv enable with chkconfig", sysv, "enable",
+			map[string]FakeResponse{"sh -c command -v chkconfig": ok, "chkconfig nginx on": ok},
+			[]string{"sh -c command -v chkconfig", "sudo chkconfig nginx on"}, false,
+		},
+		{
+			"sysv enable with update-rc.d", sysv, "enable",
+			map[string]FakeResponse{"sh -c command -v chkconfig": missing, "sh -c command -v update-rc.d": ok, "update-rc.d nginx defaults": ok},
+			[]string{"sh -c command -v chkconfig", "sh -c command -v update-rc.d", "sudo update-rc.d nginx defaults"}, false,
+		},
+		{
+			"sysv disable with chkconfig", sysv, "disable",
+			map[string]FakeResponse{"sh -c command -v chkconfig": ok, "chkconfig nginx off": ok},
+			[]string{"sh -c command -v chkconfig", "sudo chkconfig nginx off"}, false,
+		},
+		{
+			"sysv enable without a tool", sysv, "enable",
+			map[string]FakeResponse{"sh -c command -v chkconfig": missing, "sh -c command -v update-rc.d": missing},
+			[]string{"sh -c command -v chkconfig", "sh -c command -v update-rc.d"}, true,
+		},
+		{"sysv status", sysv, "status", map[string]FakeResponse{"service nginx status": ok}, []string{"service nginx status"}, false},
+		{"unknown action", systemd, "reload", nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &FakeExecutor{Responses: tt.responses}
+			err := ServiceAction(context.Background(), tt.manager(fake), tt.action, "nginx")
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if got := commandLines(fake.Calls()); !slices.Equal(got, tt.want) {
+				t.Errorf("ran %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewInstallerFor(t *testing.T) {
+	tests := []struct {
+		distro DistroInfo
+		want   string
+	}{
+		{DistroInfo{ID: "ubuntu"}, "apt"},
+		{DistroInfo{ID: "linuxmint", Like: "ubuntu debian"}, "apt"},
+		{DistroInfo{ID: "fedora"}, "dnf"},
+		{DistroInfo{ID: "rocky", Like: "rhel centos fedora"}, "dnf"},
+		{DistroInfo{ID: "manjaro"}, "pacman"},
+		{DistroInfo{ID: "opensuse-leap", Like: "suse opensuse"}, "zypper"},
+		{DistroInfo{ID: "alpine"}, "generic"},
+	}
+	for _, tt := range tests {
+		if got := InstallerName(NewInstallerFor(tt.distro, &FakeExecutor{}, nil)); got != tt.want {
+			t.Errorf("installer for %+v = %s, want %s", tt.distro, got, tt.want)
+		}
+	}
+}
+
+func TestDetectDistro(t *testing.T) {
+	fake := &FakeExecutor{Responses: map[string]FakeResponse{"cat /etc/os-release": {Stdout: `PRETTY_NAME="Debian GNU/Linux 12 (bookworm)"
+NAME="Debian GNU/Linux"
+VERSION_ID="12"
+ID=debian
+`}}}
+	d, err := DetectDistro(context.Background(), fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := DistroInfo{ID: "debian", Name: "Debian GNU/Linux 12 (bookworm)", Version: "12"}
+	if d != want {
+		t.Errorf("DetectDistro = %+v, want %+v", d, want)
+	}
+
+	fake = &FakeExecutor{Responses: map[string]FakeResponse{"cat /etc/os-release": {Stdout: "NAME=unknown\n"}}}
+	if _, err := DetectDistro(context.Background(), fake); err == nil {
+		t.Error("no error for an os-release without ID")
+	}
+}
+
+func TestInstallProgramsSkipsInstalled(t *testing.T) {
+	fake := &FakeExecutor{Responses: map[string]FakeResponse{
+		"dpkg -s docker.io":             ok,
+		"dpkg -s postgresql":            missing,
+		"apt-get update -y":             ok,
+		"apt-get install -y postgresql": ok,
+	}}
+	distro := DistroInfo{ID: "debian"}
+	err := InstallPrograms(context.Background(), NewInstallerFor(distro, fake, nil), distro, []string{"docker", "postgres"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"dpkg -s docker.io", "dpkg -s postgresql", "sudo apt-get update -y", "sudo apt-get install -y postgresql"}
+	if got := commandLines(fake.Calls()); !slices.Equal(got, want) {
+		t.Errorf("ran %q, want %q", got, want)
+	}
+
+	if err := InstallPrograms(context.Background(), NewInstallerFor(distro, fake, nil), distro, []string{"nginx"}); err == nil {
+		t.Error("no error for a program without a package mapping")
+	}
+}
+
+// deadlineExecutor notes how long each command had to run.
+type deadlineExecutor struct {
+	*FakeExecutor
+	budget map[string]time.Duration
+}
+
+func (d deadlineExecutor) Run(ctx context.Context, c Command) (CommandResult, error) {
+	deadline, _ := ctx.Deadline()
+	d.budget[strings.Join(append([]string{c.Name}, c.Args...), " ")] = time.Until(deadline)
+	return d.FakeExecutor.Run(ctx, c)
+}
+
+func TestGenericInstallerLimitsOnlyTheProbe(t *testing.T) {
+	e := deadlineExecutor{FakeExecutor: &FakeExecutor{Responses: map[string]FakeResponse{
+		"sh -c command -v apt-get": ok,
+		"apt-get update -y":        ok,
+		"apt-get install -y nginx": ok,
+	}}, budget: map[string]time.Duration{}}
+	if err := (&GenericShellInstaller{Exec: e}).Install(context.Background(), []string{"nginx"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := e.budget["sh -c command -v apt-get"]; got <= 0 || got > 30*time.Second {
+		t.Errorf("probe ran with %s to go, want at most 30s", got)
+	}
+	// the install gets the command timeout, not what is left of the probe's
+	for _, line := range []string{"apt-get update -y", "apt-get install -y nginx"} {
+		if got := e.budget[line]; got <= 30*time.Second {
+			t.Errorf("%s ran with %s to go", line, got)
+		}
+	}
+}
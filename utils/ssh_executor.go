@@ -0,0 +1,437 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"CipherOps/logging"
+)
+
+// SSHConfig says how to reach and log in to one host.
+type SSHConfig struct {
+	// host name or address, with an optional :port
+	Host string
+	User string
+	// private key file; without one the keys of the agent at SSH_AUTH_SOCK
+	// are used
+	KeyFile       string
+	KeyPassphrase string
+	// host keys are always checked; defaults to ~/.ssh/known_hosts
+	KnownHostsFile string
+	// sudo, doas, pkexec or run0 for privileged commands; sudo when empty
+	Escalation string
+	// answers the sudo prompt; without it the escalation method must not
+	// ask (NOPASSWD for sudo, nopass for doas)
+	SudoPassword string
+	// limits dialing and the handshake, 15s when zero
+	ConnectTimeout time.Duration
+	// sessions run at once over the connection, 10 (the sshd default)
+	// when zero
+	MaxSessions int
+}
+
+// SSHExecutor runs commands on a remote host. All commands share one
+// connection, opened on first use and again after it breaks. Privileged
+// commands are recorded in AuditLog with the host.
+type SSHExecutor struct {
+	cfg      SSHConfig
+	addr     string
+	client   *ssh.ClientConfig
+	hostKeys ssh.HostKeyCallback
+	agent    net.Conn
+	sessions chan struct{}
+
+	mu   sync.Mutex
+	conn *ssh.Client
+}
+
+// NewSSHExecutor checks cfg and loads the credentials; it connects on the
+// first Run.
+func NewSSHExecutor(cfg SSHConfig) (*SSHExecutor, error) {
+	if cfg.Host == "" || cfg.User == "" {
+		return nil, errors.New("ssh: host and user are required")
+	}
+	if cfg.ConnectTimeout <= 0 {
+		cfg.ConnectTimeout = 15 * time.Second
+	}
+	if cfg.MaxSessions <= 0 {
+		cfg.MaxSessions = 10
+	}
+	if cfg.KnownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("ssh: no known_hosts file: %w", err)
+		}
+		cfg.KnownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeys, err := knownhosts.New(cfg.KnownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("ssh: %w", err)
+	}
+
+	e := &SSHExecutor{cfg: cfg, addr: cfg.Host, hostKeys: hostKeys, sessions: make(chan struct{}, cfg.MaxSessions)}
+	if _, _, err := net.SplitHostPort(cfg.Host); err != nil {
+		e.addr = net.JoinHostPort(cfg.Host, "22")
+	}
+	var auth ssh.AuthMethod
+	if cfg.KeyFile != "" {
+		signer, err := loadSSHKey(cfg.KeyFile, cfg.KeyPassphrase)
+		if err != nil {
+			return nil, err
+		}
+		auth = ssh.PublicKeys(signer)
+	} else {
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if sock == "" {
+			return nil, errors.New("ssh: no key file given and no agent at SSH_AUTH_SOCK")
+		}
+		if e.agent, err = net.Dial("unix", sock); err != nil {
+			return nil, fmt.Errorf("ssh: agent: %w", err)
+		}
+		auth = ssh.PublicKeysCallback(agent.NewClient(e.agent).Signers)
+	}
+	e.client = &ssh.ClientConfig{
+		User:            cfg.User,
+		Auth:            []ssh.AuthMethod{auth},
+		HostKeyCallback: hostKeys,
+		Timeout:         cfg.ConnectTimeout,
+	}
+	return e, nil
+}
+
+func loadSSHKey(path, passphrase string) (ssh.Signer, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("ssh: %w", err)
+	}
+	var signer ssh.Signer
+	if passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pem, []byte(passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(pem)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ssh: %s: %w", path, err)
+	}
+	return signer, nil
+}
+
+// Host is the host commands run on.
+func (e *SSHExecutor) Host() string {
+	return e.cfg.Host
+}
+
+// Close drops the connection and the agent; e is not usable afterwards.
+func (e *SSHExecutor) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var errs []error
+	if e.conn != nil {
+		errs = append(errs, e.conn.Close())
+		e.conn = nil
+	}
+	if e.agent != nil {
+		errs = append(errs, e.agent.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// connect returns the shared connection, dialing when there is none.
+func (e *SSHExecutor) connect(ctx context.Context) (*ssh.Client, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.conn != nil {
+		return e.conn, nil
+	}
+	dialer := net.Dialer{Timeout: e.cfg.ConnectTimeout}
+	nc, err := dialer.DialContext(ctx, "tcp", e.addr)
+	if err != nil {
+		return nil, fmt.Errorf("ssh: %w", err)
+	}
+	// the handshake has no timeout of its own
+	nc.SetDeadline(time.Now().Add(e.cfg.ConnectTimeout))
+	config := *e.client
+	config.HostKeyAlgorithms = knownHostKeyAlgorithms(e.hostKeys, e.addr, nc.RemoteAddr())
+	c, chans, reqs, err := ssh.NewClientConn(nc, e.addr, &config)
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("ssh: %s: %w", e.cfg.Host, err)
+	}
+	nc.SetDeadline(time.Time{})
+	conn := ssh.NewClient(c, chans, reqs)
+	e.conn = conn
+	go func() {
+		conn.Wait()
+		e.mu.Lock()
+		if e.conn == conn {
+			e.conn = nil
+		}
+		e.mu.Unlock()
+	}()
+	return conn, nil
+}
+
+// probeKey is in no known_hosts file; checking it makes the callback list
+// the keys that are.
+var probeKey, _ = ssh.NewPublicKey(ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)).Public())
+
+// knownHostKeyAlgorithms returns the host key algorithms of the keys
+// known_hosts has for addr, so the server offers one of those rather than
+// a type we cannot check. Nil, the defaults, for unknown hosts; their
+// handshake fails anyway.
+func knownHostKeyAlgorithms(hostKeys ssh.HostKeyCallback, addr string, remote net.Addr) []string {
+	var keyErr *knownhosts.KeyError
+	if err := hostKeys(addr, remote, probeKey); !errors.As(err, &keyErr) || len(keyErr.Want) == 0 {
+		return nil
+	}
+	var algos []string
+	for _, known := range keyErr.Want {
+		switch typ := known.Key.Type(); typ {
+		case ssh.KeyAlgoRSA:
+			// the key type names SHA-1 signatures, prefer the SHA-2 ones
+			algos = append(algos, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			algos = append(algos, typ)
+		}
+	}
+	return algos
+}
+
+// session opens a session, reconnecting once if the connection went stale.
+func (e *SSHExecutor) session(ctx context.Context) (*ssh.Session, error) {
+	for attempt := 0; ; attempt++ {
+		conn, err := e.connect(ctx)
+		if err != nil {
+			return nil, err
+		}
+		s, err := conn.NewSession()
+		if err == nil || attempt > 0 {
+			return s, err
+		}
+		e.mu.Lock()
+		if e.conn == conn {
+			conn.Close()
+			e.conn = nil
+		}
+		e.mu.Unlock()
+	}
+}
+
+func (e *SSHExecutor) Run(ctx context.Context, c Command) (CommandResult, error) {
+	name, args := escalate(e.cfg.Escalation, c, e.cfg.User == "root")
+	var marker string
+	if name == "sudo" && c.Sudo && e.cfg.SudoPassword != "" {
+		// a prompt no command prints, so it can be answered safely
+		marker = "[sudo " + randomHex(8) + "] "
+		args = append([]string{"-S", "-p", marker, "--", c.Name}, c.Args...)
+	}
+	res := CommandResult{CommandLine: commandLine(name, args), ExitCode: -1}
+
+	select {
+	case e.sessions <- struct{}{}:
+		defer func() { <-e.sessions }()
+	case <-ctx.Done():
+		return res, ctx.Err()
+	}
+	session, err := e.session(ctx)
+	if err != nil {
+		return res, err
+	}
+	defer session.Close()
+
+	var mu sync.Mutex
+	stdout := &lineWriter{stream: "stdout", mu: &mu, output: c.Output}
+	stderr := &lineWriter{stream: "stderr", mu: &mu, output: c.Output}
+	session.Stdout = stdout
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return res, err
+	}
+	var answered sync.Once
+	if marker != "" {
+		session.Stderr = &promptWriter{next: stderr, marker: []byte(marker), onPrompt: func() {
+			// the password is sent once; if sudo asks again it reads EOF
+			// and fails, and the command never sees the password on stdin
+			answered.Do(func() {
+				io.WriteString(stdin, e.cfg.SudoPassword+"\n")
+				stdin.Close()
+			})
+		}}
+	} else {
+		session.Stderr = stderr
+		stdin.Close()
+	}
+
+	start := time.Now()
+	if err := session.Start(shellJoin(name, args)); err != nil {
+		return res, fmt.Errorf("ssh: %s: %w", e.cfg.Host, err)
+	}
+	if marker != "" {
+		// sudo asks before running anything; without a prompt by then it
+		// needs no password and the command gets an empty stdin
+		timer := time.AfterFunc(sudoPromptWait, func() {
+			answered.Do(func() { stdin.Close() })
+		})
+		defer timer.Stop()
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			session.Signal(ssh.SIGKILL)
+			session.Close()
+		case <-done:
+		}
+	}()
+	err = session.Wait()
+	close(done)
+	res.Duration = time.Since(start)
+	if pw, ok := session.Stderr.(*promptWriter); ok {
+		pw.flush()
+	}
+	stdout.flush()
+	stderr.flush()
+	res.Stdout, res.Stderr = stdout.all.String(), stderr.all.String()
+
+	var exitErr *ssh.ExitError
+	switch {
+	case err == nil:
+		res.ExitCode = 0
+	case errors.As(err, &exitErr):
+		res.ExitCode = exitErr.ExitStatus()
+	}
+	if ctx.Err() != nil && err != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		// stderr often echoes the command line, secrets included
+		err = fmt.Errorf("%s: %w: %s", e.cfg.Host, err, logging.Redact(strings.TrimSpace(res.Stderr)))
+		err = escalationError(e.cfg.Escalation, c, res.Stderr, err)
+		slog.Warn("command failed", "host", e.cfg.Host, "command", c.Name, "args", c.Args,
+			"exit_code", res.ExitCode, "error", err)
+	}
+	if c.Sudo {
+		AuditCommand(ctx, e.cfg.Host, c.Name, c.Args, res.Output(), err)
+	}
+	return res, err
+}
+
+// sudoPromptWait is how long Run waits for the sudo prompt.
+var sudoPromptWait = 3 * time.Second
+
+// promptWriter passes output on to next, cutting out marker and calling
+// onPrompt for each time it appears, even when split across writes.
+type promptWriter struct {
+	next     io.Writer
+	marker   []byte
+	onPrompt func()
+	pending  []byte
+}
+
+func (w *promptWriter) Write(p []byte) (int, error) {
+	data := append(w.pending, p...)
+	w.pending = nil
+	for {
+		i := bytes.Index(data, w.marker)
+		if i < 0 {
+			break
+		}
+		w.next.Write(data[:i])
+		w.onPrompt()
+		data = data[i+len(w.marker):]
+	}
+	// hold back a tail that may be the start of the marker
+	for keep := min(len(w.marker)-1, len(data)); keep > 0; keep-- {
+		if bytes.HasPrefix(w.marker, data[len(data)-keep:]) {
+			w.pending = append([]byte(nil), data[len(data)-keep:]...)
+			data = data[:len(data)-keep]
+			break
+		}
+	}
+	w.next.Write(data)
+	return len(p), nil
+}
+
+func (w *promptWriter) flush() {
+	w.next.Write(w.pending)
+	w.pending = nil
+}
+
+// shellJoin quotes a command for the remote shell.
+func shellJoin(name string, args []string) string {
+	words := make([]string, 0, len(args)+1)
+	for _, word := range append([]string{name}, args...) {
+		words = append(words, shellQuote(word))
+	}
+	return strings.Join(words, " ")
+}
+
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_./=:,+@%") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// SSHPool hands out one SSHExecutor, and so one connection, per user and
+// host.
+type SSHPool struct {
+	mu        sync.Mutex
+	executors map[string]*SSHExecutor
+}
+
+// Executor returns the pooled executor for cfg's user and host, creating it
+// on first use. Later calls for the same user and host get the same executor
+// whatever the rest of cfg says.
+func (p *SSHPool) Executor(cfg SSHConfig) (*SSHExecutor, error) {
+	key := cfg.User + "@" + cfg.Host
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.executors[key]; ok {
+		return e, nil
+	}
+	e, err := NewSSHExecutor(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if p.executors == nil {
+		p.executors = map[string]*SSHExecutor{}
+	}
+	p.executors[key] = e
+	return e, nil
+}
+
+// Close drops every pooled connection and forgets the executors.
+func (p *SSHPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var errs []error
+	for key, e := range p.executors {
+		errs = append(errs, e.Close())
+		delete(p.executors, key)
+	}
+	return errors.Join(errs...)
+}
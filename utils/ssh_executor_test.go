@@ -0,0 +1,382 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshHandler runs one exec request and returns its exit status.
+type sshHandler func(command string, stdin io.Reader, stdout, stderr io.Writer) int
+
+// testSSHServer accepts the client key and runs exec requests with handle.
+type testSSHServer struct {
+	addr   string
+	handle sshHandler
+
+	mu    sync.Mutex
+	conns []net.Conn
+	execs int
+}
+
+func startSSHServer(t *testing.T, clientKey ssh.PublicKey, hostKeys []ssh.Signer, handle sshHandler) *testSSHServer {
+	t.Helper()
+	cfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, errors.New("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	for _, k := range hostKeys {
+		cfg.AddHostKey(k)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testSSHServer{addr: ln.Addr().String(), handle: handle}
+	t.Cleanup(func() {
+		ln.Close()
+		s.dropConnections()
+	})
+	go func() {
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, nc)
+			s.mu.Unlock()
+			go s.serve(nc, cfg)
+		}
+	}()
+	return s
+}
+
+func (s *testSSHServer) serve(nc net.Conn, cfg *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(nc, cfg)
+	if err != nil {
+		nc.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(ssh.UnknownChannelType, "sessions only")
+			continue
+		}
+		ch, reqs, err := newCh.Accept()
+		if err != nil {
+			continue
+		}
+		go s.session(ch, reqs)
+	}
+}
+
+func (s *testSSHServer) session(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+		var payload struct{ Command string }
+		ssh.Unmarshal(req.Payload, &payload)
+		req.Reply(true, nil)
+		s.mu.Lock()
+		s.execs++
+		s.mu.Unlock()
+		go func() {
+			status := s.handle(payload.Command, ch, ch, ch.Stderr())
+			ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+			ch.Close()
+		}()
+	}
+}
+
+// dropConnections cuts every connection as a restarting sshd would.
+func (s *testSSHServer) dropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, nc := range s.conns {
+		nc.Close()
+	}
+}
+
+func (s *testSSHServer) counts() (conns, execs int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns), s.execs
+}
+
+// sshClientKey writes a fresh private key to dir and returns its file and
+// public half.
+func sshClientKey(t *testing.T, dir string) (string, ssh.PublicKey) {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, sshPub
+}
+
+func ed25519HostKey(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func ecdsaHostKey(t *testing.T) ssh.Signer {
+	t.Helper()
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// newTestSSHExecutor logs in to addr with keyFile, trusting known for it.
+func newTestSSHExecutor(t *testing.T, dir, addr, keyFile string, known []ssh.PublicKey, sudoPassword string) *SSHExecutor {
+	t.Helper()
+	var lines []string
+	for _, k := range known {
+		lines = append(lines, knownhosts.Line([]string{addr}, k))
+	}
+	knownHosts := filepath.Join(dir, "known_hosts")
+	if err := os.WriteFile(knownHosts, []byte(strings.Join(lines, "\n")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	e, err := NewSSHExecutor(SSHConfig{
+		Host:           addr,
+		User:           "deploy",
+		KeyFile:        keyFile,
+		KnownHostsFile: knownHosts,
+		SudoPassword:   sudoPassword,
+		ConnectTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { e.Close() })
+	return e
+}
+
+func echoCommand(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fmt.Fprintln(stdout, command)
+	return 0
+}
+
+func TestSSHExecutorHostKeys(t *testing.T) {
+	ecdsaKey, ed25519Key := ecdsaHostKey(t), ed25519HostKey(t)
+	tests := []struct {
+		name  string
+		known []ssh.PublicKey
+		err   string
+	}{
+		// the server offers both, the client has to ask for the one it knows
+		{"known ECDSA key", []ssh.PublicKey{ecdsaKey.PublicKey()}, ""},
+		{"known Ed25519 key", []ssh.PublicKey{ed25519Key.PublicKey()}, ""},
+		{"unknown host", nil, "key is unknown"},
+		{"changed key", []ssh.PublicKey{ed25519HostKey(t).PublicKey()}, "key mismatch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			keyFile, clientKey := sshClientKey(t, dir)
+			srv := startSSHServer(t, clientKey, []ssh.Signer{ecdsaKey, ed25519Key}, echoCommand)
+			e := newTestSSHExecutor(t, dir, srv.addr, keyFile, tt.known, "")
+
+			res, err := e.Run(context.Background(), Command{Name: "uptime"})
+			if tt.err == "" {
+				if err != nil || res.Stdout != "uptime\n" {
+					t.Errorf("Run = %+v, %v", res, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Run error = %v, want %q", err, tt.err)
+			}
+			if _, execs := srv.counts(); execs != 0 {
+				t.Errorf("ran %d commands on an untrusted host", execs)
+			}
+		})
+	}
+}
+
+// shellSplit undoes shellJoin.
+func shellSplit(s string) []string {
+	var words []string
+	var word strings.Builder
+	inWord, quoted := false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quoted:
+			if c == '\'' {
+				quoted = false
+			} else {
+				word.WriteByte(c)
+			}
+		case c == '\'':
+			quoted, inWord = true, true
+		case c == '\\' && i+1 < len(s):
+			i++
+			word.WriteByte(s[i])
+			inWord = true
+		case c == ' ':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+// fakeSudo behaves like sudo -S -p: it prompts on stderr when prompt is set
+// and checks the password read from stdin, then reports the command and
+// what the command found on its stdin.
+func fakeSudo(password string, prompt bool) sshHandler {
+	return func(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+		args := shellSplit(command)
+		if len(args) < 6 || args[0] != "sudo" || args[1] != "-S" || args[2] != "-p" || args[4] != "--" {
+			fmt.Fprintf(stderr, "unexpected command %q\n", args)
+			return 2
+		}
+		in := bufio.NewReader(stdin)
+		if prompt {
+			io.WriteString(stderr, args[3])
+			line, err := in.ReadString('\n')
+			if err != nil {
+				fmt.Fprintln(stderr, "sudo: no password was provided")
+				return 1
+			}
+			if strings.TrimSuffix(line, "\n") != password {
+				fmt.Fprintln(stderr, "Sorry, try again.")
+				return 1
+			}
+		}
+		rest, _ := io.ReadAll(in)
+		fmt.Fprintf(stdout, "ran %s with %q on stdin\n", strings.Join(args[5:], " "), rest)
+		return 0
+	}
+}
+
+func TestSSHExecutorSudoPassword(t *testing.T) {
+	hostKey := ed25519HostKey(t)
+	tests := []struct {
+		name     string
+		prompt   bool
+		password string
+		stdout   string
+		ok       bool
+	}{
+		{"prompt", true, "s3cret", "ran systemctl restart nginx with \"\" on stdin\n", true},
+		{"wrong password", true, "other", "", false},
+		// NOPASSWD or a cached credential: nothing asks, stdin still ends
+		{"no prompt", false, "s3cret", "ran systemctl restart nginx with \"\" on stdin\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !tt.prompt {
+				wait := sudoPromptWait
+				sudoPromptWait = 50 * time.Millisecond
+				t.Cleanup(func() { sudoPromptWait = wait })
+			}
+			dir := t.TempDir()
+			keyFile, clientKey := sshClientKey(t, dir)
+			srv := startSSHServer(t, clientKey, []ssh.Signer{hostKey}, fakeSudo(tt.password, tt.prompt))
+			e := newTestSSHExecutor(t, dir, srv.addr, keyFile, []ssh.PublicKey{hostKey.PublicKey()}, "s3cret")
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			res, err := e.Run(ctx, Command{Name: "systemctl", Args: []string{"restart", "nginx"}, Sudo: true})
+			if errors.Is(err, context.DeadlineExceeded) {
+				t.Fatal("Run hung waiting for stdin")
+			}
+			if (err == nil) != tt.ok || res.Stdout != tt.stdout {
+				t.Errorf("Run = %+v, %v", res, err)
+			}
+			if strings.Contains(res.Stderr, "[sudo ") {
+				t.Errorf("the prompt leaked into stderr: %q", res.Stderr)
+			}
+		})
+	}
+}
+
+func TestSSHExecutorReconnects(t *testing.T) {
+	dir := t.TempDir()
+	keyFile, clientKey := sshClientKey(t, dir)
+	hostKey := ed25519HostKey(t)
+	srv := startSSHServer(t, clientKey, []ssh.Signer{hostKey}, echoCommand)
+	e := newTestSSHExecutor(t, dir, srv.addr, keyFile, []ssh.PublicKey{hostKey.PublicKey()}, "")
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := e.Run(ctx, Command{Name: "uptime"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if conns, _ := srv.counts(); conns != 1 {
+		t.Errorf("%d connections for two commands, want one shared", conns)
+	}
+
+	srv.dropConnections()
+	res, err := e.Run(ctx, Command{Name: "uptime"})
+	if err != nil || res.Stdout != "uptime\n" {
+		t.Fatalf("Run after the connection dropped = %+v, %v", res, err)
+	}
+	if conns, execs := srv.counts(); conns != 2 || execs != 3 {
+		t.Errorf("%d connections and %d commands, want 2 and 3", conns, execs)
+	}
+}
@@ -1,11 +1,33 @@
 package utils
 
 import (
+	"sync/atomic"
 	"time"
+
+	"CipherOps/audit"
 )
 
 // --- Config / global vars ---
 var (
-	DefaultTimeout = 5 * time.Minute
-	DryRun         = false // testing flag
-)
\ No newline at end of file
+	// privileged commands are recorded here when set
+	AuditLog *audit.Logger
+)
+
+// DefaultTimeout limits a system command until SetCommandTimeout is called.
+const DefaultTimeout = 5 * time.Minute
+
+var commandTimeout atomic.Int64
+
+// SetCommandTimeout changes the limit for commands started from now on; it
+// is safe to call while commands run, e.g. on a configuration reload.
+func SetCommandTimeout(d time.Duration) {
+	commandTimeout.Store(int64(d))
+}
+
+// CommandTimeout is the limit for one system command.
+func CommandTimeout() time.Duration {
+	if d := time.Duration(commandTimeout.Load()); d > 0 {
+		return d
+	}
+	return DefaultTimeout
+}